@@ -64,6 +64,8 @@ func init() {
 			OldSecret: "",
 			NewSecret: "",
 		},
+		Cache:      Cache{},
+		RateLimits: map[string]RateLimit{},
 	}
 
 	// Try to load configuration from file
@@ -119,6 +121,8 @@ type Config struct {
 	Amazon        Amazon
 	Limits        Limits
 	Session       Session
+	Cache         Cache
+	RateLimits    map[string]RateLimit
 }
 
 // General options
@@ -229,4 +233,38 @@ type Session struct {
 	OldSecret string
 	// NewSecret is used for signing new tokens and validating tokens
 	NewSecret string
+	// SigningKey is the path of a PEM private key that signs tokens instead of NewSecret, only the auth service has it
+	SigningKey string
+	// SigningKeyID is the kid of the signing key in tokens and the JWKS
+	SigningKeyID string
+	// JWKS is the path or URL of a JWKS with the public keys that verify tokens
+	JWKS string
+	// RejectHS256 rejects tokens signed with the secrets once a signing key or JWKS is set
+	RejectHS256 bool
+	// RevocationFailOpen accepts tokens when redis is unavailable and revocations can not be checked,
+	// otherwise authenticated routes return 503 and optional ones treat the user as anonymous
+	RevocationFailOpen bool
+}
+
+// Cache holds settings for the redis cache
+type Cache struct {
+	// TTL overrides the expiry in seconds of registered keys by base, zero disables expiry
+	TTL map[string]uint
+	// SoftTTL sets the soft expiry in seconds of registered keys by base, stale values are served
+	// while they are rebuilt in the background, zero disables it
+	SoftTTL map[string]uint
+	// Prefix is prepended to every key, such as "staging:", so environments can share a server
+	Prefix string
+}
+
+// RateLimit holds the settings for a named rate limit
+type RateLimit struct {
+	// Algorithm is either "sliding" for a sliding window log or "gcra" for a token bucket
+	Algorithm string
+	// Limit is the number of requests allowed per period
+	Limit int
+	// Period is the length of the window in seconds
+	Period uint
+	// Burst is how many requests the token bucket allows at once, Limit if 0
+	Burst int
 }
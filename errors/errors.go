@@ -14,6 +14,10 @@ var (
 	ErrUnauthorized = &RequestError{ErrorString: "unauthorized", ErrorCode: http.StatusUnauthorized}
 	// ErrForbidden is either anon accessing a route that requires auth, or an authed user without the correct permissions
 	ErrForbidden = &RequestError{ErrorString: "forbidden", ErrorCode: http.StatusForbidden}
+	// ErrTooManyRequests means the client went over a rate limit and should wait for the Retry-After header
+	ErrTooManyRequests = &RequestError{ErrorString: "too many requests", ErrorCode: http.StatusTooManyRequests}
+	// ErrServiceUnavailable means a backing service is down and the client should try again later
+	ErrServiceUnavailable = &RequestError{ErrorString: "service unavailable", ErrorCode: http.StatusServiceUnavailable}
 
 	ErrNoIb             = errors.New("imageboard id required")
 	ErrNoThread         = errors.New("thread id required")
@@ -63,9 +67,15 @@ var (
 	ErrNoSecret         = errors.New("no secret key was set")
 	ErrInvalidUID       = errors.New("invalid uid")
 	ErrTokenInvalid     = errors.New("invalid token")
+	ErrTokenRevoked     = errors.New("token has been revoked")
+	ErrTokenUnavailable = errors.New("token store unavailable")
+	ErrUnsupportedKey   = errors.New("unsupported signing key")
+	ErrUnknownKey       = errors.New("unknown signing key id")
+	ErrNoSigningKey     = errors.New("only the signing service can make tokens")
 	ErrUserNotValid     = errors.New("user is not valid")
 	ErrCsrfNotValid     = errors.New("csrf token is not valid")
 	ErrBlacklist        = errors.New("ip is on blacklist")
+	ErrRateLimited      = errors.New("rate limit exceeded")
 )
 
 // RequestError holds the message string and http code
@@ -142,10 +142,21 @@ func TestPredefinedErrors(t *testing.T) {
 	assert.Equal(t, "forbidden", ErrForbidden.Error())
 	assert.Equal(t, http.StatusForbidden, ErrForbidden.Code())
 
+	assert.Equal(t, "too many requests", ErrTooManyRequests.Error())
+	assert.Equal(t, http.StatusTooManyRequests, ErrTooManyRequests.Code())
+
+	assert.Equal(t, "service unavailable", ErrServiceUnavailable.Error())
+	assert.Equal(t, http.StatusServiceUnavailable, ErrServiceUnavailable.Code())
+
 	// Test a few standard errors
 	assert.Equal(t, "imageboard id required", ErrNoIb.Error())
 	assert.Equal(t, "thread id required", ErrNoThread.Error())
 	assert.Equal(t, "comment too long", ErrCommentLong.Error())
 	assert.Equal(t, "invalid token", ErrTokenInvalid.Error())
+	assert.Equal(t, "token has been revoked", ErrTokenRevoked.Error())
+	assert.Equal(t, "token store unavailable", ErrTokenUnavailable.Error())
+	assert.Equal(t, "unsupported signing key", ErrUnsupportedKey.Error())
+	assert.Equal(t, "unknown signing key id", ErrUnknownKey.Error())
+	assert.Equal(t, "only the signing service can make tokens", ErrNoSigningKey.Error())
 	assert.Equal(t, "csrf token is not valid", ErrCsrfNotValid.Error())
 }
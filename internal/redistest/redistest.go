@@ -0,0 +1,37 @@
+// Package redistest starts redis servers for the tests of the packages built on the cache
+package redistest
+
+import (
+	"testing"
+
+	"github.com/stvp/tempredis"
+
+	"github.com/eirka/eirka-libs/redis"
+)
+
+// Start starts a server and makes it the cache until the test ends
+// The server is stopped and the previous cache is put back when the test ends.
+func Start(t testing.TB) {
+	t.Helper()
+
+	server, err := tempredis.Start(tempredis.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := redis.Cache
+
+	t.Cleanup(func() {
+		redis.Cache = original
+		server.Term()
+	})
+
+	cache := redis.Redis{
+		Protocol:       "unix",
+		Address:        server.Socket(),
+		MaxIdle:        1,
+		MaxConnections: 10,
+	}
+
+	cache.NewRedisCache()
+}
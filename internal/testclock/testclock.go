@@ -0,0 +1,36 @@
+// Package testclock freezes the clocks packages keep in a variable for their tests
+package testclock
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// Freeze stops a clock at the current time until the test ends and returns a function to move it forward
+// The clock is read from background goroutines, so moving it is guarded.
+func Freeze(t testing.TB, clock *func() time.Time) func(time.Duration) {
+	var mu sync.Mutex
+
+	current := time.Now()
+
+	original := *clock
+
+	*clock = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return current
+	}
+
+	t.Cleanup(func() {
+		*clock = original
+	})
+
+	return func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		current = current.Add(d)
+	}
+}
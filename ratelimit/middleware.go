@@ -0,0 +1,117 @@
+package ratelimit
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	e "github.com/eirka/eirka-libs/errors"
+	"github.com/eirka/eirka-libs/user"
+)
+
+const (
+	// HeaderLimit is the most requests that can be made at once
+	HeaderLimit = "RateLimit-Limit"
+	// HeaderRemaining is how many requests can still be made
+	HeaderRemaining = "RateLimit-Remaining"
+	// HeaderReset is how many seconds until the limit is fully available
+	HeaderReset = "RateLimit-Reset"
+	// HeaderRetryAfter is how many seconds to wait before retrying a limited request
+	HeaderRetryAfter = "Retry-After"
+)
+
+// KeyFunc returns the part of the rate limit key that identifies a client
+type KeyFunc func(c *gin.Context) string
+
+// ByIP keys on the client ip
+func ByIP(c *gin.Context) string {
+	return "ip:" + c.ClientIP()
+}
+
+// ByUser keys on the authenticated user id and falls back to the ip for anonymous users
+// It needs to run after user.Auth
+func ByUser(c *gin.Context) string {
+	data, ok := c.Get("userdata")
+	if ok {
+		u, ok := data.(user.User)
+		if ok && u.IsAuthenticated {
+			return "user:" + strconv.FormatUint(uint64(u.ID), 10)
+		}
+	}
+
+	return ByIP(c)
+}
+
+// ByRoute keys on the matched route so every client shares the limit
+func ByRoute(c *gin.Context) string {
+	route := c.FullPath()
+	if route == "" {
+		route = c.Request.URL.Path
+	}
+
+	return "route:" + route
+}
+
+// Configured is a gin middleware that applies a limit from the config file
+// Routes pass through unlimited if the limit is not configured
+func Configured(name string, keys ...KeyFunc) gin.HandlerFunc {
+	limiter, err := FromConfig(name)
+	if errors.Is(err, ErrNoLimit) {
+		return func(c *gin.Context) {
+			c.Next()
+		}
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	return Middleware(limiter, keys...)
+}
+
+// Middleware is a gin middleware that aborts with a 429 when the limiter denies a request
+// The keys are joined to identify the client, ByIP is used if none are given
+func Middleware(limiter *Limiter, keys ...KeyFunc) gin.HandlerFunc {
+	if len(keys) == 0 {
+		keys = []KeyFunc{ByIP}
+	}
+
+	return func(c *gin.Context) {
+
+		parts := make([]string, len(keys))
+		for i, key := range keys {
+			parts[i] = key(c)
+		}
+
+		result, err := limiter.Allow(strings.Join(parts, ":"))
+		if err != nil {
+			// fail open so a cache outage does not take down the site
+			c.Error(err).SetMeta("ratelimit.Middleware")
+			c.Next()
+			return
+		}
+
+		c.Header(HeaderLimit, strconv.Itoa(result.Limit))
+		c.Header(HeaderRemaining, strconv.Itoa(result.Remaining))
+		c.Header(HeaderReset, seconds(result.ResetAfter))
+
+		if !result.Allowed {
+			c.Header(HeaderRetryAfter, seconds(result.RetryAfter))
+			c.JSON(e.ErrorMessage(e.ErrTooManyRequests))
+			c.Error(e.ErrRateLimited).SetMeta("ratelimit.Middleware")
+			c.Abort()
+			return
+		}
+
+		c.Next()
+
+	}
+}
+
+// seconds rounds a duration up to whole seconds for the headers
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
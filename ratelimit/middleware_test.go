@@ -0,0 +1,171 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eirka/eirka-libs/config"
+	"github.com/eirka/eirka-libs/internal/redistest"
+	"github.com/eirka/eirka-libs/internal/testclock"
+	"github.com/eirka/eirka-libs/redis"
+	"github.com/eirka/eirka-libs/user"
+)
+
+func TestMain(m *testing.M) {
+	// Set gin to test mode
+	gin.SetMode(gin.TestMode)
+
+	// Run tests
+	m.Run()
+}
+
+func performRequest(r http.Handler, path, ip string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", path, nil)
+	req.RemoteAddr = ip + ":1234"
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestMiddleware(t *testing.T) {
+	redistest.Start(t)
+
+	testclock.Freeze(t, &now)
+
+	limiter, err := NewLimiter("middleware", Limit{Algorithm: SlidingWindow, Limit: 2, Period: 30 * time.Second})
+	assert.NoError(t, err, "An error was not expected")
+
+	router := gin.New()
+
+	router.Use(Middleware(limiter))
+
+	router.GET("/thread/:id", func(c *gin.Context) {
+		c.String(200, "OK")
+	})
+
+	first := performRequest(router, "/thread/1", "10.0.0.1")
+	assert.Equal(t, 200, first.Code, "HTTP request code should match")
+	assert.Equal(t, "2", first.Header().Get(HeaderLimit), "Limit header should match")
+	assert.Equal(t, "1", first.Header().Get(HeaderRemaining), "Remaining header should match")
+	assert.Equal(t, "30", first.Header().Get(HeaderReset), "Reset header should match")
+	assert.Empty(t, first.Header().Get(HeaderRetryAfter), "Retry header should not be set")
+
+	second := performRequest(router, "/thread/2", "10.0.0.1")
+	assert.Equal(t, 200, second.Code, "HTTP request code should match")
+
+	third := performRequest(router, "/thread/1", "10.0.0.1")
+	assert.Equal(t, http.StatusTooManyRequests, third.Code, "HTTP request code should match")
+	assert.Equal(t, "0", third.Header().Get(HeaderRemaining), "Remaining header should match")
+	assert.Equal(t, "30", third.Header().Get(HeaderRetryAfter), "Retry header should match")
+	assert.JSONEq(t, `{"error_message":"too many requests"}`, third.Body.String(), "HTTP response should match")
+
+	other := performRequest(router, "/thread/1", "10.0.0.2")
+	assert.Equal(t, 200, other.Code, "Other clients should be allowed")
+}
+
+func TestMiddlewareByUserAndRoute(t *testing.T) {
+	redistest.Start(t)
+
+	testclock.Freeze(t, &now)
+
+	limiter, err := NewLimiter("user", Limit{Algorithm: GCRA, Limit: 1, Period: time.Minute})
+	assert.NoError(t, err, "An error was not expected")
+
+	router := gin.New()
+
+	router.Use(func(c *gin.Context) {
+		u := user.DefaultUser()
+		if c.GetHeader("X-User") == "2" {
+			u.SetID(2)
+			u.SetAuthenticated()
+		}
+		c.Set("userdata", u)
+	})
+
+	router.Use(Middleware(limiter, ByRoute, ByUser))
+
+	router.GET("/reply", func(c *gin.Context) {
+		c.String(200, "OK")
+	})
+
+	router.GET("/post", func(c *gin.Context) {
+		c.String(200, "OK")
+	})
+
+	authed := func(path, ip string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.RemoteAddr = ip + ":1234"
+		req.Header.Set("X-User", "2")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, 200, authed("/reply", "10.0.0.1").Code, "First request should be allowed")
+	assert.Equal(t, http.StatusTooManyRequests, authed("/reply", "10.0.0.2").Code, "User should be limited across ips")
+	assert.Equal(t, 200, authed("/post", "10.0.0.1").Code, "Routes should be limited separately")
+
+	assert.Equal(t, 200, performRequest(router, "/reply", "10.0.0.1").Code, "Anonymous users should be keyed by ip")
+	assert.Equal(t, http.StatusTooManyRequests, performRequest(router, "/reply", "10.0.0.1").Code, "Anonymous users should be limited")
+}
+
+func TestMiddlewareFailOpen(t *testing.T) {
+
+	redis.NewRedisMock()
+
+	limiter, err := NewLimiter("failopen", Limit{Algorithm: GCRA, Limit: 1, Period: time.Minute})
+	assert.NoError(t, err, "An error was not expected")
+
+	var errs int
+
+	router := gin.New()
+
+	router.Use(func(c *gin.Context) {
+		c.Next()
+		errs = len(c.Errors)
+	})
+
+	router.Use(Middleware(limiter))
+
+	router.GET("/", func(c *gin.Context) {
+		c.String(200, "OK")
+	})
+
+	// the mock has no script registered so the eval fails
+	w := performRequest(router, "/", "10.0.0.1")
+	assert.Equal(t, 200, w.Code, "Requests should be allowed when the cache fails")
+	assert.Equal(t, 1, errs, "The cache error should be recorded")
+	assert.Empty(t, w.Header().Get(HeaderLimit), "Headers should not be set")
+}
+
+func TestConfigured(t *testing.T) {
+
+	original := config.Settings.RateLimits
+	defer func() {
+		config.Settings.RateLimits = original
+	}()
+
+	config.Settings.RateLimits = map[string]config.RateLimit{
+		"bad": {Algorithm: "bucket", Limit: 5, Period: 300},
+	}
+
+	router := gin.New()
+
+	router.Use(Configured("missing"))
+
+	router.GET("/", func(c *gin.Context) {
+		c.String(200, "OK")
+	})
+
+	w := performRequest(router, "/", "10.0.0.1")
+	assert.Equal(t, 200, w.Code, "Unconfigured limits should pass through")
+
+	assert.Panics(t, func() {
+		Configured("bad")
+	}, "Invalid limits should panic")
+}
@@ -0,0 +1,283 @@
+// Package ratelimit throttles requests across instances with atomic lua scripts on the redis cache
+package ratelimit
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/eirka/eirka-libs/config"
+	"github.com/eirka/eirka-libs/redis"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// Algorithm selects how requests are counted
+type Algorithm string
+
+const (
+	// SlidingWindow keeps a log of request times and allows Limit requests in any Period
+	SlidingWindow Algorithm = "sliding"
+	// GCRA is a token bucket that refills evenly over the Period and allows Burst requests at once
+	GCRA Algorithm = "gcra"
+)
+
+// keyPrefix is the first segment of every rate limit key
+const keyPrefix = "ratelimit"
+
+var (
+	// ErrInvalidLimit is returned if a limit can not be used
+	ErrInvalidLimit = errors.New("rate limit not valid")
+	// ErrNoLimit is returned if a limit is not in the config
+	ErrNoLimit = errors.New("rate limit not configured")
+
+	// now overrides the redis server clock in tests, the scripts call TIME when it is nil
+	now func() time.Time
+)
+
+// Limit describes how many requests are allowed
+type Limit struct {
+	Algorithm Algorithm
+	// Limit is the number of requests allowed per Period
+	Limit int
+	// Period is the length of the window, at least one millisecond
+	Period time.Duration
+	// Burst is how many requests GCRA allows at once, Limit if 0
+	Burst int
+}
+
+// Result is the outcome of a single request
+type Result struct {
+	Allowed bool
+	// Limit is the most requests that can be made at once
+	Limit int
+	// Remaining is how many more requests can be made right now
+	Remaining int
+	// RetryAfter is how long to wait until a request is allowed, zero if it was
+	RetryAfter time.Duration
+	// ResetAfter is how long until the limit is fully available again
+	ResetAfter time.Duration
+}
+
+// Limiter applies a named limit to keys
+type Limiter struct {
+	name  string
+	limit Limit
+}
+
+// NewLimiter returns a limiter after checking the limit
+func NewLimiter(name string, limit Limit) (*Limiter, error) {
+
+	if name == "" || strings.Contains(name, ":") {
+		return nil, fmt.Errorf("%w: name must be set and cannot contain a colon", ErrInvalidLimit)
+	}
+
+	if limit.Algorithm != SlidingWindow && limit.Algorithm != GCRA {
+		return nil, fmt.Errorf("%w: unknown algorithm %q", ErrInvalidLimit, limit.Algorithm)
+	}
+
+	if limit.Limit < 1 {
+		return nil, fmt.Errorf("%w: limit must be at least one", ErrInvalidLimit)
+	}
+
+	if limit.Period < time.Millisecond {
+		return nil, fmt.Errorf("%w: period must be at least one millisecond", ErrInvalidLimit)
+	}
+
+	if limit.Burst < 0 {
+		return nil, fmt.Errorf("%w: burst cannot be negative", ErrInvalidLimit)
+	}
+
+	if limit.Burst == 0 {
+		limit.Burst = limit.Limit
+	}
+
+	return &Limiter{
+		name:  name,
+		limit: limit,
+	}, nil
+}
+
+// FromConfig returns a limiter for a limit in the config file
+func FromConfig(name string) (*Limiter, error) {
+
+	if config.Settings == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoLimit, name)
+	}
+
+	settings, ok := config.Settings.RateLimits[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoLimit, name)
+	}
+
+	return NewLimiter(name, Limit{
+		Algorithm: Algorithm(settings.Algorithm),
+		Limit:     settings.Limit,
+		Period:    time.Duration(settings.Period) * time.Second,
+		Burst:     settings.Burst,
+	})
+}
+
+// Name returns the name of the limit
+func (l *Limiter) Name() string {
+	return l.name
+}
+
+// key returns the redis key for a client
+func (l *Limiter) key(key string) string {
+	return strings.Join([]string{keyPrefix, l.name, key}, ":")
+}
+
+// Allow records a request for the key and reports if it is within the limit
+func (l *Limiter) Allow(key string) (result Result, err error) {
+
+	if key == "" {
+		return result, errors.New("key cannot be empty")
+	}
+
+	// zero tells the scripts to use the server clock so instances with drifting clocks agree
+	var current int64
+	if now != nil {
+		current = now().UnixMilli()
+	}
+
+	period := l.limit.Period.Milliseconds()
+
+	var reply interface{}
+
+	switch l.limit.Algorithm {
+	case SlidingWindow:
+		result.Limit = l.limit.Limit
+
+		var member string
+
+		member, err = requestID()
+		if err != nil {
+			return
+		}
+
+		reply, err = redis.Active().Eval(slidingScript, []string{l.key(key)}, current, period, l.limit.Limit, member)
+		if err != nil {
+			return
+		}
+	case GCRA:
+		result.Limit = l.limit.Burst
+
+		// the time between requests at the steady rate
+		interval := period / int64(l.limit.Limit)
+		if interval < 1 {
+			interval = 1
+		}
+
+		reply, err = redis.Active().Eval(gcraScript, []string{l.key(key)}, current, interval, l.limit.Burst)
+		if err != nil {
+			return
+		}
+	}
+
+	values, err := redigo.Int64s(reply, nil)
+	if err != nil {
+		return result, err
+	}
+
+	if len(values) != 4 {
+		return result, errors.New("rate limit script returned unexpected reply")
+	}
+
+	result.Allowed = values[0] == 1
+	result.Remaining = int(values[1])
+	result.RetryAfter = time.Duration(values[2]) * time.Millisecond
+	result.ResetAfter = time.Duration(values[3]) * time.Millisecond
+
+	return
+}
+
+// Reset clears the recorded requests for a key, like after a successful login
+func (l *Limiter) Reset(key string) error {
+
+	if key == "" {
+		return errors.New("key cannot be empty")
+	}
+
+	return redis.Active().Delete(l.key(key))
+}
+
+// requestID returns a unique member for the sliding window log
+func requestID() (string, error) {
+	b := make([]byte, 8)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// keeps a sorted set of request times and only adds the request if the window has room
+// the server clock is used unless a time is passed in
+// returns allowed, remaining, retry after and reset after in milliseconds
+var slidingScript = redigo.NewScript(1, `
+local key = KEYS[1]
+local now = tonumber(ARGV[1])
+if now == 0 then
+	local time = redis.call("TIME")
+	now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+end
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+
+redis.call("ZREMRANGEBYSCORE", key, "-inf", now - window)
+
+local count = redis.call("ZCARD", key)
+local allowed = 0
+
+if count < limit then
+	redis.call("ZADD", key, now, ARGV[4])
+	redis.call("PEXPIRE", key, window)
+	count = count + 1
+	allowed = 1
+end
+
+local retry = 0
+if allowed == 0 then
+	local oldest = redis.call("ZRANGE", key, 0, 0, "WITHSCORES")
+	retry = tonumber(oldest[2]) + window - now
+end
+
+local newest = redis.call("ZRANGE", key, -1, -1, "WITHSCORES")
+local reset = tonumber(newest[2]) + window - now
+
+return {allowed, limit - count, retry, reset}`)
+
+// stores the theoretical arrival time and only moves it forward if the request fits in the burst
+// the server clock is used unless a time is passed in
+// returns allowed, remaining, retry after and reset after in milliseconds
+var gcraScript = redigo.NewScript(1, `
+local key = KEYS[1]
+local now = tonumber(ARGV[1])
+if now == 0 then
+	local time = redis.call("TIME")
+	now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+end
+local interval = tonumber(ARGV[2])
+local burst = tonumber(ARGV[3])
+local tolerance = interval * burst
+
+local tat = tonumber(redis.call("GET", key))
+if not tat or tat < now then
+	tat = now
+end
+
+local newtat = tat + interval
+local allowat = newtat - tolerance
+
+if allowat > now then
+	return {0, 0, allowat - now, tat - now}
+end
+
+redis.call("SET", key, newtat, "PX", newtat - now)
+
+return {1, math.floor((now - allowat) / interval), 0, newtat - now}`)
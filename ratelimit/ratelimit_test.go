@@ -0,0 +1,178 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eirka/eirka-libs/config"
+	"github.com/eirka/eirka-libs/internal/redistest"
+	"github.com/eirka/eirka-libs/internal/testclock"
+)
+
+func TestNewLimiter(t *testing.T) {
+
+	limiter, err := NewLimiter("post", Limit{Algorithm: GCRA, Limit: 10, Period: time.Minute})
+	if assert.NoError(t, err, "An error was not expected") {
+		assert.Equal(t, "post", limiter.Name(), "Name should match")
+		assert.Equal(t, 10, limiter.limit.Burst, "Burst should default to the limit")
+		assert.Equal(t, "ratelimit:post:ip:10.0.0.1", limiter.key("ip:10.0.0.1"), "Key should match")
+	}
+
+	limits := []Limit{
+		{Algorithm: "bucket", Limit: 10, Period: time.Minute},
+		{Algorithm: SlidingWindow, Limit: 0, Period: time.Minute},
+		{Algorithm: SlidingWindow, Limit: 10, Period: 0},
+		{Algorithm: GCRA, Limit: 10, Period: time.Minute, Burst: -1},
+	}
+
+	for _, limit := range limits {
+		_, err := NewLimiter("bad", limit)
+		assert.ErrorIs(t, err, ErrInvalidLimit, "Error should be invalid limit")
+	}
+
+	_, err = NewLimiter("bad:name", Limit{Algorithm: GCRA, Limit: 10, Period: time.Minute})
+	assert.ErrorIs(t, err, ErrInvalidLimit, "Error should be invalid limit")
+}
+
+func TestFromConfig(t *testing.T) {
+
+	original := config.Settings.RateLimits
+	defer func() {
+		config.Settings.RateLimits = original
+	}()
+
+	config.Settings.RateLimits = map[string]config.RateLimit{
+		"login": {Algorithm: "sliding", Limit: 5, Period: 300},
+	}
+
+	limiter, err := FromConfig("login")
+	if assert.NoError(t, err, "An error was not expected") {
+		assert.Equal(t, SlidingWindow, limiter.limit.Algorithm, "Algorithm should match")
+		assert.Equal(t, 5, limiter.limit.Limit, "Limit should match")
+		assert.Equal(t, 5*time.Minute, limiter.limit.Period, "Period should match")
+	}
+
+	_, err = FromConfig("missing")
+	assert.ErrorIs(t, err, ErrNoLimit, "Error should be no limit")
+}
+
+func TestSlidingWindow(t *testing.T) {
+	redistest.Start(t)
+
+	advance := testclock.Freeze(t, &now)
+
+	limiter, err := NewLimiter("sliding", Limit{Algorithm: SlidingWindow, Limit: 3, Period: 10 * time.Second})
+	assert.NoError(t, err, "An error was not expected")
+
+	for i := 0; i < 3; i++ {
+		result, err := limiter.Allow("ip:10.0.0.1")
+		assert.NoError(t, err, "An error was not expected")
+		assert.True(t, result.Allowed, "Request should be allowed")
+		assert.Equal(t, 3, result.Limit, "Limit should match")
+		assert.Equal(t, 2-i, result.Remaining, "Remaining should count down")
+		advance(time.Second)
+	}
+
+	result, err := limiter.Allow("ip:10.0.0.1")
+	assert.NoError(t, err, "An error was not expected")
+	assert.False(t, result.Allowed, "Request should be denied")
+	assert.Equal(t, 0, result.Remaining, "Nothing should remain")
+	assert.Equal(t, 7*time.Second, result.RetryAfter, "Retry should be when the oldest request leaves the window")
+	assert.Equal(t, 9*time.Second, result.ResetAfter, "Reset should be when the newest request leaves the window")
+
+	// other clients have their own window
+	result, err = limiter.Allow("ip:10.0.0.2")
+	assert.NoError(t, err, "An error was not expected")
+	assert.True(t, result.Allowed, "Request should be allowed")
+
+	// the oldest request leaves the window
+	advance(7 * time.Second)
+
+	result, err = limiter.Allow("ip:10.0.0.1")
+	assert.NoError(t, err, "An error was not expected")
+	assert.True(t, result.Allowed, "Request should be allowed")
+	assert.Equal(t, 0, result.Remaining, "Nothing should remain")
+
+	err = limiter.Reset("ip:10.0.0.1")
+	assert.NoError(t, err, "An error was not expected")
+
+	result, err = limiter.Allow("ip:10.0.0.1")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 2, result.Remaining, "Limit should be reset")
+}
+
+func TestGCRA(t *testing.T) {
+	redistest.Start(t)
+
+	advance := testclock.Freeze(t, &now)
+
+	limiter, err := NewLimiter("gcra", Limit{Algorithm: GCRA, Limit: 10, Period: 10 * time.Second, Burst: 3})
+	assert.NoError(t, err, "An error was not expected")
+
+	for i := 0; i < 3; i++ {
+		result, err := limiter.Allow("user:2")
+		assert.NoError(t, err, "An error was not expected")
+		assert.True(t, result.Allowed, "Burst should be allowed")
+		assert.Equal(t, 3, result.Limit, "Limit should be the burst")
+		assert.Equal(t, 2-i, result.Remaining, "Remaining should count down")
+	}
+
+	result, err := limiter.Allow("user:2")
+	assert.NoError(t, err, "An error was not expected")
+	assert.False(t, result.Allowed, "Request should be denied")
+	assert.Equal(t, time.Second, result.RetryAfter, "Retry should be one emission interval")
+	assert.Equal(t, 3*time.Second, result.ResetAfter, "Reset should be when the bucket is full")
+
+	// one token refills each second
+	advance(time.Second)
+
+	result, err = limiter.Allow("user:2")
+	assert.NoError(t, err, "An error was not expected")
+	assert.True(t, result.Allowed, "Request should be allowed")
+	assert.Equal(t, 0, result.Remaining, "Nothing should remain")
+
+	result, err = limiter.Allow("user:2")
+	assert.NoError(t, err, "An error was not expected")
+	assert.False(t, result.Allowed, "Request should be denied")
+
+	// a full bucket after waiting
+	advance(time.Minute)
+
+	result, err = limiter.Allow("user:2")
+	assert.NoError(t, err, "An error was not expected")
+	assert.True(t, result.Allowed, "Request should be allowed")
+	assert.Equal(t, 2, result.Remaining, "Bucket should be full")
+}
+
+func TestServerClock(t *testing.T) {
+	redistest.Start(t)
+
+	for _, algorithm := range []Algorithm{SlidingWindow, GCRA} {
+		limiter, err := NewLimiter("server"+string(algorithm), Limit{Algorithm: algorithm, Limit: 1, Period: 10 * time.Second})
+		assert.NoError(t, err, "An error was not expected")
+
+		result, err := limiter.Allow("ip:10.0.0.1")
+		assert.NoError(t, err, "An error was not expected")
+		assert.True(t, result.Allowed, "Request should be allowed")
+
+		result, err = limiter.Allow("ip:10.0.0.1")
+		assert.NoError(t, err, "An error was not expected")
+		assert.False(t, result.Allowed, "Request should be denied")
+		assert.True(t, result.RetryAfter > 0 && result.RetryAfter <= 10*time.Second, "Retry should come from the server clock")
+		assert.True(t, result.ResetAfter > 0 && result.ResetAfter <= 10*time.Second, "Reset should come from the server clock")
+	}
+}
+
+func TestAllowEmptyKey(t *testing.T) {
+
+	limiter, err := NewLimiter("empty", Limit{Algorithm: GCRA, Limit: 10, Period: time.Minute})
+	assert.NoError(t, err, "An error was not expected")
+
+	_, err = limiter.Allow("")
+	assert.Error(t, err, "An error was expected for empty key")
+
+	err = limiter.Reset("")
+	assert.Error(t, err, "An error was expected for empty key")
+}
@@ -0,0 +1,456 @@
+package redis
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// DefaultScanCount is used when the ScanKeys count is 0
+const DefaultScanCount = 100
+
+// ErrInvalidKeyName is returned when a key name does not match the fields of its base
+var ErrInvalidKeyName = errors.New("key name does not match its base")
+
+// KeyInfo describes a key stored in redis
+type KeyInfo struct {
+	// Name is the key without the store prefix
+	Name string
+	Base string
+	// Fields are the ids the key was set with, without the hash tag
+	Fields []string
+	// Type is the redis type, like string or hash
+	Type string
+	// TTL is the time left before the key expires, -1 if it does not expire
+	TTL time.Duration
+	// Memory is the number of bytes from MEMORY USAGE, -1 if the server does not allow it
+	Memory int64
+	// HashFields is the number of fields in a hash
+	HashFields int
+}
+
+// Entry is a decoded value from a key
+type Entry struct {
+	// Field is the hash field, empty for strings
+	Field string
+	// Size is the stored size in bytes including any headers
+	Size int
+	// StaleAt is when the value goes stale for keys with a soft expiry
+	StaleAt time.Time
+	// Codec and Version come from the header written by typed keys, Codec is empty for raw data
+	Codec   string
+	Version uint32
+	// Value is the decoded data, raw data that is not JSON is a string
+	Value interface{}
+}
+
+// entryCodecs maps the codec ids in entry headers to their names
+var entryCodecs = map[byte]struct {
+	name  string
+	codec Codec
+}{
+	codecJSON:     {"json", JSONCodec},
+	codecMsgpack:  {"msgpack", MsgpackCodec},
+	codecGzipJSON: {"gzip-json", GzipJSONCodec},
+}
+
+// ParseKey splits a key name into its base and the ids it was set with using the registered key
+func ParseKey(name string) (base string, fields []string, err error) {
+
+	base, rest, _ := strings.Cut(name, ":")
+
+	key := NewKey(base)
+	if key == nil {
+		return "", nil, fmt.Errorf("%w: %s", ErrUnknownKey, base)
+	}
+
+	fields, err = key.parse(name, rest)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return base, fields, nil
+}
+
+// parse splits the part of a key name after the base into fields, undoing the hash tag on the first
+func (r *Key) parse(name, rest string) (fields []string, err error) {
+
+	if r.fieldcount == 0 {
+		if name != r.base {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidKeyName, name)
+		}
+		return nil, nil
+	}
+
+	if r.hashtag != "" {
+		tag := "{" + r.hashtag + ":"
+
+		end := strings.Index(rest, "}")
+		if !strings.HasPrefix(rest, tag) || end < 0 {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidKeyName, name)
+		}
+
+		fields = append(fields, rest[len(tag):end])
+		rest = strings.TrimPrefix(rest[end+1:], ":")
+	}
+
+	if rest != "" {
+		fields = append(fields, strings.Split(rest, ":")...)
+	}
+
+	if len(fields) != r.fieldcount {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidKeyName, name)
+	}
+
+	for _, field := range fields {
+		if field == "" {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidKeyName, name)
+		}
+	}
+
+	return fields, nil
+}
+
+// ScanKeys lists a page of the keys of a registered base with SCAN, lock keys are left out
+// Start with cursor 0 and pass the returned cursor back in until it is 0 again. A page can be empty.
+func (c *Store) ScanKeys(ctx context.Context, base string, cursor uint64, count int) (keys []KeyInfo, next uint64, err error) {
+
+	key := NewKey(base)
+	if key == nil {
+		return nil, 0, fmt.Errorf("%w: %s", ErrUnknownKey, base)
+	}
+
+	if !isCacheInitialized() {
+		return nil, 0, ErrCacheNotInitialized
+	}
+
+	if count == 0 {
+		count = DefaultScanCount
+	}
+
+	if !c.allow() {
+		return nil, 0, ErrCircuitOpen
+	}
+
+	conn := c.Pool.Get()
+	defer conn.Close()
+
+	defer func() {
+		c.report(err)
+	}()
+
+	// a base without fields is a single key
+	if key.fieldcount == 0 {
+		keys, err = c.describe(ctx, conn, []string{base})
+		return
+	}
+
+	pattern := globEscaper.Replace(c.Prefix) + globEscaper.Replace(base) + ":*"
+
+	reply, err := redis.Values(redis.DoContext(conn, ctx, "SCAN", cursor, "MATCH", pattern, "COUNT", count))
+	if err != nil {
+		return
+	}
+
+	var scanned []string
+
+	_, err = redis.Scan(reply, &next, &scanned)
+	if err != nil {
+		return
+	}
+
+	var names []string
+
+	for _, name := range scanned {
+		name = strings.TrimPrefix(name, c.Prefix)
+		if !isLockKey(name) {
+			names = append(names, name)
+		}
+	}
+
+	keys, err = c.describe(ctx, conn, names)
+
+	return
+}
+
+// InspectKey describes a single key, returning ErrCacheMiss if it does not exist
+func (c *Store) InspectKey(ctx context.Context, name string) (info KeyInfo, err error) {
+
+	if name == "" {
+		return info, errors.New("key cannot be empty")
+	}
+
+	if !isCacheInitialized() {
+		return info, ErrCacheNotInitialized
+	}
+
+	if !c.allow() {
+		return info, ErrCircuitOpen
+	}
+
+	conn := c.Pool.Get()
+	defer conn.Close()
+
+	keys, err := c.describe(ctx, conn, []string{name})
+	c.report(err)
+	if err != nil {
+		return
+	}
+
+	if len(keys) == 0 {
+		return info, ErrCacheMiss
+	}
+
+	return keys[0], nil
+}
+
+// describe pipelines the type, ttl, memory and hash length of the keys, keys that are gone are left out
+func (c *Store) describe(ctx context.Context, conn redis.Conn, names []string) (keys []KeyInfo, err error) {
+
+	if len(names) == 0 {
+		return
+	}
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	for _, name := range names {
+		key := c.prefixed(name)
+
+		err = conn.Send("TYPE", key)
+		if err != nil {
+			return
+		}
+
+		err = conn.Send("PTTL", key)
+		if err != nil {
+			return
+		}
+
+		err = conn.Send("MEMORY", "USAGE", key)
+		if err != nil {
+			return
+		}
+	}
+
+	err = conn.Flush()
+	if err != nil {
+		return
+	}
+
+	var hashes []int
+
+	for _, name := range names {
+		info := KeyInfo{
+			Name: name,
+		}
+
+		info.Type, err = redis.String(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+
+		ttl, err := redis.Int64(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+
+		info.TTL = -1
+		if ttl >= 0 {
+			info.TTL = time.Duration(ttl) * time.Millisecond
+		}
+
+		// managed servers can disable MEMORY
+		info.Memory, err = redis.Int64(conn.Receive())
+		if err != nil {
+			info.Memory = -1
+		}
+
+		if info.Type == "none" {
+			continue
+		}
+
+		// keys outside the registered bases are still shown
+		info.Base, info.Fields, _ = ParseKey(name)
+
+		if info.Type == "hash" {
+			hashes = append(hashes, len(keys))
+		}
+
+		keys = append(keys, info)
+	}
+
+	if len(hashes) == 0 {
+		return
+	}
+
+	for _, i := range hashes {
+		err = conn.Send("HLEN", c.prefixed(keys[i].Name))
+		if err != nil {
+			return
+		}
+	}
+
+	err = conn.Flush()
+	if err != nil {
+		return
+	}
+
+	for _, i := range hashes {
+		keys[i].HashFields, err = redis.Int(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return
+}
+
+// GetEntries gets and decodes the value of a key, with an entry for every field of a hash
+// Hash fields are sorted by name. Other types than strings and hashes return an error.
+func (c *Store) GetEntries(ctx context.Context, name string) (entries []Entry, err error) {
+
+	if name == "" {
+		return nil, errors.New("key cannot be empty")
+	}
+
+	if !isCacheInitialized() {
+		return nil, ErrCacheNotInitialized
+	}
+
+	if !c.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	conn := c.Pool.Get()
+	defer conn.Close()
+
+	defer func() {
+		c.report(err)
+	}()
+
+	key := c.prefixed(name)
+
+	kind, err := redis.String(redis.DoContext(conn, ctx, "TYPE", key))
+	if err != nil {
+		return
+	}
+
+	// soft expiry headers are only written for keys that have one
+	var soft bool
+
+	base, _, parseErr := ParseKey(name)
+	if parseErr == nil {
+		soft = NewKey(base).softttl > 0
+	}
+
+	switch kind {
+	case "none":
+		return nil, ErrCacheMiss
+	case "string":
+		var data []byte
+
+		data, err = redis.Bytes(redis.DoContext(conn, ctx, "GET", key))
+		if err != nil {
+			return
+		}
+
+		return []Entry{decodeAdminEntry("", data, soft)}, nil
+	case "hash":
+		var fields map[string]string
+
+		fields, err = redis.StringMap(redis.DoContext(conn, ctx, "HGETALL", key))
+		if err != nil {
+			return
+		}
+
+		for field, data := range fields {
+			entries = append(entries, decodeAdminEntry(field, []byte(data), soft))
+		}
+
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Field < entries[j].Field
+		})
+
+		return entries, nil
+	}
+
+	return nil, fmt.Errorf("cannot decode a %s key", kind)
+}
+
+// decodeAdminEntry strips the soft expiry and codec headers and decodes the value for display
+func decodeAdminEntry(field string, data []byte, soft bool) (entry Entry) {
+
+	entry.Field = field
+	entry.Size = len(data)
+
+	if soft && len(data) >= staleHeaderSize && data[0] == staleMagic {
+		entry.StaleAt = time.UnixMilli(int64(binary.BigEndian.Uint64(data[1:staleHeaderSize])))
+		data = data[staleHeaderSize:]
+	}
+
+	if len(data) >= entryHeaderSize && data[0] == entryMagic {
+		codec, ok := entryCodecs[data[1]]
+		if ok {
+			entry.Codec = codec.name
+			entry.Version = binary.BigEndian.Uint32(data[2:entryHeaderSize])
+
+			err := codec.codec.Unmarshal(data[entryHeaderSize:], &entry.Value)
+			if err == nil {
+				return
+			}
+		}
+	}
+
+	if json.Unmarshal(data, &entry.Value) != nil {
+		entry.Value = string(data)
+	}
+
+	return
+}
+
+// DeleteEntry deletes a key, or only one field of a hash if field is set
+// It reports if anything was deleted.
+func (c *Store) DeleteEntry(ctx context.Context, name, field string) (deleted bool, err error) {
+
+	if name == "" {
+		return false, errors.New("key cannot be empty")
+	}
+
+	if !isCacheInitialized() {
+		return false, ErrCacheNotInitialized
+	}
+
+	key := c.prefixed(name)
+
+	if !c.allow() {
+		return false, ErrCircuitOpen
+	}
+
+	conn := c.Pool.Get()
+	defer conn.Close()
+
+	var count int
+
+	if field == "" {
+		count, err = redis.Int(redis.DoContext(conn, ctx, "DEL", key))
+	} else {
+		count, err = redis.Int(redis.DoContext(conn, ctx, "HDEL", key, field))
+	}
+	c.report(err)
+	if err != nil {
+		return
+	}
+
+	c.invalidate(conn, key)
+
+	return count > 0, nil
+}
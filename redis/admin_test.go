@@ -0,0 +1,198 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stvp/tempredis"
+)
+
+func TestParseKey(t *testing.T) {
+	defer unregisterKey("adminboard")
+
+	err := RegisterKey(KeySpec{Base: "adminboard", FieldCount: 2, Hash: true, HashTag: "ib"})
+	assert.NoError(t, err, "An error was not expected")
+
+	tests := []struct {
+		name   string
+		base   string
+		fields []string
+	}{
+		{"thread:1:2", "thread", []string{"1", "2"}},
+		{"index:1", "index", []string{"1"}},
+		{"tagtypes", "tagtypes", nil},
+		{"adminboard:{ib:3}:1234", "adminboard", []string{"3", "1234"}},
+	}
+
+	for _, test := range tests {
+		base, fields, err := ParseKey(test.name)
+		if assert.NoError(t, err, "An error was not expected for %s", test.name) {
+			assert.Equal(t, test.base, base, "Base should match")
+			assert.Equal(t, test.fields, fields, "Fields should match")
+		}
+	}
+
+	// the fields should build the same key again
+	key := NewKey("adminboard").SetKey("3", "1234", "5")
+	_, fields, err := ParseKey(key.String())
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []string{"3", "1234"}, fields, "Fields should round trip")
+
+	_, _, err = ParseKey("blah:1")
+	assert.ErrorIs(t, err, ErrUnknownKey, "Error should be unknown key")
+
+	invalid := []string{
+		"thread:1",
+		"thread:1:2:3",
+		"thread:1:",
+		"tagtypes:1",
+		"adminboard:3:1234",
+		"adminboard:{ib:3}",
+	}
+
+	for _, name := range invalid {
+		_, _, err = ParseKey(name)
+		assert.ErrorIs(t, err, ErrInvalidKeyName, "Error should be invalid key name for %s", name)
+	}
+}
+
+func TestDecodeAdminEntry(t *testing.T) {
+
+	entry := decodeAdminEntry("1", []byte(`{"id":1}`), false)
+	assert.Equal(t, "1", entry.Field, "Field should match")
+	assert.Equal(t, 8, entry.Size, "Size should match")
+	assert.Empty(t, entry.Codec, "Raw data should not have a codec")
+	assert.Equal(t, map[string]interface{}{"id": float64(1)}, entry.Value, "JSON should be decoded")
+
+	entry = decodeAdminEntry("", []byte("plain"), false)
+	assert.Equal(t, "plain", entry.Value, "Raw data should be a string")
+
+	data, err := encodeEntry(MsgpackCodec, 3, map[string]int{"id": 2})
+	assert.NoError(t, err, "An error was not expected")
+
+	entry = decodeAdminEntry("", wrapStale(data, time.Minute), true)
+	assert.Equal(t, "msgpack", entry.Codec, "Codec should match")
+	assert.Equal(t, uint32(3), entry.Version, "Version should match")
+	assert.False(t, entry.StaleAt.IsZero(), "Soft expiry should be set")
+	assert.NotNil(t, entry.Value, "Value should be decoded")
+}
+
+func TestAdminKeys(t *testing.T) {
+
+	server, err := tempredis.Start(tempredis.Config{})
+	if err != nil {
+		panic(err)
+	}
+	defer server.Term()
+
+	config := Redis{
+		Protocol:       "unix",
+		Address:        server.Socket(),
+		MaxIdle:        1,
+		MaxConnections: 5,
+		Prefix:         "staging:",
+	}
+
+	config.NewRedisCache()
+
+	ctx := context.Background()
+
+	assert.NoError(t, NewKey("thread").SetKey("1", "2", "1").Set([]byte(`{"page":1}`)), "An error was not expected")
+	assert.NoError(t, NewKey("thread").SetKey("1", "2", "2").Set([]byte(`{"page":2}`)), "An error was not expected")
+	assert.NoError(t, NewKey("thread").SetKey("1", "3", "1").Set([]byte(`{"page":1}`)), "An error was not expected")
+	assert.NoError(t, NewKey("new").SetKey("1").Set([]byte("new")), "An error was not expected")
+	assert.NoError(t, Cache.Lock("thread:1:2:1:compute"), "An error was not expected")
+
+	typed := NewTypedKey[[]string]("tagtypes", JSONCodec, 2).SetKey()
+	assert.NoError(t, typed.Set([]string{"general", "artist"}), "An error was not expected")
+
+	var (
+		keys   []KeyInfo
+		cursor uint64
+	)
+
+	for {
+		var page []KeyInfo
+
+		page, cursor, err = Cache.ScanKeys(ctx, "thread", cursor, 1)
+		if !assert.NoError(t, err, "An error was not expected") {
+			return
+		}
+
+		keys = append(keys, page...)
+
+		if cursor == 0 {
+			break
+		}
+	}
+
+	if assert.Len(t, keys, 2, "Thread keys should be listed without locks") {
+		for _, key := range keys {
+			assert.Equal(t, "thread", key.Base, "Base should match")
+			assert.Len(t, key.Fields, 2, "Fields should be parsed")
+			assert.Equal(t, "hash", key.Type, "Type should match")
+			assert.Equal(t, time.Duration(-1), key.TTL, "Thread keys should not expire")
+			assert.NotZero(t, key.Memory, "Memory should be set")
+		}
+	}
+
+	info, err := Cache.InspectKey(ctx, "thread:1:2")
+	if assert.NoError(t, err, "An error was not expected") {
+		assert.Equal(t, 2, info.HashFields, "Hash fields should be counted")
+		assert.Equal(t, []string{"1", "2"}, info.Fields, "Fields should match")
+	}
+
+	info, err = Cache.InspectKey(ctx, "new:1")
+	if assert.NoError(t, err, "An error was not expected") {
+		assert.Equal(t, "string", info.Type, "Type should match")
+		assert.True(t, info.TTL > 0 && info.TTL <= DefaultKeyTTL, "TTL should be set")
+	}
+
+	_, err = Cache.InspectKey(ctx, "new:2")
+	assert.Equal(t, ErrCacheMiss, err, "Error should be a cache miss")
+
+	keys, cursor, err = Cache.ScanKeys(ctx, "tagtypes", 0, 0)
+	if assert.NoError(t, err, "An error was not expected") && assert.Len(t, keys, 1, "Key without fields should be listed") {
+		assert.Equal(t, "tagtypes", keys[0].Name, "Name should not have the prefix")
+		assert.Equal(t, uint64(0), cursor, "Cursor should be done")
+	}
+
+	_, _, err = Cache.ScanKeys(ctx, "blah", 0, 0)
+	assert.ErrorIs(t, err, ErrUnknownKey, "Error should be unknown key")
+
+	entries, err := Cache.GetEntries(ctx, "thread:1:2")
+	if assert.NoError(t, err, "An error was not expected") && assert.Len(t, entries, 2, "Every field should be returned") {
+		assert.Equal(t, "1", entries[0].Field, "Fields should be sorted")
+		assert.Equal(t, map[string]interface{}{"page": float64(2)}, entries[1].Value, "Value should be decoded")
+	}
+
+	entries, err = Cache.GetEntries(ctx, "tagtypes")
+	if assert.NoError(t, err, "An error was not expected") && assert.Len(t, entries, 1, "String should have one entry") {
+		assert.Equal(t, "json", entries[0].Codec, "Codec should match")
+		assert.Equal(t, uint32(2), entries[0].Version, "Version should match")
+		assert.Equal(t, []interface{}{"general", "artist"}, entries[0].Value, "Value should be decoded")
+	}
+
+	_, err = Cache.GetEntries(ctx, "new:2")
+	assert.Equal(t, ErrCacheMiss, err, "Error should be a cache miss")
+
+	deleted, err := Cache.DeleteEntry(ctx, "thread:1:2", "1")
+	assert.NoError(t, err, "An error was not expected")
+	assert.True(t, deleted, "Field should be deleted")
+
+	_, err = NewKey("thread").SetKey("1", "2", "1").Get()
+	assert.Equal(t, ErrCacheMiss, err, "Field should be gone")
+
+	_, err = NewKey("thread").SetKey("1", "2", "2").Get()
+	assert.NoError(t, err, "Other fields should be kept")
+
+	deleted, err = Cache.DeleteEntry(ctx, "thread:1:2", "")
+	assert.NoError(t, err, "An error was not expected")
+	assert.True(t, deleted, "Key should be deleted")
+
+	deleted, err = Cache.DeleteEntry(ctx, "thread:1:2", "")
+	assert.NoError(t, err, "An error was not expected")
+	assert.False(t, deleted, "Missing key should not be deleted")
+}
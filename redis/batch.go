@@ -0,0 +1,431 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Result holds the reply for a single element of a batch operation
+// A missing key or field has ErrCacheMiss set just like Get and HGet
+type Result struct {
+	Value []byte
+	Err   error
+}
+
+// Item holds a single record for MSet, a TTL of zero means it never expires
+type Item struct {
+	Key   string
+	Value []byte
+	TTL   time.Duration
+}
+
+// Pipeliner queues commands so they are sent in a single round trip
+type Pipeliner interface {
+	Get(key string)
+	HGet(key string, value string)
+	Set(key string, result []byte)
+	SetEx(key string, timeout uint, result []byte)
+	HMSet(key string, value string, result []byte)
+	Delete(key ...interface{})
+	Expire(key string, timeout uint)
+}
+
+// pipelineCmd is a queued command and how to read its reply
+type pipelineCmd struct {
+	name  string
+	args  []interface{}
+	bytes bool
+	keys  []string
+	err   error
+}
+
+// pipeline collects commands for Store.Pipeline
+type pipeline struct {
+	prefix string
+	cmds   []pipelineCmd
+}
+
+var _ = Pipeliner(&pipeline{})
+
+// add queues a command that reads data
+func (p *pipeline) add(bytes bool, name string, args ...interface{}) {
+	p.cmds = append(p.cmds, pipelineCmd{name: name, args: args, bytes: bytes})
+}
+
+// write queues a command that changes the given keys
+func (p *pipeline) write(keys []string, name string, args ...interface{}) {
+	p.cmds = append(p.cmds, pipelineCmd{name: name, args: args, keys: keys})
+}
+
+// fail queues a command that failed validation so its result keeps its place
+func (p *pipeline) fail(err error) {
+	p.cmds = append(p.cmds, pipelineCmd{err: err})
+}
+
+// Get queues a GET
+func (p *pipeline) Get(key string) {
+	if key == "" {
+		p.fail(errors.New("key cannot be empty"))
+		return
+	}
+	p.add(true, "GET", p.prefix+key)
+}
+
+// HGet queues an HGET
+func (p *pipeline) HGet(key string, value string) {
+	if key == "" {
+		p.fail(errors.New("key cannot be empty"))
+		return
+	}
+	if value == "" {
+		p.fail(errors.New("value cannot be empty"))
+		return
+	}
+	p.add(true, "HGET", p.prefix+key, value)
+}
+
+// Set queues a SET
+func (p *pipeline) Set(key string, result []byte) {
+	if key == "" {
+		p.fail(errors.New("key cannot be empty"))
+		return
+	}
+	p.write([]string{p.prefix + key}, "SET", p.prefix+key, result)
+}
+
+// SetEx queues a SETEX
+func (p *pipeline) SetEx(key string, timeout uint, result []byte) {
+	if key == "" {
+		p.fail(errors.New("key cannot be empty"))
+		return
+	}
+	if timeout == 0 {
+		p.fail(errors.New("timeout must be greater than 0"))
+		return
+	}
+	p.write([]string{p.prefix + key}, "SETEX", p.prefix+key, timeout, result)
+}
+
+// HMSet queues an HMSET
+func (p *pipeline) HMSet(key string, value string, result []byte) {
+	if key == "" {
+		p.fail(errors.New("key cannot be empty"))
+		return
+	}
+	if value == "" {
+		p.fail(errors.New("value cannot be empty"))
+		return
+	}
+	p.write([]string{p.prefix + key}, "HMSET", p.prefix+key, value, result)
+}
+
+// Delete queues a DEL
+func (p *pipeline) Delete(key ...interface{}) {
+	if len(key) == 0 {
+		p.fail(errors.New("at least one key must be provided"))
+		return
+	}
+	keys := make([]string, len(key))
+	args := make([]interface{}, len(key))
+	for i, k := range key {
+		keys[i] = p.prefix + fmt.Sprint(k)
+		args[i] = keys[i]
+	}
+	p.write(keys, "DEL", args...)
+}
+
+// Expire queues an EXPIRE
+func (p *pipeline) Expire(key string, timeout uint) {
+	if key == "" {
+		p.fail(errors.New("key cannot be empty"))
+		return
+	}
+	if timeout == 0 {
+		p.fail(errors.New("timeout must be greater than 0"))
+		return
+	}
+	p.add(false, "EXPIRE", p.prefix+key, timeout)
+}
+
+// Pipeline will send all the commands queued by fn in a single round trip
+// The results are in the same order as the commands were queued
+func (c *Store) Pipeline(fn func(p Pipeliner)) (results []Result, err error) {
+	if fn == nil {
+		return nil, errors.New("pipeline function cannot be nil")
+	}
+
+	if !isCacheInitialized() {
+		return nil, ErrCacheNotInitialized
+	}
+
+	p := &pipeline{prefix: c.Prefix}
+
+	fn(p)
+
+	if len(p.cmds) == 0 {
+		return
+	}
+
+	if !c.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	conn := c.Pool.Get()
+	defer conn.Close()
+
+	for _, cmd := range p.cmds {
+		if cmd.err != nil {
+			continue
+		}
+
+		err = conn.Send(cmd.name, cmd.args...)
+		if err != nil {
+			c.report(err)
+			return nil, err
+		}
+	}
+
+	err = conn.Flush()
+	c.report(err)
+	if err != nil {
+		return nil, err
+	}
+
+	results = make([]Result, len(p.cmds))
+
+	var written []string
+
+	for i, cmd := range p.cmds {
+		if cmd.err != nil {
+			results[i].Err = cmd.err
+			continue
+		}
+
+		reply, err := conn.Receive()
+		if !cmd.bytes {
+			results[i].Err = err
+			if err == nil {
+				written = append(written, cmd.keys...)
+			}
+			continue
+		}
+
+		results[i] = bytesResult(reply, err)
+	}
+
+	c.invalidate(conn, written...)
+
+	return results, nil
+}
+
+// MGet will retrieve multiple keys in a single round trip
+func (c *Store) MGet(keys ...string) (results []Result, err error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one key must be provided")
+	}
+
+	args := make([]interface{}, len(keys))
+
+	for i, key := range keys {
+		if key == "" {
+			return nil, errors.New("key cannot be empty")
+		}
+		args[i] = c.prefixed(key)
+	}
+
+	if !isCacheInitialized() {
+		return nil, ErrCacheNotInitialized
+	}
+
+	if !c.allow() {
+		return missResults(len(keys)), nil
+	}
+
+	conn := c.Pool.Get()
+	defer conn.Close()
+
+	values, err := redis.Values(conn.Do("MGET", args...))
+	c.report(err)
+
+	return valuesResults(values, err)
+}
+
+// HMGet will retrieve multiple fields from a hash in a single round trip
+func (c *Store) HMGet(key string, values ...string) (results []Result, err error) {
+	if key == "" {
+		return nil, errors.New("key cannot be empty")
+	}
+
+	if len(values) == 0 {
+		return nil, errors.New("at least one value must be provided")
+	}
+
+	args := []interface{}{c.prefixed(key)}
+
+	for _, value := range values {
+		if value == "" {
+			return nil, errors.New("value cannot be empty")
+		}
+		args = append(args, value)
+	}
+
+	if !isCacheInitialized() {
+		return nil, ErrCacheNotInitialized
+	}
+
+	if !c.allow() {
+		return missResults(len(values)), nil
+	}
+
+	conn := c.Pool.Get()
+	defer conn.Close()
+
+	replies, err := redis.Values(conn.Do("HMGET", args...))
+	c.report(err)
+
+	return valuesResults(replies, err)
+}
+
+// HGetAll will retrieve every field in a hash, a missing hash is a cache miss
+func (c *Store) HGetAll(key string) (result map[string][]byte, err error) {
+	if key == "" {
+		return nil, errors.New("key cannot be empty")
+	}
+
+	if !isCacheInitialized() {
+		return nil, ErrCacheNotInitialized
+	}
+
+	if !c.allow() {
+		return nil, ErrCacheMiss
+	}
+
+	conn := c.Pool.Get()
+	defer conn.Close()
+
+	values, err := redis.ByteSlices(conn.Do("HGETALL", c.prefixed(key)))
+	c.report(err)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values) == 0 {
+		return nil, ErrCacheMiss
+	}
+
+	if len(values)%2 != 0 {
+		return nil, errors.New("hgetall expects even number of values")
+	}
+
+	result = make(map[string][]byte, len(values)/2)
+
+	for i := 0; i < len(values); i += 2 {
+		result[string(values[i])] = values[i+1]
+	}
+
+	return result, nil
+}
+
+// MSet will atomically set multiple records, each with its own expiry
+func (c *Store) MSet(items ...Item) (err error) {
+	if len(items) == 0 {
+		return errors.New("at least one item must be provided")
+	}
+
+	for _, item := range items {
+		if item.Key == "" {
+			return errors.New("key cannot be empty")
+		}
+		if item.TTL < 0 || (item.TTL > 0 && item.TTL < time.Millisecond) {
+			return errors.New("ttl must be zero or at least one millisecond")
+		}
+	}
+
+	if !isCacheInitialized() {
+		return ErrCacheNotInitialized
+	}
+
+	keys := make([]string, len(items))
+
+	for i, item := range items {
+		keys[i] = c.prefixed(item.Key)
+	}
+
+	if !c.allow() {
+		c.skip("MSET", keys...)
+		return
+	}
+
+	conn := c.Pool.Get()
+	defer conn.Close()
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		c.report(err)
+		return
+	}
+
+	for i, item := range items {
+
+		if item.TTL > 0 {
+			err = conn.Send("SET", keys[i], item.Value, "PX", int64(item.TTL/time.Millisecond))
+		} else {
+			err = conn.Send("SET", keys[i], item.Value)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	_, err = conn.Do("EXEC")
+	c.report(err)
+	if err != nil {
+		return
+	}
+
+	c.invalidate(conn, keys...)
+
+	return
+}
+
+// bytesResult converts a single reply, a nil reply is a cache miss
+func bytesResult(reply interface{}, err error) Result {
+	value, err := redis.Bytes(reply, err)
+	if err == redis.ErrNil {
+		return Result{Err: ErrCacheMiss}
+	}
+	if err != nil {
+		return Result{Err: err}
+	}
+
+	return Result{Value: value}
+}
+
+// missResults returns a cache miss for every element
+func missResults(n int) []Result {
+	results := make([]Result, n)
+
+	for i := range results {
+		results[i].Err = ErrCacheMiss
+	}
+
+	return results
+}
+
+// valuesResults converts a multi bulk reply into results
+func valuesResults(values []interface{}, err error) ([]Result, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]Result, len(values))
+
+	for i, value := range values {
+		results[i] = bytesResult(value, nil)
+	}
+
+	return results, nil
+}
@@ -0,0 +1,247 @@
+package redis
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stvp/tempredis"
+)
+
+func TestMethodMGet(t *testing.T) {
+
+	NewRedisMock()
+
+	Cache.Mock.Command("MGET", "new:1", "new:2", "new:3").Expect([]interface{}{[]byte("one"), nil, []byte("three")})
+
+	res, err := Cache.MGet("new:1", "new:2", "new:3")
+
+	assert.NoError(t, err, "An error was not expected")
+
+	if assert.Len(t, res, 3, "Should return a result per key") {
+		assert.Equal(t, Result{Value: []byte("one")}, res[0], "Result should match")
+		assert.Equal(t, Result{Err: ErrCacheMiss}, res[1], "Missing key should be a cache miss")
+		assert.Equal(t, Result{Value: []byte("three")}, res[2], "Result should match")
+	}
+
+	_, err = Cache.MGet()
+	assert.Error(t, err, "An error was expected for no keys")
+
+	_, err = Cache.MGet("new:1", "")
+	assert.Error(t, err, "An error was expected for empty key")
+
+	Cache.Mock.Command("MGET", "new:1").ExpectError(errors.New("connection error"))
+
+	_, err = Cache.MGet("new:1")
+	assert.Error(t, err, "An error was expected")
+}
+
+func TestMethodHMGet(t *testing.T) {
+
+	NewRedisMock()
+
+	Cache.Mock.Command("HMGET", "index:1", "1", "2").Expect([]interface{}{nil, []byte("two")})
+
+	res, err := Cache.HMGet("index:1", "1", "2")
+
+	assert.NoError(t, err, "An error was not expected")
+
+	if assert.Len(t, res, 2, "Should return a result per field") {
+		assert.Equal(t, ErrCacheMiss, res[0].Err, "Missing field should be a cache miss")
+		assert.Equal(t, []byte("two"), res[1].Value, "Result should match")
+	}
+
+	_, err = Cache.HMGet("", "1")
+	assert.Error(t, err, "An error was expected for empty key")
+
+	_, err = Cache.HMGet("index:1")
+	assert.Error(t, err, "An error was expected for no fields")
+
+	_, err = Cache.HMGet("index:1", "")
+	assert.Error(t, err, "An error was expected for empty field")
+}
+
+func TestMethodHGetAll(t *testing.T) {
+
+	NewRedisMock()
+
+	Cache.Mock.Command("HGETALL", "index:1").Expect([]interface{}{[]byte("1"), []byte("one"), []byte("2"), []byte("two")})
+
+	res, err := Cache.HGetAll("index:1")
+
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.Equal(t, map[string][]byte{"1": []byte("one"), "2": []byte("two")}, res, "Result should match")
+
+	Cache.Mock.Command("HGETALL", "index:2").Expect([]interface{}{})
+
+	_, err = Cache.HGetAll("index:2")
+	assert.Equal(t, ErrCacheMiss, err, "Empty hash should be a cache miss")
+
+	_, err = Cache.HGetAll("")
+	assert.Error(t, err, "An error was expected for empty key")
+}
+
+func TestMethodMSet(t *testing.T) {
+
+	NewRedisMock()
+
+	Cache.Mock.Command("MULTI")
+	Cache.Mock.Command("SET", "new:1", []byte("one"), "PX", int64(60000))
+	Cache.Mock.Command("SET", "tagtypes", []byte("two"))
+	Cache.Mock.Command("EXEC").Expect([]interface{}{"OK", "OK"})
+
+	err := Cache.MSet(
+		Item{Key: "new:1", Value: []byte("one"), TTL: time.Minute},
+		Item{Key: "tagtypes", Value: []byte("two")},
+	)
+
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.NoError(t, Cache.Mock.ExpectationsWereMet(), "All commands should have been called")
+
+	err = Cache.MSet()
+	assert.Error(t, err, "An error was expected for no items")
+
+	err = Cache.MSet(Item{Value: []byte("one")})
+	assert.Error(t, err, "An error was expected for empty key")
+
+	err = Cache.MSet(Item{Key: "new:1", TTL: time.Microsecond})
+	assert.Error(t, err, "An error was expected for short ttl")
+}
+
+func TestMethodPipeline(t *testing.T) {
+
+	NewRedisMock()
+
+	Cache.Mock.Command("GET", "new:1").Expect([]byte("one"))
+	Cache.Mock.Command("HGET", "index:1", "1").Expect(nil)
+	Cache.Mock.Command("SET", "new:2", []byte("two")).Expect("OK")
+	Cache.Mock.Command("DEL", "new:3").ExpectError(errors.New("connection error"))
+
+	res, err := Cache.Pipeline(func(p Pipeliner) {
+		p.Get("new:1")
+		p.HGet("index:1", "1")
+		p.Set("new:2", []byte("two"))
+		p.Get("")
+		p.Delete("new:3")
+	})
+
+	assert.NoError(t, err, "An error was not expected")
+
+	if assert.Len(t, res, 5, "Should return a result per command") {
+		assert.Equal(t, []byte("one"), res[0].Value, "Result should match")
+		assert.Equal(t, ErrCacheMiss, res[1].Err, "Missing field should be a cache miss")
+		assert.NoError(t, res[2].Err, "An error was not expected")
+		assert.Error(t, res[3].Err, "An error was expected for empty key")
+		assert.Error(t, res[4].Err, "An error was expected")
+	}
+
+	res, err = Cache.Pipeline(func(p Pipeliner) {})
+	assert.NoError(t, err, "An error was not expected")
+	assert.Empty(t, res, "Should not return results")
+
+	_, err = Cache.Pipeline(nil)
+	assert.Error(t, err, "An error was expected for nil function")
+}
+
+func TestBatchPrefix(t *testing.T) {
+
+	NewRedisMock()
+
+	Cache.Prefix = "staging:"
+	defer func() {
+		Cache.Prefix = ""
+	}()
+
+	Cache.Mock.Command("MGET", "staging:new:1", "staging:new:2").Expect([]interface{}{[]byte("one"), nil})
+
+	results, err := Cache.MGet("new:1", "new:2")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("one"), results[0].Value, "Value should match")
+
+	Cache.Mock.Command("GET", "staging:new:1").Expect([]byte("one"))
+	del := Cache.Mock.Command("DEL", "staging:new:3").Expect(int64(1))
+
+	results, err = Cache.Pipeline(func(p Pipeliner) {
+		p.Get("new:1")
+		p.Delete("new:3")
+	})
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("one"), results[0].Value, "Value should match")
+	assert.Equal(t, 1, Cache.Mock.Stats(del), "Command should be called with the prefix")
+}
+
+func TestBatchUninitialized(t *testing.T) {
+	originalCache := Cache
+	originalInitialized := cacheInitialized.Load()
+
+	Cache = Store{}
+	cacheInitialized.Store(0)
+
+	_, err := Cache.MGet("new:1")
+	assert.Equal(t, ErrCacheNotInitialized, err, "Should return 'cache not initialized' error")
+
+	_, err = Cache.HMGet("index:1", "1")
+	assert.Equal(t, ErrCacheNotInitialized, err, "Should return 'cache not initialized' error")
+
+	_, err = Cache.HGetAll("index:1")
+	assert.Equal(t, ErrCacheNotInitialized, err, "Should return 'cache not initialized' error")
+
+	err = Cache.MSet(Item{Key: "new:1"})
+	assert.Equal(t, ErrCacheNotInitialized, err, "Should return 'cache not initialized' error")
+
+	_, err = Cache.Pipeline(func(p Pipeliner) {})
+	assert.Equal(t, ErrCacheNotInitialized, err, "Should return 'cache not initialized' error")
+
+	Cache = originalCache
+	cacheInitialized.Store(originalInitialized)
+}
+
+func TestBatchRedis(t *testing.T) {
+
+	server, err := tempredis.Start(tempredis.Config{})
+	if err != nil {
+		panic(err)
+	}
+	defer server.Term()
+
+	config := Redis{
+		Protocol:       "unix",
+		Address:        server.Socket(),
+		MaxIdle:        1,
+		MaxConnections: 5,
+	}
+
+	config.NewRedisCache()
+
+	err = Cache.MSet(
+		Item{Key: "new:1", Value: []byte("one"), TTL: time.Minute},
+		Item{Key: "new:2", Value: []byte("two")},
+	)
+	assert.NoError(t, err, "An error was not expected")
+
+	res, err := Cache.MGet("new:1", "new:2", "new:3")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []Result{{Value: []byte("one")}, {Value: []byte("two")}, {Err: ErrCacheMiss}}, res, "Results should match")
+
+	res, err = Cache.Pipeline(func(p Pipeliner) {
+		p.HMSet("index:1", "1", []byte("one"))
+		p.HMSet("index:1", "2", []byte("two"))
+		p.Expire("index:1", 60)
+		p.HGet("index:1", "2")
+		p.HGet("index:1", "3")
+	})
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("two"), res[3].Value, "Result should match")
+	assert.Equal(t, ErrCacheMiss, res[4].Err, "Missing field should be a cache miss")
+
+	hash, err := Cache.HGetAll("index:1")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, map[string][]byte{"1": []byte("one"), "2": []byte("two")}, hash, "Hash should match")
+
+	fields, err := Cache.HMGet("index:1", "1", "3")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []Result{{Value: []byte("one")}, {Err: ErrCacheMiss}}, fields, "Results should match")
+}
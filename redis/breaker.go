@@ -0,0 +1,276 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	// DefaultBreakerThreshold is used when Breaker Threshold is 0
+	DefaultBreakerThreshold = 5
+	// DefaultBreakerInterval is used when Breaker Interval is 0
+	DefaultBreakerInterval = 5 * time.Second
+	// DefaultSkippedWrites is used when Breaker MaxSkipped is 0
+	DefaultSkippedWrites = 1000
+)
+
+// ErrCircuitOpen is returned by commands that can not be skipped while redis is unreachable
+var ErrCircuitOpen = errors.New("redis circuit breaker is open")
+
+// BreakerState is the state of the circuit breaker
+type BreakerState int
+
+const (
+	// BreakerClosed sends every command to redis
+	BreakerClosed BreakerState = iota
+	// BreakerOpen skips redis, reads are misses and writes are dropped
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe through to see if redis is back
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// SkippedWrite is a write that was dropped while the breaker was open
+type SkippedWrite struct {
+	Time    time.Time
+	Command string
+	Keys    []string
+}
+
+// Breaker stops sending commands to redis after consecutive connection failures
+type Breaker struct {
+	Threshold  int           // Consecutive failures before opening, DefaultBreakerThreshold if 0
+	Interval   time.Duration // Time between probes while open, DefaultBreakerInterval if 0
+	MaxSkipped int           // Number of skipped writes kept for logging, DefaultSkippedWrites if 0
+
+	// OnStateChange is called after every state change
+	OnStateChange func(from, to BreakerState)
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	changed  time.Time
+	skipped  []SkippedWrite
+	dropped  int
+
+	// now is the clock used for the probe interval
+	now func() time.Time
+}
+
+// NewBreaker returns a closed breaker
+func NewBreaker(threshold int, interval time.Duration) *Breaker {
+	return &Breaker{
+		Threshold: threshold,
+		Interval:  interval,
+		now:       time.Now,
+	}
+}
+
+// clock returns the current time
+func (b *Breaker) clock() time.Time {
+	if b.now == nil {
+		return time.Now()
+	}
+	return b.now()
+}
+
+// State returns the current state
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+// Allow reports if a command should be sent to redis
+// Once the interval has passed an open breaker goes half open and lets one probe through
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+
+	interval := b.Interval
+	if interval == 0 {
+		interval = DefaultBreakerInterval
+	}
+
+	switch b.state {
+	case BreakerClosed:
+		b.mu.Unlock()
+		return true
+	case BreakerOpen, BreakerHalfOpen:
+		// a half open probe that never reported is replaced after the interval
+		if b.clock().Sub(b.changed) < interval {
+			b.mu.Unlock()
+			return false
+		}
+	}
+
+	from := b.transition(BreakerHalfOpen)
+	b.mu.Unlock()
+
+	b.notify(from, BreakerHalfOpen)
+
+	return true
+}
+
+// Report records the result of a command that was allowed
+func (b *Breaker) Report(err error) {
+	failed := isConnectionError(err)
+
+	b.mu.Lock()
+
+	threshold := b.Threshold
+	if threshold == 0 {
+		threshold = DefaultBreakerThreshold
+	}
+
+	var to BreakerState
+
+	switch {
+	case b.state == BreakerHalfOpen && failed:
+		to = BreakerOpen
+	case b.state == BreakerHalfOpen:
+		b.failures = 0
+		to = BreakerClosed
+	case b.state == BreakerClosed && failed:
+		b.failures++
+		if b.failures < threshold {
+			b.mu.Unlock()
+			return
+		}
+		to = BreakerOpen
+	case b.state == BreakerClosed:
+		b.failures = 0
+		b.mu.Unlock()
+		return
+	default:
+		// commands that were in flight when the breaker opened
+		b.mu.Unlock()
+		return
+	}
+
+	from := b.transition(to)
+	b.mu.Unlock()
+
+	b.notify(from, to)
+}
+
+// transition changes the state and returns the previous one, the lock must be held
+func (b *Breaker) transition(to BreakerState) BreakerState {
+	from := b.state
+
+	b.state = to
+	b.changed = b.clock()
+
+	if to == BreakerClosed {
+		b.failures = 0
+	}
+
+	return from
+}
+
+// notify calls the state change hook outside of the lock
+func (b *Breaker) notify(from, to BreakerState) {
+	if b.OnStateChange != nil && from != to {
+		b.OnStateChange(from, to)
+	}
+}
+
+// skip records a dropped write, the oldest are discarded once MaxSkipped is reached
+func (b *Breaker) skip(command string, keys ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	limit := b.MaxSkipped
+	if limit == 0 {
+		limit = DefaultSkippedWrites
+	}
+
+	if len(b.skipped) >= limit {
+		b.skipped = b.skipped[1:]
+		b.dropped++
+	}
+
+	b.skipped = append(b.skipped, SkippedWrite{
+		Time:    b.clock(),
+		Command: command,
+		Keys:    keys,
+	})
+}
+
+// SkippedWrites returns and clears the writes dropped while the breaker was open
+// along with how many more were discarded because the queue was full
+func (b *Breaker) SkippedWrites() (writes []SkippedWrite, discarded int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	writes, discarded = b.skipped, b.dropped
+
+	b.skipped = nil
+	b.dropped = 0
+
+	return
+}
+
+// isConnectionError checks if an error means redis could not be reached
+// Misses and error replies from the server show that redis is up
+func isConnectionError(err error) bool {
+	if err == nil || err == redis.ErrNil || err == ErrCacheMiss {
+		return false
+	}
+
+	// the caller gave up, which says nothing about redis
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var reply redis.Error
+
+	return !errors.As(err, &reply)
+}
+
+// allow reports if a command should be sent to redis
+func (c *Store) allow() bool {
+	return c.Breaker == nil || c.Breaker.Allow()
+}
+
+// degraded checks if the breaker is not closed without taking the probe
+// The mutex hides connection errors so locks can not report back to the breaker
+func (c *Store) degraded() bool {
+	return c.Breaker != nil && c.Breaker.State() != BreakerClosed
+}
+
+// Degraded reports if the active store is skipping redis because the breaker is not closed
+// Reads are misses while it is, so callers that take a miss as an answer should check it first.
+func Degraded() bool {
+	store, ok := Active().(*Store)
+	return ok && store.degraded()
+}
+
+// report passes the result of a command to the breaker
+func (c *Store) report(err error) {
+	if c.Breaker != nil {
+		c.Breaker.Report(err)
+	}
+}
+
+// skip records a write dropped by the breaker
+func (c *Store) skip(command string, keys ...string) {
+	if c.Breaker != nil {
+		c.Breaker.skip(command, keys...)
+	}
+}
@@ -0,0 +1,238 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stvp/tempredis"
+)
+
+// newTestBreaker returns a breaker with a clock that can be moved forward
+func newTestBreaker(threshold int, interval time.Duration) (*Breaker, func(time.Duration)) {
+	b := NewBreaker(threshold, interval)
+
+	current := time.Now()
+
+	b.now = func() time.Time {
+		return current
+	}
+
+	return b, func(d time.Duration) {
+		current = current.Add(d)
+	}
+}
+
+func TestBreakerStates(t *testing.T) {
+
+	b, advance := newTestBreaker(3, 10*time.Second)
+
+	var changes []string
+
+	b.OnStateChange = func(from, to BreakerState) {
+		changes = append(changes, from.String()+" to "+to.String())
+	}
+
+	failure := errors.New("dial unix: connect: no such file or directory")
+
+	// misses, error replies and cancellations show redis is up
+	for _, err := range []error{nil, ErrCacheMiss, redis.ErrNil, redis.Error("WRONGTYPE"), context.Canceled} {
+		assert.True(t, b.Allow(), "Breaker should be closed")
+		b.Report(err)
+	}
+
+	// failures have to be consecutive
+	b.Report(failure)
+	b.Report(failure)
+	b.Report(nil)
+	b.Report(failure)
+	b.Report(failure)
+
+	assert.Equal(t, BreakerClosed, b.State(), "Breaker should be closed")
+
+	b.Report(failure)
+
+	assert.Equal(t, BreakerOpen, b.State(), "Breaker should be open")
+	assert.False(t, b.Allow(), "Commands should be skipped")
+
+	advance(10 * time.Second)
+
+	// a single probe is let through
+	assert.True(t, b.Allow(), "Probe should be allowed")
+	assert.Equal(t, BreakerHalfOpen, b.State(), "Breaker should be half open")
+	assert.False(t, b.Allow(), "Only one probe should be allowed")
+
+	b.Report(failure)
+
+	assert.Equal(t, BreakerOpen, b.State(), "Failed probe should open the breaker")
+	assert.False(t, b.Allow(), "Commands should be skipped")
+
+	advance(10 * time.Second)
+
+	assert.True(t, b.Allow(), "Probe should be allowed")
+
+	// a probe that never reports is replaced
+	advance(10 * time.Second)
+
+	assert.True(t, b.Allow(), "Probe should be replaced")
+
+	b.Report(nil)
+
+	assert.Equal(t, BreakerClosed, b.State(), "Successful probe should close the breaker")
+
+	assert.Equal(t, []string{
+		"closed to open",
+		"open to half-open",
+		"half-open to open",
+		"open to half-open",
+		"half-open to closed",
+	}, changes, "State changes should be observed")
+}
+
+func TestBreakerSkippedWrites(t *testing.T) {
+
+	b, _ := newTestBreaker(1, time.Second)
+
+	b.MaxSkipped = 2
+
+	b.skip("SET", "index:1")
+	b.skip("DEL", "index:2")
+	b.skip("HMSET", "index:3")
+
+	writes, discarded := b.SkippedWrites()
+
+	if assert.Len(t, writes, 2, "Skipped writes should be bounded") {
+		assert.Equal(t, "DEL", writes[0].Command, "Oldest writes should be discarded")
+		assert.Equal(t, []string{"index:3"}, writes[1].Keys, "Keys should match")
+	}
+	assert.Equal(t, 1, discarded, "Discarded count should match")
+
+	writes, discarded = b.SkippedWrites()
+
+	assert.Empty(t, writes, "Skipped writes should be cleared")
+	assert.Zero(t, discarded, "Discarded count should be cleared")
+}
+
+func TestStoreBreaker(t *testing.T) {
+
+	server, err := tempredis.Start(tempredis.Config{})
+	if err != nil {
+		panic(err)
+	}
+	defer server.Term()
+
+	config := Redis{
+		Protocol:         "unix",
+		Address:          server.Socket() + ".missing",
+		MaxIdle:          1,
+		MaxConnections:   5,
+		BreakerThreshold: 2,
+	}
+
+	config.NewRedisCache()
+
+	b, advance := newTestBreaker(2, time.Second)
+	Cache.Breaker = b
+
+	// redis is unreachable until the breaker opens
+	for i := 0; i < 2; i++ {
+		_, err = Cache.Get("index:1")
+		assert.Error(t, err, "An error was expected")
+		assert.NotEqual(t, ErrCacheMiss, err, "Error should be a connection error")
+	}
+
+	assert.Equal(t, BreakerOpen, b.State(), "Breaker should be open")
+	assert.True(t, Degraded(), "Store should be degraded")
+
+	// reads fall through to the database
+	_, err = Cache.Get("index:1")
+	assert.Equal(t, ErrCacheMiss, err, "Reads should be misses")
+
+	_, err = NewKey("thread").SetKey("1", "2", "3").Get()
+	assert.Equal(t, ErrCacheMiss, err, "Key reads should be misses")
+
+	results, err := Cache.MGet("new:1", "new:2")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []Result{{Err: ErrCacheMiss}, {Err: ErrCacheMiss}}, results, "Batch reads should be misses")
+
+	// writes are dropped
+	assert.NoError(t, NewKey("index").SetKey("1", "1").Delete(), "Key deletes should be skipped")
+	assert.NoError(t, NewKey("new").SetKey("1").Set([]byte("data")), "Key sets should be skipped")
+
+	_, err = Cache.Incr("counter")
+	assert.Equal(t, ErrCircuitOpen, err, "Error should be circuit open")
+
+	writes, _ := b.SkippedWrites()
+
+	commands := make([]string, len(writes))
+	for i, write := range writes {
+		commands[i] = write.Command
+	}
+
+	assert.Equal(t, []string{"DEL", "LOCK", "SET", "EXPIRE"}, commands, "Skipped writes should be recorded")
+
+	// redis comes back
+	Cache.Pool = &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("unix", server.Socket())
+		},
+	}
+
+	advance(time.Second)
+
+	err = Cache.Set("new:1", []byte("data"))
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.Equal(t, BreakerClosed, b.State(), "Breaker should be closed after a probe")
+	assert.False(t, Degraded(), "Store should not be degraded")
+
+	result, err := Cache.Get("new:1")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("data"), result, "Data should match")
+}
+
+func TestStoreBreakerLocks(t *testing.T) {
+
+	server, err := tempredis.Start(tempredis.Config{})
+	if err != nil {
+		panic(err)
+	}
+	defer server.Term()
+
+	config := Redis{
+		Protocol:       "unix",
+		Address:        server.Socket(),
+		MaxIdle:        1,
+		MaxConnections: 5,
+	}
+
+	config.NewRedisCache()
+
+	b, _ := newTestBreaker(1, time.Second)
+	Cache.Breaker = b
+
+	assert.NoError(t, Cache.Lock("index:1:mutex"), "An error was not expected")
+
+	// the breaker opens while the lock is held
+	b.Report(errors.New("connection refused"))
+	assert.Equal(t, BreakerOpen, b.State(), "Breaker should be open")
+
+	assert.Equal(t, ErrCircuitOpen, Cache.Lock("index:2:mutex"), "Error should be circuit open")
+	assert.Equal(t, ErrCircuitOpen, Cache.TryLock("index:2:mutex"), "Error should be circuit open")
+
+	// deletes skip redis so there is nothing for the key lock to protect
+	assert.NoError(t, NewKey("index").SetKey("2", "1").Delete(), "Key deletes should be skipped")
+
+	// the held lock is still released
+	assert.True(t, Cache.Unlock("index:1:mutex"), "Lock should be unlocked")
+
+	conn := Cache.Pool.Get()
+	defer conn.Close()
+
+	exists, err := redis.Bool(conn.Do("EXISTS", "index:1:mutex"))
+	assert.NoError(t, err, "An error was not expected")
+	assert.False(t, exists, "Lock should be deleted")
+}
@@ -0,0 +1,150 @@
+package redis
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec converts values to and from the bytes stored in redis
+type Codec interface {
+	// ID is written into the entry header so entries from another codec are not decoded
+	ID() byte
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// codec ids written into the entry header
+const (
+	codecJSON byte = iota + 1
+	codecMsgpack
+	codecGzipJSON
+)
+
+// entryMagic marks an entry as having a codec header
+const entryMagic byte = 0xec
+
+// entryHeaderSize is the magic byte, the codec id and the schema version
+const entryHeaderSize = 6
+
+var (
+	// JSONCodec encodes values with encoding/json
+	JSONCodec Codec = jsonCodec{}
+	// MsgpackCodec encodes values with msgpack
+	MsgpackCodec Codec = msgpackCodec{}
+	// GzipJSONCodec encodes values with encoding/json and compresses them with gzip
+	GzipJSONCodec Codec = gzipJSONCodec{}
+
+	// errStaleEntry is returned when the entry header does not match the codec or version
+	errStaleEntry = errors.New("cache entry header does not match")
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() byte {
+	return codecJSON
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ID() byte {
+	return codecMsgpack
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+type gzipJSONCodec struct{}
+
+func (gzipJSONCodec) ID() byte {
+	return codecGzipJSON
+}
+
+func (gzipJSONCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+
+	zw := gzip.NewWriter(&buf)
+
+	_, err = zw.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gzipJSONCodec) Unmarshal(data []byte, v interface{}) error {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(raw, v)
+}
+
+// encodeEntry marshals a value and prefixes it with the codec header
+func encodeEntry(codec Codec, version uint32, v interface{}) ([]byte, error) {
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := make([]byte, entryHeaderSize, entryHeaderSize+len(data))
+	entry[0] = entryMagic
+	entry[1] = codec.ID()
+	binary.BigEndian.PutUint32(entry[2:entryHeaderSize], version)
+
+	return append(entry, data...), nil
+}
+
+// entryMatches checks if an entry was written with the codec and version
+func entryMatches(codec Codec, version uint32, entry []byte) bool {
+	if len(entry) < entryHeaderSize || entry[0] != entryMagic {
+		return false
+	}
+
+	return entry[1] == codec.ID() && binary.BigEndian.Uint32(entry[2:entryHeaderSize]) == version
+}
+
+// decodeEntry checks the codec header and unmarshals the value
+func decodeEntry(codec Codec, version uint32, entry []byte, v interface{}) error {
+	if !entryMatches(codec, version, entry) {
+		return errStaleEntry
+	}
+
+	return codec.Unmarshal(entry[entryHeaderSize:], v)
+}
@@ -0,0 +1,85 @@
+package redis
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type codecTestData struct {
+	Name  string
+	Count int
+	Tags  []string
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+
+	input := codecTestData{Name: "test", Count: 3, Tags: []string{"a", "b"}}
+
+	for _, codec := range []Codec{JSONCodec, MsgpackCodec, GzipJSONCodec} {
+		data, err := codec.Marshal(input)
+		assert.NoError(t, err, "An error was not expected")
+
+		var output codecTestData
+
+		err = codec.Unmarshal(data, &output)
+		assert.NoError(t, err, "An error was not expected")
+
+		assert.Equal(t, input, output, "Data should match after round trip")
+	}
+}
+
+func TestCodecIDsUnique(t *testing.T) {
+
+	ids := make(map[byte]bool)
+
+	for _, codec := range []Codec{JSONCodec, MsgpackCodec, GzipJSONCodec} {
+		assert.False(t, ids[codec.ID()], "Codec ids should be unique")
+		ids[codec.ID()] = true
+	}
+}
+
+func TestEncodeEntryHeader(t *testing.T) {
+
+	entry, err := encodeEntry(JSONCodec, 2, "hello")
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.Equal(t, []byte{entryMagic, codecJSON, 0, 0, 0, 2}, entry[:entryHeaderSize], "Header should match")
+	assert.Equal(t, []byte(`"hello"`), entry[entryHeaderSize:], "Payload should follow the header")
+}
+
+func TestDecodeEntry(t *testing.T) {
+
+	entry, err := encodeEntry(MsgpackCodec, 1, codecTestData{Name: "test"})
+	assert.NoError(t, err, "An error was not expected")
+
+	var output codecTestData
+
+	err = decodeEntry(MsgpackCodec, 1, entry, &output)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, "test", output.Name, "Data should match")
+
+	// older schema version
+	err = decodeEntry(MsgpackCodec, 2, entry, &output)
+	assert.Equal(t, errStaleEntry, err, "Version mismatch should be stale")
+
+	// different codec
+	err = decodeEntry(JSONCodec, 1, entry, &output)
+	assert.Equal(t, errStaleEntry, err, "Codec mismatch should be stale")
+
+	// raw data written without a header
+	err = decodeEntry(JSONCodec, 1, []byte(`{"Name":"test"}`), &output)
+	assert.Equal(t, errStaleEntry, err, "Missing header should be stale")
+
+	// truncated header
+	err = decodeEntry(JSONCodec, 1, []byte{entryMagic}, &output)
+	assert.Equal(t, errStaleEntry, err, "Short entry should be stale")
+}
+
+func TestGzipJSONCodecBadData(t *testing.T) {
+
+	var output codecTestData
+
+	err := GzipJSONCodec.Unmarshal([]byte("not gzip"), &output)
+	assert.Error(t, err, "An error was expected")
+}
@@ -0,0 +1,177 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// ComputeFunc builds the data for a key on a cache miss
+type ComputeFunc func() ([]byte, error)
+
+// computeGroup deduplicates concurrent builds of the same key within this process
+var computeGroup singleflight.Group
+
+// computeLockKey returns the name of the distributed lock guarding a key build
+func (r *Key) computeLockKey() string {
+	if r.hash {
+		return fmt.Sprintf("%s:%s:compute", r.key, r.hashid)
+	}
+	return fmt.Sprintf("%s:compute", r.key)
+}
+
+// GetOrCompute gets a key, and on a cache miss builds and stores it with the given function.
+// Concurrent callers in this process share a single build, and the distributed mutex makes sure
+// only one instance in the cluster runs the build while the others wait for its result.
+// Stale data from a key with a soft expiry is returned right away and refreshed in the background.
+func (r *Key) GetOrCompute(ctx context.Context, compute ComputeFunc) (result []byte, err error) {
+	return r.getOrCompute(ctx, compute, nil)
+}
+
+// getOrCompute is GetOrCompute with an optional check that treats unusable entries as misses
+func (r *Key) getOrCompute(ctx context.Context, compute ComputeFunc, usable func([]byte) bool) (result []byte, err error) {
+
+	if !r.keyset {
+		return nil, ErrKeyNotSet
+	}
+
+	if !isCacheInitialized() {
+		return nil, ErrCacheNotInitialized
+	}
+
+	result, stale, err := r.getStaleUsable(usable)
+	if err == nil && stale {
+		r.Refresh(compute)
+	}
+	if err != ErrCacheMiss {
+		return
+	}
+
+	lockKey := r.computeLockKey()
+
+	// the build is shared so it should not be cancelled by the first caller going away
+	buildCtx := context.WithoutCancel(ctx)
+
+	ch := computeGroup.DoChan(lockKey, func() (interface{}, error) {
+		return r.compute(buildCtx, lockKey, compute, usable)
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.([]byte), nil
+	}
+}
+
+// compute runs the build under a lease on the distributed lock
+// Callers that find the lock held wait for the holder to build the key, the lease is extended while
+// the build runs so it can not expire under it. Waiters give up after the mutex tries and build it themselves.
+func (r *Key) compute(ctx context.Context, lockKey string, compute ComputeFunc, usable func([]byte) bool) (result []byte, err error) {
+
+	var lease *Lease
+
+	tries, delay := computeWait()
+
+	for i := 0; ; i++ {
+		lease, err = Active().Acquire(lockKey)
+		if err == nil {
+			break
+		}
+
+		// nothing is cached while redis is down so there is no build to share
+		if errors.Is(err, ErrCircuitOpen) {
+			return compute()
+		}
+
+		if !errors.Is(err, ErrFailed) {
+			return
+		}
+
+		// another instance is building it
+		result, err = r.getUsable(usable)
+		if err != ErrCacheMiss {
+			return
+		}
+
+		// the holder is taking too long or is stuck so build it here instead of waiting forever
+		if i >= tries {
+			return compute()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+
+	defer lease.Release()
+
+	stop := lease.Keep(nil)
+	defer stop()
+
+	// another instance may have built the key while we waited on the lock
+	result, err = r.getUsable(usable)
+	if err != ErrCacheMiss {
+		return
+	}
+
+	result, err = compute()
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.Set(result)
+	if err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// computeWait returns how many times and how often a build waits on the lock, from the store mutex if it has one
+func computeWait() (tries int, delay time.Duration) {
+	tries, delay = DefaultTries, DefaultDelay
+
+	store, ok := Active().(*Store)
+	if !ok || store.Mutex == nil {
+		return
+	}
+
+	if store.Mutex.Tries > 0 {
+		tries = store.Mutex.Tries
+	}
+
+	if store.Mutex.Delay > 0 {
+		delay = store.Mutex.Delay
+	}
+
+	return
+}
+
+// getUsable gets the key and reports a miss if the data fails the usable check
+func (r *Key) getUsable(usable func([]byte) bool) (result []byte, err error) {
+	result, _, err = r.getStaleUsable(usable)
+	return
+}
+
+// getStaleUsable is getUsable that also reports if the data is stale
+func (r *Key) getStaleUsable(usable func([]byte) bool) (result []byte, stale bool, err error) {
+	result, stale, err = r.GetStale()
+	if err != nil {
+		return
+	}
+
+	if usable != nil && !usable(result) {
+		return nil, false, ErrCacheMiss
+	}
+
+	return
+}
@@ -0,0 +1,273 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stvp/tempredis"
+)
+
+func TestKeysGetOrComputeHit(t *testing.T) {
+
+	key := NewKey("new")
+
+	key = key.SetKey("1")
+
+	NewRedisMock()
+
+	Cache.Mock.Command("GET", "new:1").Expect("cached")
+
+	res, err := key.GetOrCompute(context.Background(), func() ([]byte, error) {
+		t.Fatal("compute should not be called on a hit")
+		return nil, nil
+	})
+
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.Equal(t, []byte("cached"), res, "Should return the cached data")
+}
+
+func TestKeysGetOrComputeMiss(t *testing.T) {
+
+	key := NewKey("new")
+
+	key = key.SetKey("1")
+
+	NewRedisMock()
+
+	Cache.Mock.Command("GET", "new:1").Expect(nil)
+	Cache.Mock.Command("EVALSHA", redigomock.NewAnyData(), 2, "new:1:compute", "locks:mutex", redigomock.NewAnyData(), redigomock.NewAnyData(), redigomock.NewAnyData()).Expect(int64(1))
+	Cache.Mock.Command("SET", "new:1", []byte("built"))
+	Cache.Mock.Command("EXPIRE", "new:1", redigomock.NewAnyData())
+	Cache.Mock.Command("EVALSHA", redigomock.NewAnyData(), 2, "new:1:compute", "locks:mutex", redigomock.NewAnyData()).Expect(int64(1))
+
+	res, err := key.GetOrCompute(context.Background(), func() ([]byte, error) {
+		return []byte("built"), nil
+	})
+
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.Equal(t, []byte("built"), res, "Should return the computed data")
+
+	assert.NoError(t, Cache.Mock.ExpectationsWereMet(), "All commands should have been called")
+}
+
+func TestKeysGetOrComputeHashLockKey(t *testing.T) {
+
+	key := NewKey("thread")
+
+	key = key.SetKey("1", "2", "3")
+
+	assert.Equal(t, "thread:1:2:3:compute", key.computeLockKey(), "Lock key should include the hash id")
+
+	key = NewKey("tagtypes").SetKey()
+
+	assert.Equal(t, "tagtypes:compute", key.computeLockKey(), "Lock key should match")
+}
+
+func TestKeysGetOrComputeError(t *testing.T) {
+
+	key := NewKey("new")
+
+	key = key.SetKey("1")
+
+	NewRedisMock()
+
+	Cache.Mock.Command("GET", "new:1").Expect(nil)
+	Cache.Mock.Command("EVALSHA", redigomock.NewAnyData(), 2, "new:1:compute", "locks:mutex", redigomock.NewAnyData(), redigomock.NewAnyData(), redigomock.NewAnyData()).Expect(int64(1))
+	Cache.Mock.Command("EVALSHA", redigomock.NewAnyData(), 2, "new:1:compute", "locks:mutex", redigomock.NewAnyData()).Expect(int64(1))
+
+	res, err := key.GetOrCompute(context.Background(), func() ([]byte, error) {
+		return nil, errors.New("database error")
+	})
+
+	assert.Empty(t, res, "Should not return data")
+
+	if assert.Error(t, err, "An error was expected") {
+		assert.Equal(t, "database error", err.Error(), "Error should be from compute")
+	}
+}
+
+func TestKeysGetOrComputeGetError(t *testing.T) {
+
+	key := NewKey("new")
+
+	key = key.SetKey("1")
+
+	NewRedisMock()
+
+	Cache.Mock.Command("GET", "new:1").ExpectError(errors.New("redis error"))
+
+	res, err := key.GetOrCompute(context.Background(), func() ([]byte, error) {
+		t.Fatal("compute should not be called on an error")
+		return nil, nil
+	})
+
+	assert.Empty(t, res, "Should not return data")
+
+	if assert.Error(t, err, "An error was expected") {
+		assert.Equal(t, "redis error", err.Error(), "Error should be from redis")
+	}
+}
+
+func TestKeysGetOrComputeKeyNotSet(t *testing.T) {
+
+	key := NewKey("new")
+
+	res, err := key.GetOrCompute(context.Background(), func() ([]byte, error) {
+		return []byte("built"), nil
+	})
+
+	assert.Empty(t, res, "Should not return data")
+
+	assert.Equal(t, ErrKeyNotSet, err, "Error should be key not set")
+}
+
+func TestKeysGetOrComputeContextCancelled(t *testing.T) {
+
+	key := NewKey("new")
+
+	key = key.SetKey("2")
+
+	NewRedisMock()
+
+	Cache.Mock.Command("GET", "new:2").Expect(nil)
+	Cache.Mock.Command("EVALSHA", redigomock.NewAnyData(), 2, "new:2:compute", "locks:mutex", redigomock.NewAnyData(), redigomock.NewAnyData(), redigomock.NewAnyData()).Expect(int64(1))
+	Cache.Mock.Command("SET", "new:2", []byte("built"))
+	Cache.Mock.Command("EXPIRE", "new:2", redigomock.NewAnyData())
+	Cache.Mock.Command("EVALSHA", redigomock.NewAnyData(), 2, "new:2:compute", "locks:mutex", redigomock.NewAnyData()).Expect(int64(1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	release := make(chan struct{})
+
+	res, err := key.GetOrCompute(ctx, func() ([]byte, error) {
+		cancel()
+		<-release
+		return []byte("built"), nil
+	})
+
+	assert.Empty(t, res, "Should not return data")
+
+	assert.Equal(t, context.Canceled, err, "Error should be context cancelled")
+
+	// let the shared build finish before moving on
+	close(release)
+
+	_, _, _ = computeGroup.Do("new:2:compute", func() (interface{}, error) {
+		return nil, nil
+	})
+}
+
+func TestKeysGetOrComputeWaitsForHolder(t *testing.T) {
+
+	newTestMemoryCache(t)
+
+	key := NewKey("new").SetKey("3")
+
+	// another instance is building the key
+	lease, err := Active().Acquire(key.computeLockKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		key.Set([]byte("built elsewhere"))
+		lease.Release()
+	}()
+
+	res, err := key.GetOrCompute(context.Background(), func() ([]byte, error) {
+		t.Error("compute should not be called while the holder builds")
+		return []byte("built"), nil
+	})
+
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("built elsewhere"), res, "Should return the holder's data")
+}
+
+func TestKeysGetOrComputeStampede(t *testing.T) {
+
+	server, err := tempredis.Start(tempredis.Config{})
+	if err != nil {
+		panic(err)
+	}
+	defer server.Term()
+
+	config := Redis{
+		Protocol:       "unix",
+		Address:        server.Socket(),
+		MaxIdle:        1,
+		MaxConnections: 20,
+	}
+
+	config.NewRedisCache()
+
+	var builds atomic.Int32
+
+	compute := func() ([]byte, error) {
+		builds.Add(1)
+		return []byte("built"), nil
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			res, err := NewKey("popular").SetKey("1").GetOrCompute(context.Background(), compute)
+
+			assert.NoError(t, err, "An error was not expected")
+			assert.Equal(t, []byte("built"), res, "Should return the computed data")
+		}()
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, int32(1), builds.Load(), "Only one build should run")
+}
+
+func TestKeysGetOrComputeStuckHolder(t *testing.T) {
+
+	server, err := tempredis.Start(tempredis.Config{})
+	if err != nil {
+		panic(err)
+	}
+	defer server.Term()
+
+	config := Redis{
+		Protocol:       "unix",
+		Address:        server.Socket(),
+		MaxIdle:        1,
+		MaxConnections: 20,
+	}
+
+	config.NewRedisCache()
+
+	Cache.Mutex.Tries = 3
+	Cache.Mutex.Delay = 10 * time.Millisecond
+
+	key := NewKey("new").SetKey("9")
+
+	// another instance holds the lock and never builds the key
+	lease, err := Active().Acquire(key.computeLockKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lease.Release()
+
+	res, err := key.GetOrCompute(context.Background(), func() ([]byte, error) {
+		return []byte("built here"), nil
+	})
+
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("built here"), res, "Should build the key after giving up on the holder")
+}
@@ -0,0 +1,294 @@
+// Package counter buffers frequent increments like view counts in redis and flushes them to MySQL
+//
+// Increments go into a redis hash per counter. A flush renames the hash out of the way so new
+// increments start a fresh one, writes the deltas in a single transaction, and only deletes the
+// renamed hash once the transaction commits. A failed flush leaves it to be retried so nothing is
+// lost. Every claim gets a flush id that stays the same while its deltas are retried, a FlushFunc
+// that records it in the transaction can skip deltas a crash after the commit left behind.
+package counter
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eirka/eirka-libs/db"
+	"github.com/eirka/eirka-libs/redis"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// keyPrefix is the first segment of every counter key
+const keyPrefix = "counter"
+
+// DefaultInterval is used when Options Interval is 0
+const DefaultInterval = time.Minute
+
+var (
+	// ErrInvalidCounter is returned if a counter can not be used
+	ErrInvalidCounter = errors.New("counter not valid")
+	// ErrFlushRunning is returned by Flush when another instance holds the flush lock
+	ErrFlushRunning = errors.New("counter flush already running")
+	// ErrFlushLost is returned by Flush when the flush lock expired before the transaction committed
+	ErrFlushLost = errors.New("counter flush lock was lost")
+)
+
+// flushIDKey is the context key of the flush id
+type flushIDKey struct{}
+
+// FlushID returns the id of the deltas a FlushFunc is writing
+// Retries of the same deltas have the same id, so storing it with a unique key in the transaction
+// makes sure they are only written once.
+func FlushID(ctx context.Context) string {
+	id, _ := ctx.Value(flushIDKey{}).(string)
+	return id
+}
+
+// FlushFunc writes the deltas keyed by id to the database in the transaction
+type FlushFunc func(ctx context.Context, tx *sql.Tx, deltas map[string]int64) error
+
+// Options controls how a counter is flushed
+type Options struct {
+	// Flush writes the deltas, it is required
+	Flush FlushFunc
+	// Interval is the time between flushes in Run
+	Interval time.Duration
+	// OnError is called with the errors from flushes in Run
+	OnError func(err error)
+}
+
+// Counter is a named set of buffered counts keyed by id
+type Counter struct {
+	name string
+	opts Options
+}
+
+// New returns a counter after checking the options
+func New(name string, opts Options) (*Counter, error) {
+
+	if name == "" || strings.ContainsAny(name, ":{}") {
+		return nil, fmt.Errorf("%w: name must be set and cannot contain a colon or braces", ErrInvalidCounter)
+	}
+
+	if opts.Flush == nil {
+		return nil, fmt.Errorf("%w: flush function must be set", ErrInvalidCounter)
+	}
+
+	if opts.Interval < 0 {
+		return nil, fmt.Errorf("%w: interval cannot be negative", ErrInvalidCounter)
+	}
+
+	if opts.Interval == 0 {
+		opts.Interval = DefaultInterval
+	}
+
+	return &Counter{
+		name: name,
+		opts: opts,
+	}, nil
+}
+
+// Name returns the name of the counter
+func (c *Counter) Name() string {
+	return c.name
+}
+
+// key returns a redis key for the counter
+// The name is a hash tag so the flush script can rename within a cluster slot
+func (c *Counter) key(suffix string) string {
+	return fmt.Sprintf("%s:{%s}:%s", keyPrefix, c.name, suffix)
+}
+
+// Incr adds one to the count for an id
+func (c *Counter) Incr(id string) error {
+	return c.IncrBy(id, 1)
+}
+
+// IncrBy adds delta to the count for an id
+func (c *Counter) IncrBy(id string, delta int) error {
+
+	if id == "" {
+		return errors.New("id cannot be empty")
+	}
+
+	_, err := redis.Active().HIncrBy(c.key("pending"), id, delta)
+
+	return err
+}
+
+// Pending returns the count for an id that has not been written to the database yet
+func (c *Counter) Pending(id string) (pending int64, err error) {
+
+	if id == "" {
+		return 0, errors.New("id cannot be empty")
+	}
+
+	// a flush that has not committed yet still counts
+	for _, key := range []string{c.key("pending"), c.key("flushing")} {
+		data, err := redis.Active().HGet(key, id)
+		if err == redis.ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		count, err := strconv.ParseInt(string(data), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		pending += count
+	}
+
+	return
+}
+
+// Flush moves the pending deltas into the database and returns how many ids were written
+// Only one instance flushes a counter at a time, the others get ErrFlushRunning. The lock is
+// kept while the deltas are written and checked again before the transaction commits.
+func (c *Counter) Flush(ctx context.Context) (flushed int, err error) {
+
+	lease, err := redis.Active().Acquire(c.key("flush"))
+	if errors.Is(err, redis.ErrFailed) {
+		return 0, ErrFlushRunning
+	}
+	if err != nil {
+		return
+	}
+	defer lease.Release()
+
+	id, err := newFlushID()
+	if err != nil {
+		return
+	}
+
+	claim, err := redigo.Values(redis.Active().Eval(claimScript, []string{c.key("pending"), c.key("flushing"), c.key("flushid")}, id))
+	if err != nil {
+		return
+	}
+
+	if len(claim) == 0 {
+		return 0, nil
+	}
+
+	// a claim left by a failed flush keeps its id
+	id, err = redigo.String(claim[0], nil)
+	if err != nil {
+		return
+	}
+
+	deltas, err := redigo.Int64Map(claim[1:], nil)
+	if err != nil {
+		return
+	}
+
+	flushCtx, cancel := context.WithCancel(context.WithValue(ctx, flushIDKey{}, id))
+	defer cancel()
+
+	// stop writing if another instance could have taken over
+	stop := lease.Keep(cancel)
+
+	tx, err := db.GetTransaction()
+	if err != nil {
+		stop()
+		return
+	}
+
+	err = c.opts.Flush(flushCtx, tx, deltas)
+	if err != nil {
+		stop()
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	if stop() || !lease.Extend() {
+		_ = tx.Rollback()
+		return 0, ErrFlushLost
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	// the deltas are in the database so they can go
+	done, err := redigo.Int(redis.Active().Eval(doneScript, []string{c.key("flushing"), c.key("flushid")}, id))
+	if err != nil {
+		return 0, err
+	}
+
+	if done == 0 {
+		return 0, ErrFlushLost
+	}
+
+	return len(deltas), nil
+}
+
+// Run flushes the counter every interval until the context is done
+// Counts left over at shutdown stay in redis for the next flush.
+func (c *Counter) Run(ctx context.Context) {
+
+	ticker := time.NewTicker(c.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		_, err := c.Flush(ctx)
+		if err != nil && err != ErrFlushRunning && c.opts.OnError != nil {
+			c.opts.OnError(err)
+		}
+	}
+}
+
+// newFlushID returns a random id for a claim
+func newFlushID() (string, error) {
+	b := make([]byte, 16)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// renames the pending hash to the flushing hash with a new flush id and returns the id and the hash
+// a flushing hash left by a failed flush is returned again with its id before new increments are taken
+var claimScript = redigo.NewScript(3, `
+if redis.call("EXISTS", KEYS[2]) == 0 then
+	if redis.call("EXISTS", KEYS[1]) == 0 then
+		return {}
+	end
+	redis.call("RENAME", KEYS[1], KEYS[2])
+	redis.call("SET", KEYS[3], ARGV[1])
+end
+
+local id = redis.call("GET", KEYS[3])
+if not id then
+	id = ARGV[1]
+	redis.call("SET", KEYS[3], id)
+end
+
+local result = redis.call("HGETALL", KEYS[2])
+table.insert(result, 1, id)
+return result`)
+
+// deletes the flushing hash if it is still the claim with the flush id
+var doneScript = redigo.NewScript(2, `
+if redis.call("GET", KEYS[2]) ~= ARGV[1] then
+	return 0
+end
+
+redis.call("DEL", KEYS[1], KEYS[2])
+return 1`)
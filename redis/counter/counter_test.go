@@ -0,0 +1,229 @@
+package counter
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/eirka/eirka-libs/db"
+	"github.com/eirka/eirka-libs/internal/redistest"
+	"github.com/eirka/eirka-libs/redis"
+)
+
+// flushViews adds the deltas to the image views
+func flushViews(ctx context.Context, tx *sql.Tx, deltas map[string]int64) error {
+	for id, delta := range deltas {
+		_, err := tx.ExecContext(ctx, "UPDATE images SET image_views = image_views + ? WHERE image_id = ?", delta, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestNew(t *testing.T) {
+
+	counter, err := New("views", Options{Flush: flushViews})
+	if assert.NoError(t, err, "An error was not expected") {
+		assert.Equal(t, "views", counter.Name(), "Name should match")
+		assert.Equal(t, DefaultInterval, counter.opts.Interval, "Interval should default")
+		assert.Equal(t, "counter:{views}:pending", counter.key("pending"), "Key should have a hash tag")
+	}
+
+	for _, name := range []string{"", "bad:name", "bad{name}"} {
+		_, err = New(name, Options{Flush: flushViews})
+		assert.ErrorIs(t, err, ErrInvalidCounter, "Error should be invalid counter")
+	}
+
+	_, err = New("views", Options{})
+	assert.ErrorIs(t, err, ErrInvalidCounter, "Error should be invalid counter without a flush")
+
+	_, err = New("views", Options{Flush: flushViews, Interval: -time.Second})
+	assert.ErrorIs(t, err, ErrInvalidCounter, "Error should be invalid counter")
+}
+
+func TestFlush(t *testing.T) {
+
+	redistest.Start(t)
+
+	mock, err := db.NewTestDb()
+	assert.NoError(t, err, "An error was not expected")
+
+	mock.MatchExpectationsInOrder(false)
+
+	counter, err := New("views", Options{Flush: flushViews})
+	assert.NoError(t, err, "An error was not expected")
+
+	ctx := context.Background()
+
+	// nothing to flush
+	flushed, err := counter.Flush(ctx)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 0, flushed, "Nothing should be flushed")
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, counter.Incr("1"), "An error was not expected")
+	}
+
+	assert.NoError(t, counter.IncrBy("2", 5), "An error was not expected")
+
+	assert.Error(t, counter.Incr(""), "An error was expected for an empty id")
+
+	pending, err := counter.Pending("1")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, int64(3), pending, "Pending count should match")
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE images SET image_views").WithArgs(3, "1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE images SET image_views").WithArgs(5, "2").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	flushed, err = counter.Flush(ctx)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 2, flushed, "Both ids should be flushed")
+
+	assert.NoError(t, mock.ExpectationsWereMet(), "An error was not expected")
+
+	pending, err = counter.Pending("1")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, int64(0), pending, "Flushed counts should be gone")
+}
+
+func TestFlushFailure(t *testing.T) {
+
+	redistest.Start(t)
+
+	mock, err := db.NewTestDb()
+	assert.NoError(t, err, "An error was not expected")
+
+	var ids []string
+
+	counter, err := New("posts", Options{Flush: func(ctx context.Context, tx *sql.Tx, deltas map[string]int64) error {
+		ids = append(ids, FlushID(ctx))
+		return flushViews(ctx, tx, deltas)
+	}})
+	assert.NoError(t, err, "An error was not expected")
+
+	ctx := context.Background()
+
+	assert.NoError(t, counter.IncrBy("1", 2), "An error was not expected")
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE images SET image_views").WithArgs(2, "1").WillReturnError(errors.New("deadlock"))
+	mock.ExpectRollback()
+
+	_, err = counter.Flush(ctx)
+	assert.EqualError(t, err, "deadlock", "Error should come from the flush")
+
+	// increments during the failed flush go into a new hash
+	assert.NoError(t, counter.IncrBy("1", 4), "An error was not expected")
+
+	pending, err := counter.Pending("1")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, int64(6), pending, "Failed flush should be kept")
+
+	// the failed deltas are retried first
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE images SET image_views").WithArgs(2, "1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	flushed, err := counter.Flush(ctx)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 1, flushed, "Retried id should be flushed")
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE images SET image_views").WithArgs(4, "1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	flushed, err = counter.Flush(ctx)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 1, flushed, "New increments should be flushed")
+
+	assert.NoError(t, mock.ExpectationsWereMet(), "An error was not expected")
+
+	if assert.Len(t, ids, 3, "Every flush should have an id") {
+		assert.NotEmpty(t, ids[0], "Flush id should be set")
+		assert.Equal(t, ids[0], ids[1], "Retried deltas should keep their flush id")
+		assert.NotEqual(t, ids[1], ids[2], "New deltas should get a new flush id")
+	}
+
+	// another instance is flushing
+	assert.NoError(t, redis.Cache.Lock(counter.key("flush")), "An error was not expected")
+
+	_, err = counter.Flush(ctx)
+	assert.Equal(t, ErrFlushRunning, err, "Error should be flush running")
+}
+
+func TestFlushLost(t *testing.T) {
+
+	redistest.Start(t)
+
+	mock, err := db.NewTestDb()
+	assert.NoError(t, err, "An error was not expected")
+
+	var counter *Counter
+
+	counter, err = New("lost", Options{Flush: func(ctx context.Context, tx *sql.Tx, deltas map[string]int64) error {
+		// the lock expired and another instance took it
+		redis.Cache.Unlock(counter.key("flush"))
+		return redis.Cache.TryLock(counter.key("flush"))
+	}})
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.NoError(t, counter.IncrBy("1", 2), "An error was not expected")
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	_, err = counter.Flush(context.Background())
+	assert.Equal(t, ErrFlushLost, err, "Error should be flush lost")
+
+	assert.NoError(t, mock.ExpectationsWereMet(), "Transaction should be rolled back")
+
+	assert.True(t, redis.Cache.Locked(counter.key("flush")), "Lock of the other instance should be kept")
+
+	pending, err := counter.Pending("1")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, int64(2), pending, "Deltas should be kept for a retry")
+}
+
+func TestRun(t *testing.T) {
+
+	redistest.Start(t)
+
+	flushed := make(chan map[string]int64, 1)
+
+	counter, err := New("run", Options{
+		Interval: 10 * time.Millisecond,
+		Flush: func(ctx context.Context, tx *sql.Tx, deltas map[string]int64) error {
+			flushed <- deltas
+			return nil
+		},
+	})
+	assert.NoError(t, err, "An error was not expected")
+
+	mock, err := db.NewTestDb()
+	assert.NoError(t, err, "An error was not expected")
+
+	mock.ExpectBegin()
+	mock.ExpectCommit()
+
+	assert.NoError(t, counter.IncrBy("7", 3), "An error was not expected")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go counter.Run(ctx)
+
+	select {
+	case deltas := <-flushed:
+		assert.Equal(t, map[string]int64{"7": 3}, deltas, "Deltas should match")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a flush")
+	}
+}
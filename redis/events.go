@@ -0,0 +1,295 @@
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// DefaultSubscribeBuffer is how many messages a subscription holds before the receiver waits on the reader
+const DefaultSubscribeBuffer = 100
+
+// InstanceID identifies this process as the origin of the events it publishes
+var InstanceID = newInstanceID()
+
+// EventTyper lets a payload name its own event type, otherwise the channel is used
+type EventTyper interface {
+	EventType() string
+}
+
+// Event is the envelope every published payload is wrapped in
+type Event struct {
+	Type    string          `json:"type"`
+	Time    time.Time       `json:"time"`
+	Origin  string          `json:"origin"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Message is an event received from a channel
+type Message struct {
+	Channel string
+	Event
+}
+
+// Decode unmarshals the payload of the event
+func (m Message) Decode(v interface{}) error {
+	return json.Unmarshal(m.Payload, v)
+}
+
+// newInstanceID returns the hostname with a random suffix so processes on one host are distinct
+func newInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	b := make([]byte, 4)
+
+	_, err = rand.Read(b)
+	if err != nil {
+		return fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+
+	return fmt.Sprintf("%s-%s", host, hex.EncodeToString(b))
+}
+
+// encodeEvent wraps a payload in the envelope
+func encodeEvent(channel string, payload interface{}) ([]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	event := Event{
+		Type:    channel,
+		Time:    time.Now().UTC(),
+		Origin:  InstanceID,
+		Payload: data,
+	}
+
+	typer, ok := payload.(EventTyper)
+	if ok {
+		event.Type = typer.EventType()
+	}
+
+	return json.Marshal(event)
+}
+
+// decodeEvent unwraps a message, anything not sent by Publish is an error
+func decodeEvent(channel string, data []byte) (msg Message, err error) {
+	msg.Channel = channel
+
+	err = json.Unmarshal(data, &msg.Event)
+	if err != nil {
+		return
+	}
+
+	if msg.Type == "" || msg.Origin == "" {
+		return msg, errors.New("message is not an event")
+	}
+
+	return
+}
+
+// validateChannels checks the channel names for Subscribe
+func validateChannels(channels []string) error {
+	if len(channels) == 0 {
+		return errors.New("at least one channel must be provided")
+	}
+
+	for _, channel := range channels {
+		if channel == "" {
+			return errors.New("channel cannot be empty")
+		}
+	}
+
+	return nil
+}
+
+// Publish sends a payload wrapped in an event envelope to every subscriber of the channel
+func (c *Store) Publish(ctx context.Context, channel string, payload interface{}) (err error) {
+	if channel == "" {
+		return errors.New("channel cannot be empty")
+	}
+
+	if !isCacheInitialized() {
+		return ErrCacheNotInitialized
+	}
+
+	data, err := encodeEvent(channel, payload)
+	if err != nil {
+		return
+	}
+
+	if !c.allow() {
+		return ErrCircuitOpen
+	}
+
+	conn := c.Pool.Get()
+	defer conn.Close()
+
+	_, err = redis.DoContext(conn, ctx, "PUBLISH", c.prefixed(channel), data)
+	c.report(err)
+
+	return
+}
+
+// Subscribe listens on the channels until the context is done, which closes the returned channel
+// It returns once the subscription is active and resubscribes by itself if the connection drops.
+// Events published while reconnecting are lost, pub/sub does not store them.
+func (c *Store) Subscribe(ctx context.Context, channels ...string) (<-chan Message, error) {
+	err := validateChannels(channels)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isCacheInitialized() {
+		return nil, ErrCacheNotInitialized
+	}
+
+	names := make([]interface{}, len(channels))
+	for i, channel := range channels {
+		names[i] = c.prefixed(channel)
+	}
+
+	s := &subscription{
+		store: c,
+		names: names,
+		out:   make(chan Message, DefaultSubscribeBuffer),
+	}
+
+	psc, err := s.subscribe()
+	if err != nil {
+		return nil, err
+	}
+
+	go s.run(ctx, psc)
+
+	return s.out, nil
+}
+
+// subscription is a running Subscribe
+type subscription struct {
+	store *Store
+	names []interface{}
+	out   chan Message
+}
+
+// subscribe opens a connection and waits until all of the channels are subscribed
+func (s *subscription) subscribe() (*redis.PubSubConn, error) {
+	psc := &redis.PubSubConn{Conn: s.store.Pool.Get()}
+
+	err := psc.Subscribe(s.names...)
+	if err != nil {
+		psc.Close()
+		return nil, err
+	}
+
+	for confirmed := 0; confirmed < len(s.names); {
+		switch v := psc.Receive().(type) {
+		case redis.Subscription:
+			confirmed++
+		case error:
+			psc.Close()
+			return nil, v
+		}
+	}
+
+	return psc, nil
+}
+
+// run receives on the connection and resubscribes after errors until the context is done
+func (s *subscription) run(ctx context.Context, psc *redis.PubSubConn) {
+	defer close(s.out)
+
+	for {
+		err := s.receive(ctx, psc)
+		if err == nil {
+			return
+		}
+
+		// keep trying until redis is back or the subscriber goes away
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(resubscribeDelay):
+			}
+
+			psc, err = s.subscribe()
+			if err == nil {
+				break
+			}
+		}
+	}
+}
+
+// receive delivers messages from one connection, returning nil once the context is done
+func (s *subscription) receive(ctx context.Context, psc *redis.PubSubConn) error {
+	var connm sync.Mutex
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	// unsubscribing is the only way to wake up a blocked receive
+	go func() {
+		select {
+		case <-ctx.Done():
+			connm.Lock()
+			defer connm.Unlock()
+			_ = psc.Unsubscribe()
+		case <-stop:
+		}
+	}()
+
+	defer func() {
+		connm.Lock()
+		defer connm.Unlock()
+		psc.Close()
+	}()
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			msg, err := decodeEvent(strings.TrimPrefix(v.Channel, s.store.Prefix), v.Data)
+			if err != nil {
+				// messages not sent by Publish are ignored
+				continue
+			}
+
+			select {
+			case s.out <- msg:
+			case <-ctx.Done():
+				return nil
+			}
+		case redis.Subscription:
+			if v.Count == 0 {
+				return nil
+			}
+		case error:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return v
+		}
+	}
+}
+
+// Publish sends a payload to every subscriber of the channel
+func Publish(ctx context.Context, channel string, payload interface{}) error {
+	return Active().Publish(ctx, channel, payload)
+}
+
+// Subscribe listens on the channels until the context is done
+func Subscribe(ctx context.Context, channels ...string) (<-chan Message, error) {
+	return Active().Subscribe(ctx, channels...)
+}
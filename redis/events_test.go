@@ -0,0 +1,249 @@
+package redis
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stvp/tempredis"
+)
+
+type threadEvent struct {
+	Ib     uint `json:"ib"`
+	Thread uint `json:"thread"`
+}
+
+func (threadEvent) EventType() string {
+	return "thread.created"
+}
+
+// trackedDialer remembers its network connections so a test can break them
+type trackedDialer struct {
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (d *trackedDialer) dial(network, address string) (net.Conn, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	d.conns = append(d.conns, conn)
+	d.mu.Unlock()
+
+	return conn, nil
+}
+
+func (d *trackedDialer) closeAll() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, conn := range d.conns {
+		conn.Close()
+	}
+
+	d.conns = nil
+}
+
+// receiveEvent waits for a message or fails the test
+func receiveEvent(t *testing.T, messages <-chan Message) (msg Message) {
+	select {
+	case msg = <-messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return
+}
+
+func TestEventEnvelope(t *testing.T) {
+
+	data, err := encodeEvent("threads", threadEvent{Ib: 1, Thread: 2})
+	assert.NoError(t, err, "An error was not expected")
+
+	msg, err := decodeEvent("threads", data)
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.Equal(t, "threads", msg.Channel, "Channel should match")
+	assert.Equal(t, "thread.created", msg.Type, "Type should come from the payload")
+	assert.Equal(t, InstanceID, msg.Origin, "Origin should be this instance")
+	assert.WithinDuration(t, time.Now(), msg.Time, time.Second, "Time should be set")
+
+	var payload threadEvent
+
+	assert.NoError(t, msg.Decode(&payload), "An error was not expected")
+	assert.Equal(t, threadEvent{Ib: 1, Thread: 2}, payload, "Payload should match")
+
+	data, err = encodeEvent("bans", map[string]string{"ip": "10.0.0.1"})
+	assert.NoError(t, err, "An error was not expected")
+
+	msg, err = decodeEvent("bans", data)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, "bans", msg.Type, "Type should default to the channel")
+
+	_, err = decodeEvent("bans", []byte("not json"))
+	assert.Error(t, err, "An error was expected for a raw message")
+
+	_, err = decodeEvent("bans", []byte(`{"ip":"10.0.0.1"}`))
+	assert.Error(t, err, "An error was expected for a message without an envelope")
+}
+
+func TestPublishSubscribe(t *testing.T) {
+
+	server, err := tempredis.Start(tempredis.Config{})
+	if err != nil {
+		panic(err)
+	}
+	defer server.Term()
+
+	config := Redis{
+		Protocol:       "unix",
+		Address:        server.Socket(),
+		MaxIdle:        1,
+		MaxConnections: 10,
+		Prefix:         "staging:",
+	}
+
+	config.NewRedisCache()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages, err := Subscribe(ctx, "threads", "bans")
+	assert.NoError(t, err, "An error was not expected")
+
+	// raw messages on the channel are skipped
+	conn := Cache.Pool.Get()
+	_, err = conn.Do("PUBLISH", "staging:threads", "raw")
+	conn.Close()
+	assert.NoError(t, err, "An error was not expected")
+
+	err = Publish(ctx, "threads", threadEvent{Ib: 1, Thread: 2})
+	assert.NoError(t, err, "An error was not expected")
+
+	err = Publish(ctx, "bans", map[string]string{"ip": "10.0.0.1"})
+	assert.NoError(t, err, "An error was not expected")
+
+	msg := receiveEvent(t, messages)
+	assert.Equal(t, "threads", msg.Channel, "Channel should not have the prefix")
+	assert.Equal(t, "thread.created", msg.Type, "Type should match")
+
+	msg = receiveEvent(t, messages)
+	assert.Equal(t, "bans", msg.Channel, "Channel should match")
+
+	cancel()
+
+	assert.Eventually(t, func() bool {
+		select {
+		case _, ok := <-messages:
+			return !ok
+		default:
+			return false
+		}
+	}, time.Second, 10*time.Millisecond, "Channel should close when the context is done")
+
+	_, err = Subscribe(context.Background())
+	assert.Error(t, err, "An error was expected for no channels")
+
+	err = Publish(context.Background(), "", nil)
+	assert.Error(t, err, "An error was expected for an empty channel")
+}
+
+func TestSubscribeReconnect(t *testing.T) {
+
+	server, err := tempredis.Start(tempredis.Config{})
+	if err != nil {
+		panic(err)
+	}
+	defer server.Term()
+
+	config := Redis{
+		Protocol:       "unix",
+		Address:        server.Socket(),
+		MaxIdle:        1,
+		MaxConnections: 10,
+	}
+
+	config.NewRedisCache()
+
+	dialer := &trackedDialer{}
+
+	store := &Store{
+		Pool: &redis.Pool{
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("unix", server.Socket(), redis.DialNetDial(dialer.dial))
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages, err := store.Subscribe(ctx, "threads")
+	assert.NoError(t, err, "An error was not expected")
+
+	subscribed := func() bool {
+		conn := Cache.Pool.Get()
+		defer conn.Close()
+
+		reply, err := redis.Values(conn.Do("PUBSUB", "NUMSUB", "threads"))
+		if err != nil || len(reply) != 2 {
+			return false
+		}
+
+		count, _ := redis.Int(reply[1], nil)
+
+		return count == 1
+	}
+
+	// drop the subscriber connection
+	dialer.closeAll()
+
+	assert.Eventually(t, func() bool {
+		return !subscribed()
+	}, time.Second, 10*time.Millisecond, "Subscriber should be disconnected")
+
+	assert.Eventually(t, subscribed, 5*time.Second, 10*time.Millisecond, "Subscriber should resubscribe")
+
+	err = Cache.Publish(ctx, "threads", threadEvent{Ib: 1, Thread: 3})
+	assert.NoError(t, err, "An error was not expected")
+
+	var payload threadEvent
+
+	msg := receiveEvent(t, messages)
+	assert.NoError(t, msg.Decode(&payload), "An error was not expected")
+	assert.Equal(t, uint(3), payload.Thread, "Payload should match")
+}
+
+func TestMemoryPublishSubscribe(t *testing.T) {
+
+	newTestMemoryCache(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	messages, err := Subscribe(ctx, "threads")
+	assert.NoError(t, err, "An error was not expected")
+
+	err = Publish(ctx, "threads", threadEvent{Ib: 1, Thread: 2})
+	assert.NoError(t, err, "An error was not expected")
+
+	err = Publish(ctx, "bans", threadEvent{Ib: 1, Thread: 2})
+	assert.NoError(t, err, "An error was not expected")
+
+	msg := receiveEvent(t, messages)
+	assert.Equal(t, "threads", msg.Channel, "Channel should match")
+	assert.Equal(t, "thread.created", msg.Type, "Type should match")
+
+	cancel()
+
+	_, ok := <-messages
+	assert.False(t, ok, "Channel should close when the context is done")
+
+	err = Publish(context.Background(), "threads", threadEvent{})
+	assert.NoError(t, err, "Publishing without subscribers should work")
+}
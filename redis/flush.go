@@ -0,0 +1,213 @@
+package redis
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// DefaultFlushCount is used when FlushOptions Count is 0
+const DefaultFlushCount = 1000
+
+// FlushOptions limits what a scoped flush deletes
+type FlushOptions struct {
+	// Ib limits the flush to the keys of one imageboard, empty flushes every imageboard
+	Ib string
+	// Prefix deletes every key starting with it instead of the registered bases
+	// It is added after the store prefix so it cannot reach outside the store
+	Prefix string
+	// Count is the SCAN batch size hint, DefaultFlushCount if 0
+	Count int
+	// Progress is called after every batch of keys is deleted
+	Progress func(FlushProgress)
+}
+
+// FlushProgress reports how far a scoped flush has gotten
+type FlushProgress struct {
+	// Pattern is the match pattern currently being scanned
+	Pattern string
+	// Scanned is the total number of keys returned by SCAN
+	Scanned int
+	// Deleted is the total number of keys removed
+	Deleted int
+}
+
+// lockSuffixes mark the lock keys that live next to cached keys and must survive a flush
+var lockSuffixes = []string{":mutex", ":compute", ":refresh", ":semaphore"}
+
+// isLockKey checks if a key is a lock
+func isLockKey(key string) bool {
+	for _, suffix := range lockSuffixes {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// globEscaper escapes the special characters in SCAN match patterns
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// flushScope returns the exact keys and the match patterns a flush covers
+func flushScope(opts FlushOptions) (keys []string, patterns []string) {
+
+	if opts.Prefix != "" {
+		return nil, []string{globEscaper.Replace(opts.Prefix) + "*"}
+	}
+
+	keyMu.RLock()
+	defer keyMu.RUnlock()
+
+	for _, key := range RedisKeys {
+		base := globEscaper.Replace(key.base)
+
+		switch {
+		case key.fieldcount == 0:
+			// keys without fields are not scoped to an imageboard
+			if opts.Ib == "" {
+				keys = append(keys, key.base)
+			}
+		case opts.Ib == "":
+			patterns = append(patterns, base+":*")
+		case key.fieldcount == 1:
+			keys = append(keys, key.base+":"+key.firstField(opts.Ib))
+		default:
+			patterns = append(patterns, base+":"+globEscaper.Replace(key.firstField(opts.Ib))+":*")
+		}
+	}
+
+	// the invalidation tag sets
+	if opts.Ib == "" {
+		patterns = append(patterns, globEscaper.Replace(tagKeyPrefix)+"*")
+	} else {
+		keys = append(keys, tagKey(IbTag(opts.Ib)))
+		patterns = append(patterns, globEscaper.Replace(tagKey(ThreadTag(opts.Ib, "")))+"*")
+	}
+
+	return
+}
+
+// FlushScope deletes the keys belonging to the registered bases, or a prefix, with SCAN and UNLINK
+// Unlike FLUSHALL this leaves rate limit counters, locks and other data sharing the server alone
+func (c *Store) FlushScope(ctx context.Context, opts FlushOptions) (progress FlushProgress, err error) {
+
+	if !isCacheInitialized() {
+		return progress, ErrCacheNotInitialized
+	}
+
+	count := opts.Count
+	if count == 0 {
+		count = DefaultFlushCount
+	}
+
+	keys, patterns := flushScope(opts)
+
+	// keep the flush inside our namespace
+	prefix := globEscaper.Replace(c.Prefix)
+
+	for i := range keys {
+		keys[i] = c.prefixed(keys[i])
+	}
+
+	for i := range patterns {
+		patterns[i] = prefix + patterns[i]
+	}
+
+	if !c.allow() {
+		return progress, ErrCircuitOpen
+	}
+
+	conn := c.Pool.Get()
+	defer conn.Close()
+
+	// the breaker only needs to hear about the outcome once
+	defer func() {
+		c.report(err)
+	}()
+
+	// everything could have changed so clear the local caches
+	defer c.invalidate(conn, invalidateAll)
+
+	if len(keys) > 0 {
+		progress.Scanned += len(keys)
+
+		err = progress.unlink(conn, keys)
+		if err != nil {
+			return
+		}
+
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+	}
+
+	for _, pattern := range patterns {
+		progress.Pattern = pattern
+
+		cursor := "0"
+
+		for {
+			if err = ctx.Err(); err != nil {
+				return
+			}
+
+			var reply []interface{}
+
+			reply, err = redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", count))
+			if err != nil {
+				return
+			}
+
+			var scanned []string
+
+			_, err = redis.Scan(reply, &cursor, &scanned)
+			if err != nil {
+				return
+			}
+
+			progress.Scanned += len(scanned)
+
+			found := scanned[:0]
+			for _, key := range scanned {
+				if !isLockKey(key) {
+					found = append(found, key)
+				}
+			}
+
+			if len(found) > 0 {
+				err = progress.unlink(conn, found)
+				if err != nil {
+					return
+				}
+			}
+
+			if opts.Progress != nil {
+				opts.Progress(progress)
+			}
+
+			if cursor == "0" {
+				break
+			}
+		}
+	}
+
+	return
+}
+
+// unlink removes keys without blocking the server and counts them
+func (p *FlushProgress) unlink(conn redis.Conn, keys []string) error {
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+
+	deleted, err := redis.Int(conn.Do("UNLINK", args...))
+	if err != nil {
+		return err
+	}
+
+	p.Deleted += deleted
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package redis
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stvp/tempredis"
+)
+
+func TestFlushScopeAll(t *testing.T) {
+
+	keys, patterns := flushScope(FlushOptions{})
+
+	assert.Equal(t, []string{"tagtypes", "imageboards"}, keys, "Keys without fields should be deleted directly")
+
+	assert.Contains(t, patterns, "index:*", "Patterns should cover the bases")
+	assert.Contains(t, patterns, "tag:*", "Patterns should cover the bases")
+	assert.Contains(t, patterns, "cachetag:*", "Patterns should cover the tag sets")
+	assert.NotContains(t, patterns, "tag*", "Patterns should not overlap other bases")
+}
+
+func TestFlushScopeIb(t *testing.T) {
+
+	keys, patterns := flushScope(FlushOptions{Ib: "3"})
+
+	assert.Contains(t, keys, "index:3", "Single field keys should be deleted directly")
+	assert.Contains(t, keys, "new:3", "Single field keys should be deleted directly")
+	assert.Contains(t, keys, "cachetag:ib:3", "The imageboard tag set should be deleted")
+	assert.NotContains(t, keys, "tagtypes", "Global keys should not be deleted")
+
+	assert.Contains(t, patterns, "thread:3:*", "Patterns should be scoped to the imageboard")
+	assert.Contains(t, patterns, "cachetag:thread:3:*", "Thread tag sets should be scoped to the imageboard")
+}
+
+func TestFlushScopePrefix(t *testing.T) {
+
+	keys, patterns := flushScope(FlushOptions{Prefix: "app[1]:"})
+
+	assert.Empty(t, keys, "Prefix flushes only scan")
+
+	assert.Equal(t, []string{`app\[1\]:*`}, patterns, "Prefix should be escaped")
+}
+
+func TestFlushScopeHashTag(t *testing.T) {
+	defer unregisterKey("tagged")
+	defer unregisterKey("taggedindex")
+
+	err := RegisterKey(KeySpec{Base: "tagged", FieldCount: 2, Hash: true, HashTag: "ib"})
+	assert.NoError(t, err, "An error was not expected")
+
+	err = RegisterKey(KeySpec{Base: "taggedindex", FieldCount: 1, Hash: true, HashTag: "ib"})
+	assert.NoError(t, err, "An error was not expected")
+
+	keys, patterns := flushScope(FlushOptions{Ib: "3"})
+
+	assert.Contains(t, keys, "taggedindex:{ib:3}", "Hash tagged keys should be deleted directly")
+	assert.Contains(t, patterns, "tagged:{ib:3}:*", "Patterns should include the hash tag")
+}
+
+func TestFlushScopeStorePrefix(t *testing.T) {
+
+	NewRedisMock()
+
+	Cache.Prefix = "staging:"
+	defer func() {
+		Cache.Prefix = ""
+	}()
+
+	unlink := Cache.Mock.Command("UNLINK", "staging:tagtypes", "staging:imageboards").Expect(int64(2))
+	scan := Cache.Mock.Command("SCAN", "0", "MATCH", "staging:index:*", "COUNT", DefaultFlushCount).Expect([]interface{}{[]byte("0"), []interface{}{}})
+	Cache.Mock.GenericCommand("SCAN").Expect([]interface{}{[]byte("0"), []interface{}{}})
+
+	progress, err := Cache.FlushScope(context.Background(), FlushOptions{})
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 2, progress.Deleted, "Keys should be deleted")
+
+	assert.Equal(t, 1, Cache.Mock.Stats(unlink), "Keys should be prefixed")
+	assert.Equal(t, 1, Cache.Mock.Stats(scan), "Patterns should be prefixed")
+}
+
+func TestIsLockKey(t *testing.T) {
+
+	assert.True(t, isLockKey("index:1:mutex"), "Mutex keys are locks")
+	assert.True(t, isLockKey("thread:1:2:3:compute"), "Compute keys are locks")
+	assert.False(t, isLockKey("thread:1:2"), "Data keys are not locks")
+}
+
+func TestFlushScopeCacheNotInitialized(t *testing.T) {
+	originalCache := Cache
+	originalInitialized := cacheInitialized.Load()
+
+	Cache = Store{}
+	cacheInitialized.Store(0)
+
+	_, err := Cache.FlushScope(context.Background(), FlushOptions{})
+	assert.Equal(t, ErrCacheNotInitialized, err, "Should return 'cache not initialized' error")
+
+	Cache = originalCache
+	cacheInitialized.Store(originalInitialized)
+}
+
+func TestFlushScopeRedis(t *testing.T) {
+
+	server, err := tempredis.Start(tempredis.Config{})
+	if err != nil {
+		panic(err)
+	}
+	defer server.Term()
+
+	config := Redis{
+		Protocol:       "unix",
+		Address:        server.Socket(),
+		MaxIdle:        1,
+		MaxConnections: 5,
+	}
+
+	config.NewRedisCache()
+
+	conn := Cache.Pool.Get()
+	defer conn.Close()
+
+	fill := func() {
+		for _, key := range []string{
+			"index:3", "index:4", "thread:3:1", "thread:3:2", "thread:4:1",
+			"new:3", "tagtypes", "imageboards", "cachetag:ib:3", "cachetag:thread:3:1",
+			"index:3:mutex", "login:1", "ratelimit:post:1",
+		} {
+			_, err := conn.Do("SET", key, "data")
+			assert.NoError(t, err, "An error was not expected")
+		}
+	}
+
+	exists := func(key string) bool {
+		ok, err := redis.Bool(conn.Do("EXISTS", key))
+		assert.NoError(t, err, "An error was not expected")
+		return ok
+	}
+
+	fill()
+
+	// flush a single imageboard
+	progress, err := Cache.FlushScope(context.Background(), FlushOptions{Ib: "3", Count: 2})
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 6, progress.Deleted, "Only the imageboard keys should be deleted")
+
+	assert.False(t, exists("thread:3:1"), "Imageboard key should be deleted")
+	assert.False(t, exists("index:3"), "Imageboard key should be deleted")
+	assert.False(t, exists("cachetag:thread:3:1"), "Imageboard tag set should be deleted")
+	assert.True(t, exists("thread:4:1"), "Other imageboards should be kept")
+	assert.True(t, exists("tagtypes"), "Global keys should be kept")
+	assert.True(t, exists("index:3:mutex"), "Locks should be kept")
+
+	fill()
+
+	var reports int
+
+	progress, err = Cache.FlushScope(context.Background(), FlushOptions{
+		Progress: func(p FlushProgress) {
+			reports++
+		},
+	})
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 10, progress.Deleted, "All cache keys should be deleted")
+	assert.NotZero(t, reports, "Progress should be reported")
+
+	assert.False(t, exists("tagtypes"), "Cache keys should be deleted")
+	assert.False(t, exists("thread:4:1"), "Cache keys should be deleted")
+	assert.True(t, exists("index:3:mutex"), "Locks should be kept")
+	assert.True(t, exists("login:1"), "Unrelated keys should be kept")
+	assert.True(t, exists("ratelimit:post:1"), "Unrelated keys should be kept")
+
+	// flush by prefix
+	progress, err = Cache.FlushScope(context.Background(), FlushOptions{Prefix: "ratelimit:"})
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 1, progress.Deleted, "Prefixed keys should be deleted")
+	assert.True(t, exists("login:1"), "Unrelated keys should be kept")
+
+	// a cancelled flush stops
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = Cache.FlushScope(ctx, FlushOptions{})
+	assert.Equal(t, context.Canceled, err, "Error should be context cancelled")
+}
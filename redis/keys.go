@@ -1,15 +1,25 @@
 package redis
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/eirka/eirka-libs/config"
 )
 
 // Keyer describes the explicit key functions
 type Keyer interface {
 	SetKey(ids ...string) *Key
+	Tags(tags ...string) *Key
 	Get() (result []byte, err error)
+	GetStale() (result []byte, stale bool, err error)
+	GetOrCompute(ctx context.Context, compute ComputeFunc) (result []byte, err error)
+	GetWait(ctx context.Context) (result []byte, err error)
+	Refresh(compute ComputeFunc)
 	Set(data []byte) (err error)
 	Delete() (err error)
 	String() string
@@ -21,50 +31,264 @@ type Key struct {
 	fieldcount int
 	hash       bool
 	expire     bool
+	ttl        time.Duration
+	softttl    time.Duration
 	lock       bool
 	key        string
 	hashid     string
 	keyset     bool
+	tags       []string
+	hashtag    string
 }
 
 var _ = Keyer(&Key{})
 
+// KeySpec describes a type of key for registration
+type KeySpec struct {
+	// Base is the first segment of the key name and must be unique
+	Base string
+	// FieldCount is how many ids are joined onto the base
+	FieldCount int
+	// Hash stores the data in a hash field given by the ids after the key fields
+	Hash bool
+	// TTL expires the key after it is set, zero means it never expires
+	TTL time.Duration
+	// SoftTTL is the age after which Get reports the data as stale so it can be rebuilt in the background,
+	// it has to be shorter than TTL which stays as the hard expiry, zero disables it
+	SoftTTL time.Duration
+	// Lock takes a mutex on Delete that is released by the next Set
+	Lock bool
+	// HashTag wraps the first field in a redis cluster hash tag so related keys share a slot
+	// With "ib" the thread key is thread:{ib:3}:1234 and lands next to index:{ib:3}
+	HashTag string
+}
+
+// DefaultKeyTTL is the expiry used by the built in keys that expire
+const DefaultKeyTTL = 600 * time.Second
+
 var (
 	// ErrKeyNotSet returns if the key was not set properly
 	ErrKeyNotSet = errors.New("key not set")
+	// ErrDuplicateKey returns if a key base is already registered
+	ErrDuplicateKey = errors.New("key already registered")
+	// ErrInvalidKeySpec returns if a key spec is not valid
+	ErrInvalidKeySpec = errors.New("key spec not valid")
+	// ErrUnknownKey returns if a key base is not registered
+	ErrUnknownKey = errors.New("key not registered")
 	// RedisKeyIndex holds a searchable index of keys
 	RedisKeyIndex = make(map[string]Key)
 	// RedisKeys is a slice of all the explicit keys
-	RedisKeys = []Key{
-		{base: "index", fieldcount: 1, hash: true, expire: false, lock: true},
-		{base: "thread", fieldcount: 2, hash: true, expire: false},
-		{base: "tag", fieldcount: 2, hash: true, expire: true},
-		{base: "image", fieldcount: 1, hash: true, expire: false},
-		{base: "post", fieldcount: 2, hash: true, expire: false},
-		{base: "tags", fieldcount: 1, hash: true, expire: false},
-		{base: "directory", fieldcount: 1, hash: true, expire: false},
-		{base: "new", fieldcount: 1, hash: false, expire: true},
-		{base: "popular", fieldcount: 1, hash: false, expire: true},
-		{base: "favorited", fieldcount: 1, hash: false, expire: true},
-		{base: "tagtypes", fieldcount: 0, hash: false, expire: false},
-		{base: "imageboards", fieldcount: 0, hash: false, expire: true},
+	RedisKeys []Key
+
+	// keyMu guards the key registry
+	keyMu sync.RWMutex
+
+	// builtinKeys are the keys used by the eirka services
+	builtinKeys = []KeySpec{
+		{Base: "index", FieldCount: 1, Hash: true, Lock: true},
+		{Base: "thread", FieldCount: 2, Hash: true},
+		{Base: "tag", FieldCount: 2, Hash: true, TTL: DefaultKeyTTL},
+		{Base: "image", FieldCount: 1, Hash: true},
+		{Base: "post", FieldCount: 2, Hash: true},
+		{Base: "tags", FieldCount: 1, Hash: true},
+		{Base: "directory", FieldCount: 1, Hash: true},
+		{Base: "new", FieldCount: 1, TTL: DefaultKeyTTL},
+		{Base: "popular", FieldCount: 1, TTL: DefaultKeyTTL},
+		{Base: "favorited", FieldCount: 1, TTL: DefaultKeyTTL},
+		{Base: "tagtypes", FieldCount: 0},
+		{Base: "imageboards", FieldCount: 0, TTL: DefaultKeyTTL},
 	}
 )
 
 func init() {
-	// key index map
-	for _, key := range RedisKeys {
-		RedisKeyIndex[key.base] = key
+	// register the built in keys
+	for _, spec := range builtinKeys {
+		err := RegisterKey(spec)
+		if err != nil {
+			panic(err)
+		}
 	}
 }
 
+// RegisterKey adds a type of key to the index so it can be used with NewKey
+func RegisterKey(spec KeySpec) error {
+
+	err := spec.validate()
+	if err != nil {
+		return err
+	}
+
+	keyMu.Lock()
+	defer keyMu.Unlock()
+
+	_, ok := RedisKeyIndex[spec.Base]
+	if ok {
+		return fmt.Errorf("%w: %s", ErrDuplicateKey, spec.Base)
+	}
+
+	key := Key{
+		base:       spec.Base,
+		fieldcount: spec.FieldCount,
+		hash:       spec.Hash,
+		expire:     spec.TTL > 0,
+		ttl:        spec.TTL,
+		softttl:    spec.SoftTTL,
+		lock:       spec.Lock,
+		hashtag:    spec.HashTag,
+	}
+
+	RedisKeys = append(RedisKeys, key)
+	RedisKeyIndex[key.base] = key
+
+	return nil
+}
+
+// SetKeyTTL changes the expiry of a registered key, zero means it never expires
+func SetKeyTTL(base string, ttl time.Duration) error {
+
+	if !isValidTTL(ttl) {
+		return fmt.Errorf("%w: ttl must be zero or at least one second", ErrInvalidKeySpec)
+	}
+
+	keyMu.Lock()
+	defer keyMu.Unlock()
+
+	key, ok := RedisKeyIndex[base]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownKey, base)
+	}
+
+	if !isValidSoftTTL(key.softttl, ttl) {
+		return fmt.Errorf("%w: ttl must be set and longer than the soft ttl", ErrInvalidKeySpec)
+	}
+
+	key.ttl = ttl
+	key.expire = ttl > 0
+
+	updateKey(key)
+
+	return nil
+}
+
+// SetKeySoftTTL changes the soft expiry of a registered key, zero disables it
+// Entries written with a soft expiry have a header older versions can not read,
+// so only enable it once every instance sharing the cache supports it.
+func SetKeySoftTTL(base string, soft time.Duration) error {
+
+	if !isValidTTL(soft) {
+		return fmt.Errorf("%w: soft ttl must be zero or at least one second", ErrInvalidKeySpec)
+	}
+
+	keyMu.Lock()
+	defer keyMu.Unlock()
+
+	key, ok := RedisKeyIndex[base]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownKey, base)
+	}
+
+	if !isValidSoftTTL(soft, key.ttl) {
+		return fmt.Errorf("%w: soft ttl needs a ttl and must be shorter than it", ErrInvalidKeySpec)
+	}
+
+	key.softttl = soft
+
+	updateKey(key)
+
+	return nil
+}
+
+// updateKey replaces a key in the registry, the lock must be held
+func updateKey(key Key) {
+	RedisKeyIndex[key.base] = key
+
+	for i := range RedisKeys {
+		if RedisKeys[i].base == key.base {
+			RedisKeys[i] = key
+		}
+	}
+}
+
+// applyKeyConfig sets the key expiry overrides from the config file
+func applyKeyConfig() error {
+
+	if config.Settings == nil {
+		return nil
+	}
+
+	for base, seconds := range config.Settings.Cache.TTL {
+		err := SetKeyTTL(base, time.Duration(seconds)*time.Second)
+		if err != nil {
+			return err
+		}
+	}
+
+	for base, seconds := range config.Settings.Cache.SoftTTL {
+		err := SetKeySoftTTL(base, time.Duration(seconds)*time.Second)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validate checks a key spec for registration
+func (s KeySpec) validate() error {
+
+	if s.Base == "" || strings.Contains(s.Base, ":") {
+		return fmt.Errorf("%w: base must be set and cannot contain a colon", ErrInvalidKeySpec)
+	}
+
+	if s.FieldCount < 0 {
+		return fmt.Errorf("%w: field count cannot be negative", ErrInvalidKeySpec)
+	}
+
+	if s.Hash && s.FieldCount == 0 {
+		return fmt.Errorf("%w: hash keys need at least one field", ErrInvalidKeySpec)
+	}
+
+	if !isValidTTL(s.TTL) {
+		return fmt.Errorf("%w: ttl must be zero or at least one second", ErrInvalidKeySpec)
+	}
+
+	if !isValidTTL(s.SoftTTL) || !isValidSoftTTL(s.SoftTTL, s.TTL) {
+		return fmt.Errorf("%w: soft ttl must be zero or at least one second and shorter than a set ttl", ErrInvalidKeySpec)
+	}
+
+	if s.HashTag != "" && s.FieldCount == 0 {
+		return fmt.Errorf("%w: hash tags need at least one field", ErrInvalidKeySpec)
+	}
+
+	if strings.ContainsAny(s.HashTag, ":{}") {
+		return fmt.Errorf("%w: hash tag cannot contain a colon or braces", ErrInvalidKeySpec)
+	}
+
+	return nil
+}
+
+// isValidTTL checks that a ttl can be used with EXPIRE
+func isValidTTL(ttl time.Duration) bool {
+	return ttl == 0 || ttl >= time.Second
+}
+
+// isValidSoftTTL checks that a soft expiry comes before the hard one
+// Keys that never expire can not have one, a soft expiry needs a hard one to bound stale reads.
+func isValidSoftTTL(soft, ttl time.Duration) bool {
+	return soft == 0 || (ttl > 0 && soft < ttl)
+}
+
 // return a string version of the key
+// The store prefix is not included since the Store methods add it
 func (r *Key) String() string {
 	return r.key
 }
 
 // NewKey returns a key from the index or nil if it doesnt exist
 func NewKey(name string) *Key {
+	keyMu.RLock()
+	defer keyMu.RUnlock()
+
 	key, ok := RedisKeyIndex[name]
 	if !ok {
 		return nil
@@ -94,8 +318,10 @@ func (r *Key) SetKey(ids ...string) *Key {
 		return r
 	}
 
+	fields := append([]string{r.firstField(ids[0])}, ids[1:r.fieldcount]...)
+
 	// create our key
-	r.key = strings.Join([]string{r.base, strings.Join(ids[:r.fieldcount], ":")}, ":")
+	r.key = strings.Join([]string{r.base, strings.Join(fields, ":")}, ":")
 
 	// get our hash key
 	if r.hash {
@@ -107,22 +333,35 @@ func (r *Key) SetKey(ids ...string) *Key {
 	return r
 }
 
+// firstField wraps the first field in the hash tag if the key has one
+func (r *Key) firstField(id string) string {
+	if r.hashtag == "" {
+		return id
+	}
+	return fmt.Sprintf("{%s:%s}", r.hashtag, id)
+}
+
+// Tags sets the invalidation tags that are attached to the key when it is set
+func (r *Key) Tags(tags ...string) *Key {
+	r.tags = tags
+	return r
+}
+
 // Get gets a key, automatically handles hash types
+// Keys with a soft expiry return stale data as well, use GetStale to tell
 func (r *Key) Get() (result []byte, err error) {
+	result, _, err = r.GetStale()
+	return
+}
 
-	if !r.keyset {
-		return nil, ErrKeyNotSet
-	}
-
-	if !isCacheInitialized() {
-		return nil, ErrCacheNotInitialized
-	}
+// get gets the stored entry of a key, with the soft expiry header if it has one
+func (r *Key) get() (result []byte, err error) {
 
 	if r.hash {
-		return Cache.HGet(r.key, r.hashid)
+		return Active().HGet(r.key, r.hashid)
 	}
 
-	return Cache.Get(r.key)
+	return Active().Get(r.key)
 
 }
 
@@ -137,23 +376,49 @@ func (r *Key) Set(data []byte) (err error) {
 		return ErrCacheNotInitialized
 	}
 
+	// the payload is counted, not the soft expiry header
+	size := len(data)
+
+	defer func(start time.Time) {
+		recordKeyOp(r.base, opSet, start, size, err)
+	}(time.Now())
+
+	// unlock this key and wake the readers waiting on the rebuild even if the write failed
+	if r.lock {
+		defer func() {
+			Active().Unlock(r.lockKey())
+			_ = Active().Publish(context.Background(), writtenChannel, r.key)
+		}()
+	}
+
+	// store when the data goes stale with it
+	if r.softttl > 0 {
+		data = wrapStale(data, r.softttl)
+	}
+
 	if r.hash {
-		err = Cache.HMSet(r.key, r.hashid, data)
+		err = Active().HMSet(r.key, r.hashid, data)
 	} else {
-		err = Cache.Set(r.key, data)
+		err = Active().Set(r.key, data)
 	}
 	if err != nil {
 		return
 	}
 
-	// unlock this key
-	if r.lock {
-		Cache.Unlock(fmt.Sprintf("%s:mutex", r.key))
+	// expire the key if set, before it is tagged so the tag sets can outlive it
+	if r.expire {
+		err = Active().Expire(r.key, uint(r.ttl/time.Second))
+		if err != nil {
+			return
+		}
 	}
 
-	// expire the key if set
-	if r.expire {
-		return Cache.Expire(r.key, 600)
+	// add the key to its invalidation tags
+	if len(r.tags) > 0 {
+		err = Active().AddTags(r.key, r.tags...)
+		if err != nil {
+			return
+		}
 	}
 
 	return
@@ -170,15 +435,27 @@ func (r *Key) Delete() (err error) {
 		return ErrCacheNotInitialized
 	}
 
-	err = Cache.Delete(r.key)
+	defer func(start time.Time) {
+		recordKeyOp(r.base, opDelete, start, 0, err)
+	}(time.Now())
+
+	err = Active().Delete(r.key)
 	if err != nil {
 		return
 	}
 
-	// lock this key
+	// lock this key, while the breaker is open the delete was skipped so there is nothing to protect
 	if r.lock {
-		err = Cache.Lock(fmt.Sprintf("%s:mutex", r.key))
+		err = Active().Lock(r.lockKey())
+		if err == ErrCircuitOpen {
+			err = nil
+		}
 	}
 
 	return
 }
+
+// lockKey returns the key of the rebuild lock taken by Delete
+func (r *Key) lockKey() string {
+	return fmt.Sprintf("%s:mutex", r.key)
+}
@@ -3,10 +3,13 @@ package redis
 import (
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/rafaeljusto/redigomock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stvp/tempredis"
+
+	"github.com/eirka/eirka-libs/config"
 )
 
 func TestNewKey(t *testing.T) {
@@ -380,6 +383,27 @@ func TestKeysSetWithLock(t *testing.T) {
 	assert.NoError(t, err, "An error was not expected")
 }
 
+// Test Set releases the lock when the write fails
+func TestKeysSetWithLockError(t *testing.T) {
+	defer unregisterKey("custom")
+
+	err := RegisterKey(KeySpec{Base: "custom", FieldCount: 1, TTL: 30 * time.Second, Lock: true})
+	assert.NoError(t, err, "An error was not expected")
+
+	key := NewKey("custom").SetKey("1")
+
+	NewRedisMock()
+
+	Cache.Mock.Command("SET", "custom:1", []byte("hello"))
+	Cache.Mock.Command("EXPIRE", "custom:1", redigomock.NewAnyData()).ExpectError(errors.New("expire error"))
+	unlock := Cache.Mock.Command("EVALSHA", redigomock.NewAnyData(), 2, "custom:1:mutex", "locks:mutex").Expect(int64(1))
+
+	err = key.Set([]byte("hello"))
+
+	assert.Error(t, err, "An error was expected")
+	assert.Equal(t, 1, Cache.Mock.Stats(unlock), "Lock should be released")
+}
+
 func TestKeysDelete(t *testing.T) {
 
 	key := NewKey("thread")
@@ -564,3 +588,165 @@ func TestInitFunction(t *testing.T) {
 		assert.Equal(t, key, mappedKey.base, "Base name should match for mapped key: "+key)
 	}
 }
+
+// unregisterKey removes a key registered by a test
+func unregisterKey(base string) {
+	keyMu.Lock()
+	defer keyMu.Unlock()
+
+	delete(RedisKeyIndex, base)
+
+	for i := range RedisKeys {
+		if RedisKeys[i].base == base {
+			RedisKeys = append(RedisKeys[:i], RedisKeys[i+1:]...)
+			break
+		}
+	}
+}
+
+func TestRegisterKey(t *testing.T) {
+	defer unregisterKey("custom")
+
+	err := RegisterKey(KeySpec{Base: "custom", FieldCount: 2, Hash: true, TTL: 30 * time.Second, Lock: true})
+	assert.NoError(t, err, "An error was not expected")
+
+	key := NewKey("custom")
+	if assert.NotNil(t, key, "Key should be registered") {
+		assert.Equal(t, 2, key.fieldcount, "Field count should match")
+		assert.True(t, key.hash, "Hash flag should match")
+		assert.True(t, key.expire, "Expire flag should be set from the ttl")
+		assert.Equal(t, 30*time.Second, key.ttl, "TTL should match")
+		assert.True(t, key.lock, "Lock flag should match")
+	}
+
+	key = key.SetKey("1", "2", "3")
+
+	assert.Equal(t, "custom:1:2", key.String(), "Key should match")
+}
+
+func TestSetKeyHashTag(t *testing.T) {
+	defer unregisterKey("tagged")
+	defer unregisterKey("taggedindex")
+
+	err := RegisterKey(KeySpec{Base: "tagged", FieldCount: 2, Hash: true, HashTag: "ib"})
+	assert.NoError(t, err, "An error was not expected")
+
+	err = RegisterKey(KeySpec{Base: "taggedindex", FieldCount: 1, Hash: true, HashTag: "ib"})
+	assert.NoError(t, err, "An error was not expected")
+
+	key := NewKey("tagged").SetKey("3", "1234", "1")
+
+	assert.Equal(t, "tagged:{ib:3}:1234", key.String(), "Key should have a hash tag")
+	assert.Equal(t, "1", key.hashid, "Hash id should match")
+
+	index := NewKey("taggedindex").SetKey("3", "1")
+
+	assert.Equal(t, "taggedindex:{ib:3}", index.String(), "Key should have a hash tag")
+
+	NewRedisMock()
+
+	Cache.Prefix = "staging:"
+	defer func() {
+		Cache.Prefix = ""
+	}()
+
+	Cache.Mock.Command("HGET", "staging:tagged:{ib:3}:1234", "1").Expect("worked!")
+
+	result, err := key.Get()
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("worked!"), result, "Should return data")
+}
+
+func TestRegisterKeyDuplicate(t *testing.T) {
+
+	err := RegisterKey(KeySpec{Base: "thread", FieldCount: 1})
+
+	if assert.Error(t, err, "An error was expected") {
+		assert.ErrorIs(t, err, ErrDuplicateKey, "Error should be duplicate key")
+	}
+
+	assert.Equal(t, 2, NewKey("thread").fieldcount, "Existing key should not be changed")
+}
+
+func TestRegisterKeyInvalid(t *testing.T) {
+
+	specs := []KeySpec{
+		{Base: "", FieldCount: 1},
+		{Base: "bad:base", FieldCount: 1},
+		{Base: "negative", FieldCount: -1},
+		{Base: "hashnofields", FieldCount: 0, Hash: true},
+		{Base: "shortttl", FieldCount: 1, TTL: time.Millisecond},
+		{Base: "negativettl", FieldCount: 1, TTL: -time.Second},
+		{Base: "hashtagnofields", FieldCount: 0, HashTag: "ib"},
+		{Base: "badhashtag", FieldCount: 1, HashTag: "ib:{3}"},
+	}
+
+	for _, spec := range specs {
+		err := RegisterKey(spec)
+		if assert.Error(t, err, "An error was expected for "+spec.Base) {
+			assert.ErrorIs(t, err, ErrInvalidKeySpec, "Error should be invalid spec")
+		}
+		assert.Nil(t, NewKey(spec.Base), "Key should not be registered")
+	}
+}
+
+func TestSetKeyTTL(t *testing.T) {
+	defer func() {
+		_ = SetKeyTTL("popular", DefaultKeyTTL)
+	}()
+
+	err := SetKeyTTL("popular", 30*time.Second)
+	assert.NoError(t, err, "An error was not expected")
+
+	key := NewKey("popular").SetKey("1")
+	assert.Equal(t, 30*time.Second, key.ttl, "TTL should be updated")
+
+	NewRedisMock()
+
+	Cache.Mock.Command("SET", "popular:1", []byte("hello"))
+	Cache.Mock.Command("EXPIRE", "popular:1", uint(30))
+
+	err = key.Set([]byte("hello"))
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.NoError(t, Cache.Mock.ExpectationsWereMet(), "Expire should use the key ttl")
+
+	// disable expiry
+	err = SetKeyTTL("popular", 0)
+	assert.NoError(t, err, "An error was not expected")
+	assert.False(t, NewKey("popular").expire, "Expire flag should be cleared")
+
+	err = SetKeyTTL("blah", time.Minute)
+	assert.ErrorIs(t, err, ErrUnknownKey, "Error should be unknown key")
+
+	err = SetKeyTTL("popular", time.Millisecond)
+	assert.ErrorIs(t, err, ErrInvalidKeySpec, "Error should be invalid spec")
+}
+
+func TestApplyKeyConfig(t *testing.T) {
+	original := config.Settings.Cache
+	defer func() {
+		config.Settings.Cache = original
+		_ = SetKeyTTL("new", DefaultKeyTTL)
+		_ = SetKeyTTL("thread", 0)
+	}()
+
+	config.Settings.Cache.TTL = map[string]uint{
+		"new":    60,
+		"thread": 3600,
+	}
+
+	err := applyKeyConfig()
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.Equal(t, time.Minute, NewKey("new").ttl, "TTL should be overridden")
+	assert.Equal(t, time.Hour, NewKey("thread").ttl, "TTL should be overridden")
+	assert.True(t, NewKey("thread").expire, "Expire flag should be set")
+
+	config.Settings.Cache.TTL = map[string]uint{
+		"blah": 60,
+	}
+
+	err = applyKeyConfig()
+	assert.ErrorIs(t, err, ErrUnknownKey, "Error should be unknown key")
+}
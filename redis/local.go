@@ -0,0 +1,402 @@
+package redis
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	// DefaultLocalCacheTTL is used when LocalCacheTTL is 0
+	DefaultLocalCacheTTL = 5 * time.Second
+	// InvalidateChannel is the pub/sub channel used to evict local cache entries on all instances
+	InvalidateChannel = "eirka:cache:invalidate"
+	// invalidateAll is published to clear every local cache
+	invalidateAll = "*"
+	// resubscribeDelay is how long to wait before resubscribing after a connection error
+	resubscribeDelay = time.Second
+)
+
+// CacheStats holds the hit and miss counters for both cache tiers
+type CacheStats struct {
+	LocalHits   uint64
+	LocalMisses uint64
+	RedisHits   uint64
+	RedisMisses uint64
+}
+
+// cacheCounters are the live counters behind CacheStats
+type cacheCounters struct {
+	localHits   atomic.Uint64
+	localMisses atomic.Uint64
+	redisHits   atomic.Uint64
+	redisMisses atomic.Uint64
+}
+
+// localKey identifies an entry, field is empty for plain keys
+type localKey struct {
+	key   string
+	field string
+}
+
+// localEntry is a cached value
+type localEntry struct {
+	id      localKey
+	value   []byte
+	expires time.Time
+}
+
+// LocalCache is an in process LRU that sits in front of redis for Get and HGet
+type LocalCache struct {
+	size int
+	ttl  time.Duration
+
+	mu sync.Mutex
+	// gen counts evictions, a fill started before the last eviction of its key or clear is dropped
+	gen     uint64
+	cleared uint64
+	evicted map[string]uint64
+	items   map[localKey]*list.Element
+	fields  map[string]map[string]struct{}
+	order   *list.List
+
+	done     chan struct{}
+	connm    sync.Mutex
+	psc      *redis.PubSubConn
+	closeOne sync.Once
+}
+
+// NewLocalCache creates an LRU holding up to size entries for ttl
+func NewLocalCache(size int, ttl time.Duration) *LocalCache {
+	if ttl == 0 {
+		ttl = DefaultLocalCacheTTL
+	}
+
+	return &LocalCache{
+		size:    size,
+		ttl:     ttl,
+		evicted: make(map[string]uint64),
+		items:   make(map[localKey]*list.Element),
+		fields:  make(map[string]map[string]struct{}),
+		order:   list.New(),
+		done:    make(chan struct{}),
+	}
+}
+
+// get returns a copy of a cached value if it exists and has not expired
+// The generation is passed to set so a value read from redis is not cached if its key was evicted in between
+func (l *LocalCache) get(key, field string) (value []byte, gen uint64, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	el, ok := l.items[localKey{key, field}]
+	if !ok {
+		return nil, l.gen, false
+	}
+
+	entry := el.Value.(*localEntry)
+
+	if time.Now().After(entry.expires) {
+		l.remove(el)
+		return nil, l.gen, false
+	}
+
+	l.order.MoveToFront(el)
+
+	return append([]byte(nil), entry.value...), l.gen, true
+}
+
+// set caches a value, evicting the least recently used entry if full
+func (l *LocalCache) set(key, field string, value []byte, gen uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// the value could be stale if the key was evicted since it was read
+	if gen < l.cleared || gen < l.evicted[key] {
+		return
+	}
+
+	id := localKey{key, field}
+
+	el, ok := l.items[id]
+	if ok {
+		entry := el.Value.(*localEntry)
+		entry.value = value
+		entry.expires = time.Now().Add(l.ttl)
+		l.order.MoveToFront(el)
+		return
+	}
+
+	for l.order.Len() >= l.size && l.order.Len() > 0 {
+		l.remove(l.order.Back())
+	}
+
+	l.items[id] = l.order.PushFront(&localEntry{
+		id:      id,
+		value:   value,
+		expires: time.Now().Add(l.ttl),
+	})
+
+	if l.fields[key] == nil {
+		l.fields[key] = make(map[string]struct{})
+	}
+	l.fields[key][field] = struct{}{}
+}
+
+// evict removes a key and all of its hash fields
+func (l *LocalCache) evict(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.gen++
+
+	for _, key := range keys {
+		if key == invalidateAll {
+			l.clear()
+			return
+		}
+
+		l.evicted[key] = l.gen
+
+		for field := range l.fields[key] {
+			el, ok := l.items[localKey{key, field}]
+			if ok {
+				l.remove(el)
+			}
+		}
+	}
+
+	// forgetting the evictions drops every fill in flight, which is rare enough to keep the map small
+	if len(l.evicted) > l.size {
+		l.cleared = l.gen
+		l.evicted = make(map[string]uint64)
+	}
+}
+
+// clear removes every entry, the lock must be held
+func (l *LocalCache) clear() {
+	l.cleared = l.gen
+	l.evicted = make(map[string]uint64)
+	l.items = make(map[localKey]*list.Element)
+	l.fields = make(map[string]map[string]struct{})
+	l.order.Init()
+}
+
+// remove deletes a single entry, the lock must be held
+func (l *LocalCache) remove(el *list.Element) {
+	entry := l.order.Remove(el).(*localEntry)
+
+	delete(l.items, entry.id)
+
+	fields := l.fields[entry.id.key]
+	delete(fields, entry.id.field)
+	if len(fields) == 0 {
+		delete(l.fields, entry.id.key)
+	}
+}
+
+// Len returns the number of cached entries
+func (l *LocalCache) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.order.Len()
+}
+
+// subscribe listens for invalidations from other instances until Close is called
+func (l *LocalCache) subscribe(pool Pool, channel string) {
+	for {
+		select {
+		case <-l.done:
+			return
+		default:
+		}
+
+		err := l.receive(pool, channel)
+		if err == nil {
+			return
+		}
+
+		// we could have missed invalidations while disconnected
+		l.evict(invalidateAll)
+
+		select {
+		case <-l.done:
+			return
+		case <-time.After(resubscribeDelay):
+		}
+	}
+}
+
+// receive handles invalidation messages on a single connection
+func (l *LocalCache) receive(pool Pool, channel string) error {
+	psc := &redis.PubSubConn{Conn: pool.Get()}
+
+	// Close can be unsubscribing so closing has to hold the lock
+	defer func() {
+		l.connm.Lock()
+		defer l.connm.Unlock()
+
+		l.psc = nil
+		psc.Close()
+	}()
+
+	l.connm.Lock()
+	select {
+	case <-l.done:
+		l.connm.Unlock()
+		return nil
+	default:
+	}
+	err := psc.Subscribe(channel)
+	if err != nil {
+		l.connm.Unlock()
+		return err
+	}
+	l.psc = psc
+	l.connm.Unlock()
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			l.evict(string(v.Data))
+		case redis.Subscription:
+			// Close unsubscribes to stop the receiver
+			if v.Count == 0 {
+				return nil
+			}
+		case error:
+			select {
+			case <-l.done:
+				return nil
+			default:
+				return v
+			}
+		}
+	}
+}
+
+// Close stops listening for invalidations
+func (l *LocalCache) Close() {
+	l.closeOne.Do(func() {
+		l.connm.Lock()
+		defer l.connm.Unlock()
+
+		close(l.done)
+
+		if l.psc != nil {
+			_ = l.psc.Unsubscribe()
+		}
+	})
+}
+
+// Stats returns the hit and miss counters for both cache tiers
+func (c *Store) Stats() (stats CacheStats) {
+	if c.counters == nil {
+		return
+	}
+
+	return CacheStats{
+		LocalHits:   c.counters.localHits.Load(),
+		LocalMisses: c.counters.localMisses.Load(),
+		RedisHits:   c.counters.redisHits.Load(),
+		RedisMisses: c.counters.redisMisses.Load(),
+	}
+}
+
+// cachesLocally returns true if a key is kept in the local tier
+// Only registered keys are cached there, counters and other state are always read from redis so writes
+// to them do not have to be invalidated.
+func (c *Store) cachesLocally(key string) bool {
+	if c.Local == nil {
+		return false
+	}
+
+	base, _, _ := strings.Cut(strings.TrimPrefix(key, c.Prefix), ":")
+
+	keyMu.RLock()
+	defer keyMu.RUnlock()
+
+	_, ok := RedisKeyIndex[base]
+
+	return ok
+}
+
+// localGet checks the local tier and records a hit or miss
+func (c *Store) localGet(key, field string) ([]byte, uint64, bool) {
+	if !c.cachesLocally(key) {
+		return nil, 0, false
+	}
+
+	result, gen, ok := c.Local.get(key, field)
+
+	if c.counters != nil {
+		if ok {
+			c.counters.localHits.Add(1)
+		} else {
+			c.counters.localMisses.Add(1)
+		}
+	}
+
+	return result, gen, ok
+}
+
+// redisResult records a redis tier hit or miss and fills the local tier
+func (c *Store) redisResult(key, field string, gen uint64, result []byte, err error) {
+	if c.counters != nil {
+		if err == nil {
+			c.counters.redisHits.Add(1)
+		} else if err == ErrCacheMiss {
+			c.counters.redisMisses.Add(1)
+		}
+	}
+
+	if err == nil && c.cachesLocally(key) {
+		c.Local.set(key, field, append([]byte(nil), result...), gen)
+	}
+}
+
+// invalidate evicts keys from the local tier here and on every other instance
+// Keys that are never cached locally are skipped so counters do not flood the channel.
+func (c *Store) invalidate(conn redis.Conn, keys ...string) {
+	if c.Local == nil {
+		return
+	}
+
+	cached := keys[:0:0]
+
+	for _, key := range keys {
+		if key == invalidateAll || c.cachesLocally(key) {
+			cached = append(cached, key)
+		}
+	}
+
+	keys = cached
+
+	if len(keys) == 0 {
+		return
+	}
+
+	c.Local.evict(keys...)
+
+	channel := c.invalidateChannel()
+
+	for _, key := range keys {
+		err := conn.Send("PUBLISH", channel, key)
+		if err != nil {
+			return
+		}
+	}
+
+	// invalidation is best effort, entries still expire with the local ttl
+	_, _ = conn.Do("")
+}
+
+// invalidateChannel returns the invalidation channel, prefixed so environments sharing a server stay apart
+func (c *Store) invalidateChannel() string {
+	return c.prefixed(InvalidateChannel)
+}
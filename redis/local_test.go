@@ -0,0 +1,297 @@
+package redis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stvp/tempredis"
+)
+
+func TestLocalCacheGetSet(t *testing.T) {
+
+	local := NewLocalCache(10, time.Minute)
+
+	_, gen, ok := local.get("tagtypes", "")
+	assert.False(t, ok, "Should be a miss")
+
+	local.set("tagtypes", "", []byte("hello"), gen)
+
+	res, _, ok := local.get("tagtypes", "")
+	assert.True(t, ok, "Should be a hit")
+	assert.Equal(t, []byte("hello"), res, "Data should match")
+
+	assert.Equal(t, 1, local.Len(), "Should have one entry")
+
+	// callers get a copy of the cached bytes
+	res[0] = 'j'
+
+	res, _, ok = local.get("tagtypes", "")
+	assert.True(t, ok, "Should be a hit")
+	assert.Equal(t, []byte("hello"), res, "Cached data should not change")
+}
+
+func TestLocalCacheDefaultTTL(t *testing.T) {
+
+	local := NewLocalCache(10, 0)
+
+	assert.Equal(t, DefaultLocalCacheTTL, local.ttl, "TTL should default")
+}
+
+func TestLocalCacheExpiry(t *testing.T) {
+
+	local := NewLocalCache(10, 10*time.Millisecond)
+
+	local.set("tagtypes", "", []byte("hello"), 0)
+
+	time.Sleep(20 * time.Millisecond)
+
+	_, _, ok := local.get("tagtypes", "")
+	assert.False(t, ok, "Expired entry should be a miss")
+
+	assert.Equal(t, 0, local.Len(), "Expired entry should be removed")
+}
+
+func TestLocalCacheLRU(t *testing.T) {
+
+	local := NewLocalCache(2, time.Minute)
+
+	local.set("a", "", []byte("a"), 0)
+	local.set("b", "", []byte("b"), 0)
+
+	// touch a so b is the least recently used
+	_, _, ok := local.get("a", "")
+	assert.True(t, ok, "Should be a hit")
+
+	local.set("c", "", []byte("c"), 0)
+
+	assert.Equal(t, 2, local.Len(), "Size should be limited")
+
+	_, _, ok = local.get("b", "")
+	assert.False(t, ok, "Least recently used entry should be evicted")
+
+	_, _, ok = local.get("a", "")
+	assert.True(t, ok, "Recently used entry should be kept")
+}
+
+func TestLocalCacheEvict(t *testing.T) {
+
+	local := NewLocalCache(10, time.Minute)
+
+	local.set("index:1", "1", []byte("one"), 0)
+	local.set("index:1", "2", []byte("two"), 0)
+	local.set("index:2", "1", []byte("other"), 0)
+
+	local.evict("index:1")
+
+	_, _, ok := local.get("index:1", "1")
+	assert.False(t, ok, "All hash fields should be evicted")
+
+	_, _, ok = local.get("index:1", "2")
+	assert.False(t, ok, "All hash fields should be evicted")
+
+	_, gen, ok := local.get("index:2", "1")
+	assert.True(t, ok, "Other keys should be kept")
+
+	// evicting another key does not drop a fill in flight
+	_, fill, ok := local.get("index:3", "1")
+	assert.False(t, ok, "Should be a miss")
+
+	local.evict("index:1")
+
+	local.set("index:3", "1", []byte("three"), fill)
+
+	_, _, ok = local.get("index:3", "1")
+	assert.True(t, ok, "Value read before another key was evicted should be cached")
+
+	// a value read before its key was evicted is dropped
+	_, fill, ok = local.get("index:4", "1")
+	assert.False(t, ok, "Should be a miss")
+
+	local.evict("index:4")
+
+	local.set("index:4", "1", []byte("stale"), fill)
+
+	_, _, ok = local.get("index:4", "1")
+	assert.False(t, ok, "Stale value should not be cached")
+
+	local.evict(invalidateAll)
+
+	assert.Equal(t, 0, local.Len(), "Everything should be evicted")
+
+	// a value read before the eviction should not be cached
+	local.set("index:2", "1", []byte("stale"), gen)
+
+	assert.Equal(t, 0, local.Len(), "Stale value should not be cached")
+}
+
+func TestStoreLocalTier(t *testing.T) {
+
+	NewRedisMock()
+
+	Cache.Local = NewLocalCache(10, time.Minute)
+	defer func() {
+		Cache.Local = nil
+	}()
+
+	cmd := Cache.Mock.Command("GET", "imageboards").Expect([]byte("boards"))
+
+	for i := 0; i < 3; i++ {
+		res, err := Cache.Get("imageboards")
+		assert.NoError(t, err, "An error was not expected")
+		assert.Equal(t, []byte("boards"), res, "Data should match")
+	}
+
+	assert.Equal(t, 1, Cache.Mock.Stats(cmd), "Redis should only be called once")
+
+	Cache.Mock.Command("HGET", "index:1", "1").Expect(nil)
+
+	_, err := Cache.HGet("index:1", "1")
+	assert.Equal(t, ErrCacheMiss, err, "Should be a cache miss")
+
+	assert.Equal(t, CacheStats{LocalHits: 2, LocalMisses: 2, RedisHits: 1, RedisMisses: 1}, Cache.Stats(), "Stats should match")
+
+	// writes evict locally and publish the invalidation
+	Cache.Mock.Command("SET", "imageboards", []byte("new"))
+	pub := Cache.Mock.Command("PUBLISH", InvalidateChannel, "imageboards").Expect(int64(1))
+
+	err = Cache.Set("imageboards", []byte("new"))
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.Equal(t, 1, Cache.Mock.Stats(pub), "Invalidation should be published")
+
+	_, err = Cache.Get("imageboards")
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.Equal(t, 2, Cache.Mock.Stats(cmd), "Redis should be called after the eviction")
+}
+
+func TestStoreLocalTierUnregistered(t *testing.T) {
+
+	NewRedisMock()
+
+	Cache.Local = NewLocalCache(10, time.Minute)
+	defer func() {
+		Cache.Local = nil
+	}()
+
+	// keys that are not registered are always read from redis
+	cmd := Cache.Mock.Command("GET", "jwt:generation:2").Expect([]byte("1"))
+
+	for i := 0; i < 2; i++ {
+		_, err := Cache.Get("jwt:generation:2")
+		assert.NoError(t, err, "An error was not expected")
+	}
+
+	assert.Equal(t, 2, Cache.Mock.Stats(cmd), "Redis should be called every time")
+	assert.Equal(t, 0, Cache.Local.Len(), "Nothing should be cached locally")
+
+	// so counting them does not publish invalidations
+	Cache.Mock.Command("INCR", "jwt:generation:2").Expect(int64(2))
+	Cache.Mock.Command("HINCRBY", "counter:{views}:pending", "1", 1).Expect(int64(1))
+	pub := Cache.Mock.Command("PUBLISH", InvalidateChannel, redigomock.NewAnyData()).Expect(int64(1))
+
+	_, err := Cache.Incr("jwt:generation:2")
+	assert.NoError(t, err, "An error was not expected")
+
+	_, err = Cache.HIncrBy("counter:{views}:pending", "1", 1)
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.Equal(t, 0, Cache.Mock.Stats(pub), "Invalidations should not be published")
+
+	// registered keys still are
+	Cache.Mock.Command("HINCRBY", "index:1", "1", 1).Expect(int64(1))
+
+	_, err = Cache.HIncrBy("index:1", "1", 1)
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.Equal(t, 1, Cache.Mock.Stats(pub), "Invalidation should be published")
+}
+
+func TestStoreStatsNoCounters(t *testing.T) {
+
+	store := Store{}
+
+	assert.Equal(t, CacheStats{}, store.Stats(), "Stats should be empty")
+}
+
+func TestLocalCacheInvalidation(t *testing.T) {
+
+	server, err := tempredis.Start(tempredis.Config{})
+	if err != nil {
+		panic(err)
+	}
+	defer server.Term()
+
+	config := Redis{
+		Protocol:       "unix",
+		Address:        server.Socket(),
+		MaxIdle:        1,
+		MaxConnections: 10,
+		LocalCacheSize: 100,
+		LocalCacheTTL:  time.Minute,
+	}
+
+	config.NewRedisCache()
+	defer Cache.Local.Close()
+
+	// another instance sharing the redis server
+	other := Store{
+		Pool:     Cache.Pool,
+		Local:    NewLocalCache(100, time.Minute),
+		counters: &cacheCounters{},
+	}
+	defer other.Local.Close()
+
+	go other.Local.subscribe(other.Pool, other.invalidateChannel())
+
+	// wait for both instances to subscribe
+	assert.Eventually(t, func() bool {
+		conn := Cache.Pool.Get()
+		defer conn.Close()
+
+		reply, err := redis.Values(conn.Do("PUBSUB", "NUMSUB", InvalidateChannel))
+		if err != nil || len(reply) != 2 {
+			return false
+		}
+
+		count, _ := redis.Int(reply[1], nil)
+
+		return count == 2
+	}, time.Second, 10*time.Millisecond, "Both instances should subscribe")
+
+	// write directly so there is no invalidation in flight
+	conn := Cache.Pool.Get()
+	_, err = conn.Do("SET", "tagtypes", "old")
+	conn.Close()
+	assert.NoError(t, err, "An error was not expected")
+
+	res, err := other.Get("tagtypes")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("old"), res, "Data should match")
+
+	assert.Equal(t, 1, other.Local.Len(), "Value should be cached locally")
+
+	err = Cache.Set("tagtypes", []byte("new"))
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.Eventually(t, func() bool {
+		return other.Local.Len() == 0
+	}, time.Second, 10*time.Millisecond, "Other instance should evict the key")
+
+	res, err = other.Get("tagtypes")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("new"), res, "Data should be fresh")
+
+	_, err = other.Get("tagtypes")
+	assert.NoError(t, err, "An error was not expected")
+
+	err = Cache.Flush()
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.Eventually(t, func() bool {
+		return other.Local.Len() == 0
+	}, time.Second, 10*time.Millisecond, "Flush should clear other instances")
+}
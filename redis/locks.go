@@ -0,0 +1,336 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// lockRegistryKey is the sorted set of held lock keys scored by when they expire
+// It ends in a lock suffix so flushes leave it alone. The lock scripts keep it up to date and prune it.
+const lockRegistryKey = "locks:mutex"
+
+// LockHolder is the metadata stored in a lock key
+type LockHolder struct {
+	// Instance is the InstanceID of the process holding the lock
+	Instance string    `json:"instance"`
+	Acquired time.Time `json:"acquired"`
+	// Label is set with WithLockLabel
+	Label string `json:"label,omitempty"`
+	// Token makes the value unique to this holder
+	Token string `json:"token"`
+}
+
+// HeldLock is a lock that is currently held
+type HeldLock struct {
+	// Key is the lock key without the mutex prefix
+	Key string
+	// TTL is the time left before the lock expires
+	TTL time.Duration
+	// Holder is nil for locks that do not carry metadata
+	Holder *LockHolder
+}
+
+// LockEvent describes a Lock call that was slow or failed for the OnSlowLock hook
+type LockEvent struct {
+	Key   string
+	Label string
+	// Waited is the time from calling Lock to getting the lock or giving up
+	Waited  time.Duration
+	Retries int
+	// Err is ErrFailed or the context error if the lock was not acquired
+	Err error
+	// Holder is who held the lock after the first attempt failed, nil if it was not held
+	Holder *LockHolder
+}
+
+// LockStats holds the lock counters for a key prefix
+type LockStats struct {
+	// Acquired counts locks taken by Lock, TryLock and Acquire
+	Acquired uint64
+	// Failures counts Lock calls that gave up
+	Failures uint64
+	// Busy counts TryLock and Acquire calls that found the lock held
+	Busy uint64
+	// Retries counts the attempts after the first in Lock
+	Retries uint64
+	// Slow counts Lock calls that took longer than the mutex SlowThreshold
+	Slow uint64
+	// Wait is the time spent in Lock
+	Wait Latency
+	// Held is the time from taking a lock to releasing it
+	Held Latency
+}
+
+// lockLabelKey is the context key for the lock label
+type lockLabelKey struct{}
+
+// WithLockLabel returns a context that labels the locks taken with it in LockContext
+func WithLockLabel(ctx context.Context, label string) context.Context {
+	return context.WithValue(ctx, lockLabelKey{}, label)
+}
+
+// lockLabel returns the label from the context
+func lockLabel(ctx context.Context) string {
+	label, _ := ctx.Value(lockLabelKey{}).(string)
+	return label
+}
+
+// newLockHolder returns the metadata for a new lock encoded as the lock value
+func newLockHolder(label string) (string, error) {
+	token, err := lockValue()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(LockHolder{
+		Instance: InstanceID,
+		Acquired: time.Now(),
+		Label:    label,
+		Token:    token,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// parseLockHolder decodes a lock value, returning nil for values without metadata
+func parseLockHolder(value []byte) *LockHolder {
+	var holder LockHolder
+
+	if json.Unmarshal(value, &holder) != nil || holder.Token == "" {
+		return nil
+	}
+
+	return &holder
+}
+
+var (
+	// lockMetricsMu guards the lock counters
+	lockMetricsMu sync.Mutex
+	// lockMetrics holds the counters by lock key prefix
+	lockMetrics = make(map[string]*LockStats)
+)
+
+// lockPrefix returns the first segment of a lock key that the counters are grouped by
+func lockPrefix(key string) string {
+	prefix, _, _ := strings.Cut(key, ":")
+	return prefix
+}
+
+// recordLock updates the counters for a lock key
+func recordLock(key string, update func(stats *LockStats)) {
+	prefix := lockPrefix(key)
+
+	lockMetricsMu.Lock()
+	defer lockMetricsMu.Unlock()
+
+	stats, ok := lockMetrics[prefix]
+	if !ok {
+		stats = &LockStats{}
+		lockMetrics[prefix] = stats
+	}
+
+	update(stats)
+}
+
+// LockMetrics returns a copy of the lock counters by key prefix
+func LockMetrics() map[string]LockStats {
+	lockMetricsMu.Lock()
+	defer lockMetricsMu.Unlock()
+
+	metrics := make(map[string]LockStats, len(lockMetrics))
+
+	for prefix, stats := range lockMetrics {
+		copied := *stats
+		copied.Wait.Mean = copied.Wait.mean()
+		copied.Held.Mean = copied.Held.mean()
+		metrics[prefix] = copied
+	}
+
+	return metrics
+}
+
+// ResetLockMetrics clears all of the lock counters
+func ResetLockMetrics() {
+	lockMetricsMu.Lock()
+	defer lockMetricsMu.Unlock()
+
+	lockMetrics = make(map[string]*LockStats)
+}
+
+// observeLock records the result of a Lock call and calls the hook if it was slow or failed
+func (m *Mutex) observeLock(key, label string, start time.Time, retries int, holder *LockHolder, err error) {
+	waited := time.Since(start)
+
+	slow := m.SlowThreshold > 0 && waited >= m.SlowThreshold
+
+	recordLock(key, func(stats *LockStats) {
+		stats.Wait.add(waited)
+		stats.Retries += uint64(retries)
+
+		if err != nil {
+			stats.Failures++
+		} else {
+			stats.Acquired++
+		}
+
+		if slow {
+			stats.Slow++
+		}
+	})
+
+	if err == nil {
+		m.held.Store(key, time.Now())
+	}
+
+	if m.OnSlowLock != nil && (slow || err != nil) {
+		m.OnSlowLock(LockEvent{
+			Key:     key,
+			Label:   label,
+			Waited:  waited,
+			Retries: retries,
+			Err:     err,
+			Holder:  holder,
+		})
+	}
+}
+
+// observeTry records the result of a single attempt at a lock
+func (m *Mutex) observeTry(key string, acquired bool) {
+	recordLock(key, func(stats *LockStats) {
+		if acquired {
+			stats.Acquired++
+		} else {
+			stats.Busy++
+		}
+	})
+
+	if acquired {
+		m.held.Store(key, time.Now())
+	}
+}
+
+// observeRelease records how long a lock taken by this process was held
+func (m *Mutex) observeRelease(key string) {
+	acquired, ok := m.held.LoadAndDelete(key)
+	if !ok {
+		return
+	}
+
+	recordLock(key, func(stats *LockStats) {
+		stats.Held.add(time.Since(acquired.(time.Time)))
+	})
+}
+
+// holder returns the metadata of the current holder of a lock from the first node that has it
+func (m *Mutex) holder(key string) *LockHolder {
+	m.nodem.Lock()
+	defer m.nodem.Unlock()
+
+	for _, node := range m.nodes {
+		if node == nil {
+			continue
+		}
+
+		conn := node.Get()
+		value, err := redis.Bytes(conn.Do("GET", m.Prefix+key))
+		conn.Close()
+		if err != nil {
+			continue
+		}
+
+		return parseLockHolder(value)
+	}
+
+	return nil
+}
+
+// Held lists the locks currently held, sorted by key
+// The registry on the first node is used, locks taken before it existed are not listed.
+func (m *Mutex) Held(ctx context.Context) (locks []HeldLock, err error) {
+	m.nodem.Lock()
+
+	var node Pool
+	for _, n := range m.nodes {
+		if n != nil {
+			node = n
+			break
+		}
+	}
+
+	m.nodem.Unlock()
+
+	if node == nil {
+		return nil, ErrCacheNotInitialized
+	}
+
+	conn := node.Get()
+	defer conn.Close()
+
+	registry := m.Prefix + lockRegistryKey
+
+	// locks that expired without being unlocked
+	_, err = redis.DoContext(conn, ctx, "ZREMRANGEBYSCORE", registry, "-inf", time.Now().UnixMilli())
+	if err != nil {
+		return
+	}
+
+	keys, err := redis.Strings(redis.DoContext(conn, ctx, "ZRANGE", registry, 0, -1))
+	if err != nil || len(keys) == 0 {
+		return
+	}
+
+	for _, key := range keys {
+		err = conn.Send("GET", key)
+		if err != nil {
+			return
+		}
+
+		err = conn.Send("PTTL", key)
+		if err != nil {
+			return
+		}
+	}
+
+	err = conn.Flush()
+	if err != nil {
+		return
+	}
+
+	for _, key := range keys {
+		value, getErr := redis.Bytes(conn.Receive())
+		if getErr != nil && getErr != redis.ErrNil {
+			return nil, getErr
+		}
+
+		ttl, err := redis.Int64(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+
+		// released between the range and the get
+		if getErr == redis.ErrNil || ttl < 0 {
+			continue
+		}
+
+		locks = append(locks, HeldLock{
+			Key:    strings.TrimPrefix(key, m.Prefix),
+			TTL:    time.Duration(ttl) * time.Millisecond,
+			Holder: parseLockHolder(value),
+		})
+	}
+
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].Key < locks[j].Key
+	})
+
+	return
+}
@@ -0,0 +1,202 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stvp/tempredis"
+)
+
+func TestLockHolder(t *testing.T) {
+
+	value, err := newLockHolder("rebuild")
+	assert.NoError(t, err, "An error was not expected")
+
+	holder := parseLockHolder([]byte(value))
+	if assert.NotNil(t, holder, "Holder should be parsed") {
+		assert.Equal(t, InstanceID, holder.Instance, "Instance should match")
+		assert.Equal(t, "rebuild", holder.Label, "Label should match")
+		assert.NotEmpty(t, holder.Token, "Token should be set")
+		assert.False(t, holder.Acquired.IsZero(), "Acquired should be set")
+	}
+
+	other, err := newLockHolder("rebuild")
+	assert.NoError(t, err, "An error was not expected")
+	assert.NotEqual(t, value, other, "Values should be unique")
+
+	assert.Nil(t, parseLockHolder([]byte("c29tZSByYW5kb20gZGF0YQ==")), "Old lock values should not have a holder")
+
+	assert.Equal(t, "thread", lockPrefix("thread:1:2:1:compute"), "Prefix should be the first segment")
+	assert.Equal(t, "test", lockPrefix("test"), "Prefix should be the key without a colon")
+
+	assert.Equal(t, "rebuild", lockLabel(WithLockLabel(context.Background(), "rebuild")), "Label should come from the context")
+	assert.Empty(t, lockLabel(context.Background()), "Label should be empty")
+}
+
+func TestLockObservability(t *testing.T) {
+
+	server, err := tempredis.Start(tempredis.Config{})
+	if err != nil {
+		panic(err)
+	}
+	defer server.Term()
+
+	config := Redis{
+		Protocol:       "unix",
+		Address:        server.Socket(),
+		MaxIdle:        1,
+		MaxConnections: 5,
+		Prefix:         "staging:",
+	}
+
+	config.NewRedisCache()
+
+	ResetLockMetrics()
+	defer ResetLockMetrics()
+
+	var events []LockEvent
+
+	Cache.Mutex.Tries = 3
+	Cache.Mutex.Delay = 10 * time.Millisecond
+	Cache.Mutex.OnSlowLock = func(event LockEvent) {
+		events = append(events, event)
+	}
+
+	ctx := WithLockLabel(context.Background(), "thread rebuild")
+
+	err = Cache.LockContext(ctx, "thread:1:2:1:compute")
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.NoError(t, Cache.TryLock("counter:{views}:flush"), "An error was not expected")
+
+	locks, err := Cache.Mutex.Held(context.Background())
+	if assert.NoError(t, err, "An error was not expected") && assert.Len(t, locks, 2, "Both locks should be listed") {
+		assert.Equal(t, "counter:{views}:flush", locks[0].Key, "Locks should be sorted without the prefix")
+		assert.Equal(t, "thread:1:2:1:compute", locks[1].Key, "Key should match")
+		assert.True(t, locks[1].TTL > 0 && locks[1].TTL <= DefaultExpiry, "TTL should be set")
+
+		if assert.NotNil(t, locks[1].Holder, "Holder should be set") {
+			assert.Equal(t, InstanceID, locks[1].Holder.Instance, "Instance should match")
+			assert.Equal(t, "thread rebuild", locks[1].Holder.Label, "Label should match")
+		}
+	}
+
+	// another caller waits on the held lock and gives up
+	err = Cache.Lock("thread:1:2:1:compute")
+	assert.Equal(t, ErrFailed, err, "Error should be failed")
+
+	if assert.Len(t, events, 1, "Failure should be passed to the hook") {
+		assert.Equal(t, "thread:1:2:1:compute", events[0].Key, "Key should match")
+		assert.Equal(t, 2, events[0].Retries, "Retries should match")
+		assert.Equal(t, ErrFailed, events[0].Err, "Error should match")
+		if assert.NotNil(t, events[0].Holder, "Holder should be looked up") {
+			assert.Equal(t, "thread rebuild", events[0].Holder.Label, "Holder should be the first caller")
+		}
+	}
+
+	assert.Equal(t, ErrFailed, Cache.TryLock("counter:{views}:flush"), "Lock should be held")
+
+	assert.True(t, Cache.Unlock("thread:1:2:1:compute"), "Lock should be unlocked")
+	assert.True(t, Cache.Unlock("counter:{views}:flush"), "Lock should be unlocked")
+
+	locks, err = Cache.Mutex.Held(context.Background())
+	assert.NoError(t, err, "An error was not expected")
+	assert.Empty(t, locks, "Unlocked locks should not be listed")
+
+	// every lock call is slow
+	Cache.Mutex.SlowThreshold = time.Nanosecond
+
+	assert.NoError(t, Cache.Lock("thread:1:2:1:compute"), "An error was not expected")
+	assert.True(t, Cache.Unlock("thread:1:2:1:compute"), "Lock should be unlocked")
+
+	if assert.Len(t, events, 2, "Slow lock should be passed to the hook") {
+		assert.NoError(t, events[1].Err, "Slow lock should have been acquired")
+		assert.Nil(t, events[1].Holder, "Lock was not held")
+	}
+
+	metrics := LockMetrics()
+
+	thread := metrics["thread"]
+	assert.Equal(t, uint64(2), thread.Acquired, "Acquired should be counted")
+	assert.Equal(t, uint64(1), thread.Failures, "Failures should be counted")
+	assert.Equal(t, uint64(2), thread.Retries, "Retries should be counted")
+	assert.Equal(t, uint64(1), thread.Slow, "Slow locks should be counted")
+	assert.Equal(t, uint64(3), thread.Wait.Count, "Waits should be measured")
+	assert.Equal(t, uint64(2), thread.Held.Count, "Hold times should be measured")
+	assert.NotZero(t, thread.Held.Mean, "Mean should be set")
+
+	counter := metrics["counter"]
+	assert.Equal(t, uint64(1), counter.Acquired, "Acquired should be counted")
+	assert.Equal(t, uint64(1), counter.Busy, "Busy should be counted")
+	assert.Equal(t, uint64(1), counter.Held.Count, "Hold times should be measured")
+
+	// a lock that expires without an unlock drops out of the list
+	Cache.Mutex.Expiry = 50 * time.Millisecond
+
+	lease, err := Cache.Mutex.Acquire("scheduler:{prune}:lease")
+	assert.NoError(t, err, "An error was not expected")
+	assert.True(t, lease.Extend(), "Lease should be extended")
+
+	locks, err = Cache.Mutex.Held(context.Background())
+	assert.NoError(t, err, "An error was not expected")
+	assert.Len(t, locks, 1, "Lease should be listed")
+
+	time.Sleep(100 * time.Millisecond)
+
+	locks, err = Cache.Mutex.Held(context.Background())
+	assert.NoError(t, err, "An error was not expected")
+	assert.Empty(t, locks, "Expired lock should not be listed")
+}
+
+func TestLockRegistryPruned(t *testing.T) {
+
+	server, err := tempredis.Start(tempredis.Config{})
+	if err != nil {
+		panic(err)
+	}
+	defer server.Term()
+
+	config := Redis{
+		Protocol:       "unix",
+		Address:        server.Socket(),
+		MaxIdle:        1,
+		MaxConnections: 5,
+	}
+
+	config.NewRedisCache()
+
+	Cache.Mutex.Expiry = 50 * time.Millisecond
+
+	assert.NoError(t, Cache.TryLock("thread:1:2:1:compute"), "An error was not expected")
+
+	conn := Cache.Pool.Get()
+	defer conn.Close()
+
+	ttl, err := redis.Int64(conn.Do("PTTL", lockRegistryKey))
+	assert.NoError(t, err, "An error was not expected")
+	assert.True(t, ttl > 0 && ttl <= 50, "Registry should expire with its locks")
+
+	time.Sleep(100 * time.Millisecond)
+
+	// the lock expired without an unlock and is pruned by the next one
+	Cache.Mutex.Expiry = time.Minute
+
+	assert.NoError(t, Cache.TryLock("index:1:mutex"), "An error was not expected")
+
+	members, err := redis.Strings(conn.Do("ZRANGE", lockRegistryKey, 0, -1))
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []string{"index:1:mutex"}, members, "Expired lock should be pruned")
+
+	ttl, err = redis.Int64(conn.Do("PTTL", lockRegistryKey))
+	assert.NoError(t, err, "An error was not expected")
+	assert.Greater(t, ttl, int64(50), "Registry should live as long as its longest lock")
+
+	assert.True(t, Cache.Unlock("index:1:mutex"), "Lock should be unlocked")
+
+	exists, err := redis.Bool(conn.Do("EXISTS", lockRegistryKey))
+	assert.NoError(t, err, "An error was not expected")
+	assert.False(t, exists, "Empty registry should be removed")
+}
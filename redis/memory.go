@@ -0,0 +1,923 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var (
+	// ErrWrongType is returned when a command is used on a key holding another kind of value
+	ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	// ErrNotSupported is returned by MemoryStore for commands it can not emulate like lua scripts
+	ErrNotSupported = errors.New("command not supported by the memory store")
+	// errNotInteger is returned by Incr when the value is not a number
+	errNotInteger = errors.New("ERR value is not an integer or out of range")
+)
+
+// sweepInterval is how many writes happen between removing expired entries
+const sweepInterval = 1024
+
+// memoryEntry holds a single key, only one of the values is set
+type memoryEntry struct {
+	value   []byte
+	hash    map[string][]byte
+	set     map[string]struct{}
+	expires time.Time
+}
+
+// MemoryStore is a thread safe Storer that keeps everything in process
+// It honors expiry, hashes, counters, tags and locks but can not run lua scripts
+type MemoryStore struct {
+	mu     sync.Mutex
+	items  map[string]*memoryEntry
+	writes int
+
+	subm sync.Mutex
+	subs map[string]map[*memorySub]struct{}
+
+	// now is the clock used for expiry
+	now func() time.Time
+}
+
+var _ = Storer(&MemoryStore{})
+
+// NewMemoryStore returns an empty in memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		items: make(map[string]*memoryEntry),
+		subs:  make(map[string]map[*memorySub]struct{}),
+		now:   time.Now,
+	}
+}
+
+// entry returns a live entry, removing it if it has expired, the lock must be held
+func (m *MemoryStore) entry(key string) *memoryEntry {
+	e, ok := m.items[key]
+	if !ok {
+		return nil
+	}
+
+	if !e.expires.IsZero() && !m.now().Before(e.expires) {
+		delete(m.items, key)
+		return nil
+	}
+
+	return e
+}
+
+// put stores an entry and occasionally sweeps expired ones, the lock must be held
+func (m *MemoryStore) put(key string, e *memoryEntry) {
+	m.items[key] = e
+
+	m.writes++
+	if m.writes%sweepInterval == 0 {
+		for k := range m.items {
+			m.entry(k)
+		}
+	}
+}
+
+// ttl converts a timeout in seconds into an expiry time
+func (m *MemoryStore) ttl(timeout uint) time.Time {
+	return m.now().Add(time.Duration(timeout) * time.Second)
+}
+
+// Lock sets a lock key, retrying like the redis mutex
+func (m *MemoryStore) Lock(key string) error {
+	return m.LockContext(context.Background(), key)
+}
+
+// LockContext sets a lock key, giving up early if the context is done
+func (m *MemoryStore) LockContext(ctx context.Context, key string) error {
+	for i := 0; i < DefaultTries; i++ {
+		if m.acquire(key) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(DefaultDelay):
+		}
+	}
+
+	return ErrFailed
+}
+
+// TryLock makes a single attempt at the lock key, returning ErrFailed if it is held
+func (m *MemoryStore) TryLock(key string) error {
+	if !m.acquire(key) {
+		return ErrFailed
+	}
+	return nil
+}
+
+// Acquire makes a single attempt at the lock key and returns a lease on it, ErrFailed if it is held
+func (m *MemoryStore) Acquire(key string) (*Lease, error) {
+	value, err := lockValue()
+	if err != nil {
+		return nil, err
+	}
+
+	if !m.acquireValue(key, value) {
+		return nil, ErrFailed
+	}
+
+	return &Lease{
+		owner:  m,
+		key:    key,
+		value:  value,
+		expiry: DefaultExpiry,
+	}, nil
+}
+
+// extend resets the expiry of a lock key if it still holds the value
+func (m *MemoryStore) extend(key, value string, expiry time.Duration) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := m.entry(key)
+	if e == nil || string(e.value) != value {
+		return false
+	}
+
+	e.expires = m.now().Add(expiry)
+
+	return true
+}
+
+// release deletes a lock key if it still holds the value
+func (m *MemoryStore) release(key, value string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := m.entry(key)
+	if e == nil || string(e.value) != value {
+		return false
+	}
+
+	delete(m.items, key)
+
+	return true
+}
+
+// acquire makes a single attempt at setting the lock key
+func (m *MemoryStore) acquire(key string) bool {
+	return m.acquireValue(key, "locked")
+}
+
+// acquireValue makes a single attempt at setting the lock key to a value
+func (m *MemoryStore) acquireValue(key, value string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.entry(key) != nil {
+		return false
+	}
+
+	m.put(key, &memoryEntry{
+		value:   []byte(value),
+		expires: m.now().Add(DefaultExpiry),
+	})
+
+	return true
+}
+
+// Unlock deletes the lock key and reports if it existed
+func (m *MemoryStore) Unlock(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.entry(key) == nil {
+		return false
+	}
+
+	delete(m.items, key)
+
+	return true
+}
+
+// Locked reports if the lock key is set
+func (m *MemoryStore) Locked(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.entry(key) != nil
+}
+
+// Get will retrieve a key
+func (m *MemoryStore) Get(key string) ([]byte, error) {
+	if key == "" {
+		return nil, errors.New("key cannot be empty")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.get(key)
+}
+
+// get reads a copy of a string key, the lock must be held
+func (m *MemoryStore) get(key string) ([]byte, error) {
+	e := m.entry(key)
+	if e == nil {
+		return nil, ErrCacheMiss
+	}
+
+	if e.value == nil {
+		return nil, ErrWrongType
+	}
+
+	// callers own the result so it can not change the stored value
+	return append([]byte{}, e.value...), nil
+}
+
+// HGet will retrieve a hash
+func (m *MemoryStore) HGet(key string, value string) ([]byte, error) {
+	if key == "" {
+		return nil, errors.New("key cannot be empty")
+	}
+
+	if value == "" {
+		return nil, errors.New("value cannot be empty")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.hget(key, value)
+}
+
+// hget reads a copy of a hash field, the lock must be held
+func (m *MemoryStore) hget(key string, value string) ([]byte, error) {
+	e := m.entry(key)
+	if e == nil {
+		return nil, ErrCacheMiss
+	}
+
+	if e.hash == nil {
+		return nil, ErrWrongType
+	}
+
+	result, ok := e.hash[value]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+
+	return append([]byte{}, result...), nil
+}
+
+// Set will set a single record
+func (m *MemoryStore) Set(key string, result []byte) (err error) {
+	if key == "" {
+		return errors.New("key cannot be empty")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.set(key, result, time.Time{})
+
+	return
+}
+
+// set stores a string key, the lock must be held
+func (m *MemoryStore) set(key string, result []byte, expires time.Time) {
+	// copy so the caller can reuse its buffer like with a real connection
+	value := append([]byte{}, result...)
+
+	m.put(key, &memoryEntry{
+		value:   value,
+		expires: expires,
+	})
+}
+
+// SetEx will set a single record with an expiration
+func (m *MemoryStore) SetEx(key string, timeout uint, result []byte) (err error) {
+	if key == "" {
+		return errors.New("key cannot be empty")
+	}
+
+	if timeout == 0 {
+		return errors.New("timeout must be greater than 0")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.set(key, result, m.ttl(timeout))
+
+	return
+}
+
+// HMSet will set a hash
+func (m *MemoryStore) HMSet(key string, value string, result []byte) (err error) {
+	if key == "" {
+		return errors.New("key cannot be empty")
+	}
+
+	if value == "" {
+		return errors.New("value cannot be empty")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.hmset(key, value, result)
+}
+
+// hmset stores a hash field, the lock must be held
+func (m *MemoryStore) hmset(key string, value string, result []byte) error {
+	e := m.entry(key)
+	if e == nil {
+		e = &memoryEntry{hash: make(map[string][]byte)}
+		m.put(key, e)
+	}
+
+	if e.hash == nil {
+		return ErrWrongType
+	}
+
+	e.hash[value] = append([]byte{}, result...)
+
+	return nil
+}
+
+// Delete will delete a key
+func (m *MemoryStore) Delete(key ...interface{}) (err error) {
+	if len(key) == 0 {
+		return errors.New("at least one key must be provided")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, k := range key {
+		delete(m.items, fmt.Sprint(k))
+	}
+
+	return
+}
+
+// Flush will delete the keys of all the registered bases
+func (m *MemoryStore) Flush() (err error) {
+	_, err = m.FlushScope(context.Background(), FlushOptions{})
+	return
+}
+
+// FlushScope deletes the keys belonging to the registered bases, or a prefix, leaving locks alone
+func (m *MemoryStore) FlushScope(ctx context.Context, opts FlushOptions) (progress FlushProgress, err error) {
+
+	keys, patterns := flushScope(opts)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range keys {
+		progress.Scanned++
+		if m.entry(key) != nil {
+			delete(m.items, key)
+			progress.Deleted++
+		}
+	}
+
+	if len(keys) > 0 && opts.Progress != nil {
+		opts.Progress(progress)
+	}
+
+	for _, pattern := range patterns {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		progress.Pattern = pattern
+
+		for key := range m.items {
+			if !globMatch(pattern, key) {
+				continue
+			}
+
+			progress.Scanned++
+
+			if isLockKey(key) {
+				continue
+			}
+
+			if m.entry(key) != nil {
+				delete(m.items, key)
+				progress.Deleted++
+			}
+		}
+
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+	}
+
+	return
+}
+
+// Incr will increment a key
+func (m *MemoryStore) Incr(key string) (result int, err error) {
+	if key == "" {
+		return 0, errors.New("key cannot be empty")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := m.entry(key)
+	if e == nil {
+		e = &memoryEntry{value: []byte("0")}
+		m.put(key, e)
+	}
+
+	if e.value == nil {
+		return 0, ErrWrongType
+	}
+
+	result, err = strconv.Atoi(string(e.value))
+	if err != nil {
+		return 0, errNotInteger
+	}
+
+	result++
+
+	e.value = []byte(strconv.Itoa(result))
+
+	return
+}
+
+// HIncrBy will add delta to a hash field
+func (m *MemoryStore) HIncrBy(key string, value string, delta int) (result int, err error) {
+	if key == "" {
+		return 0, errors.New("key cannot be empty")
+	}
+
+	if value == "" {
+		return 0, errors.New("hash field cannot be empty")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := m.entry(key)
+	if e == nil {
+		e = &memoryEntry{hash: make(map[string][]byte)}
+		m.put(key, e)
+	}
+
+	if e.hash == nil {
+		return 0, ErrWrongType
+	}
+
+	current, ok := e.hash[value]
+	if ok {
+		result, err = strconv.Atoi(string(current))
+		if err != nil {
+			return 0, errNotInteger
+		}
+	}
+
+	result += delta
+
+	e.hash[value] = []byte(strconv.Itoa(result))
+
+	return
+}
+
+// Expire will set expire on a key
+func (m *MemoryStore) Expire(key string, timeout uint) (err error) {
+	if key == "" {
+		return errors.New("key cannot be empty")
+	}
+
+	if timeout == 0 {
+		return errors.New("timeout must be greater than 0")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := m.entry(key)
+	if e != nil {
+		e.expires = m.ttl(timeout)
+	}
+
+	return
+}
+
+// MGet will retrieve multiple keys
+func (m *MemoryStore) MGet(keys ...string) (results []Result, err error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one key must be provided")
+	}
+
+	for _, key := range keys {
+		if key == "" {
+			return nil, errors.New("key cannot be empty")
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results = make([]Result, len(keys))
+
+	for i, key := range keys {
+		value, err := m.get(key)
+		if err == ErrWrongType {
+			// MGET returns nil for keys of another type
+			err = ErrCacheMiss
+		}
+		results[i] = Result{Value: value, Err: err}
+	}
+
+	return
+}
+
+// HMGet will retrieve multiple fields from a hash
+func (m *MemoryStore) HMGet(key string, values ...string) (results []Result, err error) {
+	if key == "" {
+		return nil, errors.New("key cannot be empty")
+	}
+
+	if len(values) == 0 {
+		return nil, errors.New("at least one value must be provided")
+	}
+
+	for _, value := range values {
+		if value == "" {
+			return nil, errors.New("value cannot be empty")
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := m.entry(key)
+	if e != nil && e.hash == nil {
+		return nil, ErrWrongType
+	}
+
+	results = make([]Result, len(values))
+
+	for i, value := range values {
+		result, err := m.hget(key, value)
+		results[i] = Result{Value: result, Err: err}
+	}
+
+	return
+}
+
+// HGetAll will retrieve every field in a hash, a missing hash is a cache miss
+func (m *MemoryStore) HGetAll(key string) (result map[string][]byte, err error) {
+	if key == "" {
+		return nil, errors.New("key cannot be empty")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := m.entry(key)
+	if e == nil {
+		return nil, ErrCacheMiss
+	}
+
+	if e.hash == nil {
+		return nil, ErrWrongType
+	}
+
+	result = make(map[string][]byte, len(e.hash))
+
+	for field, value := range e.hash {
+		result[field] = append([]byte{}, value...)
+	}
+
+	return
+}
+
+// MSet will atomically set multiple records, each with its own expiry
+func (m *MemoryStore) MSet(items ...Item) (err error) {
+	if len(items) == 0 {
+		return errors.New("at least one item must be provided")
+	}
+
+	for _, item := range items {
+		if item.Key == "" {
+			return errors.New("key cannot be empty")
+		}
+		if item.TTL < 0 || (item.TTL > 0 && item.TTL < time.Millisecond) {
+			return errors.New("ttl must be zero or at least one millisecond")
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, item := range items {
+		var expires time.Time
+		if item.TTL > 0 {
+			expires = m.now().Add(item.TTL)
+		}
+
+		m.set(item.Key, item.Value, expires)
+	}
+
+	return
+}
+
+// Pipeline will run all the commands queued by fn while holding the store lock
+func (m *MemoryStore) Pipeline(fn func(p Pipeliner)) (results []Result, err error) {
+	if fn == nil {
+		return nil, errors.New("pipeline function cannot be nil")
+	}
+
+	p := &pipeline{}
+
+	fn(p)
+
+	if len(p.cmds) == 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results = make([]Result, len(p.cmds))
+
+	for i, cmd := range p.cmds {
+		if cmd.err != nil {
+			results[i].Err = cmd.err
+			continue
+		}
+
+		results[i] = m.run(cmd)
+	}
+
+	return
+}
+
+// run executes a queued pipeline command, the lock must be held
+func (m *MemoryStore) run(cmd pipelineCmd) (result Result) {
+	key := fmt.Sprint(cmd.args[0])
+
+	switch cmd.name {
+	case "GET":
+		result.Value, result.Err = m.get(key)
+	case "HGET":
+		result.Value, result.Err = m.hget(key, fmt.Sprint(cmd.args[1]))
+	case "SET":
+		m.set(key, cmd.args[1].([]byte), time.Time{})
+	case "SETEX":
+		m.set(key, cmd.args[2].([]byte), m.ttl(cmd.args[1].(uint)))
+	case "HMSET":
+		result.Err = m.hmset(key, fmt.Sprint(cmd.args[1]), cmd.args[2].([]byte))
+	case "DEL":
+		for _, k := range cmd.keys {
+			delete(m.items, k)
+		}
+	case "EXPIRE":
+		e := m.entry(key)
+		if e != nil {
+			e.expires = m.ttl(cmd.args[1].(uint))
+		}
+	default:
+		result.Err = ErrNotSupported
+	}
+
+	return
+}
+
+// AddTags will add a key to the sets of the given tags
+func (m *MemoryStore) AddTags(key string, tags ...string) (err error) {
+	if key == "" {
+		return errors.New("key cannot be empty")
+	}
+
+	if len(tags) == 0 {
+		return errors.New("at least one tag must be provided")
+	}
+
+	for _, tag := range tags {
+		if tag == "" {
+			return errors.New("tag cannot be empty")
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// the sets have to outlive the key so it can still be invalidated
+	expires := m.now()
+	if k := m.entry(key); k != nil {
+		expires = k.expires
+	}
+
+	for _, tag := range tags {
+		e := m.entry(tagKey(tag))
+		if e == nil {
+			e = &memoryEntry{set: make(map[string]struct{}), expires: expires}
+			m.put(tagKey(tag), e)
+		}
+
+		if e.set == nil {
+			return ErrWrongType
+		}
+
+		e.set[key] = struct{}{}
+
+		if expires.IsZero() || (!e.expires.IsZero() && e.expires.Before(expires)) {
+			e.expires = expires
+		}
+	}
+
+	return
+}
+
+// InvalidateTags will delete every key carrying one of the tags
+// It returns the number of keys that were deleted
+func (m *MemoryStore) InvalidateTags(tags ...string) (deleted int, err error) {
+	if len(tags) == 0 {
+		return 0, errors.New("at least one tag must be provided")
+	}
+
+	for _, tag := range tags {
+		if tag == "" {
+			return 0, errors.New("tag cannot be empty")
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, tag := range tags {
+		e := m.entry(tagKey(tag))
+		if e == nil || e.set == nil {
+			continue
+		}
+
+		for key := range e.set {
+			if m.entry(key) != nil {
+				delete(m.items, key)
+				deleted++
+			}
+		}
+
+		delete(m.items, tagKey(tag))
+	}
+
+	return
+}
+
+// Eval is not supported since there is no lua interpreter
+func (m *MemoryStore) Eval(script *redis.Script, keys []string, args ...interface{}) (reply interface{}, err error) {
+	return nil, ErrNotSupported
+}
+
+// Ping always succeeds since the store is in process
+func (m *MemoryStore) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// memorySub is a Subscribe on the memory store
+type memorySub struct {
+	mu     sync.Mutex
+	closed bool
+	out    chan Message
+}
+
+// deliver sends a message unless the subscription has ended
+// A subscriber that is not keeping up loses the message so it can not block the publisher.
+func (s *memorySub) deliver(msg Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	select {
+	case s.out <- msg:
+	default:
+	}
+}
+
+// Publish sends a payload wrapped in an event envelope to every subscriber of the channel
+func (m *MemoryStore) Publish(ctx context.Context, channel string, payload interface{}) (err error) {
+	if channel == "" {
+		return errors.New("channel cannot be empty")
+	}
+
+	data, err := encodeEvent(channel, payload)
+	if err != nil {
+		return
+	}
+
+	// go through the same decoding as a message from redis
+	msg, err := decodeEvent(channel, data)
+	if err != nil {
+		return
+	}
+
+	m.subm.Lock()
+	subs := make([]*memorySub, 0, len(m.subs[channel]))
+	for sub := range m.subs[channel] {
+		subs = append(subs, sub)
+	}
+	m.subm.Unlock()
+
+	for _, sub := range subs {
+		sub.deliver(msg)
+	}
+
+	return
+}
+
+// Subscribe listens on the channels until the context is done, which closes the returned channel
+func (m *MemoryStore) Subscribe(ctx context.Context, channels ...string) (<-chan Message, error) {
+	err := validateChannels(channels)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := &memorySub{
+		out: make(chan Message, DefaultSubscribeBuffer),
+	}
+
+	m.subm.Lock()
+	for _, channel := range channels {
+		if m.subs[channel] == nil {
+			m.subs[channel] = make(map[*memorySub]struct{})
+		}
+		m.subs[channel][sub] = struct{}{}
+	}
+	m.subm.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		m.subm.Lock()
+		for _, channel := range channels {
+			delete(m.subs[channel], sub)
+			if len(m.subs[channel]) == 0 {
+				delete(m.subs, channel)
+			}
+		}
+		m.subm.Unlock()
+
+		sub.mu.Lock()
+		defer sub.mu.Unlock()
+
+		sub.closed = true
+		close(sub.out)
+	}()
+
+	return sub.out, nil
+}
+
+// globMatch reports if a key matches a SCAN style pattern with * ? and \ escapes
+func globMatch(pattern, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			// collapse repeated stars and try every split
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if globMatch(pattern, key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(key) == 0 || key[0] != pattern[0] {
+				return false
+			}
+		}
+
+		pattern = pattern[1:]
+		key = key[1:]
+	}
+
+	return len(key) == 0
+}
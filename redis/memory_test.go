@@ -0,0 +1,417 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestMemoryCache uses a memory cache with a clock that can be moved forward
+func newTestMemoryCache(t *testing.T) (*MemoryStore, func(time.Duration)) {
+	memory := NewMemoryCache()
+
+	t.Cleanup(func() {
+		setActive(&Cache)
+	})
+
+	current := time.Now()
+
+	memory.now = func() time.Time {
+		return current
+	}
+
+	return memory, func(d time.Duration) {
+		current = current.Add(d)
+	}
+}
+
+func TestNewMemoryCache(t *testing.T) {
+
+	memory, _ := newTestMemoryCache(t)
+
+	assert.Equal(t, Storer(memory), Active(), "Keys should use the memory store")
+	assert.True(t, isCacheInitialized(), "Cache should be initialized")
+	assert.NoError(t, Ping(context.Background()), "Memory store should always answer")
+
+	NewRedisMock()
+
+	assert.Equal(t, Storer(&Cache), Active(), "Keys should use the redis store")
+}
+
+func TestMemoryKeys(t *testing.T) {
+
+	memory, advance := newTestMemoryCache(t)
+
+	// hash keys
+	key := NewKey("thread").SetKey("1", "2", "3")
+
+	_, err := key.Get()
+	assert.Equal(t, ErrCacheMiss, err, "Error should be cache miss")
+
+	err = key.Set([]byte("thread data"))
+	assert.NoError(t, err, "An error was not expected")
+
+	result, err := key.Get()
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("thread data"), result, "Data should match")
+
+	hash, err := memory.HGetAll("thread:1:2")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, map[string][]byte{"3": []byte("thread data")}, hash, "Hash should match")
+
+	err = key.Delete()
+	assert.NoError(t, err, "An error was not expected")
+
+	_, err = key.Get()
+	assert.Equal(t, ErrCacheMiss, err, "Error should be cache miss")
+
+	// expiring keys
+	popular := NewKey("popular").SetKey("1")
+
+	err = popular.Set([]byte("popular data"))
+	assert.NoError(t, err, "An error was not expected")
+
+	advance(DefaultKeyTTL - time.Second)
+
+	_, err = popular.Get()
+	assert.NoError(t, err, "Key should not have expired")
+
+	advance(time.Second)
+
+	_, err = popular.Get()
+	assert.Equal(t, ErrCacheMiss, err, "Key should have expired")
+}
+
+func TestMemoryKeyLock(t *testing.T) {
+
+	memory, _ := newTestMemoryCache(t)
+
+	key := NewKey("index").SetKey("1", "1")
+
+	err := key.Delete()
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.False(t, memory.acquire("index:1:mutex"), "Key should be locked after delete")
+
+	err = key.Set([]byte("index data"))
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.True(t, memory.acquire("index:1:mutex"), "Key should be unlocked after set")
+	assert.True(t, memory.Unlock("index:1:mutex"), "Lock should be released")
+	assert.False(t, memory.Unlock("index:1:mutex"), "Lock should not exist")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.NoError(t, memory.Lock("held"), "An error was not expected")
+	assert.Equal(t, context.Canceled, memory.LockContext(ctx, "held"), "Error should be context cancelled")
+	assert.Equal(t, ErrFailed, memory.TryLock("held"), "Error should be failed while the lock is held")
+	assert.NoError(t, memory.TryLock("free"), "An error was not expected")
+}
+
+func TestMemoryLease(t *testing.T) {
+
+	memory, advance := newTestMemoryCache(t)
+
+	lease, err := memory.Acquire("job:lease")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, DefaultExpiry, lease.Expiry(), "Expiry should be the default")
+
+	_, err = memory.Acquire("job:lease")
+	assert.Equal(t, ErrFailed, err, "Error should be failed while the lease is held")
+
+	// extending keeps the lock past its first expiry
+	advance(DefaultExpiry / 2)
+	assert.True(t, lease.Extend(), "Lease should be extended")
+	advance(DefaultExpiry / 2)
+	assert.True(t, memory.Locked("job:lease"), "Lock should still be held")
+
+	assert.True(t, lease.Release(), "Lease should be released")
+	assert.False(t, lease.Release(), "Lease should only be released once")
+
+	// a lease that expired can not touch the new holder's lock
+	lease, err = memory.Acquire("job:lease")
+	assert.NoError(t, err, "An error was not expected")
+
+	advance(DefaultExpiry)
+
+	assert.NoError(t, memory.TryLock("job:lease"), "Lock should have expired")
+	assert.False(t, lease.Extend(), "Lost lease should not be extended")
+	assert.False(t, lease.Release(), "Lost lease should not be released")
+	assert.True(t, memory.Locked("job:lease"), "Lock should belong to the new holder")
+}
+
+func TestMemoryGetOrCompute(t *testing.T) {
+
+	newTestMemoryCache(t)
+
+	key := NewKey("tags").SetKey("1", "1")
+
+	calls := 0
+
+	for i := 0; i < 2; i++ {
+		result, err := key.GetOrCompute(context.Background(), func() ([]byte, error) {
+			calls++
+			return []byte("computed"), nil
+		})
+		assert.NoError(t, err, "An error was not expected")
+		assert.Equal(t, []byte("computed"), result, "Data should match")
+	}
+
+	assert.Equal(t, 1, calls, "Data should only be computed once")
+}
+
+func TestMemoryMethods(t *testing.T) {
+
+	memory, advance := newTestMemoryCache(t)
+
+	err := memory.SetEx("short", 1, []byte("data"))
+	assert.NoError(t, err, "An error was not expected")
+
+	_, err = memory.Get("short")
+	assert.NoError(t, err, "An error was not expected")
+
+	advance(time.Second)
+
+	_, err = memory.Get("short")
+	assert.Equal(t, ErrCacheMiss, err, "Key should have expired")
+
+	// counters
+	for i := 1; i <= 3; i++ {
+		count, err := memory.Incr("counter")
+		assert.NoError(t, err, "An error was not expected")
+		assert.Equal(t, i, count, "Count should match")
+	}
+
+	err = memory.Expire("counter", 10)
+	assert.NoError(t, err, "An error was not expected")
+
+	advance(10 * time.Second)
+
+	count, err := memory.Incr("counter")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 1, count, "Counter should have expired")
+
+	err = memory.Set("text", []byte("hello"))
+	assert.NoError(t, err, "An error was not expected")
+
+	_, err = memory.Incr("text")
+	assert.Error(t, err, "An error was expected for non integer")
+
+	// hash counters
+	count, err = memory.HIncrBy("views", "1", 2)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 2, count, "Count should match")
+
+	count, err = memory.HIncrBy("views", "1", -1)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 1, count, "Count should match")
+
+	_, err = memory.HIncrBy("text", "1", 1)
+	assert.Equal(t, ErrWrongType, err, "Error should be wrong type")
+
+	// wrong types
+	_, err = memory.HGet("text", "1")
+	assert.Equal(t, ErrWrongType, err, "Error should be wrong type")
+
+	err = memory.HMSet("text", "1", []byte("data"))
+	assert.Equal(t, ErrWrongType, err, "Error should be wrong type")
+
+	// batches
+	err = memory.MSet(Item{Key: "a", Value: []byte("1")}, Item{Key: "b", Value: []byte("2"), TTL: time.Minute})
+	assert.NoError(t, err, "An error was not expected")
+
+	results, err := memory.MGet("a", "b", "missing")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []Result{{Value: []byte("1")}, {Value: []byte("2")}, {Err: ErrCacheMiss}}, results, "Results should match")
+
+	err = memory.HMSet("hash", "1", []byte("one"))
+	assert.NoError(t, err, "An error was not expected")
+
+	results, err = memory.HMGet("hash", "1", "2")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []Result{{Value: []byte("one")}, {Err: ErrCacheMiss}}, results, "Results should match")
+
+	results, err = memory.Pipeline(func(p Pipeliner) {
+		p.Set("c", []byte("3"))
+		p.Get("c")
+		p.HGet("hash", "1")
+		p.Delete("a")
+		p.Get("a")
+		p.Get("")
+	})
+	assert.NoError(t, err, "An error was not expected")
+	if assert.Len(t, results, 6, "Results should match the commands") {
+		assert.Equal(t, []byte("3"), results[1].Value, "Value should match")
+		assert.Equal(t, []byte("one"), results[2].Value, "Value should match")
+		assert.Equal(t, ErrCacheMiss, results[4].Err, "Key should be deleted")
+		assert.Error(t, results[5].Err, "An error was expected for empty key")
+	}
+
+	_, err = memory.Eval(nil, nil)
+	assert.Equal(t, ErrNotSupported, err, "Error should be not supported")
+}
+
+func TestMemoryTags(t *testing.T) {
+
+	memory, advance := newTestMemoryCache(t)
+
+	err := NewKey("thread").SetKey("3", "1234", "1").Tags(IbTag("3"), ThreadTag("3", "1234")).Set([]byte("data"))
+	assert.NoError(t, err, "An error was not expected")
+
+	err = NewKey("index").SetKey("3", "1").Tags(IbTag("3")).Set([]byte("data"))
+	assert.NoError(t, err, "An error was not expected")
+
+	deleted, err := InvalidateTags(IbTag("3"))
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 2, deleted, "Tagged keys should be deleted")
+
+	_, err = memory.Get(tagKey(IbTag("3")))
+	assert.Equal(t, ErrCacheMiss, err, "Tag set should be deleted")
+
+	// tag sets expire with their keys
+	err = NewKey("new").SetKey("4").Tags(IbTag("4")).Set([]byte("data"))
+	assert.NoError(t, err, "An error was not expected")
+
+	err = NewKey("index").SetKey("5", "1").Tags(IbTag("5")).Set([]byte("data"))
+	assert.NoError(t, err, "An error was not expected")
+
+	advance(DefaultKeyTTL)
+
+	memory.mu.Lock()
+	expired, kept := memory.entry(tagKey(IbTag("4"))), memory.entry(tagKey(IbTag("5")))
+	memory.mu.Unlock()
+
+	assert.Nil(t, expired, "Tag set should expire with its key")
+	assert.NotNil(t, kept, "Tag set with a key that never expires should be kept")
+}
+
+func TestMemoryFlush(t *testing.T) {
+
+	memory, _ := newTestMemoryCache(t)
+
+	for _, key := range []string{"index:3", "thread:3:1", "thread:4:1", "tagtypes", "index:3:mutex", "login:1"} {
+		assert.NoError(t, memory.Set(key, []byte("data")), "An error was not expected")
+	}
+
+	progress, err := memory.FlushScope(context.Background(), FlushOptions{Ib: "3"})
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 2, progress.Deleted, "Only the imageboard keys should be deleted")
+
+	err = memory.Flush()
+	assert.NoError(t, err, "An error was not expected")
+
+	for key, exists := range map[string]bool{"thread:4:1": false, "tagtypes": false, "index:3:mutex": true, "login:1": true} {
+		_, err := memory.Get(key)
+		assert.Equal(t, exists, err == nil, "Key existence should match for "+key)
+	}
+}
+
+func TestMemoryConcurrent(t *testing.T) {
+
+	memory, _ := newTestMemoryCache(t)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, _ = memory.Incr("counter")
+				_ = memory.HMSet("hash", fmt.Sprint(i), []byte("data"))
+				_, _ = memory.HGetAll("hash")
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	count, err := memory.Incr("counter")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 1001, count, "Every increment should be counted")
+}
+
+func TestMemoryCopies(t *testing.T) {
+
+	memory, _ := newTestMemoryCache(t)
+
+	err := memory.Set("text", []byte("hello"))
+	assert.NoError(t, err, "An error was not expected")
+
+	err = memory.HMSet("hash", "1", []byte("hello"))
+	assert.NoError(t, err, "An error was not expected")
+
+	result, err := memory.Get("text")
+	assert.NoError(t, err, "An error was not expected")
+	result[0] = 'j'
+
+	field, err := memory.HGet("hash", "1")
+	assert.NoError(t, err, "An error was not expected")
+	field[0] = 'j'
+
+	all, err := memory.HGetAll("hash")
+	assert.NoError(t, err, "An error was not expected")
+	all["1"][0] = 'j'
+
+	result, err = memory.Get("text")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("hello"), result, "Stored value should not change")
+
+	all, err = memory.HGetAll("hash")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("hello"), all["1"], "Stored field should not change")
+}
+
+func TestMemoryPublishSlowSubscriber(t *testing.T) {
+
+	memory, _ := newTestMemoryCache(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages, err := memory.Subscribe(ctx, "threads")
+	assert.NoError(t, err, "An error was not expected")
+
+	// nobody reads so the buffer fills up and the rest are dropped
+	for i := 0; i < DefaultSubscribeBuffer+10; i++ {
+		err = memory.Publish(context.Background(), "threads", i)
+		assert.NoError(t, err, "An error was not expected")
+	}
+
+	assert.Equal(t, DefaultSubscribeBuffer, len(messages), "Only a full buffer should be kept")
+}
+
+func TestMemoryEvalNotSupported(t *testing.T) {
+
+	memory, _ := newTestMemoryCache(t)
+
+	_, err := memory.Eval(semaphoreAcquireScript, []string{"semaphore"}, 1, "token", 1000)
+	assert.ErrorIs(t, err, ErrNotSupported, "Error should be not supported")
+}
+
+func TestGlobMatch(t *testing.T) {
+
+	tests := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"index:*", "index:1", true},
+		{"index:*", "indexes:1", false},
+		{"thread:3:*", "thread:3:1234", true},
+		{"thread:3:*", "thread:31:1234", false},
+		{`app\[1\]:*`, "app[1]:index:1", true},
+		{"new:?", "new:1", true},
+		{"new:?", "new:12", false},
+		{"*:mutex", "index:1:mutex", true},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.match, globMatch(tt.pattern, tt.key), "Match should be correct for "+tt.pattern+" "+tt.key)
+	}
+}
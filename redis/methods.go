@@ -1,7 +1,9 @@
 package redis
 
 import (
+	"context"
 	"errors"
+	"fmt"
 
 	"github.com/gomodule/redigo/redis"
 )
@@ -9,7 +11,11 @@ import (
 // Storer defines custom methods for redis operations
 type Storer interface {
 	Lock(key string) error
+	LockContext(ctx context.Context, key string) error
+	TryLock(key string) error
+	Acquire(key string) (*Lease, error)
 	Unlock(key string) bool
+	Locked(key string) bool
 	Get(key string) (result []byte, err error)
 	HGet(key string, value string) (result []byte, err error)
 	Set(key string, result []byte) (err error)
@@ -17,22 +23,106 @@ type Storer interface {
 	HMSet(key string, value string, result []byte) (err error)
 	Delete(key ...interface{}) (err error)
 	Flush() (err error)
+	FlushScope(ctx context.Context, opts FlushOptions) (progress FlushProgress, err error)
 	Incr(key string) (result int, err error)
+	HIncrBy(key string, value string, delta int) (result int, err error)
 	Expire(key string, timeout uint) (err error)
+	MGet(keys ...string) (results []Result, err error)
+	HMGet(key string, values ...string) (results []Result, err error)
+	HGetAll(key string) (result map[string][]byte, err error)
+	MSet(items ...Item) (err error)
+	Pipeline(fn func(p Pipeliner)) (results []Result, err error)
+	AddTags(key string, tags ...string) (err error)
+	InvalidateTags(tags ...string) (deleted int, err error)
+	Eval(script *redis.Script, keys []string, args ...interface{}) (reply interface{}, err error)
+	Publish(ctx context.Context, channel string, payload interface{}) (err error)
+	Subscribe(ctx context.Context, channels ...string) (<-chan Message, error)
+	Ping(ctx context.Context) (err error)
 }
 
 var _ = Storer(&Store{})
 
+// Ping checks that the active store answers, for health checks
+func Ping(ctx context.Context) error {
+	return Active().Ping(ctx)
+}
+
+// Ping checks that redis answers
+// It goes around the breaker so a health check sees the real state of the server.
+func (c *Store) Ping(ctx context.Context) (err error) {
+	if !isCacheInitialized() {
+		return ErrCacheNotInitialized
+	}
+
+	conn := c.Pool.Get()
+	defer conn.Close()
+
+	reply, err := redis.String(redis.DoContext(conn, ctx, "PING"))
+	if err != nil {
+		return
+	}
+
+	if reply != "PONG" {
+		return fmt.Errorf("unexpected ping reply: %s", reply)
+	}
+
+	return nil
+}
+
 // Lock our shared mutex
 func (c *Store) Lock(key string) error {
-	return c.Mutex.Lock(key)
+	return c.LockContext(context.Background(), key)
+}
+
+// LockContext locks our shared mutex, giving up early if the context is done
+// While the breaker is open there is no lock to hold so it returns ErrCircuitOpen, callers decide if they can go on
+// without it
+func (c *Store) LockContext(ctx context.Context, key string) error {
+	if c.degraded() {
+		c.skip("LOCK", key)
+		return ErrCircuitOpen
+	}
+
+	return c.Mutex.LockContext(ctx, key)
+}
+
+// TryLock makes a single attempt at our shared mutex, returning ErrFailed if it is held
+// While the breaker is open it returns ErrCircuitOpen
+func (c *Store) TryLock(key string) error {
+	if c.degraded() {
+		c.skip("LOCK", key)
+		return ErrCircuitOpen
+	}
+
+	return c.Mutex.TryLock(key)
+}
+
+// Acquire makes a single attempt at our shared mutex and returns a lease on it, ErrFailed if it is held
+// While the breaker is open there is no lock to hold so it returns ErrCircuitOpen
+func (c *Store) Acquire(key string) (*Lease, error) {
+	if c.degraded() {
+		c.skip("LOCK", key)
+		return nil, ErrCircuitOpen
+	}
+
+	return c.Mutex.Acquire(key)
 }
 
 // Unlock our shared mutex
+// It is tried even while the breaker is open so a lock taken just before it opened is not left to expire
 func (c *Store) Unlock(key string) bool {
 	return c.Mutex.Unlock(key)
 }
 
+// Locked reports if our shared mutex is held
+func (c *Store) Locked(key string) bool {
+	if c.degraded() {
+		return false
+	}
+
+	return c.Mutex.Locked(key)
+}
+
 // Get will retrieve a key
 func (c *Store) Get(key string) ([]byte, error) {
 	if key == "" {
@@ -43,13 +133,29 @@ func (c *Store) Get(key string) ([]byte, error) {
 		return nil, ErrCacheNotInitialized
 	}
 
+	key = c.prefixed(key)
+
+	result, gen, ok := c.localGet(key, "")
+	if ok {
+		return result, nil
+	}
+
+	// fall through to the database while redis is down
+	if !c.allow() {
+		return nil, ErrCacheMiss
+	}
+
 	conn := c.Pool.Get()
 	defer conn.Close()
 
 	result, err := redis.Bytes(conn.Do("GET", key))
+	c.report(err)
 	if err == redis.ErrNil {
-		return nil, ErrCacheMiss
+		err = ErrCacheMiss
 	}
+
+	c.redisResult(key, "", gen, result, err)
+
 	if err != nil {
 		return nil, err
 	}
@@ -71,13 +177,29 @@ func (c *Store) HGet(key string, value string) ([]byte, error) {
 		return nil, ErrCacheNotInitialized
 	}
 
+	key = c.prefixed(key)
+
+	result, gen, ok := c.localGet(key, value)
+	if ok {
+		return result, nil
+	}
+
+	// fall through to the database while redis is down
+	if !c.allow() {
+		return nil, ErrCacheMiss
+	}
+
 	conn := c.Pool.Get()
 	defer conn.Close()
 
 	result, err := redis.Bytes(conn.Do("HGET", key, value))
+	c.report(err)
 	if err == redis.ErrNil {
-		return nil, ErrCacheMiss
+		err = ErrCacheMiss
 	}
+
+	c.redisResult(key, value, gen, result, err)
+
 	if err != nil {
 		return nil, err
 	}
@@ -95,10 +217,23 @@ func (c *Store) Set(key string, result []byte) (err error) {
 		return ErrCacheNotInitialized
 	}
 
+	key = c.prefixed(key)
+
+	if !c.allow() {
+		c.skip("SET", key)
+		return
+	}
+
 	conn := c.Pool.Get()
 	defer conn.Close()
 
 	_, err = conn.Do("SET", key, result)
+	c.report(err)
+	if err != nil {
+		return
+	}
+
+	c.invalidate(conn, key)
 
 	return
 }
@@ -117,10 +252,23 @@ func (c *Store) SetEx(key string, timeout uint, result []byte) (err error) {
 		return ErrCacheNotInitialized
 	}
 
+	key = c.prefixed(key)
+
+	if !c.allow() {
+		c.skip("SETEX", key)
+		return
+	}
+
 	conn := c.Pool.Get()
 	defer conn.Close()
 
 	_, err = conn.Do("SETEX", key, timeout, result)
+	c.report(err)
+	if err != nil {
+		return
+	}
+
+	c.invalidate(conn, key)
 
 	return
 }
@@ -139,10 +287,23 @@ func (c *Store) HMSet(key string, value string, result []byte) (err error) {
 		return ErrCacheNotInitialized
 	}
 
+	key = c.prefixed(key)
+
+	if !c.allow() {
+		c.skip("HMSET", key)
+		return
+	}
+
 	conn := c.Pool.Get()
 	defer conn.Close()
 
 	_, err = conn.Do("HMSET", key, value, result)
+	c.report(err)
+	if err != nil {
+		return
+	}
+
+	c.invalidate(conn, key)
 
 	return
 }
@@ -157,43 +318,101 @@ func (c *Store) Delete(key ...interface{}) (err error) {
 		return ErrCacheNotInitialized
 	}
 
+	keys := make([]string, len(key))
+	args := make([]interface{}, len(key))
+	for i, k := range key {
+		keys[i] = c.prefixed(fmt.Sprint(k))
+		args[i] = keys[i]
+	}
+
+	if !c.allow() {
+		c.skip("DEL", keys...)
+		return
+	}
+
 	conn := c.Pool.Get()
 	defer conn.Close()
 
-	_, err = conn.Do("DEL", key...)
+	_, err = conn.Do("DEL", args...)
+	c.report(err)
+	if err != nil {
+		return
+	}
+
+	c.invalidate(conn, keys...)
 
 	return
 }
 
-// Flush will call flushall and delete all keys
+// Flush will delete the keys of all the registered bases
+// Other data sharing the redis server is left alone, see FlushScope
 func (c *Store) Flush() (err error) {
+	_, err = c.FlushScope(context.Background(), FlushOptions{})
+	return
+}
+
+// Incr will increment a redis key
+func (c *Store) Incr(key string) (result int, err error) {
+	if key == "" {
+		return 0, errors.New("key cannot be empty")
+	}
 
 	if !isCacheInitialized() {
-		return ErrCacheNotInitialized
+		return 0, ErrCacheNotInitialized
+	}
+
+	key = c.prefixed(key)
+
+	if !c.allow() {
+		return 0, ErrCircuitOpen
 	}
 
 	conn := c.Pool.Get()
 	defer conn.Close()
 
-	_, err = conn.Do("FLUSHALL")
+	result, err = redis.Int(conn.Do("INCR", key))
+	c.report(err)
+	if err != nil {
+		return
+	}
+
+	c.invalidate(conn, key)
 
 	return
 }
 
-// Incr will increment a redis key
-func (c *Store) Incr(key string) (result int, err error) {
+// HIncrBy will add delta to a hash field
+func (c *Store) HIncrBy(key string, value string, delta int) (result int, err error) {
 	if key == "" {
 		return 0, errors.New("key cannot be empty")
 	}
 
+	if value == "" {
+		return 0, errors.New("hash field cannot be empty")
+	}
+
 	if !isCacheInitialized() {
 		return 0, ErrCacheNotInitialized
 	}
 
+	key = c.prefixed(key)
+
+	if !c.allow() {
+		return 0, ErrCircuitOpen
+	}
+
 	conn := c.Pool.Get()
 	defer conn.Close()
 
-	return redis.Int(conn.Do("INCR", key))
+	result, err = redis.Int(conn.Do("HINCRBY", key, value, delta))
+	c.report(err)
+	if err != nil {
+		return
+	}
+
+	c.invalidate(conn, key)
+
+	return
 }
 
 // Expire will set expire on a redis key
@@ -210,10 +429,52 @@ func (c *Store) Expire(key string, timeout uint) (err error) {
 		return ErrCacheNotInitialized
 	}
 
+	key = c.prefixed(key)
+
+	if !c.allow() {
+		c.skip("EXPIRE", key)
+		return
+	}
+
 	conn := c.Pool.Get()
 	defer conn.Close()
 
 	_, err = conn.Do("EXPIRE", key, timeout)
+	c.report(err)
+
+	return
+}
+
+// Eval will run a lua script with the store prefix added to its keys
+func (c *Store) Eval(script *redis.Script, keys []string, args ...interface{}) (reply interface{}, err error) {
+	if script == nil {
+		return nil, errors.New("script cannot be nil")
+	}
+
+	if !isCacheInitialized() {
+		return nil, ErrCacheNotInitialized
+	}
+
+	params := make([]interface{}, 0, len(keys)+len(args))
+
+	for _, key := range keys {
+		if key == "" {
+			return nil, errors.New("key cannot be empty")
+		}
+		params = append(params, c.prefixed(key))
+	}
+
+	params = append(params, args...)
+
+	if !c.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	conn := c.Pool.Get()
+	defer conn.Close()
+
+	reply, err = script.Do(conn, params...)
+	c.report(err)
 
 	return
 }
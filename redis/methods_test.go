@@ -4,6 +4,7 @@ import (
 	"errors"
 	"testing"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/rafaeljusto/redigomock"
 	"github.com/stretchr/testify/assert"
 )
@@ -202,18 +203,63 @@ func TestMethodDelete(t *testing.T) {
 	assert.Equal(t, "connection error", err.Error(), "Error should match expected error")
 }
 
+func TestMethodPrefix(t *testing.T) {
+
+	NewRedisMock()
+
+	Cache.Prefix = "staging:"
+	defer func() {
+		Cache.Prefix = ""
+	}()
+
+	Cache.Mock.Command("GET", "staging:index:1").Expect("worked!")
+
+	res, err := Cache.Get("index:1")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("worked!"), res, "Should return data")
+
+	Cache.Mock.Command("HGET", "staging:index:1", "1").Expect("worked!")
+
+	res, err = Cache.HGet("index:1", "1")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("worked!"), res, "Should return data")
+
+	set := Cache.Mock.Command("SET", "staging:index:1", []byte("data")).Expect("OK")
+
+	err = Cache.Set("index:1", []byte("data"))
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 1, Cache.Mock.Stats(set), "Command should be called with the prefix")
+
+	del := Cache.Mock.Command("DEL", "staging:index:1", "staging:thread:2")
+
+	err = Cache.Delete("index:1", "thread:2")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 1, Cache.Mock.Stats(del), "Command should be called with the prefix")
+
+	Cache.Mock.Command("INCR", "staging:counter").Expect(int64(1))
+
+	count, err := Cache.Incr("counter")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 1, count, "Count should match")
+}
+
 func TestMethodFlush(t *testing.T) {
 
 	NewRedisMock()
 
-	Cache.Mock.Command("FLUSHALL")
+	scan := Cache.Mock.Command("SCAN", "0", "MATCH", redigomock.NewAnyData(), "COUNT", DefaultFlushCount).Expect([]interface{}{[]byte("0"), []interface{}{}})
+	Cache.Mock.Command("UNLINK", "tagtypes", "imageboards").Expect(int64(2))
 
 	err := Cache.Flush()
 
 	assert.NoError(t, err, "An error was not expected")
 
-	// Test with FLUSHALL error
-	Cache.Mock.Command("FLUSHALL").ExpectError(errors.New("connection error"))
+	assert.Equal(t, 11, Cache.Mock.Stats(scan), "Every base with fields and the tag sets should be scanned")
+
+	assert.NoError(t, Cache.Mock.ExpectationsWereMet(), "All commands should have been called")
+
+	// Test with SCAN error
+	Cache.Mock.Command("SCAN", "0", "MATCH", redigomock.NewAnyData(), "COUNT", DefaultFlushCount).ExpectError(errors.New("connection error"))
 	err = Cache.Flush()
 	assert.Error(t, err, "An error was expected")
 	assert.Equal(t, "connection error", err.Error(), "Error should match expected error")
@@ -245,6 +291,28 @@ func TestMethodIncr(t *testing.T) {
 	assert.Equal(t, "connection error", err.Error(), "Error should match expected error")
 }
 
+func TestMethodHIncrBy(t *testing.T) {
+
+	NewRedisMock()
+
+	Cache.Mock.Command("HINCRBY", "views:1", "2", 5).Expect(int64(7))
+
+	res, err := Cache.HIncrBy("views:1", "2", 5)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 7, res, "Result should match")
+
+	_, err = Cache.HIncrBy("", "2", 5)
+	assert.Error(t, err, "An error was expected for empty key")
+
+	_, err = Cache.HIncrBy("views:1", "", 5)
+	assert.Error(t, err, "An error was expected for empty field")
+
+	Cache.Mock.Command("HINCRBY", "views:1", "2", 5).ExpectError(errors.New("connection error"))
+	res, err = Cache.HIncrBy("views:1", "2", 5)
+	assert.Equal(t, 0, res, "Result should be 0 for error")
+	assert.Equal(t, "connection error", err.Error(), "Error should match expected error")
+}
+
 func TestMethodExpire(t *testing.T) {
 
 	NewRedisMock()
@@ -271,3 +339,30 @@ func TestMethodExpire(t *testing.T) {
 	assert.Error(t, err, "An error was expected")
 	assert.Equal(t, "connection error", err.Error(), "Error should match expected error")
 }
+
+func TestMethodEval(t *testing.T) {
+
+	NewRedisMock()
+
+	Cache.Prefix = "staging:"
+	defer func() {
+		Cache.Prefix = ""
+	}()
+
+	script := redis.NewScript(1, `return redis.call("INCRBY", KEYS[1], ARGV[1])`)
+
+	Cache.Mock.Command("EVALSHA", redigomock.NewAnyData(), 1, "staging:counter", 2).Expect(int64(2))
+
+	reply, err := redis.Int(Cache.Eval(script, []string{"counter"}, 2))
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 2, reply, "Reply should match")
+
+	// Test with nil script
+	_, err = Cache.Eval(nil, []string{"counter"})
+	assert.Error(t, err, "An error was expected for nil script")
+
+	// Test with empty key
+	_, err = Cache.Eval(script, []string{""}, 2)
+	assert.Error(t, err, "An error was expected for empty key")
+	assert.Equal(t, "key cannot be empty", err.Error(), "Error should be for empty key")
+}
@@ -0,0 +1,273 @@
+package redis
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// metricsBucket is the resolution of the sliding window
+	metricsBucket = 10 * time.Second
+	// metricsBuckets is how many buckets are kept
+	metricsBuckets = 30
+	// MetricsWindow is the period covered by the windowed counters and ratio
+	MetricsWindow = metricsBucket * metricsBuckets
+)
+
+// keyOp is an operation on a Key that is measured
+type keyOp int
+
+const (
+	opGet keyOp = iota
+	opSet
+	opDelete
+)
+
+// Latency summarizes how long an operation took
+type Latency struct {
+	Count uint64
+	Total time.Duration
+	Mean  time.Duration
+	Max   time.Duration
+}
+
+// BaseMetrics holds the counters for all the keys of a base
+type BaseMetrics struct {
+	// Hits, Misses and Errors count Get results, Errors also counts failed Sets and Deletes
+	Hits   uint64
+	Misses uint64
+	Errors uint64
+	Sets   uint64
+	// Deletes counts successful deletes
+	Deletes uint64
+	// BytesRead and BytesWritten total the payload sizes of hits and sets
+	BytesRead    uint64
+	BytesWritten uint64
+	// HitRatio is hits over hits and misses since startup
+	HitRatio float64
+	// Stale counts hits past their soft expiry
+	Stale uint64
+	// Refreshes and RefreshErrors count background refreshes of stale keys
+	Refreshes     uint64
+	RefreshErrors uint64
+
+	// The window fields only cover the last MetricsWindow
+	WindowHits     uint64
+	WindowMisses   uint64
+	WindowErrors   uint64
+	WindowHitRatio float64
+
+	Get    Latency
+	Set    Latency
+	Delete Latency
+}
+
+// MetricsSnapshot is a copy of the metrics for every base that has been used
+type MetricsSnapshot struct {
+	Time   time.Time
+	Window time.Duration
+	Bases  map[string]BaseMetrics
+}
+
+// metricsSlot holds the counters for one bucket of the window
+type metricsSlot struct {
+	slot   int64
+	hits   uint64
+	misses uint64
+	errors uint64
+}
+
+// baseMetrics are the live counters for a base
+type baseMetrics struct {
+	mu      sync.Mutex
+	totals  BaseMetrics
+	buckets [metricsBuckets]metricsSlot
+}
+
+var (
+	// metricsMu guards the metrics index
+	metricsMu sync.RWMutex
+	// keyMetrics holds the counters by key base
+	keyMetrics = make(map[string]*baseMetrics)
+
+	// metricsNow is the clock used for the window
+	metricsNow = time.Now
+)
+
+// metricsFor returns the counters for a base, creating them if needed
+func metricsFor(base string) *baseMetrics {
+	metricsMu.RLock()
+	m, ok := keyMetrics[base]
+	metricsMu.RUnlock()
+	if ok {
+		return m
+	}
+
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	m, ok = keyMetrics[base]
+	if !ok {
+		m = &baseMetrics{}
+		keyMetrics[base] = m
+	}
+
+	return m
+}
+
+// recordKeyOp adds the result of an operation to the counters of the base
+func recordKeyOp(base string, op keyOp, start time.Time, size int, err error) {
+	elapsed := time.Since(start)
+
+	m := metricsFor(base)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	bucket := m.bucket(metricsNow())
+
+	if err != nil && err != ErrCacheMiss {
+		m.totals.Errors++
+		bucket.errors++
+	}
+
+	switch op {
+	case opGet:
+		m.totals.Get.add(elapsed)
+		if err == nil {
+			m.totals.Hits++
+			m.totals.BytesRead += uint64(size)
+			bucket.hits++
+		} else if err == ErrCacheMiss {
+			m.totals.Misses++
+			bucket.misses++
+		}
+	case opSet:
+		m.totals.Set.add(elapsed)
+		if err == nil {
+			m.totals.Sets++
+			m.totals.BytesWritten += uint64(size)
+		}
+	case opDelete:
+		m.totals.Delete.add(elapsed)
+		if err == nil {
+			m.totals.Deletes++
+		}
+	}
+}
+
+// recordStale counts a hit past its soft expiry
+func recordStale(base string) {
+	m := metricsFor(base)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.totals.Stale++
+}
+
+// recordRefresh counts the result of a background refresh
+func recordRefresh(base string, err error) {
+	m := metricsFor(base)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil {
+		m.totals.RefreshErrors++
+		return
+	}
+
+	m.totals.Refreshes++
+}
+
+// bucket returns the window bucket for a time, clearing it if it is from an older window
+func (m *baseMetrics) bucket(t time.Time) *metricsSlot {
+	slot := t.UnixNano() / int64(metricsBucket)
+
+	bucket := &m.buckets[slot%metricsBuckets]
+	if bucket.slot != slot {
+		*bucket = metricsSlot{slot: slot}
+	}
+
+	return bucket
+}
+
+// snapshot copies the counters and sums the window
+func (m *baseMetrics) snapshot(t time.Time) BaseMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	metrics := m.totals
+
+	current := t.UnixNano() / int64(metricsBucket)
+
+	for _, bucket := range m.buckets {
+		if bucket.slot > current-metricsBuckets && bucket.slot <= current {
+			metrics.WindowHits += bucket.hits
+			metrics.WindowMisses += bucket.misses
+			metrics.WindowErrors += bucket.errors
+		}
+	}
+
+	metrics.HitRatio = ratio(metrics.Hits, metrics.Misses)
+	metrics.WindowHitRatio = ratio(metrics.WindowHits, metrics.WindowMisses)
+	metrics.Get.Mean = metrics.Get.mean()
+	metrics.Set.Mean = metrics.Set.mean()
+	metrics.Delete.Mean = metrics.Delete.mean()
+
+	return metrics
+}
+
+// add records a single operation
+func (l *Latency) add(d time.Duration) {
+	l.Count++
+	l.Total += d
+	if d > l.Max {
+		l.Max = d
+	}
+}
+
+// mean returns the average duration
+func (l *Latency) mean() time.Duration {
+	if l.Count == 0 {
+		return 0
+	}
+	return l.Total / time.Duration(l.Count)
+}
+
+// ratio returns hits over hits and misses, zero if there were none
+func ratio(hits, misses uint64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// KeyMetrics returns a snapshot of the hit, miss, error, size and latency counters by key base
+func KeyMetrics() MetricsSnapshot {
+	t := metricsNow()
+
+	metricsMu.RLock()
+	defer metricsMu.RUnlock()
+
+	snapshot := MetricsSnapshot{
+		Time:   t,
+		Window: MetricsWindow,
+		Bases:  make(map[string]BaseMetrics, len(keyMetrics)),
+	}
+
+	for base, m := range keyMetrics {
+		snapshot.Bases[base] = m.snapshot(t)
+	}
+
+	return snapshot
+}
+
+// ResetKeyMetrics clears all of the key counters
+func ResetKeyMetrics() {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	keyMetrics = make(map[string]*baseMetrics)
+}
@@ -0,0 +1,135 @@
+package redis
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eirka/eirka-libs/internal/testclock"
+)
+
+// setMetricsClock freezes the metrics clock with empty metrics and returns a function to move it forward
+func setMetricsClock(t *testing.T) func(time.Duration) {
+	ResetKeyMetrics()
+	t.Cleanup(ResetKeyMetrics)
+
+	return testclock.Freeze(t, &metricsNow)
+}
+
+func TestKeyMetrics(t *testing.T) {
+
+	setMetricsClock(t)
+
+	newTestMemoryCache(t)
+
+	key := NewKey("thread").SetKey("1", "2", "3")
+
+	_, err := key.Get()
+	assert.Equal(t, ErrCacheMiss, err, "Error should be cache miss")
+
+	err = key.Set([]byte("thread data"))
+	assert.NoError(t, err, "An error was not expected")
+
+	for i := 0; i < 3; i++ {
+		_, err = key.Get()
+		assert.NoError(t, err, "An error was not expected")
+	}
+
+	err = key.Delete()
+	assert.NoError(t, err, "An error was not expected")
+
+	// keys that were never set up are not counted
+	_, err = NewKey("thread").Get()
+	assert.Equal(t, ErrKeyNotSet, err, "Error should be key not set")
+
+	snapshot := KeyMetrics()
+
+	assert.Equal(t, MetricsWindow, snapshot.Window, "Window should match")
+
+	metrics, ok := snapshot.Bases["thread"]
+	if assert.True(t, ok, "Base should have metrics") {
+		assert.Equal(t, uint64(3), metrics.Hits, "Hits should match")
+		assert.Equal(t, uint64(1), metrics.Misses, "Misses should match")
+		assert.Equal(t, uint64(0), metrics.Errors, "Errors should match")
+		assert.Equal(t, uint64(1), metrics.Sets, "Sets should match")
+		assert.Equal(t, uint64(1), metrics.Deletes, "Deletes should match")
+		assert.Equal(t, uint64(33), metrics.BytesRead, "Bytes read should match")
+		assert.Equal(t, uint64(11), metrics.BytesWritten, "Bytes written should match")
+		assert.Equal(t, 0.75, metrics.HitRatio, "Hit ratio should match")
+		assert.Equal(t, 0.75, metrics.WindowHitRatio, "Window hit ratio should match")
+		assert.Equal(t, uint64(4), metrics.Get.Count, "Get count should match")
+		assert.Equal(t, uint64(1), metrics.Set.Count, "Set count should match")
+		assert.Equal(t, uint64(1), metrics.Delete.Count, "Delete count should match")
+		assert.True(t, metrics.Get.Max >= metrics.Get.Mean, "Max should not be less than the mean")
+	}
+
+	_, ok = snapshot.Bases["index"]
+	assert.False(t, ok, "Unused bases should not have metrics")
+}
+
+func TestKeyMetricsErrors(t *testing.T) {
+
+	setMetricsClock(t)
+
+	NewRedisMock()
+
+	Cache.Mock.Command("GET", "tagtypes").ExpectError(errors.New("connection error"))
+	Cache.Mock.Command("SET", "tagtypes", []byte("data")).ExpectError(errors.New("connection error"))
+
+	key := NewKey("tagtypes").SetKey()
+
+	_, err := key.Get()
+	assert.Error(t, err, "An error was expected")
+
+	err = key.Set([]byte("data"))
+	assert.Error(t, err, "An error was expected")
+
+	metrics := KeyMetrics().Bases["tagtypes"]
+
+	assert.Equal(t, uint64(2), metrics.Errors, "Errors should match")
+	assert.Equal(t, uint64(2), metrics.WindowErrors, "Window errors should match")
+	assert.Equal(t, uint64(0), metrics.Sets, "Failed sets should not be counted")
+	assert.Equal(t, float64(0), metrics.HitRatio, "Hit ratio should be zero without gets")
+}
+
+func TestKeyMetricsWindow(t *testing.T) {
+
+	advance := setMetricsClock(t)
+
+	start := time.Now()
+
+	recordKeyOp("index", opGet, start, 10, ErrCacheMiss)
+	recordKeyOp("index", opGet, start, 10, ErrCacheMiss)
+
+	advance(MetricsWindow / 2)
+
+	recordKeyOp("index", opGet, start, 10, nil)
+
+	metrics := KeyMetrics().Bases["index"]
+	assert.Equal(t, uint64(1), metrics.WindowHits, "Window hits should match")
+	assert.Equal(t, uint64(2), metrics.WindowMisses, "Window misses should match")
+
+	// the misses leave the window
+	advance(MetricsWindow / 2)
+
+	recordKeyOp("index", opGet, start, 10, nil)
+
+	metrics = KeyMetrics().Bases["index"]
+	assert.Equal(t, uint64(2), metrics.WindowHits, "Window hits should match")
+	assert.Equal(t, uint64(0), metrics.WindowMisses, "Old misses should leave the window")
+	assert.Equal(t, float64(1), metrics.WindowHitRatio, "Window hit ratio should match")
+	assert.Equal(t, 0.5, metrics.HitRatio, "Total hit ratio should keep everything")
+
+	// everything leaves the window
+	advance(2 * MetricsWindow)
+
+	metrics = KeyMetrics().Bases["index"]
+	assert.Equal(t, uint64(0), metrics.WindowHits, "Window should be empty")
+	assert.Equal(t, uint64(2), metrics.Hits, "Totals should be kept")
+
+	ResetKeyMetrics()
+
+	assert.Empty(t, KeyMetrics().Bases, "Metrics should be cleared")
+}
@@ -3,6 +3,7 @@ package redis
 // redis mutex based on https://github.com/hjr265/redsync.go
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
@@ -45,8 +46,16 @@ type Mutex struct {
 
 	Quorum int // Quorum for the lock, set to len(addrs)/2+1 by NewMutex()
 
+	Prefix string // Prepended to every lock key
+
+	SlowThreshold time.Duration   // Lock calls slower than this are passed to OnSlowLock, disabled if 0
+	OnSlowLock    func(LockEvent) // Called for Lock calls that were slow or failed
+
 	nodes []Pool
 	nodem sync.Mutex
+
+	// held is when this process took the locks it holds, for the hold time metrics
+	held sync.Map
 }
 
 var _ = Locker(&Mutex{})
@@ -66,22 +75,18 @@ func NewMutex(genericNodes []Pool) *Mutex {
 // Lock will put a lock key in redis
 // In case it returns an error on failure, you may retry to acquire the lock by calling this method again.
 func (m *Mutex) Lock(key string) error {
-	m.nodem.Lock()
-	defer m.nodem.Unlock()
+	return m.LockContext(context.Background(), key)
+}
 
-	// generate random data to place in key
-	b := make([]byte, 16)
-	_, err := rand.Read(b)
+// LockContext will put a lock key in redis, giving up early if the context is done
+// The lock is labeled with the label from WithLockLabel.
+func (m *Mutex) LockContext(ctx context.Context, key string) error {
+	label := lockLabel(ctx)
+
+	value, err := newLockHolder(label)
 	if err != nil {
 		return err
 	}
-	value := base64.StdEncoding.EncodeToString(b)
-
-	// set expiry
-	expiry := m.Expiry
-	if expiry == 0 {
-		expiry = DefaultExpiry
-	}
 
 	// set retries
 	retries := m.Tries
@@ -89,65 +94,258 @@ func (m *Mutex) Lock(key string) error {
 		retries = DefaultTries
 	}
 
+	delay := m.Delay
+	if delay == 0 {
+		delay = DefaultDelay
+	}
+
+	start := time.Now()
+
+	// who we are waiting on, only looked up for the hook
+	var holder *LockHolder
+
 	// loop to try and set lock
 	for i := 0; i < retries; i++ {
-		n := 0
-		start := time.Now()
+		if m.acquire(key, value) {
+			m.observeLock(key, label, start, i, holder, nil)
+			return nil
+		}
 
-		// loop through redis pools
-		for _, node := range m.nodes {
-			if node == nil {
-				continue
-			}
+		if i == 0 && m.OnSlowLock != nil {
+			holder = m.holder(key)
+		}
 
-			// try and set the key, NX will prevent the key from being overwritten
-			conn := node.Get()
-			reply, err := redis.String(conn.Do("SET", key, value, "NX", "PX", int(expiry/time.Millisecond)))
-			conn.Close()
-			if err != nil {
-				continue
-			}
+		select {
+		case <-ctx.Done():
+			m.observeLock(key, label, start, i, holder, ctx.Err())
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
 
-			if reply != "OK" {
-				continue
-			}
+	m.observeLock(key, label, start, retries-1, holder, ErrFailed)
 
-			n++
+	return ErrFailed
+}
+
+// TryLock makes a single attempt at the lock, returning ErrFailed if it is held
+func (m *Mutex) TryLock(key string) error {
+	value, err := newLockHolder("")
+	if err != nil {
+		return err
+	}
+
+	acquired := m.acquire(key, value)
+
+	m.observeTry(key, acquired)
+
+	if !acquired {
+		return ErrFailed
+	}
+
+	return nil
+}
+
+// Lease is a held lock that can be extended while the work it guards runs
+type Lease struct {
+	owner  leaseOwner
+	key    string
+	value  string
+	expiry time.Duration
+}
+
+// leaseOwner extends and releases the lock of a lease while it still holds the value
+type leaseOwner interface {
+	extend(key, value string, expiry time.Duration) bool
+	release(key, value string) bool
+}
+
+// Acquire makes a single attempt at the lock and returns a lease on it, ErrFailed if it is held
+// Unlike Lock the lease only releases or extends the lock while it still owns it.
+func (m *Mutex) Acquire(key string) (*Lease, error) {
+	value, err := newLockHolder("")
+	if err != nil {
+		return nil, err
+	}
+
+	acquired := m.acquire(key, value)
+
+	m.observeTry(key, acquired)
+
+	if !acquired {
+		return nil, ErrFailed
+	}
+
+	expiry := m.Expiry
+	if expiry == 0 {
+		expiry = DefaultExpiry
+	}
+
+	return &Lease{
+		owner:  m,
+		key:    key,
+		value:  value,
+		expiry: expiry,
+	}, nil
+}
+
+// Expiry returns how long the lease lasts after it is acquired or extended
+func (l *Lease) Expiry() time.Duration {
+	return l.expiry
+}
+
+// Extend resets the expiry of the lock, returning false if the lease was lost
+func (l *Lease) Extend() bool {
+	return l.owner.extend(l.key, l.value, l.expiry)
+}
+
+// Release deletes the lock if the lease still holds it
+func (l *Lease) Release() bool {
+	return l.owner.release(l.key, l.value)
+}
+
+// Keep extends the lease in the background until the returned function is called
+// The lease is extended every third of its expiry. If it is lost lost is called once and it stops,
+// stop reports if that happened.
+func (l *Lease) Keep(lost func()) (stop func() bool) {
+	done := make(chan struct{})
+	result := make(chan bool, 1)
+
+	go func() {
+		ticker := time.NewTicker(l.expiry / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				result <- false
+				return
+			case <-ticker.C:
+				if !l.Extend() {
+					if lost != nil {
+						lost()
+					}
+					result <- true
+					return
+				}
+			}
 		}
+	}()
+
+	return func() bool {
+		close(done)
+		return <-result
+	}
+}
+
+// extend resets the expiry of a lock on a quorum of nodes if it still holds the value
+func (m *Mutex) extend(key, value string, expiry time.Duration) bool {
+	return m.eval(extendScript, key, value, int(expiry/time.Millisecond), time.Now().UnixMilli())
+}
+
+// release deletes a lock on a quorum of nodes if it still holds the value
+func (m *Mutex) release(key, value string) bool {
+	if !m.eval(delScript, key, value) {
+		return false
+	}
+
+	m.observeRelease(key)
+
+	return true
+}
 
-		factor := m.Factor
-		if factor == 0 {
-			factor = DefaultFactor
+// eval runs a lock script with the lock and registry keys on every node and reports if it succeeded on a quorum
+func (m *Mutex) eval(script *redis.Script, key string, args ...interface{}) bool {
+	m.nodem.Lock()
+	defer m.nodem.Unlock()
+
+	n := 0
+	for _, node := range m.nodes {
+		if node == nil {
+			continue
 		}
 
-		// if the time is past then we will delete the key
-		until := time.Now().Add(expiry - time.Since(start) - time.Duration(int64(float64(expiry)*factor)) + 2*time.Millisecond)
-		if n >= m.Quorum && time.Now().Before(until) {
-			return nil
+		conn := node.Get()
+		status, err := m.do(conn, script, key, args...)
+		conn.Close()
+		if err != nil || status == 0 {
+			continue
 		}
+		n++
+	}
 
-		for _, node := range m.nodes {
-			if node == nil {
-				continue
-			}
+	return n >= m.Quorum
+}
 
-			// delete the key if it matches our value
-			conn := node.Get()
-			_, err := delScript.Do(conn, key, value)
-			conn.Close()
-			if err != nil {
-				continue
-			}
+// do runs a lock script with the lock and registry keys on a node
+func (m *Mutex) do(conn redis.Conn, script *redis.Script, key string, args ...interface{}) (int, error) {
+	return redis.Int(script.Do(conn, append([]interface{}{m.Prefix + key, m.Prefix + lockRegistryKey}, args...)...))
+}
+
+// lockValue generates random data to place in a lock key
+func lockValue() (string, error) {
+	b := make([]byte, 16)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// acquire makes a single attempt at setting the lock key on a quorum of nodes
+func (m *Mutex) acquire(key, value string) bool {
+	m.nodem.Lock()
+	defer m.nodem.Unlock()
+
+	// set expiry
+	expiry := m.Expiry
+	if expiry == 0 {
+		expiry = DefaultExpiry
+	}
+
+	n := 0
+	start := time.Now()
+
+	// loop through redis pools
+	for _, node := range m.nodes {
+		if node == nil {
+			continue
+		}
+
+		// try and set the key, NX will prevent the key from being overwritten
+		conn := node.Get()
+		status, err := m.do(conn, acquireScript, key, value, int(expiry/time.Millisecond), start.UnixMilli())
+		if err == nil && status != 0 {
+			n++
 		}
+		conn.Close()
+	}
+
+	factor := m.Factor
+	if factor == 0 {
+		factor = DefaultFactor
+	}
 
-		delay := m.Delay
-		if delay == 0 {
-			delay = DefaultDelay
+	// if the time is past then we will delete the key
+	until := time.Now().Add(expiry - time.Since(start) - time.Duration(int64(float64(expiry)*factor)) + 2*time.Millisecond)
+	if n >= m.Quorum && time.Now().Before(until) {
+		return true
+	}
+
+	for _, node := range m.nodes {
+		if node == nil {
+			continue
 		}
-		time.Sleep(delay)
+
+		// delete the key if it matches our value
+		conn := node.Get()
+		_, _ = m.do(conn, delScript, key, value)
+		conn.Close()
 	}
 
-	return ErrFailed
+	return false
 }
 
 // Unlock will delete the lock key
@@ -164,7 +362,7 @@ func (m *Mutex) Unlock(key string) bool {
 
 		// delete the key
 		conn := node.Get()
-		status, err := conn.Do("DEL", key)
+		status, err := m.do(conn, unlockScript, key)
 		conn.Close()
 		if err != nil {
 			continue
@@ -175,13 +373,76 @@ func (m *Mutex) Unlock(key string) bool {
 		n++
 	}
 
+	if n < m.Quorum {
+		return false
+	}
+
+	m.observeRelease(key)
+
+	return true
+}
+
+// Locked reports if the lock key is set on a quorum of nodes
+func (m *Mutex) Locked(key string) bool {
+	m.nodem.Lock()
+	defer m.nodem.Unlock()
+
+	key = m.Prefix + key
+
+	n := 0
+	for _, node := range m.nodes {
+		if node == nil {
+			continue
+		}
+
+		conn := node.Get()
+		exists, err := redis.Bool(conn.Do("EXISTS", key))
+		conn.Close()
+		if err != nil || !exists {
+			continue
+		}
+		n++
+	}
+
 	return n >= m.Quorum
 }
 
-// checks to see if the key data matches our current lock, and deletes if so
-var delScript = redis.NewScript(1, `
-if redis.call("get", KEYS[1]) == ARGV[1] then
-	return redis.call("del", KEYS[1])
+// sets the lock if it is free and adds it to the registry, pruning the locks that expired without an unlock
+// the registry lives as long as the longest lock in it
+var acquireScript = redis.NewScript(2, `
+if not redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return 0
+end
+redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", ARGV[3])
+redis.call("ZADD", KEYS[2], ARGV[3] + ARGV[2], KEYS[1])
+if redis.call("PTTL", KEYS[2]) < tonumber(ARGV[2]) then
+	redis.call("PEXPIRE", KEYS[2], ARGV[2])
+end
+return 1`)
+
+// checks to see if the key data matches our current lock, and deletes it and its registry entry if so
+var delScript = redis.NewScript(2, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("ZREM", KEYS[2], KEYS[1])
+	return redis.call("DEL", KEYS[1])
 else
 	return 0
 end`)
+
+// deletes the lock whoever holds it along with its registry entry
+var unlockScript = redis.NewScript(2, `
+redis.call("ZREM", KEYS[2], KEYS[1])
+return redis.call("DEL", KEYS[1])`)
+
+// resets the expiry and the registry score if the key data matches our current lock
+var extendScript = redis.NewScript(2, `
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", ARGV[3])
+redis.call("ZADD", KEYS[2], ARGV[3] + ARGV[2], KEYS[1])
+if redis.call("PTTL", KEYS[2]) < tonumber(ARGV[2]) then
+	redis.call("PEXPIRE", KEYS[2], ARGV[2])
+end
+return 1`)
@@ -40,6 +40,12 @@ func TestMutex(t *testing.T) {
 
 	assert.True(t, Cache.Unlock("test:mutex"), "Mutex should be unlocked")
 
+	assert.NoError(t, Cache.TryLock("test:mutex"), "An error was not expected")
+
+	assert.Equal(t, ErrFailed, Cache.TryLock("test:mutex"), "Error should be failed while the lock is held")
+
+	assert.True(t, Cache.Unlock("test:mutex"), "Mutex should be unlocked")
+
 	server.Term()
 }
 
@@ -199,3 +205,106 @@ func TestMutexNoNodes(t *testing.T) {
 
 	NewMutex([]Pool{})
 }
+
+func TestMutexLease(t *testing.T) {
+
+	server, err := tempredis.Start(tempredis.Config{})
+	if err != nil {
+		panic(err)
+	}
+	defer server.Term()
+
+	config := Redis{
+		Protocol:       "unix",
+		Address:        server.Socket(),
+		MaxIdle:        1,
+		MaxConnections: 5,
+	}
+
+	config.NewRedisCache()
+
+	Cache.Mutex.Expiry = 200 * time.Millisecond
+
+	lease, err := Cache.Mutex.Acquire("lease:mutex")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 200*time.Millisecond, lease.Expiry(), "Expiry should come from the mutex")
+
+	_, err = Cache.Mutex.Acquire("lease:mutex")
+	assert.Equal(t, ErrFailed, err, "Error should be failed while the lease is held")
+
+	// extending keeps the lock past its first expiry
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		assert.True(t, lease.Extend(), "Lease should be extended")
+	}
+
+	assert.Equal(t, ErrFailed, Cache.TryLock("lease:mutex"), "Lock should still be held")
+
+	assert.True(t, lease.Release(), "Lease should be released")
+	assert.False(t, lease.Release(), "Lease should only be released once")
+
+	// a lease that expired can not touch the new holder's lock
+	lease, err = Cache.Mutex.Acquire("lease:mutex")
+	assert.NoError(t, err, "An error was not expected")
+
+	time.Sleep(300 * time.Millisecond)
+
+	assert.NoError(t, Cache.TryLock("lease:mutex"), "Lock should have expired")
+
+	assert.False(t, lease.Extend(), "Lost lease should not be extended")
+	assert.False(t, lease.Release(), "Lost lease should not be released")
+	assert.True(t, Cache.Unlock("lease:mutex"), "Lock should belong to the new holder")
+}
+
+func TestMutexLeaseKeep(t *testing.T) {
+
+	server, err := tempredis.Start(tempredis.Config{})
+	if err != nil {
+		panic(err)
+	}
+	defer server.Term()
+
+	config := Redis{
+		Protocol:       "unix",
+		Address:        server.Socket(),
+		MaxIdle:        1,
+		MaxConnections: 5,
+	}
+
+	config.NewRedisCache()
+
+	Cache.Mutex.Expiry = 150 * time.Millisecond
+
+	lease, err := Cache.Acquire("keep:mutex")
+	assert.NoError(t, err, "An error was not expected")
+
+	stop := lease.Keep(func() {
+		t.Error("Lease should not be lost")
+	})
+
+	time.Sleep(400 * time.Millisecond)
+
+	assert.Equal(t, ErrFailed, Cache.TryLock("keep:mutex"), "Lock should still be held")
+	assert.False(t, stop(), "Lease should not be lost")
+	assert.True(t, lease.Release(), "Lease should be released")
+
+	// another holder took the lock
+	lease, err = Cache.Acquire("keep:mutex")
+	assert.NoError(t, err, "An error was not expected")
+
+	lost := make(chan struct{})
+
+	stop = lease.Keep(func() {
+		close(lost)
+	})
+
+	assert.True(t, Cache.Unlock("keep:mutex"), "Lock should be deleted")
+
+	select {
+	case <-lost:
+	case <-time.After(time.Second):
+		t.Fatal("Lost lease should be reported")
+	}
+
+	assert.True(t, stop(), "Lease should be lost")
+}
@@ -0,0 +1,345 @@
+// Package queue runs background jobs from redis streams with consumer groups
+//
+// Jobs are kept in a stream per queue and read by a consumer group so every job goes to one worker.
+// Delayed jobs and retries wait in a sorted set until they are due. A job that keeps failing is
+// moved to a dead letter stream, and jobs left pending by a crashed worker are claimed by another
+// once they have been idle for ClaimIdle. Every claim counts as an attempt.
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/eirka/eirka-libs/redis"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// keyPrefix is the first segment of every queue key
+const keyPrefix = "queue"
+
+const (
+	// DefaultConcurrency is used when Options Concurrency is 0
+	DefaultConcurrency = 1
+	// DefaultMaxAttempts is used when Options MaxAttempts is 0
+	DefaultMaxAttempts = 5
+	// DefaultClaimIdle is used when Options ClaimIdle is 0
+	DefaultClaimIdle = 5 * time.Minute
+	// DefaultPollInterval is used when Options PollInterval is 0
+	DefaultPollInterval = time.Second
+	// DefaultGroup is used when Options Group is empty
+	DefaultGroup = "workers"
+	// DefaultMaxDead is used when Options MaxDead is 0
+	DefaultMaxDead = 10000
+)
+
+var (
+	// ErrInvalidQueue is returned if a queue can not be used
+	ErrInvalidQueue = errors.New("queue not valid")
+
+	// now is the clock used for delays
+	now = time.Now
+)
+
+// Backoff returns how long to wait before the next attempt after a job failed on attempt
+type Backoff func(attempt int) time.Duration
+
+// ExponentialBackoff doubles the wait after every attempt starting at base, up to limit
+func ExponentialBackoff(base, limit time.Duration) Backoff {
+	return func(attempt int) time.Duration {
+		wait := base
+		for i := 1; i < attempt; i++ {
+			wait *= 2
+			if wait >= limit {
+				return limit
+			}
+		}
+		return wait
+	}
+}
+
+// Options controls how a queue runs its jobs
+type Options struct {
+	// Concurrency is how many jobs run at once in Run
+	Concurrency int
+	// MaxAttempts is how many times a job runs before it is moved to the dead letter stream
+	MaxAttempts int
+	// Backoff is the wait before a retry, ExponentialBackoff from a second up to an hour if nil
+	Backoff Backoff
+	// ClaimIdle is how long a job can be pending before another worker takes it over,
+	// it is also the timeout for the handler so it has to be longer than any job takes
+	ClaimIdle time.Duration
+	// PollInterval is how long Run waits when there are no jobs
+	PollInterval time.Duration
+	// Group is the consumer group, queues with different groups each get every job
+	Group string
+	// MaxDead is roughly how many jobs the dead letter stream keeps
+	MaxDead int
+	// OnError is called with errors that do not fail a job, like redis being unreachable,
+	// job is nil if there was no job involved
+	OnError func(job *Job, err error)
+}
+
+// Queue is a named stream of jobs
+type Queue struct {
+	name string
+	opts Options
+}
+
+// Job is a unit of work in a queue
+type Job struct {
+	// ID stays the same through retries
+	ID      string          `json:"id"`
+	Payload json.RawMessage `json:"payload"`
+	// Attempt is the current run starting at 1
+	Attempt  int       `json:"attempt"`
+	Enqueued time.Time `json:"enqueued"`
+	// Error is the failure of the last attempt
+	Error string `json:"error,omitempty"`
+
+	// entry is the id of the stream entry the job was read from
+	entry string
+	// deliveries is how many times the entry was read, it is only known for jobs taken over from a consumer
+	deliveries int
+}
+
+// Decode unmarshals the payload of the job
+func (j *Job) Decode(v interface{}) error {
+	return json.Unmarshal(j.Payload, v)
+}
+
+// New returns a queue after checking the options
+func New(name string, opts Options) (*Queue, error) {
+
+	if name == "" || strings.ContainsAny(name, ":{}") {
+		return nil, fmt.Errorf("%w: name must be set and cannot contain a colon or braces", ErrInvalidQueue)
+	}
+
+	if opts.Concurrency < 0 || opts.MaxAttempts < 0 || opts.MaxDead < 0 {
+		return nil, fmt.Errorf("%w: concurrency, attempts and dead jobs cannot be negative", ErrInvalidQueue)
+	}
+
+	if opts.ClaimIdle < 0 || opts.PollInterval < 0 {
+		return nil, fmt.Errorf("%w: durations cannot be negative", ErrInvalidQueue)
+	}
+
+	if opts.Concurrency == 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+
+	if opts.MaxAttempts == 0 {
+		opts.MaxAttempts = DefaultMaxAttempts
+	}
+
+	if opts.Backoff == nil {
+		opts.Backoff = ExponentialBackoff(time.Second, time.Hour)
+	}
+
+	if opts.ClaimIdle == 0 {
+		opts.ClaimIdle = DefaultClaimIdle
+	}
+
+	if opts.PollInterval == 0 {
+		opts.PollInterval = DefaultPollInterval
+	}
+
+	if opts.Group == "" {
+		opts.Group = DefaultGroup
+	}
+
+	if opts.MaxDead == 0 {
+		opts.MaxDead = DefaultMaxDead
+	}
+
+	return &Queue{
+		name: name,
+		opts: opts,
+	}, nil
+}
+
+// Name returns the name of the queue
+func (q *Queue) Name() string {
+	return q.name
+}
+
+// keys returns the stream, delayed set and dead letter stream
+// The name is a hash tag so the scripts can use all three in a cluster
+func (q *Queue) keys() []string {
+	base := fmt.Sprintf("%s:{%s}:", keyPrefix, q.name)
+
+	return []string{base + "jobs", base + "delayed", base + "dead"}
+}
+
+// Enqueue adds a job that runs as soon as a worker is free
+func (q *Queue) Enqueue(payload interface{}) (*Job, error) {
+	return q.EnqueueIn(0, payload)
+}
+
+// EnqueueIn adds a job that runs once the delay has passed
+func (q *Queue) EnqueueIn(delay time.Duration, payload interface{}) (job *Job, err error) {
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+
+	id, err := jobID()
+	if err != nil {
+		return
+	}
+
+	job = &Job{
+		ID:       id,
+		Payload:  data,
+		Attempt:  1,
+		Enqueued: now().UTC(),
+	}
+
+	encoded, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+
+	var at int64
+	if delay > 0 {
+		at = now().Add(delay).UnixMilli()
+	}
+
+	_, err = redis.Active().Eval(enqueueScript, q.keys(), encoded, at)
+	if err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// Dead returns up to count of the oldest jobs in the dead letter stream
+func (q *Queue) Dead(count int) (jobs []*Job, err error) {
+
+	if count < 1 {
+		return nil, errors.New("count must be at least one")
+	}
+
+	reply, err := redis.Active().Eval(deadScript, q.keys(), count)
+	if err != nil {
+		return
+	}
+
+	return parseEntries(reply)
+}
+
+// Requeue moves a job returned by Dead back onto the queue with its attempts reset
+func (q *Queue) Requeue(job *Job) error {
+
+	if job == nil || job.entry == "" {
+		return errors.New("job is not from the dead letter stream")
+	}
+
+	requeued := *job
+	requeued.Attempt = 1
+	requeued.Error = ""
+
+	encoded, err := json.Marshal(&requeued)
+	if err != nil {
+		return err
+	}
+
+	moved, err := redigo.Int(redis.Active().Eval(requeueScript, q.keys(), job.entry, encoded))
+	if err != nil {
+		return err
+	}
+
+	if moved == 0 {
+		return errors.New("job is no longer in the dead letter stream")
+	}
+
+	return nil
+}
+
+// jobID returns a random id for a new job
+func jobID() (string, error) {
+	b := make([]byte, 12)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// parseEntries turns stream entries into jobs, entries that are not jobs are skipped
+func parseEntries(reply interface{}) (jobs []*Job, err error) {
+
+	entries, err := redigo.Values(reply, nil)
+	if err != nil {
+		if err == redigo.ErrNil {
+			return nil, nil
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		// entries deleted while pending are claimed as nil
+		parts, err := redigo.Values(entry, nil)
+		if err != nil || len(parts) < 2 {
+			continue
+		}
+
+		id, err := redigo.String(parts[0], nil)
+		if err != nil {
+			continue
+		}
+
+		fields, err := redigo.StringMap(parts[1], nil)
+		if err != nil {
+			continue
+		}
+
+		job := &Job{}
+
+		err = json.Unmarshal([]byte(fields["job"]), job)
+		if err != nil {
+			continue
+		}
+
+		job.entry = id
+
+		if len(parts) > 2 {
+			job.deliveries, _ = redigo.Int(parts[2], nil)
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+// adds a job to the stream or the delayed set if it has a time
+var enqueueScript = redigo.NewScript(3, `
+local at = tonumber(ARGV[2])
+
+if at > 0 then
+	redis.call("ZADD", KEYS[2], at, ARGV[1])
+	return 0
+end
+
+return redis.call("XADD", KEYS[1], "*", "job", ARGV[1])`)
+
+// returns the oldest entries of the dead letter stream
+var deadScript = redigo.NewScript(3, `
+return redis.call("XRANGE", KEYS[3], "-", "+", "COUNT", ARGV[1])`)
+
+// moves a dead job back to the stream if it is still there
+var requeueScript = redigo.NewScript(3, `
+if redis.call("XDEL", KEYS[3], ARGV[1]) == 0 then
+	return 0
+end
+
+redis.call("XADD", KEYS[1], "*", "job", ARGV[2])
+
+return 1`)
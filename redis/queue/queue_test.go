@@ -0,0 +1,144 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eirka/eirka-libs/internal/redistest"
+	"github.com/eirka/eirka-libs/internal/testclock"
+)
+
+type thumbnail struct {
+	Image uint `json:"image"`
+}
+
+func TestNew(t *testing.T) {
+
+	q, err := New("thumbnails", Options{})
+	if assert.NoError(t, err, "An error was not expected") {
+		assert.Equal(t, "thumbnails", q.Name(), "Name should match")
+		assert.Equal(t, DefaultConcurrency, q.opts.Concurrency, "Concurrency should default")
+		assert.Equal(t, DefaultMaxAttempts, q.opts.MaxAttempts, "Attempts should default")
+		assert.Equal(t, DefaultClaimIdle, q.opts.ClaimIdle, "Claim idle should default")
+		assert.Equal(t, DefaultGroup, q.opts.Group, "Group should default")
+		assert.NotNil(t, q.opts.Backoff, "Backoff should default")
+		assert.Equal(t, []string{"queue:{thumbnails}:jobs", "queue:{thumbnails}:delayed", "queue:{thumbnails}:dead"}, q.keys(), "Keys should share a hash tag")
+	}
+
+	for _, name := range []string{"", "bad:name", "bad{name}"} {
+		_, err := New(name, Options{})
+		assert.ErrorIs(t, err, ErrInvalidQueue, "Error should be invalid queue")
+	}
+
+	options := []Options{
+		{Concurrency: -1},
+		{MaxAttempts: -1},
+		{MaxDead: -1},
+		{ClaimIdle: -time.Second},
+		{PollInterval: -time.Second},
+	}
+
+	for _, opts := range options {
+		_, err := New("thumbnails", opts)
+		assert.ErrorIs(t, err, ErrInvalidQueue, "Error should be invalid queue")
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+
+	backoff := ExponentialBackoff(time.Second, 10*time.Second)
+
+	assert.Equal(t, time.Second, backoff(1), "First retry should wait the base")
+	assert.Equal(t, 2*time.Second, backoff(2), "Wait should double")
+	assert.Equal(t, 8*time.Second, backoff(4), "Wait should double")
+	assert.Equal(t, 10*time.Second, backoff(5), "Wait should stop at the limit")
+	assert.Equal(t, 10*time.Second, backoff(100), "Wait should stop at the limit")
+}
+
+func TestEnqueue(t *testing.T) {
+
+	redistest.Start(t)
+
+	advance := testclock.Freeze(t, &now)
+
+	q, err := New("enqueue", Options{})
+	assert.NoError(t, err, "An error was not expected")
+
+	job, err := q.Enqueue(thumbnail{Image: 1})
+	if assert.NoError(t, err, "An error was not expected") {
+		assert.NotEmpty(t, job.ID, "Job should have an id")
+		assert.Equal(t, 1, job.Attempt, "Attempt should start at one")
+	}
+
+	_, err = q.EnqueueIn(time.Minute, thumbnail{Image: 2})
+	assert.NoError(t, err, "An error was not expected")
+
+	jobs, err := q.fetch("worker", 10)
+	if assert.NoError(t, err, "An error was not expected") && assert.Len(t, jobs, 1, "Only the job that is due should be read") {
+		var payload thumbnail
+
+		assert.Equal(t, job.ID, jobs[0].ID, "Job should match")
+		assert.NoError(t, jobs[0].Decode(&payload), "An error was not expected")
+		assert.Equal(t, uint(1), payload.Image, "Payload should match")
+	}
+
+	advance(time.Minute)
+
+	jobs, err = q.fetch("worker", 10)
+	if assert.NoError(t, err, "An error was not expected") && assert.Len(t, jobs, 1, "Delayed job should be read once due") {
+		var payload thumbnail
+
+		assert.NoError(t, jobs[0].Decode(&payload), "An error was not expected")
+		assert.Equal(t, uint(2), payload.Image, "Payload should match")
+	}
+
+	jobs, err = q.fetch("worker", 10)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Empty(t, jobs, "Jobs should only be read once")
+
+	_, err = q.Enqueue(func() {})
+	assert.Error(t, err, "An error was expected for a payload that can not be encoded")
+}
+
+func TestDeadRequeue(t *testing.T) {
+
+	redistest.Start(t)
+
+	q, err := New("dead", Options{MaxAttempts: 1})
+	assert.NoError(t, err, "An error was not expected")
+
+	job, err := q.Enqueue(thumbnail{Image: 1})
+	assert.NoError(t, err, "An error was not expected")
+
+	jobs, err := q.fetch("worker", 1)
+	if assert.NoError(t, err, "An error was not expected") && assert.Len(t, jobs, 1, "Job should be read") {
+		jobs[0].Attempt = 1
+		assert.NoError(t, q.finish("worker", jobs[0], assert.AnError), "An error was not expected")
+	}
+
+	dead, err := q.Dead(10)
+	if assert.NoError(t, err, "An error was not expected") && assert.Len(t, dead, 1, "Job should be dead") {
+		assert.Equal(t, job.ID, dead[0].ID, "Job should match")
+		assert.Equal(t, assert.AnError.Error(), dead[0].Error, "Error should be recorded")
+	}
+
+	assert.NoError(t, q.Requeue(dead[0]), "An error was not expected")
+	assert.Error(t, q.Requeue(dead[0]), "An error was expected for a job that was already requeued")
+	assert.Error(t, q.Requeue(job), "An error was expected for a job not from the dead letter stream")
+
+	dead, err = q.Dead(10)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Empty(t, dead, "Dead letter stream should be empty")
+
+	jobs, err = q.fetch("worker", 1)
+	if assert.NoError(t, err, "An error was not expected") && assert.Len(t, jobs, 1, "Requeued job should be read") {
+		assert.Equal(t, job.ID, jobs[0].ID, "Job should match")
+		assert.Equal(t, 1, jobs[0].Attempt, "Attempts should be reset")
+		assert.Empty(t, jobs[0].Error, "Error should be cleared")
+	}
+
+	_, err = q.Dead(0)
+	assert.Error(t, err, "An error was expected for no count")
+}
@@ -0,0 +1,255 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eirka/eirka-libs/redis"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// Handler runs a job, returning an error retries it after the backoff
+type Handler func(ctx context.Context, job *Job) error
+
+var (
+	// ErrAbandoned is the error of a job that stopped its worker on every attempt
+	ErrAbandoned = errors.New("job was abandoned by its worker")
+
+	// runs numbers the calls to Run for the consumer names
+	runs atomic.Uint64
+)
+
+// Run hands jobs to the handler until the context is done, then waits for the running jobs to finish
+// Handlers get their own context that ends after ClaimIdle so shutting down does not interrupt them. Every
+// worker reads as its own consumer named after the instance, the call to Run and the worker.
+func (q *Queue) Run(ctx context.Context, handler Handler) error {
+
+	if handler == nil {
+		return errors.New("handler cannot be nil")
+	}
+
+	run := runs.Add(1)
+
+	// the numbers of the free workers
+	workers := make(chan int, q.opts.Concurrency)
+	for i := 1; i <= q.opts.Concurrency; i++ {
+		workers <- i
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		var worker int
+
+		// wait for a free worker
+		select {
+		case worker = <-workers:
+		case <-ctx.Done():
+			return nil
+		}
+
+		consumer := fmt.Sprintf("%s-%d-%d", redis.InstanceID, run, worker)
+
+		jobs, err := q.fetch(consumer, 1)
+		if err != nil {
+			q.onError(nil, err)
+		}
+
+		if len(jobs) == 0 {
+			workers <- worker
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(q.opts.PollInterval):
+			}
+
+			continue
+		}
+
+		wg.Add(1)
+
+		go func(job *Job) {
+			defer wg.Done()
+			defer func() { workers <- worker }()
+
+			q.process(ctx, consumer, handler, job)
+		}(jobs[0])
+	}
+}
+
+// fetch moves due delayed jobs onto the stream and reads up to count jobs for the consumer,
+// taking over jobs that other consumers left pending first
+// A job that was taken over counts every delivery as an attempt, so one that keeps stopping its worker
+// is moved to the dead letter stream once it is over MaxAttempts instead of running again.
+func (q *Queue) fetch(consumer string, count int) ([]*Job, error) {
+
+	reply, err := redis.Active().Eval(fetchScript, q.keys(),
+		now().UnixMilli(), q.opts.Group, consumer, count, q.opts.ClaimIdle.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+
+	jobs, err := parseEntries(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	runnable := jobs[:0]
+
+	for _, job := range jobs {
+		if job.deliveries > 1 {
+			job.Attempt += job.deliveries - 1
+		}
+
+		if job.Attempt <= q.opts.MaxAttempts {
+			runnable = append(runnable, job)
+			continue
+		}
+
+		err = q.finish(consumer, job, ErrAbandoned)
+		if err != nil {
+			q.onError(job, err)
+		}
+	}
+
+	return runnable, nil
+}
+
+// process runs the handler and acknowledges, retries or buries the job
+func (q *Queue) process(ctx context.Context, consumer string, handler Handler, job *Job) {
+
+	jobCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), q.opts.ClaimIdle)
+	err := call(jobCtx, handler, job)
+	cancel()
+
+	err = q.finish(consumer, job, err)
+	if err != nil {
+		// the job stays pending and is claimed again after ClaimIdle
+		q.onError(job, err)
+	}
+}
+
+// call runs the handler, turning a panic into an error
+func call(ctx context.Context, handler Handler, job *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+
+	return handler(ctx, job)
+}
+
+// finish removes the job from the stream and schedules a retry or moves it to the dead letter stream if it failed
+func (q *Queue) finish(consumer string, job *Job, failure error) error {
+
+	if failure == nil {
+		_, err := redis.Active().Eval(finishScript, q.keys(), q.opts.Group, consumer, job.entry, "ack")
+		return err
+	}
+
+	next := *job
+	next.Error = failure.Error()
+
+	if job.Attempt >= q.opts.MaxAttempts {
+		encoded, err := json.Marshal(&next)
+		if err != nil {
+			return err
+		}
+
+		_, err = redis.Active().Eval(finishScript, q.keys(), q.opts.Group, consumer, job.entry, "dead", encoded, q.opts.MaxDead)
+		return err
+	}
+
+	next.Attempt++
+
+	encoded, err := json.Marshal(&next)
+	if err != nil {
+		return err
+	}
+
+	at := now().Add(q.opts.Backoff(job.Attempt)).UnixMilli()
+
+	_, err = redis.Active().Eval(finishScript, q.keys(), q.opts.Group, consumer, job.entry, "retry", encoded, at)
+	return err
+}
+
+// onError passes an error to the hook if there is one
+func (q *Queue) onError(job *Job, err error) {
+	if q.opts.OnError != nil {
+		q.opts.OnError(job, err)
+	}
+}
+
+// moves due delayed jobs to the stream, claims idle jobs from other consumers and reads new ones
+var fetchScript = redigo.NewScript(3, `
+local now = ARGV[1]
+local group = ARGV[2]
+local consumer = ARGV[3]
+local count = tonumber(ARGV[4])
+local idle = ARGV[5]
+
+local due = redis.call("ZRANGEBYSCORE", KEYS[2], "-inf", now, "LIMIT", 0, 100)
+for _, job in ipairs(due) do
+	redis.call("XADD", KEYS[1], "*", "job", job)
+	redis.call("ZREM", KEYS[2], job)
+end
+
+-- reading from the start keeps jobs added before the group existed
+redis.pcall("XGROUP", "CREATE", KEYS[1], group, "0", "MKSTREAM")
+
+local entries = {}
+
+-- claimed entries carry their delivery count so crashed attempts are counted
+local claimed = redis.call("XAUTOCLAIM", KEYS[1], group, consumer, idle, "0-0", "COUNT", count)
+for _, entry in ipairs(claimed[2]) do
+	if entry then
+		local pending = redis.call("XPENDING", KEYS[1], group, entry[1], entry[1], 1)
+		if pending[1] then
+			table.insert(entry, pending[1][4])
+		end
+		table.insert(entries, entry)
+	end
+end
+
+if #entries < count then
+	local read = redis.call("XREADGROUP", "GROUP", group, consumer, "COUNT", count - #entries, "STREAMS", KEYS[1], ">")
+	if read and read[1] then
+		for _, entry in ipairs(read[1][2]) do
+			table.insert(entries, entry)
+		end
+	end
+end
+
+return entries`)
+
+// acknowledges a job if the consumer still owns it, then schedules the retry or buries it
+var finishScript = redigo.NewScript(3, `
+local group = ARGV[1]
+local consumer = ARGV[2]
+local entry = ARGV[3]
+local action = ARGV[4]
+
+-- another worker claimed the job so it is theirs to finish
+local pending = redis.call("XPENDING", KEYS[1], group, entry, entry, 1)
+if #pending == 0 or pending[1][2] ~= consumer then
+	return 0
+end
+
+redis.call("XACK", KEYS[1], group, entry)
+redis.call("XDEL", KEYS[1], entry)
+
+if action == "retry" then
+	redis.call("ZADD", KEYS[2], ARGV[6], ARGV[5])
+elseif action == "dead" then
+	redis.call("XADD", KEYS[3], "MAXLEN", "~", ARGV[6], "*", "job", ARGV[5])
+end
+
+return 1`)
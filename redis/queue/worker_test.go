@@ -0,0 +1,289 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eirka/eirka-libs/internal/redistest"
+	"github.com/eirka/eirka-libs/redis"
+)
+
+// runQueue runs the queue in the background and returns a function that stops it
+func runQueue(t *testing.T, q *Queue, handler Handler) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error)
+
+	go func() {
+		done <- q.Run(ctx, handler)
+	}()
+
+	return func() {
+		cancel()
+		assert.NoError(t, <-done, "An error was not expected")
+	}
+}
+
+func TestRun(t *testing.T) {
+
+	redistest.Start(t)
+
+	q, err := New("run", Options{Concurrency: 3, PollInterval: 10 * time.Millisecond})
+	assert.NoError(t, err, "An error was not expected")
+
+	for i := uint(1); i <= 10; i++ {
+		_, err = q.Enqueue(thumbnail{Image: i})
+		assert.NoError(t, err, "An error was not expected")
+	}
+
+	var (
+		mu      sync.Mutex
+		images  = make(map[uint]int)
+		running int
+		most    int
+	)
+
+	stop := runQueue(t, q, func(ctx context.Context, job *Job) error {
+		var payload thumbnail
+
+		err := job.Decode(&payload)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		images[payload.Image]++
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+
+		return nil
+	})
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(images) == 10
+	}, 5*time.Second, 10*time.Millisecond, "Every job should run")
+
+	stop()
+
+	for image, runs := range images {
+		assert.Equal(t, 1, runs, "Job %d should run once", image)
+	}
+
+	assert.LessOrEqual(t, most, 3, "Jobs should not run above the concurrency")
+
+	jobs, err := q.fetch("worker", 10)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Empty(t, jobs, "Jobs should be acknowledged")
+
+	assert.Error(t, q.Run(context.Background(), nil), "An error was expected for no handler")
+}
+
+func TestRunRetry(t *testing.T) {
+
+	redistest.Start(t)
+
+	q, err := New("retry", Options{
+		MaxAttempts:  3,
+		PollInterval: 10 * time.Millisecond,
+		Backoff: func(attempt int) time.Duration {
+			return 0
+		},
+	})
+	assert.NoError(t, err, "An error was not expected")
+
+	retried, err := q.Enqueue(thumbnail{Image: 1})
+	assert.NoError(t, err, "An error was not expected")
+
+	buried, err := q.Enqueue(thumbnail{Image: 2})
+	assert.NoError(t, err, "An error was not expected")
+
+	var (
+		mu       sync.Mutex
+		attempts = make(map[string][]int)
+		errs     = make(map[string]string)
+	)
+
+	stop := runQueue(t, q, func(ctx context.Context, job *Job) error {
+		mu.Lock()
+		attempts[job.ID] = append(attempts[job.ID], job.Attempt)
+		errs[job.ID] = job.Error
+		mu.Unlock()
+
+		if job.ID == buried.ID {
+			panic("corrupt image")
+		}
+
+		if job.Attempt == 1 {
+			return errors.New("upload failed")
+		}
+
+		return nil
+	})
+
+	assert.Eventually(t, func() bool {
+		dead, err := q.Dead(10)
+		return err == nil && len(dead) == 1
+	}, 5*time.Second, 10*time.Millisecond, "Failing job should be moved to the dead letter stream")
+
+	stop()
+
+	assert.Equal(t, []int{1, 2}, attempts[retried.ID], "Job should be retried once")
+	assert.Equal(t, "upload failed", errs[retried.ID], "Retry should have the last error")
+	assert.Equal(t, []int{1, 2, 3}, attempts[buried.ID], "Job should run until the attempts are used")
+
+	dead, err := q.Dead(10)
+	if assert.NoError(t, err, "An error was not expected") && assert.Len(t, dead, 1, "Job should be dead") {
+		assert.Equal(t, buried.ID, dead[0].ID, "Job should match")
+		assert.Equal(t, "job panicked: corrupt image", dead[0].Error, "Error should be recorded")
+	}
+}
+
+func TestRunClaim(t *testing.T) {
+
+	redistest.Start(t)
+
+	q, err := New("claim", Options{
+		ClaimIdle:    50 * time.Millisecond,
+		PollInterval: 10 * time.Millisecond,
+	})
+	assert.NoError(t, err, "An error was not expected")
+
+	job, err := q.Enqueue(thumbnail{Image: 1})
+	assert.NoError(t, err, "An error was not expected")
+
+	// a worker reads the job and crashes
+	jobs, err := q.fetch("crashed", 1)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Len(t, jobs, 1, "Job should be read")
+
+	claimed := make(chan *Job, 1)
+
+	stop := runQueue(t, q, func(ctx context.Context, job *Job) error {
+		claimed <- job
+		return nil
+	})
+	defer stop()
+
+	select {
+	case got := <-claimed:
+		assert.Equal(t, job.ID, got.ID, "Job should be claimed from the crashed worker")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the job to be claimed")
+	}
+
+	// the crashed worker can no longer finish it
+	assert.NoError(t, q.finish("crashed", jobs[0], errors.New("late")), "An error was not expected")
+
+	dead, err := q.Dead(10)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Empty(t, dead, "Job should not be buried by the old worker")
+}
+
+func TestRunAbandoned(t *testing.T) {
+
+	redistest.Start(t)
+
+	q, err := New("abandoned", Options{
+		MaxAttempts: 2,
+		ClaimIdle:   20 * time.Millisecond,
+	})
+	assert.NoError(t, err, "An error was not expected")
+
+	job, err := q.Enqueue(thumbnail{Image: 1})
+	assert.NoError(t, err, "An error was not expected")
+
+	// the first worker crashes
+	jobs, err := q.fetch("first", 1)
+	if assert.NoError(t, err, "An error was not expected") && assert.Len(t, jobs, 1, "Job should be read") {
+		assert.Equal(t, 1, jobs[0].Attempt, "Attempt should match")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	// the second worker takes it over and crashes too
+	jobs, err = q.fetch("second", 1)
+	if assert.NoError(t, err, "An error was not expected") && assert.Len(t, jobs, 1, "Job should be claimed") {
+		assert.Equal(t, 2, jobs[0].Attempt, "Crashed attempt should be counted")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	jobs, err = q.fetch("third", 1)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Empty(t, jobs, "Job should not run again")
+
+	dead, err := q.Dead(10)
+	if assert.NoError(t, err, "An error was not expected") && assert.Len(t, dead, 1, "Job should be dead") {
+		assert.Equal(t, job.ID, dead[0].ID, "Job should match")
+		assert.Equal(t, 3, dead[0].Attempt, "Attempts should match")
+		assert.Equal(t, ErrAbandoned.Error(), dead[0].Error, "Error should be recorded")
+	}
+}
+
+func TestRunConsumers(t *testing.T) {
+
+	redistest.Start(t)
+
+	q, err := New("consumers", Options{Concurrency: 2, PollInterval: 10 * time.Millisecond})
+	assert.NoError(t, err, "An error was not expected")
+
+	for i := uint(1); i <= 2; i++ {
+		_, err = q.Enqueue(thumbnail{Image: i})
+		assert.NoError(t, err, "An error was not expected")
+	}
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+
+	stop := runQueue(t, q, func(ctx context.Context, job *Job) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	})
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the jobs to start")
+		}
+	}
+
+	conn := redis.Cache.Pool.Get()
+	defer conn.Close()
+
+	reply, err := redigo.Values(conn.Do("XPENDING", q.keys()[0], q.opts.Group))
+	if assert.NoError(t, err, "An error was not expected") && assert.Len(t, reply, 4, "Reply should be a summary") {
+		consumers, err := redigo.Values(reply[3], nil)
+		assert.NoError(t, err, "An error was not expected")
+		assert.Len(t, consumers, 2, "Every worker should be its own consumer")
+
+		for _, consumer := range consumers {
+			fields, _ := redigo.Strings(consumer, nil)
+			if assert.Len(t, fields, 2, "Consumer should have a name and count") {
+				assert.True(t, strings.HasPrefix(fields[0], redis.InstanceID+"-"), "Consumer should be named after the instance")
+			}
+		}
+	}
+
+	close(release)
+	stop()
+}
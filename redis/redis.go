@@ -2,9 +2,12 @@ package redis
 
 import (
 	"errors"
+	"fmt"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/eirka/eirka-libs/config"
 	"github.com/gomodule/redigo/redis"
 	"github.com/rafaeljusto/redigomock"
 )
@@ -37,6 +40,14 @@ type Store struct {
 	Pool  Pool
 	Mutex *Mutex
 	Mock  *redigomock.Conn
+	// Local is the optional in process cache in front of Get and HGet of registered keys
+	Local *LocalCache
+	// Prefix is prepended to every key so separate environments or apps can share a server
+	Prefix string
+	// Breaker skips redis while it is unreachable, nil disables it
+	Breaker *Breaker
+
+	counters *cacheCounters
 }
 
 var (
@@ -46,6 +57,29 @@ var (
 	ErrCacheMiss = errors.New("cache: key not found")
 )
 
+var (
+	// activeMu guards the active store
+	activeMu sync.RWMutex
+	// active is the store used by keys
+	active Storer = &Cache
+)
+
+// Active returns the Storer used by keys, the redis Cache unless NewMemoryCache was called
+func Active() Storer {
+	activeMu.RLock()
+	defer activeMu.RUnlock()
+
+	return active
+}
+
+// setActive changes the store used by keys
+func setActive(store Storer) {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+
+	active = store
+}
+
 // Redis holds connection options for redis
 type Redis struct {
 	// Redis address and max pool connections
@@ -53,28 +87,105 @@ type Redis struct {
 	Address        string
 	MaxIdle        int
 	MaxConnections int
+	// LocalCacheSize enables an in process LRU of this many entries in front of redis for registered keys
+	LocalCacheSize int
+	// LocalCacheTTL is how long local entries live, DefaultLocalCacheTTL if 0
+	LocalCacheTTL time.Duration
+	// Prefix is prepended to every key, the cache prefix from the config is used if empty
+	Prefix string
+	// DialTimeout limits how long connecting can take, DefaultDialTimeout if 0
+	DialTimeout time.Duration
+	// BreakerThreshold is how many consecutive connection failures open the breaker, DefaultBreakerThreshold if 0
+	BreakerThreshold int
+	// BreakerInterval is how long the breaker stays open between probes, DefaultBreakerInterval if 0
+	BreakerInterval time.Duration
+	// SentinelAddresses are the host:port of sentinels to ask for the master, Protocol and Address are not used if set
+	SentinelAddresses []string
+	// MasterName is the name the sentinels monitor the master under
+	MasterName string
 }
 
+// DefaultDialTimeout is used when Redis DialTimeout is 0
+const DefaultDialTimeout = time.Second
+
 // NewRedisCache creates a new pool
 func (r *Redis) NewRedisCache() {
 
-	Cache.Pool = &redis.Pool{
-		MaxIdle:     r.MaxIdle,
-		MaxActive:   r.MaxConnections,
-		IdleTimeout: 240 * time.Second,
-		Dial: func() (c redis.Conn, err error) {
-			c, err = redis.Dial(r.Protocol, r.Address)
-			if err != nil {
-				return
-			}
+	// set any key expiry overrides from the config
+	err := applyKeyConfig()
+	if err != nil {
+		panic(fmt.Errorf("failed to configure redis keys: %w", err))
+	}
+
+	dialTimeout := r.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = DefaultDialTimeout
+	}
+
+	dial := func() (c redis.Conn, err error) {
+		c, err = redis.Dial(r.Protocol, r.Address, redis.DialConnectTimeout(dialTimeout))
+		if err != nil {
 			return
-		},
+		}
+		return
+	}
+
+	var testOnBorrow func(c redis.Conn, t time.Time) error
+
+	// resolve the master on every dial so a failover only costs the pooled connections
+	if len(r.SentinelAddresses) > 0 {
+		if r.MasterName == "" {
+			panic(errors.New("redis master name must be set with sentinel addresses"))
+		}
+
+		s := &sentinel{
+			masterName: r.MasterName,
+			timeout:    dialTimeout,
+			addrs:      append([]string(nil), r.SentinelAddresses...),
+		}
+
+		dial = s.dial
+		testOnBorrow = s.testOnBorrow
+	}
+
+	Cache.Pool = &redis.Pool{
+		MaxIdle:      r.MaxIdle,
+		MaxActive:    r.MaxConnections,
+		IdleTimeout:  240 * time.Second,
+		Dial:         dial,
+		TestOnBorrow: testOnBorrow,
+	}
+
+	// namespace our keys
+	Cache.Prefix = r.Prefix
+	if Cache.Prefix == "" && config.Settings != nil {
+		Cache.Prefix = config.Settings.Cache.Prefix
 	}
 
 	// create our distributed lock
 	Cache.Mutex = NewMutex([]Pool{
 		Cache.Pool,
 	})
+	Cache.Mutex.Prefix = Cache.Prefix
+
+	Cache.counters = &cacheCounters{}
+
+	// stop sending commands while redis is unreachable
+	Cache.Breaker = NewBreaker(r.BreakerThreshold, r.BreakerInterval)
+
+	// stop any previous local cache
+	if Cache.Local != nil {
+		Cache.Local.Close()
+		Cache.Local = nil
+	}
+
+	// start the local cache and listen for invalidations from other instances
+	if r.LocalCacheSize > 0 {
+		Cache.Local = NewLocalCache(r.LocalCacheSize, r.LocalCacheTTL)
+		go Cache.Local.subscribe(Cache.Pool, Cache.invalidateChannel())
+	}
+
+	setActive(&Cache)
 
 	SetCacheInitialized()
 }
@@ -90,10 +201,44 @@ func NewRedisMock() {
 		},
 	}
 
+	Cache.Prefix = ""
+
 	// create our distributed lock
 	Cache.Mutex = NewMutex([]Pool{
 		Cache.Pool,
 	})
 
+	Cache.counters = &cacheCounters{}
+
+	// the mock scripts its own failures
+	Cache.Breaker = nil
+
+	if Cache.Local != nil {
+		Cache.Local.Close()
+		Cache.Local = nil
+	}
+
+	setActive(&Cache)
+
+	SetCacheInitialized()
+}
+
+// NewMemoryCache uses an in memory store instead of redis for tests and single node development
+// Keys use it transparently, the raw Cache is left alone. The store can not run lua scripts so
+// Eval returns ErrNotSupported, which means semaphores, rate limits, queues, counter flushes and
+// the scheduler do not work on it.
+func NewMemoryCache() *MemoryStore {
+
+	memory := NewMemoryStore()
+
+	setActive(memory)
+
 	SetCacheInitialized()
+
+	return memory
+}
+
+// prefixed returns the name of a key in redis
+func (c *Store) prefixed(key string) string {
+	return c.Prefix + key
 }
@@ -1,8 +1,11 @@
 package redis
 
 import (
+	"context"
 	"testing"
 
+	"github.com/eirka/eirka-libs/config"
+	"github.com/gomodule/redigo/redis"
 	"github.com/stretchr/testify/assert"
 	"github.com/stvp/tempredis"
 )
@@ -31,8 +34,70 @@ func TestNewRedisCache(t *testing.T) {
 
 	conn.Close()
 
+	assert.NoError(t, Ping(context.Background()), "An error was not expected")
+
 	server.Term()
 
+	assert.Error(t, Ping(context.Background()), "An error was expected after the server stopped")
+
+}
+
+func TestNewRedisCachePrefix(t *testing.T) {
+
+	server, err := tempredis.Start(tempredis.Config{})
+	if err != nil {
+		panic(err)
+	}
+	defer server.Term()
+
+	original := config.Settings.Cache.Prefix
+	defer func() {
+		config.Settings.Cache.Prefix = original
+	}()
+
+	config.Settings.Cache.Prefix = "staging:"
+
+	redisConfig := Redis{
+		Protocol:       "unix",
+		Address:        server.Socket(),
+		MaxIdle:        1,
+		MaxConnections: 5,
+	}
+
+	redisConfig.NewRedisCache()
+
+	assert.Equal(t, "staging:", Cache.Prefix, "Prefix should come from the config")
+	assert.Equal(t, "staging:", Cache.Mutex.Prefix, "Mutex should share the prefix")
+
+	redisConfig.Prefix = "app:"
+
+	redisConfig.NewRedisCache()
+
+	assert.Equal(t, "app:", Cache.Prefix, "Prefix should override the config")
+	assert.Equal(t, "app:", Cache.Mutex.Prefix, "Mutex should share the prefix")
+
+	err = Cache.Set("index:1", []byte("data"))
+	assert.NoError(t, err, "An error was not expected")
+
+	conn := Cache.Pool.Get()
+	defer conn.Close()
+
+	exists, err := redis.Bool(conn.Do("EXISTS", "app:index:1"))
+	assert.NoError(t, err, "An error was not expected")
+	assert.True(t, exists, "Key should be prefixed")
+
+	result, err := Cache.Get("index:1")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("data"), result, "Data should match")
+
+	err = Cache.Lock("index:1:mutex")
+	assert.NoError(t, err, "An error was not expected")
+
+	exists, err = redis.Bool(conn.Do("EXISTS", "app:index:1:mutex"))
+	assert.NoError(t, err, "An error was not expected")
+	assert.True(t, exists, "Lock should be prefixed")
+
+	assert.True(t, Cache.Unlock("index:1:mutex"), "Mutex should be unlocked")
 }
 
 // Test cache initialization status
@@ -0,0 +1,226 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidSchedule is returned if a cron expression or interval can not be used
+var ErrInvalidSchedule = errors.New("schedule not valid")
+
+// Schedule returns the next time a job runs after the given time
+type Schedule interface {
+	Next(after time.Time) time.Time
+}
+
+// every runs at multiples of an interval since the unix epoch
+type every time.Duration
+
+// Every returns a schedule that runs every interval
+// Runs are aligned to the unix epoch so every instance agrees on when they are.
+func Every(interval time.Duration) (Schedule, error) {
+	if interval < time.Second {
+		return nil, fmt.Errorf("%w: interval must be at least a second", ErrInvalidSchedule)
+	}
+	return every(interval), nil
+}
+
+// Next returns the start of the interval after the one the time is in
+func (e every) Next(after time.Time) time.Time {
+	return after.Truncate(time.Duration(e)).Add(time.Duration(e))
+}
+
+// cron is a parsed cron expression with a bit set for every field
+type cron struct {
+	minute, hour, dom, month, dow uint64
+	// a day matches either day field when both are restricted
+	anyDom, anyDow bool
+}
+
+// cronField is the range of a cron field
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// cronDescriptors are the shorthand expressions
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Cron parses a five field cron expression: minute, hour, day of month, month and day of week
+// Fields take *, numbers, ranges like 1-5, lists like 1,3 and steps like */15 or 0-30/10.
+// Sunday is 0 or 7. The descriptors @hourly, @daily, @weekly, @monthly and @yearly are also
+// accepted. Times are matched in UTC.
+func Cron(expr string) (Schedule, error) {
+
+	if descriptor, ok := cronDescriptors[strings.TrimSpace(expr)]; ok {
+		expr = descriptor
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("%w: cron expression needs %d fields: %q", ErrInvalidSchedule, len(cronFields), expr)
+	}
+
+	var (
+		sets [5]uint64
+		err  error
+	)
+
+	for i, field := range fields {
+		sets[i], err = parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// sunday can be written as 7
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+
+	schedule := &cron{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		anyDom: strings.HasPrefix(fields[2], "*"),
+		anyDow: strings.HasPrefix(fields[4], "*"),
+	}
+
+	if schedule.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("%w: cron expression never matches: %q", ErrInvalidSchedule, expr)
+	}
+
+	return schedule, nil
+}
+
+// parseCronField returns the bit set of the values a field matches
+func parseCronField(field string, bounds cronField) (set uint64, err error) {
+
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("%w: bad step in %s field: %q", ErrInvalidSchedule, bounds.name, part)
+			}
+		}
+
+		var low, high int
+
+		switch {
+		case rangePart == "*":
+			low, high = bounds.min, bounds.max
+		case strings.Contains(rangePart, "-"):
+			lowPart, highPart, _ := strings.Cut(rangePart, "-")
+
+			low, err = strconv.Atoi(lowPart)
+			if err != nil {
+				return 0, fmt.Errorf("%w: bad range in %s field: %q", ErrInvalidSchedule, bounds.name, part)
+			}
+
+			high, err = strconv.Atoi(highPart)
+			if err != nil {
+				return 0, fmt.Errorf("%w: bad range in %s field: %q", ErrInvalidSchedule, bounds.name, part)
+			}
+		default:
+			low, err = strconv.Atoi(rangePart)
+			if err != nil {
+				return 0, fmt.Errorf("%w: bad value in %s field: %q", ErrInvalidSchedule, bounds.name, part)
+			}
+
+			high = low
+			// a single value with a step runs to the end of the range
+			if hasStep {
+				high = bounds.max
+			}
+		}
+
+		if low < bounds.min || high > bounds.max || low > high {
+			return 0, fmt.Errorf("%w: %s field must be between %d and %d: %q", ErrInvalidSchedule, bounds.name, bounds.min, bounds.max, part)
+		}
+
+		for value := low; value <= high; value += step {
+			set |= 1 << uint(value)
+		}
+	}
+
+	return set, nil
+}
+
+// cronSearchLimit stops the search for expressions that never match, like february 30
+const cronSearchLimit = 5
+
+// Next returns the first minute after the time that matches the expression, or zero if none does
+func (c *cron) Next(after time.Time) time.Time {
+
+	t := after.UTC().Truncate(time.Minute).Add(time.Minute)
+
+	limit := t.AddDate(cronSearchLimit, 0, 0)
+
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+// matchDay checks the day fields, a restricted day of month or week is enough when both are set
+func (c *cron) matchDay(t time.Time) bool {
+
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+
+	switch {
+	case c.anyDom && c.anyDow:
+		return true
+	case c.anyDom:
+		return dow
+	case c.anyDow:
+		return dom
+	}
+
+	return dom || dow
+}
@@ -0,0 +1,81 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCron(t *testing.T) {
+
+	// a wednesday
+	start := time.Date(2024, time.January, 10, 10, 30, 15, 0, time.UTC)
+
+	tests := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2024, time.January, 10, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, time.January, 10, 10, 45, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2024, time.January, 11, 3, 0, 0, 0, time.UTC)},
+		{"0-10/5 11 * * *", time.Date(2024, time.January, 10, 11, 0, 0, 0, time.UTC)},
+		{"30 10 * * *", time.Date(2024, time.January, 11, 10, 30, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2024, time.January, 14, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, time.January, 14, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 1-5", time.Date(2024, time.January, 11, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2024, time.January, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 12 31 * *", time.Date(2024, time.January, 31, 12, 0, 0, 0, time.UTC)},
+		// either day field matches when both are set
+		{"0 0 20 * 5", time.Date(2024, time.January, 12, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, time.January, 10, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, time.January, 11, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		schedule, err := Cron(test.expr)
+		if assert.NoError(t, err, "An error was not expected for %s", test.expr) {
+			assert.Equal(t, test.next, schedule.Next(start), "Next run should match for %s", test.expr)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-a * * * *",
+		"0 0 30 2 *",
+		"@never",
+	}
+
+	for _, expr := range invalid {
+		_, err := Cron(expr)
+		assert.ErrorIs(t, err, ErrInvalidSchedule, "Error should be invalid schedule for %q", expr)
+	}
+}
+
+func TestEvery(t *testing.T) {
+
+	schedule, err := Every(time.Minute)
+	if assert.NoError(t, err, "An error was not expected") {
+		start := time.Date(2024, time.January, 10, 10, 30, 15, 0, time.UTC)
+		assert.Equal(t, time.Date(2024, time.January, 10, 10, 31, 0, 0, time.UTC), schedule.Next(start), "Next run should be aligned")
+
+		next := schedule.Next(start)
+		assert.Equal(t, next.Add(time.Minute), schedule.Next(next), "Next run should be an interval later")
+	}
+
+	_, err = Every(time.Millisecond)
+	assert.ErrorIs(t, err, ErrInvalidSchedule, "Error should be invalid schedule")
+}
@@ -0,0 +1,368 @@
+// Package scheduler runs jobs on cron expressions or intervals on exactly one instance
+//
+// Every instance runs the same scheduler and wakes at the same times. Before a run the
+// instances race for a lease on the job through the redis mutex, and the lease is extended
+// for as long as the job runs. The winner records the run in a status key so an instance
+// that wakes late does not run the same slot again, and the status is kept for inspection.
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eirka/eirka-libs/redis"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// keyPrefix is the first segment of every scheduler key
+const keyPrefix = "scheduler"
+
+var (
+	// ErrInvalidJob is returned if a job can not be registered
+	ErrInvalidJob = errors.New("job not valid")
+	// ErrRunning is returned when jobs are registered or Run is called while the scheduler is running
+	ErrRunning = errors.New("scheduler already running")
+	// ErrLeaseLost is passed to OnError when a lease could not be extended while its job ran
+	ErrLeaseLost = errors.New("job lease lost")
+	// ErrScriptsUnsupported is returned by Run when the active store can not run the lua scripts runs are claimed with
+	ErrScriptsUnsupported = errors.New("scheduler needs a store that runs lua scripts")
+
+	// now is the clock used for the status times
+	now = time.Now
+)
+
+// Func is the work done by a job
+// The context is cancelled when the scheduler stops or the lease is lost.
+type Func func(ctx context.Context) error
+
+// Status is the last run of a job
+type Status struct {
+	Name string `json:"name"`
+	// Instance is the redis InstanceID of the process that ran the job
+	Instance string `json:"instance"`
+	// Scheduled is the time the run was due
+	Scheduled time.Time `json:"scheduled"`
+	Started   time.Time `json:"started"`
+	// Finished and Duration are zero while the job is running
+	Finished time.Time     `json:"finished"`
+	Duration time.Duration `json:"duration"`
+	Running  bool          `json:"running"`
+	// Error is the error returned by the job
+	Error string `json:"error,omitempty"`
+}
+
+// Options controls how a scheduler reports errors
+type Options struct {
+	// OnError is called with the errors from jobs and from redis
+	OnError func(name string, err error)
+}
+
+// job is a registered job
+type job struct {
+	name     string
+	schedule Schedule
+	fn       Func
+}
+
+// Scheduler runs registered jobs on their schedules
+type Scheduler struct {
+	opts Options
+
+	mu      sync.Mutex
+	jobs    []*job
+	running bool
+}
+
+// New returns a scheduler without jobs
+func New(opts Options) *Scheduler {
+	return &Scheduler{
+		opts: opts,
+	}
+}
+
+// Register adds a job, it must be called before Run
+// Every instance should register the same jobs with the same schedules.
+func (s *Scheduler) Register(name string, schedule Schedule, fn Func) error {
+
+	if name == "" || strings.ContainsAny(name, ":{}") {
+		return fmt.Errorf("%w: name must be set and cannot contain a colon or braces", ErrInvalidJob)
+	}
+
+	if schedule == nil || fn == nil {
+		return fmt.Errorf("%w: schedule and function must be set", ErrInvalidJob)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return ErrRunning
+	}
+
+	for _, j := range s.jobs {
+		if j.name == name {
+			return fmt.Errorf("%w: %s is already registered", ErrInvalidJob, name)
+		}
+	}
+
+	s.jobs = append(s.jobs, &job{
+		name:     name,
+		schedule: schedule,
+		fn:       fn,
+	})
+
+	return nil
+}
+
+// key returns a redis key for a job
+func key(name, suffix string) string {
+	return fmt.Sprintf("%s:{%s}:%s", keyPrefix, name, suffix)
+}
+
+// Run starts the jobs on their schedules until the context is done, then waits for running jobs
+// A run is skipped if the job is still running from an earlier one.
+func (s *Scheduler) Run(ctx context.Context) error {
+
+	// runs are claimed with a script so the memory store can not be used
+	_, err := redis.Active().Eval(probeScript, nil)
+	if errors.Is(err, redis.ErrNotSupported) {
+		return ErrScriptsUnsupported
+	}
+	if errors.Is(err, redis.ErrCacheNotInitialized) {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return ErrRunning
+	}
+	s.running = true
+	jobs := s.jobs
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	current := now()
+
+	next := make([]time.Time, len(jobs))
+	for i, j := range jobs {
+		next[i] = j.schedule.Next(current)
+	}
+
+	for {
+		// a schedule that returns zero never runs again
+		var earliest time.Time
+		for _, t := range next {
+			if !t.IsZero() && (earliest.IsZero() || t.Before(earliest)) {
+				earliest = t
+			}
+		}
+
+		var (
+			timer *time.Timer
+			wake  <-chan time.Time
+		)
+
+		if !earliest.IsZero() {
+			timer = time.NewTimer(earliest.Sub(now()))
+			wake = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return nil
+		case <-wake:
+		}
+
+		current = now()
+
+		for i, j := range jobs {
+			if next[i].IsZero() || next[i].After(current) {
+				continue
+			}
+
+			wg.Add(1)
+			go func(j *job, scheduled time.Time) {
+				defer wg.Done()
+				s.run(ctx, j, scheduled)
+			}(j, next[i])
+
+			next[i] = j.schedule.Next(current)
+		}
+	}
+}
+
+// run takes the lease for a job and runs it if no instance has run the scheduled time yet
+func (s *Scheduler) run(ctx context.Context, j *job, scheduled time.Time) {
+
+	lease, err := redis.Active().Acquire(key(j.name, "lease"))
+	if errors.Is(err, redis.ErrFailed) {
+		// another instance is running it
+		return
+	}
+	if err != nil {
+		s.onError(j.name, err)
+		return
+	}
+	defer lease.Release()
+
+	status := Status{
+		Name:      j.name,
+		Instance:  redis.InstanceID,
+		Scheduled: scheduled,
+		Started:   now(),
+		Running:   true,
+	}
+
+	claimed, err := claim(status)
+	if err != nil {
+		s.onError(j.name, err)
+		return
+	}
+
+	// an instance that woke earlier already ran it
+	if !claimed {
+		return
+	}
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// keep the lease while the job runs, stopping the job if it was taken
+	stop := lease.Keep(cancel)
+
+	err = call(jobCtx, j.fn)
+
+	lost := stop()
+
+	if err != nil {
+		s.onError(j.name, err)
+	}
+
+	// the status may belong to another instance now
+	if lost {
+		s.onError(j.name, ErrLeaseLost)
+		return
+	}
+
+	status.Finished = now()
+	status.Duration = status.Finished.Sub(status.Started)
+	status.Running = false
+
+	if err != nil {
+		status.Error = err.Error()
+	}
+
+	err = save(status)
+	if err != nil {
+		s.onError(j.name, err)
+	}
+}
+
+// call runs the job, turning a panic into an error
+func call(ctx context.Context, fn Func) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+
+	return fn(ctx)
+}
+
+// claim records the start of a run if the scheduled time is later than the last run
+func claim(status Status) (bool, error) {
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		return false, err
+	}
+
+	return redigo.Bool(redis.Active().Eval(claimScript, []string{key(status.Name, "scheduled"), key(status.Name, "status")},
+		status.Scheduled.UnixMilli(), data))
+}
+
+// save writes the status of a job
+func save(status Status) error {
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	return redis.Active().Set(key(status.Name, "status"), data)
+}
+
+// Status returns the last run of a job, ErrCacheMiss if it has not run
+// A status left running by an instance that crashed stays running until the next run.
+func (s *Scheduler) Status(name string) (status Status, err error) {
+
+	data, err := redis.Active().Get(key(name, "status"))
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &status)
+
+	return
+}
+
+// Statuses returns the last run of every registered job that has run
+func (s *Scheduler) Statuses() (statuses []Status, err error) {
+
+	s.mu.Lock()
+	jobs := s.jobs
+	s.mu.Unlock()
+
+	for _, j := range jobs {
+		status, err := s.Status(j.name)
+		if err == redis.ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return
+}
+
+// onError passes an error to the hook
+func (s *Scheduler) onError(name string, err error) {
+	if s.opts.OnError != nil {
+		s.opts.OnError(name, err)
+	}
+}
+
+// sets the last scheduled time and the status unless a run at or after the time was already claimed
+var claimScript = redigo.NewScript(2, `
+local last = tonumber(redis.call("GET", KEYS[1]) or "0")
+if last >= tonumber(ARGV[1]) then
+	return 0
+end
+
+redis.call("SET", KEYS[1], ARGV[1])
+redis.call("SET", KEYS[2], ARGV[2])
+
+return 1`)
+
+// checks that the store runs scripts
+var probeScript = redigo.NewScript(0, `return 1`)
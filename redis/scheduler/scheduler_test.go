@@ -0,0 +1,251 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eirka/eirka-libs/internal/redistest"
+	"github.com/eirka/eirka-libs/redis"
+)
+
+// fast runs faster than Every allows so the tests do not wait for seconds
+type fast time.Duration
+
+func (f fast) Next(after time.Time) time.Time {
+	return after.Truncate(time.Duration(f)).Add(time.Duration(f))
+}
+
+func TestRegister(t *testing.T) {
+
+	s := New(Options{})
+
+	noop := func(ctx context.Context) error {
+		return nil
+	}
+
+	assert.NoError(t, s.Register("cleanup", fast(time.Second), noop), "An error was not expected")
+
+	err := s.Register("cleanup", fast(time.Second), noop)
+	assert.ErrorIs(t, err, ErrInvalidJob, "Error should be invalid job for a duplicate")
+
+	for _, name := range []string{"", "bad:name", "bad{name}"} {
+		err = s.Register(name, fast(time.Second), noop)
+		assert.ErrorIs(t, err, ErrInvalidJob, "Error should be invalid job")
+	}
+
+	err = s.Register("nothing", nil, noop)
+	assert.ErrorIs(t, err, ErrInvalidJob, "Error should be invalid job without a schedule")
+
+	err = s.Register("nothing", fast(time.Second), nil)
+	assert.ErrorIs(t, err, ErrInvalidJob, "Error should be invalid job without a function")
+
+	assert.Equal(t, "scheduler:{cleanup}:lease", key("cleanup", "lease"), "Key should have a hash tag")
+}
+
+func TestRunSingleInstance(t *testing.T) {
+
+	redistest.Start(t)
+
+	var (
+		mu   sync.Mutex
+		runs = map[time.Time]int{}
+	)
+
+	interval := 100 * time.Millisecond
+
+	prune := func(ctx context.Context) error {
+		mu.Lock()
+		runs[now().Truncate(interval)]++
+		mu.Unlock()
+
+		// long enough that both instances see the run
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+
+	// two instances with the same jobs
+	for i := 0; i < 2; i++ {
+		s := New(Options{})
+		assert.NoError(t, s.Register("prune", fast(interval), prune), "An error was not expected")
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, s.Run(ctx), "An error was not expected")
+		}()
+	}
+
+	time.Sleep(550 * time.Millisecond)
+	cancel()
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.GreaterOrEqual(t, len(runs), 3, "Job should run on its schedule")
+
+	for slot, count := range runs {
+		assert.Equal(t, 1, count, "Job should run once at %s", slot)
+	}
+
+	s := New(Options{})
+	assert.NoError(t, s.Register("prune", fast(interval), prune), "An error was not expected")
+
+	status, err := s.Status("prune")
+	if assert.NoError(t, err, "An error was not expected") {
+		assert.Equal(t, redis.InstanceID, status.Instance, "Instance should match")
+		assert.False(t, status.Running, "Job should be finished")
+		assert.GreaterOrEqual(t, status.Duration, 20*time.Millisecond, "Duration should be set")
+		assert.Empty(t, status.Error, "Error should be empty")
+	}
+
+	statuses, err := s.Statuses()
+	assert.NoError(t, err, "An error was not expected")
+	assert.Len(t, statuses, 1, "Statuses should include the job")
+
+	_, err = s.Status("blah")
+	assert.Equal(t, redis.ErrCacheMiss, err, "Error should be a cache miss")
+}
+
+func TestRunFailures(t *testing.T) {
+
+	redistest.Start(t)
+
+	errs := make(chan error, 10)
+
+	s := New(Options{
+		OnError: func(name string, err error) {
+			errs <- err
+		},
+	})
+
+	assert.NoError(t, s.Register("broken", fast(50*time.Millisecond), func(ctx context.Context) error {
+		return errors.New("out of disk")
+	}), "An error was not expected")
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+
+	select {
+	case err := <-errs:
+		assert.EqualError(t, err, "out of disk", "Error should come from the job")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the job")
+	}
+
+	assert.Equal(t, ErrRunning, s.Run(ctx), "Error should be running")
+	assert.Equal(t, ErrRunning, s.Register("late", fast(time.Second), func(ctx context.Context) error {
+		return nil
+	}), "Error should be running")
+
+	cancel()
+	assert.NoError(t, <-done, "An error was not expected")
+
+	status, err := s.Status("broken")
+	if assert.NoError(t, err, "An error was not expected") {
+		assert.Equal(t, "out of disk", status.Error, "Error should be recorded")
+	}
+
+	// a panic is reported like an error
+	assert.Contains(t, call(ctx, func(ctx context.Context) error {
+		panic("boom")
+	}).Error(), "boom", "Panic should be returned as an error")
+}
+
+func TestRunHeldLease(t *testing.T) {
+
+	redistest.Start(t)
+
+	s := New(Options{})
+
+	j := &job{
+		name:     "held",
+		schedule: fast(time.Second),
+		fn: func(ctx context.Context) error {
+			t.Error("job should not run while another instance holds the lease")
+			return nil
+		},
+	}
+
+	// another instance is running the job
+	lease, err := redis.Cache.Mutex.Acquire(key("held", "lease"))
+	assert.NoError(t, err, "An error was not expected")
+
+	s.run(context.Background(), j, now())
+
+	_, err = s.Status("held")
+	assert.Equal(t, redis.ErrCacheMiss, err, "Job should not have run")
+
+	assert.True(t, lease.Release(), "Lease should be released")
+
+	// a later run was already claimed
+	scheduled := now()
+
+	claimed, err := claim(Status{Name: "held", Scheduled: scheduled})
+	assert.NoError(t, err, "An error was not expected")
+	assert.True(t, claimed, "Run should be claimed")
+
+	s.run(context.Background(), j, scheduled.Add(-time.Second))
+	s.run(context.Background(), j, scheduled)
+}
+
+func TestRunLostLease(t *testing.T) {
+
+	redistest.Start(t)
+
+	redis.Cache.Mutex.Expiry = 30 * time.Millisecond
+
+	errs := make(chan error, 10)
+
+	s := New(Options{
+		OnError: func(name string, err error) {
+			errs <- err
+		},
+	})
+
+	j := &job{
+		name:     "lost",
+		schedule: fast(time.Second),
+		fn: func(ctx context.Context) error {
+			// the lease is taken from under the job
+			_ = redis.Cache.Delete(key("lost", "lease"))
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+
+	s.run(context.Background(), j, now())
+
+	assert.Equal(t, context.Canceled, <-errs, "Job should be cancelled")
+	assert.Equal(t, ErrLeaseLost, <-errs, "Error should be lease lost")
+}
+
+func TestRunMemoryStore(t *testing.T) {
+
+	redis.NewMemoryCache()
+
+	s := New(Options{})
+
+	assert.NoError(t, s.Register("memory", fast(time.Second), func(ctx context.Context) error {
+		return nil
+	}), "An error was not expected")
+
+	assert.Equal(t, ErrScriptsUnsupported, s.Run(context.Background()), "Error should be scripts unsupported")
+
+	// the status is read through the active store
+	_, err := s.Status("memory")
+	assert.Equal(t, redis.ErrCacheMiss, err, "Job should not have run")
+}
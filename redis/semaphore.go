@@ -0,0 +1,138 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// DefaultSemaphoreDelay is used when Semaphore Delay is 0
+const DefaultSemaphoreDelay = 100 * time.Millisecond
+
+// A Semaphore lets up to Limit holders run at once across every instance
+// Holders are random tokens in a sorted set scored by when they expire, so the slot of a
+// holder that crashed without releasing is taken back once its expiry passes.
+type Semaphore struct {
+	Limit int // Number of holders allowed at once
+
+	Expiry time.Duration // Duration a holder keeps its slot without extending it, DefaultExpiry if 0
+	Delay  time.Duration // Delay between two attempts in Acquire, DefaultSemaphoreDelay if 0
+
+	key string
+}
+
+// NewSemaphore returns a semaphore with a limit on a key in the active store
+func NewSemaphore(name string, limit int) *Semaphore {
+	return &Semaphore{
+		Limit: limit,
+		key:   name + ":semaphore",
+	}
+}
+
+// Acquire waits for a free slot and returns the token that holds it
+// It keeps trying until the context is done.
+func (s *Semaphore) Acquire(ctx context.Context) (string, error) {
+	delay := s.Delay
+	if delay == 0 {
+		delay = DefaultSemaphoreDelay
+	}
+
+	for {
+		token, err := s.TryAcquire()
+		if err != ErrFailed {
+			return token, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// TryAcquire makes a single attempt at a slot, returning ErrFailed if they are all held
+func (s *Semaphore) TryAcquire() (string, error) {
+	if s.Limit < 1 {
+		return "", errors.New("semaphore limit must be greater than 0")
+	}
+
+	token, err := lockValue()
+	if err != nil {
+		return "", err
+	}
+
+	acquired, err := redis.Bool(Active().Eval(semaphoreAcquireScript, []string{s.key}, s.Limit, token, s.expiry()))
+	if err != nil {
+		return "", err
+	}
+
+	if !acquired {
+		return "", ErrFailed
+	}
+
+	return token, nil
+}
+
+// Extend resets the expiry of a held slot, returning false if it expired and was lost
+func (s *Semaphore) Extend(token string) bool {
+	extended, err := redis.Bool(Active().Eval(semaphoreExtendScript, []string{s.key}, token, s.expiry()))
+	return err == nil && extended
+}
+
+// Release gives up a held slot
+func (s *Semaphore) Release(token string) bool {
+	released, err := redis.Bool(Active().Eval(semaphoreReleaseScript, []string{s.key}, token))
+	return err == nil && released
+}
+
+// expiry returns the holder expiry in milliseconds
+func (s *Semaphore) expiry() int64 {
+	if s.Expiry == 0 {
+		return DefaultExpiry.Milliseconds()
+	}
+	return s.Expiry.Milliseconds()
+}
+
+// clears expired holders and adds the token if there is a free slot
+// the server clock is used so instances with drifting clocks agree on expiry
+var semaphoreAcquireScript = redis.NewScript(1, `
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now)
+
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[1]) then
+	return 0
+end
+
+redis.call("ZADD", KEYS[1], now + tonumber(ARGV[3]), ARGV[2])
+
+-- the set goes away with the last holder
+local last = redis.call("ZRANGE", KEYS[1], -1, -1, "WITHSCORES")
+redis.call("PEXPIREAT", KEYS[1], last[2])
+
+return 1`)
+
+// moves the expiry of the token forward if it has not expired
+var semaphoreExtendScript = redis.NewScript(1, `
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local score = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if not score or tonumber(score) <= now then
+	return 0
+end
+
+redis.call("ZADD", KEYS[1], now + tonumber(ARGV[2]), ARGV[1])
+
+local last = redis.call("ZRANGE", KEYS[1], -1, -1, "WITHSCORES")
+redis.call("PEXPIREAT", KEYS[1], last[2])
+
+return 1`)
+
+// removes the token
+var semaphoreReleaseScript = redis.NewScript(1, `
+return redis.call("ZREM", KEYS[1], ARGV[1])`)
@@ -0,0 +1,164 @@
+package redis
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stvp/tempredis"
+)
+
+func TestSemaphore(t *testing.T) {
+
+	server, err := tempredis.Start(tempredis.Config{})
+	if err != nil {
+		panic(err)
+	}
+	defer server.Term()
+
+	config := Redis{
+		Protocol:       "unix",
+		Address:        server.Socket(),
+		MaxIdle:        1,
+		MaxConnections: 10,
+	}
+
+	config.NewRedisCache()
+
+	sem := NewSemaphore("webm", 2)
+
+	first, err := sem.TryAcquire()
+	assert.NoError(t, err, "An error was not expected")
+
+	second, err := sem.TryAcquire()
+	assert.NoError(t, err, "An error was not expected")
+	assert.NotEqual(t, first, second, "Tokens should be unique")
+
+	_, err = sem.TryAcquire()
+	assert.Equal(t, ErrFailed, err, "Error should be failed when every slot is held")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = sem.Acquire(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err, "Acquire should give up with the context")
+
+	assert.True(t, sem.Release(first), "Slot should be released")
+	assert.False(t, sem.Release(first), "Slot should only be released once")
+
+	third, err := sem.Acquire(context.Background())
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.True(t, sem.Release(second), "Slot should be released")
+	assert.True(t, sem.Release(third), "Slot should be released")
+
+	_, err = NewSemaphore("webm", 0).TryAcquire()
+	assert.Error(t, err, "An error was expected for a limit of 0")
+}
+
+func TestSemaphoreExpiry(t *testing.T) {
+
+	server, err := tempredis.Start(tempredis.Config{})
+	if err != nil {
+		panic(err)
+	}
+	defer server.Term()
+
+	config := Redis{
+		Protocol:       "unix",
+		Address:        server.Socket(),
+		MaxIdle:        1,
+		MaxConnections: 10,
+	}
+
+	config.NewRedisCache()
+
+	sem := NewSemaphore("upload", 1)
+	sem.Expiry = 200 * time.Millisecond
+
+	held, err := sem.TryAcquire()
+	assert.NoError(t, err, "An error was not expected")
+
+	// extending keeps the slot past its first expiry
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		assert.True(t, sem.Extend(held), "Slot should be extended")
+	}
+
+	_, err = sem.TryAcquire()
+	assert.Equal(t, ErrFailed, err, "Slot should still be held")
+
+	// the holder crashed
+	time.Sleep(300 * time.Millisecond)
+
+	token, err := sem.TryAcquire()
+	assert.NoError(t, err, "Expired slot should be taken back")
+
+	assert.False(t, sem.Extend(held), "Expired slot should not be extended")
+	assert.True(t, sem.Release(token), "Slot should be released")
+
+	conn := Cache.Pool.Get()
+	exists, err := conn.Do("EXISTS", "upload:semaphore")
+	conn.Close()
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, int64(0), exists, "Empty set should be gone")
+}
+
+func TestSemaphoreConcurrent(t *testing.T) {
+
+	server, err := tempredis.Start(tempredis.Config{})
+	if err != nil {
+		panic(err)
+	}
+	defer server.Term()
+
+	config := Redis{
+		Protocol:       "unix",
+		Address:        server.Socket(),
+		MaxIdle:        5,
+		MaxConnections: 20,
+	}
+
+	config.NewRedisCache()
+
+	sem := NewSemaphore("probe", 3)
+	sem.Delay = 5 * time.Millisecond
+
+	var (
+		wg      sync.WaitGroup
+		current int32
+		most    int32
+	)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			token, err := sem.Acquire(context.Background())
+			if !assert.NoError(t, err, "An error was not expected") {
+				return
+			}
+			defer sem.Release(token)
+
+			n := atomic.AddInt32(&current, 1)
+			for {
+				m := atomic.LoadInt32(&most)
+				if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+					break
+				}
+			}
+
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&current, -1)
+		}()
+	}
+
+	wg.Wait()
+
+	assert.LessOrEqual(t, atomic.LoadInt32(&most), int32(3), "No more than the limit should hold the semaphore")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&most), "Every slot should have been used")
+}
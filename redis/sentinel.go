@@ -0,0 +1,209 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// ErrNotMaster is returned when a server that was resolved as the master has been demoted
+var ErrNotMaster = errors.New("redis server is not the master")
+
+// sentinelCheckIdle is how long a pooled connection can be idle before its role is checked on borrow
+var sentinelCheckIdle = time.Second
+
+// sentinel resolves the current master from a list of sentinels
+type sentinel struct {
+	masterName string
+	timeout    time.Duration
+
+	mu    sync.Mutex
+	addrs []string
+}
+
+// master asks the sentinels in order for the master address
+// The sentinel that answers is moved to the front so it is asked first next time.
+func (s *sentinel) master() (string, error) {
+	s.mu.Lock()
+	addrs := append([]string(nil), s.addrs...)
+	s.mu.Unlock()
+
+	var lastErr error
+
+	for i, addr := range addrs {
+		master, err := s.query(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if i > 0 {
+			s.mu.Lock()
+			for j, a := range s.addrs {
+				if a == addr {
+					copy(s.addrs[1:j+1], s.addrs[:j])
+					s.addrs[0] = addr
+					break
+				}
+			}
+			s.mu.Unlock()
+		}
+
+		return master, nil
+	}
+
+	return "", fmt.Errorf("no sentinel could resolve master %s: %w", s.masterName, lastErr)
+}
+
+// query asks a sentinel for the address of the master
+func (s *sentinel) query(addr string) (string, error) {
+	conn, err := redis.Dial("tcp", addr,
+		redis.DialConnectTimeout(s.timeout),
+		redis.DialReadTimeout(s.timeout),
+		redis.DialWriteTimeout(s.timeout),
+	)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	reply, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", s.masterName))
+	if err == redis.ErrNil {
+		return "", fmt.Errorf("sentinel %s does not know master %s", addr, s.masterName)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if len(reply) != 2 {
+		return "", fmt.Errorf("sentinel %s returned a bad master address", addr)
+	}
+
+	return net.JoinHostPort(reply[0], reply[1]), nil
+}
+
+// dial connects to the current master
+func (s *sentinel) dial() (redis.Conn, error) {
+	addr, err := s.master()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := redis.Dial("tcp", addr, redis.DialConnectTimeout(s.timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	// the sentinels can be behind during a failover
+	err = checkMaster(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &masterConn{Conn: conn}, nil
+}
+
+// testOnBorrow checks the role of connections that have been idle so the pool drops them after a failover
+func (s *sentinel) testOnBorrow(conn redis.Conn, t time.Time) error {
+	if time.Since(t) < sentinelCheckIdle {
+		return nil
+	}
+
+	return checkMaster(conn)
+}
+
+// checkMaster returns ErrNotMaster if the server is not a master
+func checkMaster(conn redis.Conn) error {
+	values, err := redis.Values(conn.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+
+	if len(values) == 0 {
+		return errors.New("empty role reply")
+	}
+
+	role, err := redis.String(values[0], nil)
+	if err != nil {
+		return err
+	}
+
+	if role != "master" {
+		return fmt.Errorf("%w: %s", ErrNotMaster, role)
+	}
+
+	return nil
+}
+
+// masterConn is a connection to a master that marks itself broken after a READONLY error
+// A broken connection is closed by the pool instead of being reused, so busy connections to a
+// demoted master are replaced without waiting for the role check on borrow.
+type masterConn struct {
+	redis.Conn
+	readonly bool
+}
+
+// Err returns ErrNotMaster once a command was refused by a replica
+func (c *masterConn) Err() error {
+	if c.readonly {
+		return ErrNotMaster
+	}
+	return c.Conn.Err()
+}
+
+// Do sends a command and checks the reply
+func (c *masterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(cmd, args...)
+	c.check(err)
+	return reply, err
+}
+
+// DoContext sends a command and checks the reply
+func (c *masterConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := redis.DoContext(c.Conn, ctx, cmd, args...)
+	c.check(err)
+	return reply, err
+}
+
+// DoWithTimeout sends a command and checks the reply
+func (c *masterConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := redis.DoWithTimeout(c.Conn, timeout, cmd, args...)
+	c.check(err)
+	return reply, err
+}
+
+// Receive reads a reply and checks it
+func (c *masterConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	c.check(err)
+	return reply, err
+}
+
+// ReceiveContext reads a reply and checks it
+func (c *masterConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	reply, err := redis.ReceiveContext(c.Conn, ctx)
+	c.check(err)
+	return reply, err
+}
+
+// ReceiveWithTimeout reads a reply and checks it
+func (c *masterConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	reply, err := redis.ReceiveWithTimeout(c.Conn, timeout)
+	c.check(err)
+	return reply, err
+}
+
+// check marks the connection broken if the server refused a write as a replica
+func (c *masterConn) check(err error) {
+	var e redis.Error
+	if errors.As(err, &e) && strings.HasPrefix(string(e), "READONLY") {
+		c.readonly = true
+	}
+}
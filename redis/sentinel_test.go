@@ -0,0 +1,312 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeServer answers redis commands with a handler, for the sentinel and master roles the test server lacks
+type fakeServer struct {
+	listener net.Listener
+	handler  func(args []string) interface{}
+
+	mu       sync.Mutex
+	commands []string
+}
+
+// startFakeServer listens on a local port until the test ends
+func startFakeServer(t *testing.T, handler func(args []string) interface{}) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &fakeServer{
+		listener: listener,
+		handler:  handler,
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+
+	t.Cleanup(func() {
+		listener.Close()
+	})
+
+	return server
+}
+
+// Addr returns the host:port of the server
+func (f *fakeServer) Addr() string {
+	return f.listener.Addr().String()
+}
+
+// received returns the names of the commands the server has seen
+func (f *fakeServer) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.commands...)
+}
+
+// serve reads commands from a connection and writes the replies
+func (f *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		f.mu.Lock()
+		f.commands = append(f.commands, args[0])
+		f.mu.Unlock()
+
+		_, err = io.WriteString(conn, encodeReply(f.handler(args)))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readCommand reads an array of bulk strings
+func readCommand(r *bufio.Reader) (args []string, err error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	count, err := strconv.Atoi(line[1 : len(line)-2])
+	if err != nil {
+		return
+	}
+
+	for i := 0; i < count; i++ {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		size, err := strconv.Atoi(line[1 : len(line)-2])
+		if err != nil {
+			return nil, err
+		}
+
+		data := make([]byte, size+2)
+
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, string(data[:size]))
+	}
+
+	return
+}
+
+// encodeReply writes a reply in the redis protocol
+func encodeReply(reply interface{}) string {
+	switch v := reply.(type) {
+	case nil:
+		return "$-1\r\n"
+	case redis.Error:
+		return "-" + string(v) + "\r\n"
+	case int:
+		return fmt.Sprintf(":%d\r\n", v)
+	case string:
+		return "+" + v + "\r\n"
+	case []string:
+		out := fmt.Sprintf("*%d\r\n", len(v))
+		for _, s := range v {
+			out += fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+		}
+		return out
+	}
+
+	panic(fmt.Sprintf("cannot encode %T", reply))
+}
+
+// fakeMaster answers as a master until it is demoted
+func fakeMaster(t *testing.T) (*fakeServer, *atomic.Bool) {
+	var demoted atomic.Bool
+
+	server := startFakeServer(t, func(args []string) interface{} {
+		switch args[0] {
+		case "PING":
+			return "PONG"
+		case "ROLE":
+			if demoted.Load() {
+				return []string{"slave"}
+			}
+			return []string{"master"}
+		case "SET":
+			if demoted.Load() {
+				return redis.Error("READONLY You can't write against a read only replica.")
+			}
+			return "OK"
+		}
+		return redis.Error("ERR unknown command")
+	})
+
+	return server, &demoted
+}
+
+// unusedAddr returns an address nothing is listening on
+func unusedAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr().String()
+	listener.Close()
+
+	return addr
+}
+
+func TestSentinelFailover(t *testing.T) {
+
+	original := sentinelCheckIdle
+	defer func() {
+		sentinelCheckIdle = original
+	}()
+
+	sentinelCheckIdle = time.Millisecond
+
+	first, demoted := fakeMaster(t)
+	second, _ := fakeMaster(t)
+
+	var current atomic.Value
+	current.Store(first.Addr())
+
+	sentinelServer := startFakeServer(t, func(args []string) interface{} {
+		if len(args) != 3 || args[0] != "SENTINEL" || args[1] != "get-master-addr-by-name" {
+			return redis.Error("ERR unknown command")
+		}
+
+		if args[2] != "mymaster" {
+			return nil
+		}
+
+		host, port, _ := net.SplitHostPort(current.Load().(string))
+
+		return []string{host, port}
+	})
+
+	config := Redis{
+		MaxIdle:           2,
+		MaxConnections:    5,
+		SentinelAddresses: []string{unusedAddr(t), sentinelServer.Addr()},
+		MasterName:        "mymaster",
+	}
+
+	config.NewRedisCache()
+
+	ctx := context.Background()
+
+	assert.NoError(t, Ping(ctx), "An error was not expected")
+	assert.Contains(t, first.received(), "PING", "Ping should go to the master")
+
+	// the old master is demoted and the sentinels point at the new one
+	demoted.Store(true)
+	current.Store(second.Addr())
+
+	time.Sleep(5 * time.Millisecond)
+
+	assert.NoError(t, Ping(ctx), "An error was not expected")
+	assert.Contains(t, second.received(), "PING", "Ping should go to the new master")
+
+	assert.Panics(t, func() {
+		config := Redis{
+			SentinelAddresses: []string{sentinelServer.Addr()},
+		}
+		config.NewRedisCache()
+	}, "A master name should be required")
+}
+
+func TestSentinelMaster(t *testing.T) {
+
+	master, _ := fakeMaster(t)
+
+	sentinelServer := startFakeServer(t, func(args []string) interface{} {
+		if args[2] != "mymaster" {
+			return nil
+		}
+
+		host, port, _ := net.SplitHostPort(master.Addr())
+
+		return []string{host, port}
+	})
+
+	dead := unusedAddr(t)
+
+	s := &sentinel{
+		masterName: "mymaster",
+		timeout:    time.Second,
+		addrs:      []string{dead, sentinelServer.Addr()},
+	}
+
+	addr, err := s.master()
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, master.Addr(), addr, "Address should be the master")
+	assert.Equal(t, []string{sentinelServer.Addr(), dead}, s.addrs, "Sentinel that answered should be asked first")
+
+	s.masterName = "blah"
+
+	_, err = s.master()
+	assert.Error(t, err, "An error was expected for an unknown master")
+
+	s.addrs = []string{dead}
+
+	_, err = s.dial()
+	assert.Error(t, err, "An error was expected without a sentinel")
+}
+
+func TestMasterConnReadOnly(t *testing.T) {
+
+	master, demoted := fakeMaster(t)
+
+	conn, err := redis.Dial("tcp", master.Addr())
+	if !assert.NoError(t, err, "An error was not expected") {
+		return
+	}
+	defer conn.Close()
+
+	wrapped := &masterConn{Conn: conn}
+
+	_, err = wrapped.Do("SET", "index:1", "data")
+	assert.NoError(t, err, "An error was not expected")
+	assert.NoError(t, wrapped.Err(), "Connection should be usable")
+
+	assert.NoError(t, checkMaster(wrapped), "Server should be the master")
+
+	demoted.Store(true)
+
+	assert.ErrorIs(t, checkMaster(wrapped), ErrNotMaster, "Error should be not master")
+
+	_, err = redis.DoContext(wrapped, context.Background(), "SET", "index:1", "data")
+	assert.Error(t, err, "An error was expected from a replica")
+	assert.Equal(t, ErrNotMaster, wrapped.Err(), "Connection should be marked broken")
+}
@@ -0,0 +1,163 @@
+package redis
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// staleMagic marks an entry that starts with a soft expiry
+const staleMagic byte = 0x5e
+
+// staleHeaderSize is the magic byte and the soft expiry in unix milliseconds
+const staleHeaderSize = 9
+
+// staleHeaderWindow is the least distance from now a soft expiry can be for the header to be recognized
+// Keys need a ttl to have a soft expiry, so an entry with one is gone after it.
+const staleHeaderWindow = 30 * 24 * time.Hour
+
+var (
+	// staleNow is the clock used for soft expiry
+	staleNow = time.Now
+
+	// refreshing holds the lock keys of the refreshes running in this process
+	refreshing sync.Map
+)
+
+// wrapStale prefixes data with the time it goes stale
+func wrapStale(data []byte, soft time.Duration) []byte {
+	entry := make([]byte, staleHeaderSize, staleHeaderSize+len(data))
+	entry[0] = staleMagic
+	binary.BigEndian.PutUint64(entry[1:staleHeaderSize], uint64(staleNow().Add(soft).UnixMilli()))
+
+	return append(entry, data...)
+}
+
+// unwrapStale strips the soft expiry and reports if it has passed
+// Entries without one were written before the soft expiry was enabled so they are stale too.
+func unwrapStale(entry []byte) (data []byte, stale bool) {
+	if len(entry) < staleHeaderSize || entry[0] != staleMagic {
+		return entry, true
+	}
+
+	expires := int64(binary.BigEndian.Uint64(entry[1:staleHeaderSize]))
+
+	return entry[staleHeaderSize:], staleNow().UnixMilli() >= expires
+}
+
+// stripStale removes a soft expiry header left from when the key had one
+// The expiry has to be within the ttl of now for the header to be recognized, so data that only
+// starts with the magic byte is returned as is.
+func stripStale(entry []byte, ttl time.Duration) []byte {
+	if len(entry) < staleHeaderSize || entry[0] != staleMagic {
+		return entry
+	}
+
+	window := max(ttl, staleHeaderWindow)
+
+	expires := time.UnixMilli(int64(binary.BigEndian.Uint64(entry[1:staleHeaderSize])))
+
+	if expires.Sub(staleNow()).Abs() > window {
+		return entry
+	}
+
+	return entry[staleHeaderSize:]
+}
+
+// refreshLockKey returns the name of the distributed lock guarding a background refresh
+func (r *Key) refreshLockKey() string {
+	if r.hash {
+		return fmt.Sprintf("%s:%s:refresh", r.key, r.hashid)
+	}
+	return fmt.Sprintf("%s:refresh", r.key)
+}
+
+// GetStale gets a key and reports if it is past its soft expiry and should be refreshed
+// Keys without a soft expiry are never stale, entries written before it was turned off lose their header.
+func (r *Key) GetStale() (result []byte, stale bool, err error) {
+
+	if !r.keyset {
+		return nil, false, ErrKeyNotSet
+	}
+
+	if !isCacheInitialized() {
+		return nil, false, ErrCacheNotInitialized
+	}
+
+	// the payload is counted, not the soft expiry header
+	defer func(start time.Time) {
+		recordKeyOp(r.base, opGet, start, len(result), err)
+	}(time.Now())
+
+	result, err = r.get()
+	if err != nil {
+		return
+	}
+
+	if r.softttl == 0 {
+		return stripStale(result, r.ttl), false, nil
+	}
+
+	result, stale = unwrapStale(result)
+	if stale {
+		recordStale(r.base)
+	}
+
+	return
+}
+
+// Refresh rebuilds the key in the background with the given function
+// The distributed mutex makes sure only one instance in the cluster refreshes a key at a time,
+// if another one is already at it this does nothing.
+func (r *Key) Refresh(compute ComputeFunc) {
+
+	if !r.keyset {
+		return
+	}
+
+	lockKey := r.refreshLockKey()
+
+	_, running := refreshing.LoadOrStore(lockKey, struct{}{})
+	if running {
+		return
+	}
+
+	// the caller can reuse the key with other ids
+	key := *r
+
+	go func() {
+		defer refreshing.Delete(lockKey)
+
+		err := key.refresh(lockKey, compute)
+		if err != ErrFailed {
+			recordRefresh(key.base, err)
+		}
+	}()
+}
+
+// refresh rebuilds the key if it is still stale once we hold the lock
+func (r *Key) refresh(lockKey string, compute ComputeFunc) (err error) {
+
+	lease, err := Active().Acquire(lockKey)
+	if err != nil {
+		return
+	}
+	defer lease.Release()
+
+	stop := lease.Keep(nil)
+	defer stop()
+
+	// another instance may have just refreshed it
+	_, stale, err := r.GetStale()
+	if err == nil && !stale {
+		return nil
+	}
+
+	result, err := compute()
+	if err != nil {
+		return
+	}
+
+	return r.Set(result)
+}
@@ -0,0 +1,251 @@
+package redis
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stvp/tempredis"
+
+	"github.com/eirka/eirka-libs/config"
+	"github.com/eirka/eirka-libs/internal/testclock"
+)
+
+// setSoftTTL enables a soft expiry on a key until the test ends
+func setSoftTTL(t *testing.T, base string, soft time.Duration) {
+	err := SetKeySoftTTL(base, soft)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = SetKeySoftTTL(base, 0)
+	})
+}
+
+func TestStaleEntry(t *testing.T) {
+
+	advance := testclock.Freeze(t, &staleNow)
+
+	entry := wrapStale([]byte("data"), time.Minute)
+
+	data, stale := unwrapStale(entry)
+	assert.Equal(t, []byte("data"), data, "Data should match")
+	assert.False(t, stale, "Data should be fresh")
+
+	advance(time.Minute)
+
+	data, stale = unwrapStale(entry)
+	assert.Equal(t, []byte("data"), data, "Data should match")
+	assert.True(t, stale, "Data should be stale after the soft expiry")
+
+	data, stale = unwrapStale([]byte("legacy"))
+	assert.Equal(t, []byte("legacy"), data, "Data without a header should be returned as is")
+	assert.True(t, stale, "Data without a header should be stale")
+}
+
+func TestStripStale(t *testing.T) {
+
+	testclock.Freeze(t, &staleNow)
+
+	entry := wrapStale([]byte("data"), time.Minute)
+
+	assert.Equal(t, []byte("data"), stripStale(entry, DefaultKeyTTL), "Header should be stripped")
+	assert.Equal(t, []byte("legacy"), stripStale([]byte("legacy"), DefaultKeyTTL), "Data without a header should be returned as is")
+
+	data := append([]byte{staleMagic}, []byte("12345678 not a header")...)
+	assert.Equal(t, data, stripStale(data, DefaultKeyTTL), "Data with a magic byte and no plausible expiry should be returned as is")
+}
+
+func TestGetStaleSoftTTLDisabled(t *testing.T) {
+
+	memory, _ := newTestMemoryCache(t)
+
+	setSoftTTL(t, "new", 5*time.Minute)
+
+	key := NewKey("new").SetKey("1")
+
+	err := key.Set([]byte("data"))
+	assert.NoError(t, err, "An error was not expected")
+
+	raw, err := memory.Get("new:1")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, staleHeaderSize+4, len(raw), "Entry should carry the soft expiry")
+
+	err = SetKeySoftTTL("new", 0)
+	assert.NoError(t, err, "An error was not expected")
+
+	res, stale, err := NewKey("new").SetKey("1").GetStale()
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("data"), res, "Header should be stripped once the soft ttl is off")
+	assert.False(t, stale, "Data should not be stale")
+}
+
+func TestSetKeySoftTTL(t *testing.T) {
+
+	setSoftTTL(t, "popular", 5*time.Minute)
+
+	assert.Equal(t, 5*time.Minute, NewKey("popular").softttl, "Soft TTL should be set")
+
+	err := SetKeySoftTTL("popular", DefaultKeyTTL)
+	assert.ErrorIs(t, err, ErrInvalidKeySpec, "Error should be invalid spec for a soft ttl past the ttl")
+
+	err = SetKeySoftTTL("popular", time.Millisecond)
+	assert.ErrorIs(t, err, ErrInvalidKeySpec, "Error should be invalid spec")
+
+	err = SetKeyTTL("popular", time.Minute)
+	assert.ErrorIs(t, err, ErrInvalidKeySpec, "Error should be invalid spec for a ttl before the soft ttl")
+
+	err = SetKeySoftTTL("blah", time.Minute)
+	assert.ErrorIs(t, err, ErrUnknownKey, "Error should be unknown key")
+
+	err = RegisterKey(KeySpec{Base: "softbad", FieldCount: 1, TTL: time.Minute, SoftTTL: time.Minute})
+	assert.ErrorIs(t, err, ErrInvalidKeySpec, "Error should be invalid spec")
+
+	err = RegisterKey(KeySpec{Base: "softbad", FieldCount: 1, SoftTTL: time.Minute})
+	assert.ErrorIs(t, err, ErrInvalidKeySpec, "Error should be invalid spec for a soft ttl without a ttl")
+
+	err = SetKeyTTL("popular", 0)
+	assert.ErrorIs(t, err, ErrInvalidKeySpec, "Error should be invalid spec for removing the ttl under a soft ttl")
+
+	err = SetKeySoftTTL("index", time.Minute)
+	assert.ErrorIs(t, err, ErrInvalidKeySpec, "Error should be invalid spec for a key without a ttl")
+
+	original := config.Settings.Cache
+	defer func() {
+		config.Settings.Cache = original
+	}()
+
+	config.Settings.Cache.SoftTTL = map[string]uint{
+		"new": 300,
+	}
+
+	t.Cleanup(func() {
+		_ = SetKeySoftTTL("new", 0)
+	})
+
+	err = applyKeyConfig()
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 5*time.Minute, NewKey("new").softttl, "Soft TTL should come from the config")
+}
+
+func TestKeyStaleWhileRevalidate(t *testing.T) {
+
+	server, err := tempredis.Start(tempredis.Config{})
+	if err != nil {
+		panic(err)
+	}
+	defer server.Term()
+
+	redis := Redis{
+		Protocol:       "unix",
+		Address:        server.Socket(),
+		MaxIdle:        1,
+		MaxConnections: 10,
+	}
+
+	redis.NewRedisCache()
+
+	ResetKeyMetrics()
+
+	advance := testclock.Freeze(t, &staleNow)
+
+	setSoftTTL(t, "tag", 5*time.Minute)
+
+	key := NewKey("tag").SetKey("1", "2", "1")
+
+	err = key.Set([]byte("old"))
+	assert.NoError(t, err, "An error was not expected")
+
+	raw, err := Cache.HGet("tag:1:2", "1")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, staleHeaderSize+3, len(raw), "Entry should carry the soft expiry")
+
+	res, stale, err := key.GetStale()
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("old"), res, "Data should match")
+	assert.False(t, stale, "Data should be fresh")
+
+	advance(5 * time.Minute)
+
+	res, err = key.Get()
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("old"), res, "Get should return the stale data")
+
+	var calls int32
+
+	compute := func() ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		return []byte("new"), nil
+	}
+
+	res, err = key.GetOrCompute(context.Background(), compute)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("old"), res, "Stale data should be returned right away")
+
+	assert.Eventually(t, func() bool {
+		res, stale, err := key.GetStale()
+		return err == nil && !stale && string(res) == "new"
+	}, 5*time.Second, 10*time.Millisecond, "Key should be refreshed in the background")
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "Data should be computed once")
+
+	conn := Cache.Pool.Get()
+	ttl, err := conn.Do("TTL", "tag:1:2")
+	conn.Close()
+	assert.NoError(t, err, "An error was not expected")
+	assert.Greater(t, ttl, int64(0), "Hard expiry should still be set")
+
+	metrics := KeyMetrics().Bases["tag"]
+	assert.Equal(t, uint64(1), metrics.Refreshes, "Refresh should be counted")
+	assert.GreaterOrEqual(t, metrics.Stale, uint64(2), "Stale hits should be counted")
+
+	// another instance is refreshing the key
+	advance(5 * time.Minute)
+
+	assert.NoError(t, Cache.Lock(key.refreshLockKey()), "An error was not expected")
+
+	key.Refresh(compute)
+
+	assert.Eventually(t, func() bool {
+		_, running := refreshing.Load(key.refreshLockKey())
+		return !running
+	}, 5*time.Second, 10*time.Millisecond, "Refresh should give up")
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "Data should not be computed while another instance holds the lock")
+	assert.Equal(t, uint64(0), KeyMetrics().Bases["tag"].RefreshErrors, "A held lock is not an error")
+
+	assert.True(t, Cache.Unlock(key.refreshLockKey()), "Lock should be released")
+
+	// the lease is kept while a slow refresh runs
+	Cache.Mutex.Expiry = 150 * time.Millisecond
+
+	slow := make(chan struct{})
+
+	key.Refresh(func() ([]byte, error) {
+		<-slow
+		return []byte("newer"), nil
+	})
+
+	time.Sleep(400 * time.Millisecond)
+
+	assert.Equal(t, ErrFailed, Cache.TryLock(key.refreshLockKey()), "Lock should be kept while refreshing")
+
+	close(slow)
+
+	assert.Eventually(t, func() bool {
+		_, running := refreshing.Load(key.refreshLockKey())
+		return !running
+	}, 5*time.Second, 10*time.Millisecond, "Refresh should finish")
+
+	assert.False(t, Cache.Locked(key.refreshLockKey()), "Lock should be released")
+
+	// a miss still builds the key in the foreground
+	miss := NewKey("tag").SetKey("1", "2", "2")
+
+	res, err = miss.GetOrCompute(context.Background(), compute)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("new"), res, "Data should be computed on a miss")
+}
@@ -0,0 +1,189 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	// tagKeyPrefix is prepended to a tag to get the name of the set holding its keys
+	tagKeyPrefix = "cachetag:"
+	// invalidateBatch is how many keys are deleted from a tag set by one script
+	invalidateBatch = 100
+)
+
+// IbTag returns the invalidation tag for everything cached for an imageboard
+func IbTag(ib string) string {
+	return strings.Join([]string{"ib", ib}, ":")
+}
+
+// ThreadTag returns the invalidation tag for everything cached for a thread
+func ThreadTag(ib, thread string) string {
+	return strings.Join([]string{"thread", ib, thread}, ":")
+}
+
+// tagKey returns the name of the set holding the keys for a tag
+func tagKey(tag string) string {
+	return tagKeyPrefix + tag
+}
+
+// AddTags will add a key to the sets of the given tags
+// The sets expire with the last of their keys, a key that never expires keeps them until they are invalidated
+func (c *Store) AddTags(key string, tags ...string) (err error) {
+	if key == "" {
+		return errors.New("key cannot be empty")
+	}
+
+	if len(tags) == 0 {
+		return errors.New("at least one tag must be provided")
+	}
+
+	if !isCacheInitialized() {
+		return ErrCacheNotInitialized
+	}
+
+	key = c.prefixed(key)
+
+	for _, tag := range tags {
+		if tag == "" {
+			return errors.New("tag cannot be empty")
+		}
+	}
+
+	if !c.allow() {
+		c.skip("SADD", key)
+		return
+	}
+
+	conn := c.Pool.Get()
+	defer conn.Close()
+
+	// the sets have to outlive the key so it can still be invalidated
+	ttl, err := redis.Int64(conn.Do("PTTL", key))
+	c.report(err)
+	if err != nil {
+		return
+	}
+
+	// the key is already gone so the sets do not need to outlive it
+	if ttl == -2 {
+		ttl = 1
+	}
+
+	for _, tag := range tags {
+		_, err = addTagScript.Do(conn, c.prefixed(tagKey(tag)), key, ttl)
+		c.report(err)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// InvalidateTags will atomically delete every key carrying one of the tags
+// It returns the number of keys that were deleted. Each script pops a batch of keys from a set and deletes
+// them together, so a failure never drops a key from its set without deleting it and large sets do not block
+// the server.
+func (c *Store) InvalidateTags(tags ...string) (deleted int, err error) {
+	if len(tags) == 0 {
+		return 0, errors.New("at least one tag must be provided")
+	}
+
+	if !isCacheInitialized() {
+		return 0, ErrCacheNotInitialized
+	}
+
+	tagKeys := make([]string, len(tags))
+
+	for i, tag := range tags {
+		if tag == "" {
+			return 0, errors.New("tag cannot be empty")
+		}
+		tagKeys[i] = c.prefixed(tagKey(tag))
+	}
+
+	if !c.allow() {
+		c.skip("INVALIDATE", tagKeys...)
+		return 0, nil
+	}
+
+	conn := c.Pool.Get()
+	defer conn.Close()
+
+	for _, tagKey := range tagKeys {
+		for {
+			var reply []interface{}
+
+			reply, err = redis.Values(invalidateScript.Do(conn, tagKey, invalidateBatch))
+			c.report(err)
+			if err != nil {
+				return
+			}
+
+			if len(reply) != 2 {
+				return deleted, fmt.Errorf("unexpected invalidate reply: %v", reply)
+			}
+
+			var popped int
+			var keys []string
+
+			popped, err = redis.Int(reply[0], nil)
+			if err != nil {
+				return
+			}
+
+			keys, err = redis.Strings(reply[1], nil)
+			if err != nil {
+				return
+			}
+
+			deleted += len(keys)
+
+			c.invalidate(conn, keys...)
+
+			if popped < invalidateBatch {
+				break
+			}
+		}
+	}
+
+	return
+}
+
+// InvalidateTags will delete every key carrying one of the tags from the cache
+func InvalidateTags(tags ...string) (deleted int, err error) {
+	return Active().InvalidateTags(tags...)
+}
+
+// adds a key to a tag set and makes sure the set lives at least as long as the key
+// a ttl below zero is a key without an expiry and the set is kept until it is invalidated
+var addTagScript = redis.NewScript(1, `
+local new = redis.call("EXISTS", KEYS[1]) == 0
+redis.call("SADD", KEYS[1], ARGV[1])
+
+local ttl = tonumber(ARGV[2])
+if ttl < 0 then
+	redis.call("PERSIST", KEYS[1])
+	return 1
+end
+
+local current = redis.call("PTTL", KEYS[1])
+if new or (current >= 0 and current < ttl) then
+	redis.call("PEXPIRE", KEYS[1], ttl)
+end
+return 1`)
+
+// pops a batch of keys from a tag set and deletes them, it returns the number popped and the keys that existed
+var invalidateScript = redis.NewScript(1, `
+local members = redis.call("SPOP", KEYS[1], ARGV[1])
+local deleted = {}
+for _, key in ipairs(members) do
+	if redis.call("DEL", key) == 1 then
+		deleted[#deleted + 1] = key
+	end
+end
+return {#members, deleted}`)
@@ -0,0 +1,201 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stvp/tempredis"
+)
+
+func TestTagNames(t *testing.T) {
+
+	assert.Equal(t, "ib:3", IbTag("3"), "Tag should match")
+
+	assert.Equal(t, "thread:3:1234", ThreadTag("3", "1234"), "Tag should match")
+
+	assert.Equal(t, "cachetag:ib:3", tagKey(IbTag("3")), "Tag key should match")
+}
+
+func TestMethodAddTags(t *testing.T) {
+
+	NewRedisMock()
+
+	Cache.Mock.Command("PTTL", "thread:3:1234").Expect(int64(-1))
+	Cache.Mock.Command("EVALSHA", redigomock.NewAnyData(), 1, "cachetag:ib:3", "thread:3:1234", int64(-1)).Expect(int64(1))
+	Cache.Mock.Command("EVALSHA", redigomock.NewAnyData(), 1, "cachetag:thread:3:1234", "thread:3:1234", int64(-1)).Expect(int64(1))
+
+	err := Cache.AddTags("thread:3:1234", IbTag("3"), ThreadTag("3", "1234"))
+
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.NoError(t, Cache.Mock.ExpectationsWereMet(), "All commands should have been called")
+
+	err = Cache.AddTags("", "ib:3")
+	assert.Error(t, err, "An error was expected for empty key")
+
+	err = Cache.AddTags("thread:3:1234")
+	assert.Error(t, err, "An error was expected for no tags")
+
+	err = Cache.AddTags("thread:3:1234", "")
+	assert.Error(t, err, "An error was expected for empty tag")
+
+	Cache.Mock.Command("PTTL", "index:4").ExpectError(errors.New("connection error"))
+
+	err = Cache.AddTags("index:4", "ib:4")
+	assert.Error(t, err, "An error was expected")
+}
+
+func TestMethodInvalidateTags(t *testing.T) {
+
+	NewRedisMock()
+
+	Cache.Mock.Command("EVALSHA", redigomock.NewAnyData(), 1, "cachetag:ib:3", invalidateBatch).Expect([]interface{}{int64(2), []interface{}{[]byte("index:3"), []byte("thread:3:1234")}})
+	// the key was already deleted with the first tag
+	Cache.Mock.Command("EVALSHA", redigomock.NewAnyData(), 1, "cachetag:thread:3:1234", invalidateBatch).Expect([]interface{}{int64(1), []interface{}{}})
+
+	deleted, err := InvalidateTags(IbTag("3"), ThreadTag("3", "1234"))
+
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.Equal(t, 2, deleted, "Deleted count should match")
+
+	// a failed script leaves the keys in the set to try again
+	Cache.Mock.Command("EVALSHA", redigomock.NewAnyData(), 1, "cachetag:ib:4", invalidateBatch).ExpectError(errors.New("connection error"))
+
+	_, err = InvalidateTags(IbTag("4"))
+	assert.Error(t, err, "An error was expected")
+
+	_, err = Cache.InvalidateTags()
+	assert.Error(t, err, "An error was expected for no tags")
+
+	_, err = Cache.InvalidateTags("")
+	assert.Error(t, err, "An error was expected for empty tag")
+}
+
+func TestTagsPrefix(t *testing.T) {
+
+	NewRedisMock()
+
+	Cache.Prefix = "staging:"
+	defer func() {
+		Cache.Prefix = ""
+	}()
+
+	Cache.Mock.Command("PTTL", "staging:index:3").Expect(int64(-1))
+	sadd := Cache.Mock.Command("EVALSHA", redigomock.NewAnyData(), 1, "staging:cachetag:ib:3", "staging:index:3", int64(-1)).Expect(int64(1))
+
+	err := Cache.AddTags("index:3", IbTag("3"))
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 1, Cache.Mock.Stats(sadd), "Command should be called with the prefix")
+
+	Cache.Mock.Command("EVALSHA", redigomock.NewAnyData(), 1, "staging:cachetag:ib:3", invalidateBatch).Expect([]interface{}{int64(1), []interface{}{[]byte("staging:index:3")}})
+
+	deleted, err := Cache.InvalidateTags(IbTag("3"))
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 1, deleted, "Deleted count should match")
+}
+
+func TestKeysSetTags(t *testing.T) {
+
+	key := NewKey("thread").SetKey("3", "1234", "1").Tags(IbTag("3"), ThreadTag("3", "1234"))
+
+	NewRedisMock()
+
+	Cache.Mock.Command("HMSET", "thread:3:1234", "1", []byte("hello"))
+	Cache.Mock.Command("PTTL", "thread:3:1234").Expect(int64(-1))
+	Cache.Mock.Command("EVALSHA", redigomock.NewAnyData(), 1, "cachetag:ib:3", "thread:3:1234", int64(-1)).Expect(int64(1))
+	Cache.Mock.Command("EVALSHA", redigomock.NewAnyData(), 1, "cachetag:thread:3:1234", "thread:3:1234", int64(-1)).Expect(int64(1))
+
+	err := key.Set([]byte("hello"))
+
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.NoError(t, Cache.Mock.ExpectationsWereMet(), "All commands should have been called")
+}
+
+func TestInvalidateTags(t *testing.T) {
+
+	server, err := tempredis.Start(tempredis.Config{})
+	if err != nil {
+		panic(err)
+	}
+	defer server.Term()
+
+	config := Redis{
+		Protocol:       "unix",
+		Address:        server.Socket(),
+		MaxIdle:        1,
+		MaxConnections: 5,
+	}
+
+	config.NewRedisCache()
+
+	err = NewKey("thread").SetKey("3", "1234", "1").Tags(IbTag("3"), ThreadTag("3", "1234")).Set([]byte("thread"))
+	assert.NoError(t, err, "An error was not expected")
+
+	err = NewKey("tags").SetKey("3", "1").Tags(IbTag("3")).Set([]byte("tags"))
+	assert.NoError(t, err, "An error was not expected")
+
+	err = NewKey("new").SetKey("3").Tags(IbTag("3")).Set([]byte("new"))
+	assert.NoError(t, err, "An error was not expected")
+
+	err = NewKey("new").SetKey("4").Tags(IbTag("4")).Set([]byte("other"))
+	assert.NoError(t, err, "An error was not expected")
+
+	conn := Cache.Pool.Get()
+	defer conn.Close()
+
+	// the sets live as long as their longest lived key
+	ttl, err := redis.Int64(conn.Do("PTTL", "cachetag:ib:4"))
+	assert.NoError(t, err, "An error was not expected")
+	assert.InDelta(t, DefaultKeyTTL.Milliseconds(), ttl, 5000, "Tag set should expire with its key")
+
+	ttl, err = redis.Int64(conn.Do("PTTL", "cachetag:ib:3"))
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, int64(-1), ttl, "Tag set with a key that never expires should be kept")
+
+	err = NewKey("tag").SetKey("4", "1", "1").Tags(IbTag("5")).Set([]byte("short"))
+	assert.NoError(t, err, "An error was not expected")
+
+	_, err = conn.Do("EXPIRE", "cachetag:ib:5", 10)
+	assert.NoError(t, err, "An error was not expected")
+
+	err = NewKey("new").SetKey("5").Tags(IbTag("5")).Set([]byte("longer"))
+	assert.NoError(t, err, "An error was not expected")
+
+	ttl, err = redis.Int64(conn.Do("PTTL", "cachetag:ib:5"))
+	assert.NoError(t, err, "An error was not expected")
+	assert.Greater(t, ttl, int64(10000), "Tag set should be extended for a longer lived key")
+
+	deleted, err := InvalidateTags(IbTag("3"), ThreadTag("3", "1234"))
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 3, deleted, "All keys for the imageboard should be deleted")
+
+	_, err = NewKey("thread").SetKey("3", "1234", "1").Get()
+	assert.Equal(t, ErrCacheMiss, err, "Key should be deleted")
+
+	_, err = NewKey("new").SetKey("3").Get()
+	assert.Equal(t, ErrCacheMiss, err, "Key should be deleted")
+
+	res, err := NewKey("new").SetKey("4").Get()
+	assert.NoError(t, err, "Other imageboards should not be touched")
+	assert.Equal(t, []byte("other"), res, "Data should match")
+
+	exists, err := redis.Bool(conn.Do("EXISTS", "cachetag:ib:3"))
+	assert.NoError(t, err, "An error was not expected")
+	assert.False(t, exists, "Tag set should be deleted")
+
+	// large sets are deleted in batches
+	for i := 0; i < invalidateBatch*2+50; i++ {
+		err = NewKey("new").SetKey(fmt.Sprintf("batch%d", i)).Tags(IbTag("6")).Set([]byte("batch"))
+		assert.NoError(t, err, "An error was not expected")
+	}
+
+	deleted, err = InvalidateTags(IbTag("6"))
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, invalidateBatch*2+50, deleted, "Every batch should be deleted")
+}
@@ -0,0 +1,119 @@
+package redis
+
+import (
+	"context"
+)
+
+// TypedKey wraps a Key and encodes its data with a codec and schema version
+type TypedKey[T any] struct {
+	key     *Key
+	codec   Codec
+	version uint32
+}
+
+// NewTypedKey returns a typed key from the index or nil if it doesnt exist
+// Bump the version whenever T changes shape so entries from an older deploy are treated as misses
+func NewTypedKey[T any](name string, codec Codec, version uint32) *TypedKey[T] {
+	key := NewKey(name)
+	if key == nil {
+		return nil
+	}
+
+	if codec == nil {
+		codec = JSONCodec
+	}
+
+	return &TypedKey[T]{
+		key:     key,
+		codec:   codec,
+		version: version,
+	}
+}
+
+// SetKey populates the fields in the underlying key
+func (t *TypedKey[T]) SetKey(ids ...string) *TypedKey[T] {
+	t.key.SetKey(ids...)
+	return t
+}
+
+// Tags sets the invalidation tags that are attached to the key when it is set
+func (t *TypedKey[T]) Tags(tags ...string) *TypedKey[T] {
+	t.key.Tags(tags...)
+	return t
+}
+
+// String returns a string version of the key
+func (t *TypedKey[T]) String() string {
+	return t.key.String()
+}
+
+// Get gets and decodes a key, entries written with another codec or version are a cache miss
+func (t *TypedKey[T]) Get() (result T, err error) {
+
+	data, err := t.key.Get()
+	if err != nil {
+		return
+	}
+
+	return t.decode(data)
+}
+
+// Set encodes and sets a key
+func (t *TypedKey[T]) Set(data T) (err error) {
+
+	entry, err := encodeEntry(t.codec, t.version, data)
+	if err != nil {
+		return
+	}
+
+	return t.key.Set(entry)
+}
+
+// Delete deletes a key
+func (t *TypedKey[T]) Delete() (err error) {
+	return t.key.Delete()
+}
+
+// GetOrCompute gets a key, and on a cache miss builds and stores it with the given function
+func (t *TypedKey[T]) GetOrCompute(ctx context.Context, compute func() (T, error)) (result T, err error) {
+
+	data, err := t.key.getOrCompute(ctx, func() ([]byte, error) {
+		value, err := compute()
+		if err != nil {
+			return nil, err
+		}
+		return encodeEntry(t.codec, t.version, value)
+	}, t.usable)
+	if err != nil {
+		return
+	}
+
+	return t.decode(data)
+}
+
+// GetWait gets and decodes a key, waiting for a rebuild in progress on a miss
+func (t *TypedKey[T]) GetWait(ctx context.Context) (result T, err error) {
+
+	data, err := t.key.GetWait(ctx)
+	if err != nil {
+		return
+	}
+
+	return t.decode(data)
+}
+
+// decode unmarshals an entry, turning a header mismatch into a cache miss
+func (t *TypedKey[T]) decode(data []byte) (result T, err error) {
+
+	err = decodeEntry(t.codec, t.version, data, &result)
+	if err == errStaleEntry {
+		return result, ErrCacheMiss
+	}
+
+	return
+}
+
+// usable checks if an entry was written with our codec and version
+func (t *TypedKey[T]) usable(data []byte) bool {
+	return entryMatches(t.codec, t.version, data)
+}
@@ -0,0 +1,171 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+)
+
+type typedTestData struct {
+	ID   uint
+	Name string
+}
+
+func TestNewTypedKey(t *testing.T) {
+
+	key := NewTypedKey[typedTestData]("image", JSONCodec, 1)
+
+	assert.NotNil(t, key, "Should not be nil")
+
+	empty := NewTypedKey[typedTestData]("blah", JSONCodec, 1)
+
+	assert.Nil(t, empty, "Should be nil")
+
+	defaulted := NewTypedKey[typedTestData]("image", nil, 1)
+
+	assert.Equal(t, JSONCodec, defaulted.codec, "Codec should default to json")
+}
+
+func TestTypedKeySetKey(t *testing.T) {
+
+	key := NewTypedKey[typedTestData]("thread", JSONCodec, 1).SetKey("1", "2", "3")
+
+	assert.Equal(t, "thread:1:2", key.String(), "Key should match")
+}
+
+func TestTypedKeySet(t *testing.T) {
+
+	key := NewTypedKey[typedTestData]("tagtypes", JSONCodec, 1).SetKey()
+
+	entry, err := encodeEntry(JSONCodec, 1, typedTestData{ID: 1, Name: "test"})
+	assert.NoError(t, err, "An error was not expected")
+
+	NewRedisMock()
+
+	Cache.Mock.Command("SET", "tagtypes", entry)
+
+	err = key.Set(typedTestData{ID: 1, Name: "test"})
+
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.NoError(t, Cache.Mock.ExpectationsWereMet(), "All commands should have been called")
+}
+
+func TestTypedKeyGet(t *testing.T) {
+
+	key := NewTypedKey[typedTestData]("tagtypes", GzipJSONCodec, 3).SetKey()
+
+	entry, err := encodeEntry(GzipJSONCodec, 3, typedTestData{ID: 1, Name: "test"})
+	assert.NoError(t, err, "An error was not expected")
+
+	NewRedisMock()
+
+	Cache.Mock.Command("GET", "tagtypes").Expect(entry)
+
+	res, err := key.Get()
+
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.Equal(t, typedTestData{ID: 1, Name: "test"}, res, "Data should match")
+}
+
+func TestTypedKeyGetStale(t *testing.T) {
+
+	key := NewTypedKey[typedTestData]("tagtypes", JSONCodec, 2).SetKey()
+
+	entry, err := encodeEntry(JSONCodec, 1, typedTestData{ID: 1, Name: "test"})
+	assert.NoError(t, err, "An error was not expected")
+
+	NewRedisMock()
+
+	Cache.Mock.Command("GET", "tagtypes").Expect(entry)
+
+	res, err := key.Get()
+
+	assert.Empty(t, res, "Should not return data")
+
+	assert.Equal(t, ErrCacheMiss, err, "Stale entry should be a cache miss")
+
+	// entries written before typed keys existed
+	Cache.Mock.Command("GET", "tagtypes").Expect([]byte(`{"ID":1}`))
+
+	res, err = key.Get()
+
+	assert.Empty(t, res, "Should not return data")
+
+	assert.Equal(t, ErrCacheMiss, err, "Raw entry should be a cache miss")
+}
+
+func TestTypedKeyGetDecodeError(t *testing.T) {
+
+	key := NewTypedKey[typedTestData]("tagtypes", JSONCodec, 1).SetKey()
+
+	NewRedisMock()
+
+	Cache.Mock.Command("GET", "tagtypes").Expect(append([]byte{entryMagic, codecJSON, 0, 0, 0, 1}, []byte("{bad")...))
+
+	_, err := key.Get()
+
+	assert.Error(t, err, "An error was expected")
+
+	assert.NotEqual(t, ErrCacheMiss, err, "Corrupt data should not be a cache miss")
+}
+
+func TestTypedKeyGetError(t *testing.T) {
+
+	key := NewTypedKey[typedTestData]("tagtypes", JSONCodec, 1).SetKey()
+
+	NewRedisMock()
+
+	Cache.Mock.Command("GET", "tagtypes").ExpectError(errors.New("redis error"))
+
+	_, err := key.Get()
+
+	if assert.Error(t, err, "An error was expected") {
+		assert.Equal(t, "redis error", err.Error(), "Error should be from redis")
+	}
+}
+
+func TestTypedKeyGetOrComputeStale(t *testing.T) {
+
+	key := NewTypedKey[typedTestData]("tagtypes", MsgpackCodec, 2).SetKey()
+
+	stale, err := encodeEntry(MsgpackCodec, 1, typedTestData{ID: 1, Name: "old"})
+	assert.NoError(t, err, "An error was not expected")
+
+	fresh, err := encodeEntry(MsgpackCodec, 2, typedTestData{ID: 1, Name: "new"})
+	assert.NoError(t, err, "An error was not expected")
+
+	NewRedisMock()
+
+	Cache.Mock.Command("GET", "tagtypes").Expect(stale)
+	Cache.Mock.Command("EVALSHA", redigomock.NewAnyData(), 2, "tagtypes:compute", "locks:mutex", redigomock.NewAnyData(), redigomock.NewAnyData(), redigomock.NewAnyData()).Expect(int64(1))
+	Cache.Mock.Command("SET", "tagtypes", fresh)
+	Cache.Mock.Command("EVALSHA", redigomock.NewAnyData(), 2, "tagtypes:compute", "locks:mutex", redigomock.NewAnyData()).Expect(int64(1))
+
+	res, err := key.GetOrCompute(context.Background(), func() (typedTestData, error) {
+		return typedTestData{ID: 1, Name: "new"}, nil
+	})
+
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.Equal(t, "new", res.Name, "Should return the computed data")
+
+	assert.NoError(t, Cache.Mock.ExpectationsWereMet(), "All commands should have been called")
+}
+
+func TestTypedKeyDelete(t *testing.T) {
+
+	key := NewTypedKey[typedTestData]("thread", JSONCodec, 1).SetKey("1", "1", "1")
+
+	NewRedisMock()
+
+	Cache.Mock.Command("DEL", "thread:1:1")
+
+	err := key.Delete()
+
+	assert.NoError(t, err, "An error was not expected")
+}
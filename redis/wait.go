@@ -0,0 +1,169 @@
+package redis
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// writtenChannel is where Set announces that a locked key was rebuilt
+const writtenChannel = "keys:written"
+
+var (
+	// rebuildPoll is how often GetWait checks the key in case a notification is lost
+	rebuildPoll = 100 * time.Millisecond
+	// subscribeRetry is how long the waiters go without a subscription after one fails
+	subscribeRetry = 5 * time.Second
+)
+
+// GetWait gets a key, and on a miss while Delete holds the rebuild lock it waits for the key to be written
+// Waiting readers are woken by the notification Set publishes when it releases the lock, and the key is
+// polled every rebuildPoll in case one is lost. It gives up with ErrCacheMiss when the lock is released or
+// expires without the key being written, so the caller can build it, or with the error of the context.
+func (r *Key) GetWait(ctx context.Context) (result []byte, err error) {
+
+	result, err = r.Get()
+	if err != ErrCacheMiss || !r.lock {
+		return
+	}
+
+	written, done := waiters.wait(r.key)
+	defer done()
+
+	poll := time.NewTicker(rebuildPoll)
+	defer poll.Stop()
+
+	// the lock expires by itself so there is no point waiting longer
+	limit := time.NewTimer(DefaultExpiry)
+	defer limit.Stop()
+
+	for {
+		// checked after registering so a write in between is not missed
+		if !Active().Locked(r.lockKey()) {
+			return r.Get()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-limit.C:
+			return nil, ErrCacheMiss
+		case <-written:
+		case <-poll.C:
+		}
+
+		result, err = r.Get()
+		if err != ErrCacheMiss {
+			return
+		}
+	}
+}
+
+// writeWaiters fans the notifications from a single subscription out to the waiting readers
+type writeWaiters struct {
+	mu          sync.Mutex
+	store       Storer
+	cancel      context.CancelFunc
+	subscribing bool
+	failed      time.Time
+	waiters     map[string]map[chan struct{}]struct{}
+}
+
+// waiters holds the readers waiting in GetWait by key
+var waiters = &writeWaiters{
+	waiters: make(map[string]map[chan struct{}]struct{}),
+}
+
+// wait registers a reader for a key and returns the channel it is woken on and a function to remove it
+func (w *writeWaiters) wait(key string) (<-chan struct{}, func()) {
+	w.mu.Lock()
+
+	ch := make(chan struct{}, 1)
+
+	if w.waiters[key] == nil {
+		w.waiters[key] = make(map[chan struct{}]struct{})
+	}
+	w.waiters[key][ch] = struct{}{}
+
+	w.mu.Unlock()
+
+	w.subscribe()
+
+	return ch, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+
+		delete(w.waiters[key], ch)
+		if len(w.waiters[key]) == 0 {
+			delete(w.waiters, key)
+		}
+	}
+}
+
+// subscribe starts listening on the active store if it is not already
+// The subscription is made without the lock so other readers are not held up, they poll until it is ready.
+func (w *writeWaiters) subscribe() {
+	store := Active()
+
+	w.mu.Lock()
+
+	if w.subscribing || (w.cancel != nil && w.store == store) {
+		w.mu.Unlock()
+		return
+	}
+
+	if w.store == store && time.Since(w.failed) < subscribeRetry {
+		w.mu.Unlock()
+		return
+	}
+
+	w.subscribing = true
+
+	w.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	messages, err := store.Subscribe(ctx, writtenChannel)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.subscribing = false
+
+	if err != nil {
+		cancel()
+		w.store = store
+		w.failed = time.Now()
+		return
+	}
+
+	// the active store changed
+	if w.cancel != nil {
+		w.cancel()
+	}
+
+	w.store = store
+	w.cancel = cancel
+
+	go w.dispatch(messages)
+}
+
+// dispatch wakes the readers waiting on the keys that were written
+func (w *writeWaiters) dispatch(messages <-chan Message) {
+	for msg := range messages {
+		var key string
+
+		if msg.Decode(&key) != nil {
+			continue
+		}
+
+		w.mu.Lock()
+		for ch := range w.waiters[key] {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+		w.mu.Unlock()
+	}
+}
@@ -0,0 +1,196 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stvp/tempredis"
+)
+
+// setRebuildPoll changes the poll interval of GetWait until the test ends
+func setRebuildPoll(t *testing.T, poll time.Duration) {
+	original := rebuildPoll
+	rebuildPoll = poll
+
+	t.Cleanup(func() {
+		rebuildPoll = original
+	})
+}
+
+func TestKeyGetWait(t *testing.T) {
+
+	server, err := tempredis.Start(tempredis.Config{})
+	if err != nil {
+		panic(err)
+	}
+	defer server.Term()
+
+	config := Redis{
+		Protocol:       "unix",
+		Address:        server.Socket(),
+		MaxIdle:        2,
+		MaxConnections: 10,
+	}
+
+	config.NewRedisCache()
+
+	// only a notification can wake the reader in time
+	setRebuildPoll(t, time.Minute)
+
+	ctx := context.Background()
+
+	key := NewKey("index").SetKey("1", "1")
+
+	// nobody is rebuilding so the miss is returned right away
+	_, err = key.GetWait(ctx)
+	assert.Equal(t, ErrCacheMiss, err, "Error should be a cache miss")
+
+	assert.NoError(t, key.Delete(), "An error was not expected")
+	assert.True(t, Cache.Locked("index:1:mutex"), "Key should be locked after delete")
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = NewKey("index").SetKey("1", "1").Set([]byte("rebuilt"))
+	}()
+
+	start := time.Now()
+
+	result, err := key.GetWait(ctx)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("rebuilt"), result, "Should return the rebuilt data")
+	assert.Less(t, time.Since(start), time.Second, "Reader should be woken by the notification")
+
+	assert.False(t, Cache.Locked("index:1:mutex"), "Key should be unlocked after set")
+
+	// the lock is released without the key being written
+	assert.NoError(t, key.Delete(), "An error was not expected")
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		Cache.Unlock("index:1:mutex")
+	}()
+
+	setRebuildPoll(t, 10*time.Millisecond)
+
+	_, err = key.GetWait(ctx)
+	assert.Equal(t, ErrCacheMiss, err, "Error should be a cache miss once the lock is gone")
+
+	// the notification is lost and the poll finds the key
+	assert.NoError(t, key.Delete(), "An error was not expected")
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = Cache.HMSet("index:1", "1", []byte("polled"))
+	}()
+
+	result, err = key.GetWait(ctx)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("polled"), result, "Should return the data found by polling")
+
+	assert.True(t, Cache.Unlock("index:1:mutex"), "Lock should be released")
+
+	// the caller gives up first
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+
+	other := NewKey("index").SetKey("2", "1")
+
+	assert.NoError(t, other.Delete(), "An error was not expected")
+
+	_, err = other.GetWait(timeout)
+	assert.Equal(t, context.DeadlineExceeded, err, "Error should come from the context")
+
+	assert.True(t, Cache.Unlock("index:2:mutex"), "Lock should be released")
+}
+
+func TestMemoryGetWait(t *testing.T) {
+
+	newTestMemoryCache(t)
+
+	setRebuildPoll(t, time.Minute)
+
+	key := NewTypedKey[[]string]("index", JSONCodec, 1).SetKey("1", "1")
+
+	assert.NoError(t, key.Delete(), "An error was not expected")
+	assert.True(t, Active().Locked("index:1:mutex"), "Key should be locked after delete")
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = NewTypedKey[[]string]("index", JSONCodec, 1).SetKey("1", "1").Set([]string{"thread"})
+	}()
+
+	result, err := key.GetWait(context.Background())
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []string{"thread"}, result, "Should return the rebuilt data")
+
+	assert.False(t, Active().Locked("index:1:mutex"), "Key should be unlocked after set")
+}
+
+// slowSubscribeStore is a memory store that does not subscribe until it is released
+type slowSubscribeStore struct {
+	*MemoryStore
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *slowSubscribeStore) Subscribe(ctx context.Context, channels ...string) (<-chan Message, error) {
+	select {
+	case s.started <- struct{}{}:
+	default:
+	}
+
+	<-s.release
+
+	return s.MemoryStore.Subscribe(ctx, channels...)
+}
+
+func TestWaitersSubscribe(t *testing.T) {
+
+	newTestMemoryCache(t)
+
+	store := &slowSubscribeStore{
+		MemoryStore: NewMemoryStore(),
+		started:     make(chan struct{}, 1),
+		release:     make(chan struct{}),
+	}
+
+	setActive(store)
+
+	first := make(chan struct{})
+
+	go func() {
+		defer close(first)
+		_, done := waiters.wait("index:1")
+		done()
+	}()
+
+	<-store.started
+
+	// other readers poll instead of waiting on the subscription
+	second := make(chan struct{})
+
+	go func() {
+		defer close(second)
+		_, done := waiters.wait("index:2")
+		done()
+	}()
+
+	select {
+	case <-second:
+	case <-time.After(time.Second):
+		t.Error("Reader should not wait for the subscription")
+	}
+
+	close(store.release)
+
+	<-first
+	<-second
+
+	waiters.mu.Lock()
+	subscribed := waiters.cancel != nil && waiters.store == Storer(store)
+	waiters.mu.Unlock()
+
+	assert.True(t, subscribed, "Subscription should be published")
+}
@@ -0,0 +1,44 @@
+package status
+
+import (
+	"encoding/json"
+
+	"github.com/gin-gonic/gin"
+
+	e "github.com/eirka/eirka-libs/errors"
+	"github.com/eirka/eirka-libs/redis"
+)
+
+// CacheStatistics holds the cache counters
+type CacheStatistics struct {
+	// Breaker is the state of the redis circuit breaker
+	Breaker string `json:",omitempty"`
+	// Tiers has the local and redis hit counters for raw gets
+	Tiers redis.CacheStats
+	// Keys has the counters for each key base
+	Keys redis.MetricsSnapshot
+}
+
+// CacheController is a Gin controller to display cache hit rates and latency by key base over http
+func CacheController(c *gin.Context) {
+
+	stats := &CacheStatistics{
+		Tiers: redis.Cache.Stats(),
+		Keys:  redis.KeyMetrics(),
+	}
+
+	if redis.Cache.Breaker != nil {
+		stats.Breaker = redis.Cache.Breaker.State().String()
+	}
+
+	// Marshal the structs into JSON
+	output, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		c.JSON(e.ErrorMessage(e.ErrInternalError))
+		c.Error(err).SetMeta("CacheController.Marshal")
+		return
+	}
+
+	c.Data(200, "application/json", output)
+
+}
@@ -0,0 +1,113 @@
+package status
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eirka/eirka-libs/redis"
+)
+
+func performRequest(r http.Handler, method, path string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestCacheController(t *testing.T) {
+
+	redis.ResetKeyMetrics()
+	defer redis.ResetKeyMetrics()
+
+	redis.NewMemoryCache()
+
+	// the soft expiry header is not counted in the bytes
+	err := redis.SetKeySoftTTL("tag", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer redis.SetKeySoftTTL("tag", 0)
+
+	key := redis.NewKey("tag").SetKey("1", "2", "1")
+
+	_, err = key.Get()
+	assert.Equal(t, redis.ErrCacheMiss, err, "Error should be cache miss")
+
+	err = key.Set([]byte("tag data"))
+	assert.NoError(t, err, "An error was not expected")
+
+	for i := 0; i < 2; i++ {
+		_, err = key.Get()
+		assert.NoError(t, err, "An error was not expected")
+	}
+
+	err = redis.NewKey("thread").SetKey("1", "2", "3").Set([]byte("thread"))
+	assert.NoError(t, err, "An error was not expected")
+
+	gin.SetMode(gin.ReleaseMode)
+
+	router := gin.New()
+
+	router.GET("/status/cache", CacheController)
+
+	first := performRequest(router, "GET", "/status/cache")
+
+	assert.Equal(t, 200, first.Code, "HTTP request code should match")
+	assert.Equal(t, "application/json", first.Header().Get("Content-Type"), "Content type should match")
+
+	var shape map[string]json.RawMessage
+
+	err = json.Unmarshal(first.Body.Bytes(), &shape)
+	if assert.NoError(t, err, "An error was not expected") {
+		assert.Contains(t, shape, "Tiers", "Tiers should be in the output")
+		assert.Contains(t, shape, "Keys", "Keys should be in the output")
+		assert.NotContains(t, shape, "Breaker", "Breaker should be left out without one")
+	}
+
+	var stats CacheStatistics
+
+	err = json.Unmarshal(first.Body.Bytes(), &stats)
+	if assert.NoError(t, err, "An error was not expected") {
+		assert.Equal(t, redis.MetricsWindow, stats.Keys.Window, "Window should match")
+
+		tag, ok := stats.Keys.Bases["tag"]
+		if assert.True(t, ok, "Base should have metrics") {
+			assert.Equal(t, uint64(2), tag.Hits, "Hits should match")
+			assert.Equal(t, uint64(1), tag.Misses, "Misses should match")
+			assert.Equal(t, uint64(1), tag.Sets, "Sets should match")
+			assert.Equal(t, uint64(16), tag.BytesRead, "Bytes read should be the payload")
+			assert.Equal(t, uint64(8), tag.BytesWritten, "Bytes written should be the payload")
+		}
+
+		thread, ok := stats.Keys.Bases["thread"]
+		if assert.True(t, ok, "Base should have metrics") {
+			assert.Equal(t, uint64(0), thread.Hits, "Hits should match")
+			assert.Equal(t, uint64(1), thread.Sets, "Sets should match")
+			assert.Equal(t, uint64(6), thread.BytesWritten, "Bytes written should match")
+		}
+
+		_, ok = stats.Keys.Bases["index"]
+		assert.False(t, ok, "Unused bases should not have metrics")
+	}
+
+	// the breaker state is shown once there is one
+	redis.Cache.Breaker = redis.NewBreaker(1, time.Minute)
+	defer func() {
+		redis.Cache.Breaker = nil
+	}()
+
+	second := performRequest(router, "GET", "/status/cache")
+
+	assert.Equal(t, 200, second.Code, "HTTP request code should match")
+
+	err = json.Unmarshal(second.Body.Bytes(), &stats)
+	if assert.NoError(t, err, "An error was not expected") {
+		assert.Equal(t, "closed", stats.Breaker, "Breaker state should match")
+	}
+}
@@ -1,6 +1,7 @@
 package user
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -29,11 +30,18 @@ func Auth(authenticated bool) gin.HandlerFunc {
 		// try and get the jwt cookie from the request
 		cookie, err := c.Request.Cookie(CookieName)
 
+		// the refresh cookie outlives the access token
+		refreshCookie, refreshErr := c.Request.Cookie(RefreshCookieName)
+
+		// a missing or expired access token is replaced if there is a refresh token
+		refresh := err == http.ErrNoCookie && refreshErr == nil
+
 		// parse jwt token if its there
 		if err != http.ErrNoCookie {
 			// Get all active secrets
+			// services that only verify asymmetric tokens have no secret
 			secrets, err := GetSecrets()
-			if err != nil {
+			if err != nil && !hasKeys() {
 				c.JSON(e.ErrorMessage(e.ErrInternalError))
 				c.Error(err).SetMeta("auth.Auth.GetSecrets")
 				c.Abort()
@@ -47,8 +55,11 @@ func Auth(authenticated bool) gin.HandlerFunc {
 
 			token, parseErr := jwt.ParseWithClaims(cookie.Value, &TokenClaims{}, parseFunc)
 
+			// the signature is checked before the expiry so the token was ours
+			expired := errors.Is(parseErr, jwt.ErrTokenExpired)
+
 			// If token validation failed and old secret is available, try with it
-			if parseErr != nil && len(secrets) > 1 {
+			if parseErr != nil && len(secrets) > 1 && !secretRejected() {
 				// Try with old secret directly
 				secondaryFunc := func(token *jwt.Token) (interface{}, error) {
 					// Validate algorithm
@@ -86,17 +97,56 @@ func Auth(authenticated bool) gin.HandlerFunc {
 
 				// Try parsing with old secret
 				token, parseErr = jwt.ParseWithClaims(cookie.Value, &TokenClaims{}, secondaryFunc)
+				expired = expired || errors.Is(parseErr, jwt.ErrTokenExpired)
 			}
 
-			// If still invalid after all attempts
-			if parseErr != nil || !token.Valid {
-				// delete the cookie
+			valid := parseErr == nil && token.Valid
+
+			if !valid && expired && refreshErr == nil {
+				// the refresh token replaces it below
+				refresh = true
+			} else if !valid {
+				// If still invalid after all attempts delete the cookie
 				http.SetCookie(c.Writer, DeleteCookie())
 				c.JSON(e.ErrorMessage(e.ErrUnauthorized))
 				c.Error(parseErr).SetMeta("user.Auth")
 				c.Abort()
 				return
+			} else if err = checkRevoked(token.Claims.(*TokenClaims)); errors.Is(err, e.ErrTokenUnavailable) {
+				// keep the cookie so the session works again once redis is back
+				user = DefaultUser()
+
+				if authenticated {
+					c.JSON(e.ErrorMessage(e.ErrServiceUnavailable))
+					c.Error(err).SetMeta("user.Auth.Revoked.Unavailable")
+					c.Abort()
+					return
+				}
+
+				c.Error(err).SetMeta("user.Auth.Revoked.Unavailable")
+			} else if err != nil {
+				// reject tokens that were logged out
+				http.SetCookie(c.Writer, DeleteCookie())
+				c.JSON(e.ErrorMessage(e.ErrUnauthorized))
+				c.Error(err).SetMeta("user.Auth.Revoked")
+				c.Abort()
+				return
+			}
+		}
+
+		if refresh && !canSign() {
+			// only the auth service rotates refresh tokens, the client gets new ones there
+			user = DefaultUser()
+
+			if authenticated {
+				c.JSON(e.ErrorMessage(e.ErrUnauthorized))
+				c.Error(e.ErrNoSigningKey).SetMeta("user.Auth.Refresh")
+				c.Abort()
+				return
 			}
+		} else if refresh && !refreshSession(c, &user, refreshCookie.Value, authenticated) {
+			// get a new access token and rotate the refresh token
+			return
 		}
 
 		// check if user needed to be authenticated
@@ -116,3 +166,47 @@ func Auth(authenticated bool) gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// refreshSession sets the user from a refresh token and sends the new tokens, it aborts the request on failure
+func refreshSession(c *gin.Context, user *User, token string, authenticated bool) bool {
+	// the expired access token could have set the user already
+	*user = DefaultUser()
+
+	uid, access, refresh, err := RefreshTokens(token)
+	switch {
+	case err == errRefreshRace:
+		// another request is rotating the token and sends the new cookies, this one goes through without them
+	case err == e.ErrTokenInvalid || err == e.ErrTokenRevoked:
+		http.SetCookie(c.Writer, DeleteCookie())
+		http.SetCookie(c.Writer, DeleteRefreshCookie())
+		c.JSON(e.ErrorMessage(e.ErrUnauthorized))
+		c.Error(err).SetMeta("user.Auth.Refresh")
+		c.Abort()
+		return false
+	case errors.Is(err, e.ErrTokenUnavailable):
+		// keep the cookies so the session works again once redis is back
+		if !authenticated {
+			c.Error(err).SetMeta("user.Auth.Refresh.Unavailable")
+			return true
+		}
+		c.JSON(e.ErrorMessage(e.ErrServiceUnavailable))
+		c.Error(err).SetMeta("user.Auth.Refresh.Unavailable")
+		c.Abort()
+		return false
+	case err != nil:
+		c.JSON(e.ErrorMessage(e.ErrInternalError))
+		c.Error(err).SetMeta("user.Auth.Refresh")
+		c.Abort()
+		return false
+	}
+
+	user.SetID(uid)
+	user.SetAuthenticated()
+
+	if err == nil {
+		http.SetCookie(c.Writer, CreateCookie(access))
+		http.SetCookie(c.Writer, CreateRefreshCookie(refresh))
+	}
+
+	return true
+}
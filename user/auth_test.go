@@ -39,6 +39,8 @@ func resetAuthTestConfig() {
 	// Reset secrets
 	config.Settings.Session.NewSecret = ""
 	config.Settings.Session.OldSecret = ""
+	config.Settings.Session.RejectHS256 = false
+	config.Settings.Session.RevocationFailOpen = false
 }
 
 func TestAuthSecret(t *testing.T) {
@@ -180,8 +182,8 @@ func TestAuthValidateToken(t *testing.T) {
 	now := time.Now()
 
 	claims := TokenClaims{
-		2,
-		jwt.RegisteredClaims{
+		User: 2,
+		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer:    jwtIssuer,
 			IssuedAt:  jwt.NewNumericDate(now),
 			NotBefore: jwt.NewNumericDate(now),
@@ -259,8 +261,8 @@ func TestAuthValidateTokenBadUser(t *testing.T) {
 	now := time.Now()
 
 	claims := TokenClaims{
-		1,
-		jwt.RegisteredClaims{
+		User: 1,
+		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer:    jwtIssuer,
 			IssuedAt:  jwt.NewNumericDate(now),
 			NotBefore: jwt.NewNumericDate(now),
@@ -296,8 +298,8 @@ func TestAuthValidateTokenNoIssuer(t *testing.T) {
 	now := time.Now()
 
 	claims := TokenClaims{
-		2,
-		jwt.RegisteredClaims{
+		User: 2,
+		RegisteredClaims: jwt.RegisteredClaims{
 			IssuedAt:  jwt.NewNumericDate(now),
 			NotBefore: jwt.NewNumericDate(now),
 			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour * 24 * jwtExpireDays)),
@@ -332,8 +334,8 @@ func TestAuthValidateTokenBadIssuer(t *testing.T) {
 	now := time.Now()
 
 	claims := TokenClaims{
-		2,
-		jwt.RegisteredClaims{
+		User: 2,
+		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer:    "derp",
 			IssuedAt:  jwt.NewNumericDate(now),
 			NotBefore: jwt.NewNumericDate(now),
@@ -378,8 +380,8 @@ func TestAuthTokenBadNBF(t *testing.T) {
 	now := time.Now()
 
 	claims := TokenClaims{
-		2,
-		jwt.RegisteredClaims{
+		User: 2,
+		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer:    jwtIssuer,
 			IssuedAt:  jwt.NewNumericDate(now),
 			NotBefore: jwt.NewNumericDate(now.AddDate(0, 1, 0)),
@@ -421,8 +423,8 @@ func TestAuthTokenExpired(t *testing.T) {
 	now := time.Now()
 
 	claims := TokenClaims{
-		2,
-		jwt.RegisteredClaims{
+		User: 2,
+		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer:    jwtIssuer,
 			IssuedAt:  jwt.NewNumericDate(now),
 			NotBefore: jwt.NewNumericDate(now),
@@ -522,8 +524,8 @@ func TestAuthInvalidSigningMethod(t *testing.T) {
 	now := time.Now()
 
 	claims := TokenClaims{
-		2,
-		jwt.RegisteredClaims{
+		User: 2,
+		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer:    jwtIssuer,
 			IssuedAt:  jwt.NewNumericDate(now),
 			NotBefore: jwt.NewNumericDate(now),
@@ -573,8 +575,8 @@ func TestAuthInvalidUserID(t *testing.T) {
 		now := time.Now()
 
 		claims := TokenClaims{
-			uid,
-			jwt.RegisteredClaims{
+			User: uid,
+			RegisteredClaims: jwt.RegisteredClaims{
 				Issuer:    jwtIssuer,
 				IssuedAt:  jwt.NewNumericDate(now),
 				NotBefore: jwt.NewNumericDate(now),
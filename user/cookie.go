@@ -8,6 +8,8 @@ import (
 const (
 	// CookieName is the name of the jwt session cookie
 	CookieName = "session_jwt"
+	// RefreshCookieName is the name of the refresh token cookie
+	RefreshCookieName = "session_refresh"
 )
 
 // CreateCookie will make a cookie for the JWT
@@ -36,3 +38,17 @@ func DeleteCookie() *http.Cookie {
 		SameSite: http.SameSiteLaxMode,
 	}
 }
+
+// CreateRefreshCookie will make a cookie for the refresh token
+func CreateRefreshCookie(token string) *http.Cookie {
+	cookie := CreateCookie(token)
+	cookie.Name = RefreshCookieName
+	return cookie
+}
+
+// DeleteRefreshCookie will delete the refresh token cookie
+func DeleteRefreshCookie() *http.Cookie {
+	cookie := DeleteCookie()
+	cookie.Name = RefreshCookieName
+	return cookie
+}
@@ -173,3 +173,19 @@ func (w *testResponseWriter) Write([]byte) (int, error) {
 
 func (w *testResponseWriter) WriteHeader(int) {
 }
+
+func TestRefreshCookie(t *testing.T) {
+	cookie := CreateRefreshCookie("token")
+
+	assert.Equal(t, RefreshCookieName, cookie.Name, "Cookie name should match constant")
+	assert.Equal(t, "token", cookie.Value, "Cookie value should match token")
+	assert.Equal(t, "/", cookie.Path, "Cookie path should be root")
+	assert.True(t, cookie.HttpOnly, "Cookie should be HttpOnly")
+	assert.True(t, cookie.Secure, "Cookie should be Secure")
+
+	deleted := DeleteRefreshCookie()
+
+	assert.Equal(t, RefreshCookieName, deleted.Name, "Cookie name should match constant")
+	assert.Equal(t, "", deleted.Value, "Cookie value should be empty")
+	assert.Equal(t, -1, deleted.MaxAge, "Cookie MaxAge should be -1")
+}
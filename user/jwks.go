@@ -0,0 +1,330 @@
+package user
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"golang.org/x/sync/singleflight"
+
+	e "github.com/eirka/eirka-libs/errors"
+)
+
+var (
+	// jwksRefresh is how long the keys of a KeySet are used before they are loaded again
+	jwksRefresh = time.Hour
+	// jwksMinRefresh limits how often a token with an unknown kid can load the keys again
+	jwksMinRefresh = time.Minute
+	// jwksMaxSize is the largest JWKS document that is read
+	jwksMaxSize int64 = 1 << 20
+)
+
+// jwk is a public key in a JWKS
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// jwkSet is a JWKS document
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// publicKey is a verification key and the method its tokens have to be signed with
+type publicKey struct {
+	key    crypto.PublicKey
+	method jwt.SigningMethod
+}
+
+// signingMethod returns the method for a key type
+func signingMethod(key crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA, nil
+	case *rsa.PublicKey:
+		if k.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("%w: rsa keys need at least 2048 bits", e.ErrUnsupportedKey)
+		}
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%w: ecdsa keys need the P-256 curve", e.ErrUnsupportedKey)
+		}
+		return jwt.SigningMethodES256, nil
+	}
+
+	return nil, fmt.Errorf("%w: %T", e.ErrUnsupportedKey, key)
+}
+
+// encodeJWK returns the JWK of a public key
+func encodeJWK(kid string, key crypto.PublicKey) (jwk, error) {
+	method, err := signingMethod(key)
+	if err != nil {
+		return jwk{}, err
+	}
+
+	out := jwk{
+		Kid: kid,
+		Use: "sig",
+		Alg: method.Alg(),
+	}
+
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		out.Kty = "OKP"
+		out.Crv = "Ed25519"
+		out.X = base64.RawURLEncoding.EncodeToString(k)
+	case *rsa.PublicKey:
+		out.Kty = "RSA"
+		out.N = base64.RawURLEncoding.EncodeToString(k.N.Bytes())
+		out.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes())
+	case *ecdsa.PublicKey:
+		out.Kty = "EC"
+		out.Crv = "P-256"
+		out.X = base64.RawURLEncoding.EncodeToString(k.X.FillBytes(make([]byte, 32)))
+		out.Y = base64.RawURLEncoding.EncodeToString(k.Y.FillBytes(make([]byte, 32)))
+	}
+
+	return out, nil
+}
+
+// publicKey decodes a JWK, only the key types we can sign with are supported
+func (j jwk) publicKey() (publicKey, error) {
+	var key crypto.PublicKey
+
+	switch {
+	case j.Kty == "OKP" && j.Crv == "Ed25519":
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return publicKey{}, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return publicKey{}, errors.New("bad ed25519 key size")
+		}
+		key = ed25519.PublicKey(x)
+	case j.Kty == "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(j.N)
+		if err != nil {
+			return publicKey{}, err
+		}
+		exponent, err := base64.RawURLEncoding.DecodeString(j.E)
+		if err != nil {
+			return publicKey{}, err
+		}
+		if len(exponent) == 0 || len(exponent) > 4 {
+			return publicKey{}, errors.New("bad rsa exponent")
+		}
+		key = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(exponent).Int64()),
+		}
+	case j.Kty == "EC" && j.Crv == "P-256":
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return publicKey{}, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(j.Y)
+		if err != nil {
+			return publicKey{}, err
+		}
+		if len(x) != 32 || len(y) != 32 {
+			return publicKey{}, errors.New("bad ecdsa key size")
+		}
+		// ecdh checks that the point is on the curve
+		_, err = ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...))
+		if err != nil {
+			return publicKey{}, err
+		}
+		key = &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+	default:
+		return publicKey{}, fmt.Errorf("%w: %s", e.ErrUnsupportedKey, j.Kty)
+	}
+
+	method, err := signingMethod(key)
+	if err != nil {
+		return publicKey{}, err
+	}
+
+	// the alg is optional but has to agree with the key
+	if j.Alg != "" && j.Alg != method.Alg() {
+		return publicKey{}, fmt.Errorf("%w: alg %s does not match the key", e.ErrUnsupportedKey, j.Alg)
+	}
+
+	return publicKey{key: key, method: method}, nil
+}
+
+// KeySet holds the public keys from a JWKS file or endpoint by kid
+// The keys are loaded again every jwksRefresh, or when a token has a kid that is not in the set,
+// at most every jwksMinRefresh. The old keys are kept if loading fails.
+type KeySet struct {
+	source string
+	// Client fetches the JWKS from an endpoint
+	Client *http.Client
+
+	// group shares a load between the verifications that need it
+	group singleflight.Group
+
+	mu      sync.Mutex
+	keys    map[string]publicKey
+	loaded  time.Time
+	attempt time.Time
+}
+
+// NewKeySet returns a key set for a JWKS file path or an http(s) URL
+func NewKeySet(source string) *KeySet {
+	return &KeySet{
+		source: source,
+		Client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+// Load loads the keys, to fail at start up instead of on the first token
+func (k *KeySet) Load() error {
+	_, err, _ := k.group.Do("load", func() (interface{}, error) {
+		return nil, k.load()
+	})
+
+	return err
+}
+
+// key returns the public key for a kid
+// A stale set is loaded again in the background while its keys are still used, only a kid that
+// is not in the set waits for the load.
+func (k *KeySet) key(kid string) (publicKey, error) {
+	k.mu.Lock()
+	key, ok := k.keys[kid]
+	stale := time.Since(k.loaded) > jwksRefresh
+	due := time.Since(k.attempt) >= jwksMinRefresh
+	k.mu.Unlock()
+
+	if ok {
+		if stale && due {
+			k.group.DoChan("load", func() (interface{}, error) {
+				return nil, k.load()
+			})
+		}
+		return key, nil
+	}
+
+	var err error
+
+	if due {
+		err = k.Load()
+
+		k.mu.Lock()
+		key, ok = k.keys[kid]
+		k.mu.Unlock()
+	}
+
+	if !ok {
+		if err != nil {
+			return publicKey{}, fmt.Errorf("%w: %s: %w", e.ErrUnknownKey, kid, err)
+		}
+		return publicKey{}, fmt.Errorf("%w: %s", e.ErrUnknownKey, kid)
+	}
+
+	return key, nil
+}
+
+// load reads the JWKS and replaces the keys
+// The lock is only held to swap the keys so verifications do not wait on the fetch.
+func (k *KeySet) load() error {
+	attempt := time.Now()
+
+	k.mu.Lock()
+	k.attempt = attempt
+	k.mu.Unlock()
+
+	data, err := k.read()
+	if err != nil {
+		return fmt.Errorf("loading jwks %s: %w", k.source, err)
+	}
+
+	var set jwkSet
+
+	err = json.Unmarshal(data, &set)
+	if err != nil {
+		return fmt.Errorf("parsing jwks %s: %w", k.source, err)
+	}
+
+	keys := make(map[string]publicKey, len(set.Keys))
+
+	for _, j := range set.Keys {
+		// keys for encryption or that we can not verify with are skipped
+		if j.Kid == "" || (j.Use != "" && j.Use != "sig") {
+			continue
+		}
+
+		key, err := j.publicKey()
+		if err != nil {
+			continue
+		}
+
+		keys[j.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		return fmt.Errorf("jwks %s has no usable keys", k.source)
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.loaded = attempt
+	k.mu.Unlock()
+
+	return nil
+}
+
+// read returns the JWKS document from the file or endpoint
+func (k *KeySet) read() ([]byte, error) {
+	if !strings.HasPrefix(k.source, "https://") && !strings.HasPrefix(k.source, "http://") {
+		return os.ReadFile(k.source)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, k.source, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := k.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, jwksMaxSize))
+}
@@ -0,0 +1,302 @@
+package user
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	e "github.com/eirka/eirka-libs/errors"
+)
+
+// setJWKSRefresh changes how often key sets are loaded until the test ends
+func setJWKSRefresh(t *testing.T, refresh, minimum time.Duration) {
+	originalRefresh, originalMinimum := jwksRefresh, jwksMinRefresh
+	jwksRefresh, jwksMinRefresh = refresh, minimum
+
+	t.Cleanup(func() {
+		jwksRefresh, jwksMinRefresh = originalRefresh, originalMinimum
+	})
+}
+
+func TestJWKRoundTrip(t *testing.T) {
+
+	for alg, signer := range testSigners(t) {
+		encoded, err := encodeJWK("1", signer.Public())
+		if !assert.NoError(t, err, "An error was not expected") {
+			continue
+		}
+
+		assert.Equal(t, alg, encoded.Alg, "Alg should match")
+		assert.Equal(t, "sig", encoded.Use, "Use should be signing")
+
+		decoded, err := encoded.publicKey()
+		if assert.NoError(t, err, "An error was not expected") {
+			assert.Equal(t, signer.Public(), decoded.key, "Key should survive the round trip")
+			assert.Equal(t, alg, decoded.method.Alg(), "Method should match")
+		}
+
+		// a key can not claim another alg
+		encoded.Alg = "HS256"
+
+		_, err = encoded.publicKey()
+		assert.ErrorIs(t, err, e.ErrUnsupportedKey, "Alg should have to match the key")
+	}
+
+	_, err := jwk{Kty: "oct", Kid: "1"}.publicKey()
+	assert.ErrorIs(t, err, e.ErrUnsupportedKey, "Symmetric keys should be rejected")
+
+	// a point that is not on the curve
+	_, err = jwk{Kty: "EC", Crv: "P-256", X: "AQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", Y: "AQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"}.publicKey()
+	assert.Error(t, err, "An error was expected for a bad point")
+}
+
+func TestKeySetFile(t *testing.T) {
+
+	signers := testSigners(t)
+
+	var keys []jwk
+
+	for alg, signer := range signers {
+		encoded, err := encodeJWK(alg, signer.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, encoded)
+	}
+
+	// keys that can not verify tokens are skipped
+	encryption, err := encodeJWK("enc", signers["RS256"].Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryption.Use = "enc"
+
+	keys = append(keys, encryption, jwk{Kty: "oct", Kid: "oct"})
+
+	data, err := json.Marshal(jwkSet{Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+
+	err = os.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set := NewKeySet(path)
+
+	assert.NoError(t, set.Load(), "An error was not expected")
+	assert.Len(t, set.keys, 3, "Only the signing keys should be loaded")
+
+	for alg, signer := range signers {
+		key, err := set.key(alg)
+		if assert.NoError(t, err, "An error was not expected") {
+			assert.Equal(t, signer.Public(), key.key, "Key should match")
+			assert.Equal(t, alg, key.method.Alg(), "Method should match")
+		}
+	}
+
+	_, err = set.key("enc")
+	assert.ErrorIs(t, err, e.ErrUnknownKey, "Error should be unknown key")
+
+	err = os.WriteFile(path, []byte(`{"keys":[]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Error(t, set.Load(), "An error was expected without usable keys")
+	assert.Len(t, set.keys, 3, "Old keys should be kept")
+
+	assert.Error(t, NewKeySet(filepath.Join(t.TempDir(), "missing.json")).Load(), "An error was expected for a missing file")
+}
+
+func TestKeySetEndpoint(t *testing.T) {
+
+	resetAuthTestConfig()
+	resetKeys(t)
+
+	signers := testSigners(t)
+
+	first, err := NewSigningKey("1", signers["EdDSA"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := NewSigningKey("2", signers["ES256"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tokens are made by the auth service
+	makeToken := func(key *SigningKey) string {
+		SetSigningKey(key)
+		defer SetSigningKey(nil)
+
+		token, err := MakeToken(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return token
+	}
+
+	firstToken := makeToken(first)
+	secondToken := makeToken(second)
+
+	// the auth service publishes the public keys
+	var published atomic.Value
+	var fetches atomic.Int32
+	var down atomic.Bool
+
+	publish := func(keys ...*SigningKey) {
+		set := jwkSet{Keys: []jwk{}}
+		for _, key := range keys {
+			encoded, err := encodeJWK(key.ID, key.Public())
+			if err != nil {
+				t.Fatal(err)
+			}
+			set.Keys = append(set.Keys, encoded)
+		}
+		published.Store(set)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		set := published.Load()
+		if set == nil || down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	defer server.Close()
+
+	// the other services only have the key set
+	setJWKSRefresh(t, time.Hour, time.Hour)
+
+	set := NewKeySet(server.URL)
+
+	assert.Error(t, set.Load(), "An error was expected while the endpoint is down")
+
+	publish(first)
+
+	assert.NoError(t, set.Load(), "An error was not expected")
+	assert.Equal(t, int32(2), fetches.Load(), "Keys should be fetched")
+
+	SetKeySet(set)
+
+	gin.SetMode(gin.ReleaseMode)
+
+	router := gin.New()
+
+	router.Use(Auth(true))
+
+	router.GET("/", func(c *gin.Context) {
+		c.String(200, "OK")
+	})
+
+	for i := 0; i < 3; i++ {
+		result := performJWTCookieRequest(router, "GET", "/", firstToken)
+		assert.Equal(t, http.StatusOK, result.Code, "HTTP request code should match")
+	}
+
+	assert.Equal(t, int32(2), fetches.Load(), "Keys should be cached")
+
+	// the auth service rotates to a new key
+	publish(second, first)
+
+	result := performJWTCookieRequest(router, "GET", "/", secondToken)
+	assert.Equal(t, http.StatusUnauthorized, result.Code, "Unknown kid should wait for the minimum refresh")
+	assert.Equal(t, int32(2), fetches.Load(), "Keys should not be fetched again yet")
+
+	setJWKSRefresh(t, time.Hour, 0)
+
+	result = performJWTCookieRequest(router, "GET", "/", secondToken)
+	assert.Equal(t, http.StatusOK, result.Code, "HTTP request code should match")
+	assert.Equal(t, int32(3), fetches.Load(), "Unknown kid should fetch the keys")
+
+	_, err = set.key("3")
+	assert.ErrorIs(t, err, e.ErrUnknownKey, "Error should be unknown key")
+	assert.Equal(t, int32(4), fetches.Load(), "Unknown kid should fetch the keys")
+
+	// keys are kept while the endpoint is down
+	setJWKSRefresh(t, 0, 0)
+
+	down.Store(true)
+
+	result = performJWTCookieRequest(router, "GET", "/", firstToken)
+	assert.Equal(t, http.StatusOK, result.Code, "HTTP request code should match")
+
+	assert.Eventually(t, func() bool {
+		return fetches.Load() == 5
+	}, time.Second, 10*time.Millisecond, "Stale keys should be fetched again in the background")
+}
+
+func TestKeySetSlowEndpoint(t *testing.T) {
+
+	signer := testSigners(t)["EdDSA"]
+
+	encoded, err := encodeJWK("1", signer.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fetches atomic.Int32
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// only the first fetch is fast
+		if fetches.Add(1) > 1 {
+			close(started)
+			<-release
+		}
+		json.NewEncoder(w).Encode(jwkSet{Keys: []jwk{encoded}})
+	}))
+	defer server.Close()
+
+	set := NewKeySet(server.URL)
+
+	assert.NoError(t, set.Load(), "An error was not expected")
+
+	setJWKSRefresh(t, 0, 0)
+
+	loaded := make(chan error, 1)
+
+	go func() {
+		loaded <- set.Load()
+	}()
+
+	<-started
+
+	// known keys are used while the endpoint is slow
+	found := make(chan error, 1)
+
+	go func() {
+		_, err := set.key("1")
+		found <- err
+	}()
+
+	select {
+	case err := <-found:
+		assert.NoError(t, err, "An error was not expected")
+	case <-time.After(time.Second):
+		t.Error("Verification should not wait for the fetch")
+	}
+
+	close(release)
+
+	assert.NoError(t, <-loaded, "An error was not expected")
+	assert.Equal(t, int32(2), fetches.Load(), "Loads should be shared")
+}
@@ -15,13 +15,24 @@ const (
 	jwtHeaderKeyID = "kid"
 	// jwt issuer
 	jwtIssuer = "pram"
-	// jwt expire days
+	// jwt expire days, the lifetime of a refresh token family
 	jwtExpireDays = 90
+	// jwtAccessExpiry is the lifetime of an access token, Auth refreshes it with the refresh token
+	jwtAccessExpiry = 15 * time.Minute
 )
 
+// asymmetricMethods are the signing methods of the key types we support
+var asymmetricMethods = map[string]bool{
+	jwt.SigningMethodEdDSA.Alg(): true,
+	jwt.SigningMethodRS256.Alg(): true,
+	jwt.SigningMethodES256.Alg(): true,
+}
+
 // TokenClaims holds the custom and standard claims for the JWT token
 type TokenClaims struct {
 	User uint `json:"user_id"`
+	// Generation is the token generation of the user when the token was made, see RevokeAllForUser
+	Generation uint64 `json:"gen,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -48,12 +59,34 @@ func (u *User) CreateToken() (newtoken string, err error) {
 	return MakeToken(u.ID)
 }
 
-// MakeToken will create a JWT token
+// MakeToken will create a JWT token that lasts as long as a refresh token family, for logins without one
+// See MakeTokens for a short lived access token and a refresh token.
 func MakeToken(uid uint) (newtoken string, err error) {
+	return makeToken(uid, time.Hour*24*jwtExpireDays)
+}
+
+// makeAccessToken will create a short lived JWT access token that Auth replaces with the refresh token
+func makeAccessToken(uid uint) (newtoken string, err error) {
+	return makeToken(uid, jwtAccessExpiry)
+}
+
+// makeToken will create a JWT token that expires after expiry
+func makeToken(uid uint, expiry time.Duration) (newtoken string, err error) {
+	// services that only verify tokens never make them
+	if !canSign() {
+		return "", e.ErrNoSigningKey
+	}
+
+	// a private key replaces the secret if there is one
+	key := signingKey()
+
 	// Get the new secret for signing
-	secret, err := GetPrimarySecret()
-	if err != nil {
-		return "", err
+	var secret string
+	if key == nil {
+		secret, err = GetPrimarySecret()
+		if err != nil {
+			return "", err
+		}
 	}
 
 	// a token should never be created for these users
@@ -62,19 +95,42 @@ func MakeToken(uid uint) (newtoken string, err error) {
 		return
 	}
 
+	// the id for revoking the token
+	id, err := newTokenID()
+	if err != nil {
+		return
+	}
+
+	// tokens from before the last RevokeAllForUser are rejected
+	generation, err := tokenGeneration(uid)
+	if err != nil {
+		return
+	}
+
 	// the current timestamp
 	now := time.Now()
 
 	claims := TokenClaims{
-		uid,
-		jwt.RegisteredClaims{
+		User:       uid,
+		Generation: generation,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        id,
 			Issuer:    jwtIssuer,
 			IssuedAt:  jwt.NewNumericDate(now),
 			NotBefore: jwt.NewNumericDate(now),
-			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour * 24 * jwtExpireDays)),
+			ExpiresAt: jwt.NewNumericDate(now.Add(expiry)),
 		},
 	}
 
+	if key != nil {
+		token := jwt.NewWithClaims(key.method, claims)
+
+		// verifiers look up the public key by its id
+		token.Header[jwtHeaderKeyID] = key.ID
+
+		return token.SignedString(key.key)
+	}
+
 	// Create the token
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
@@ -87,9 +143,9 @@ func MakeToken(uid uint) (newtoken string, err error) {
 // validateToken checks all the claims in the provided token and returns the appropriate secret
 // for token validation. It also updates the user object with information from the token.
 func validateToken(token *jwt.Token, user *User) (interface{}, error) {
-	// check alg to make sure its hmac
-	_, ok := token.Method.(*jwt.SigningMethodHMAC)
-	if !ok {
+	// check alg to make sure its hmac or one of our key types
+	_, hmac := token.Method.(*jwt.SigningMethodHMAC)
+	if (hmac && secretRejected()) || (!hmac && !asymmetricMethods[token.Method.Alg()]) {
 		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 	}
 
@@ -126,6 +182,11 @@ func validateToken(token *jwt.Token, user *User) (interface{}, error) {
 		return nil, fmt.Errorf("user is not authenticated")
 	}
 
+	// asymmetric tokens are verified with the public key
+	if !hmac {
+		return verificationKey(token)
+	}
+
 	// Get the new secret for validation
 	// The Auth middleware will try with old secret if this fails
 	if config.Settings.Session.NewSecret == "" {
@@ -82,6 +82,9 @@ func TestMakeTokenValidateOutput(t *testing.T) {
 	assert.True(t, ok, "Should be true")
 
 	assert.Equal(t, claims.User, uint(2), "Claim should match")
+
+	// tokens without a refresh token keep the old lifetime
+	assert.WithinDuration(t, time.Now().Add(time.Hour*24*jwtExpireDays), claims.ExpiresAt.Time, 2*time.Second, "Token should be long lived")
 }
 
 func TestCreateTokenAnonAuth(t *testing.T) {
@@ -171,8 +174,8 @@ func TestAlgorithmConfusionAttack(t *testing.T) {
 
 	// Create token with none algorithm (which should be rejected)
 	claims := TokenClaims{
-		2,
-		jwt.RegisteredClaims{
+		User: 2,
+		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer:    jwtIssuer,
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
@@ -310,8 +313,8 @@ func TestTokenTimeSkew(t *testing.T) {
 	futureTime := time.Now().Add(time.Hour)
 
 	claims := TokenClaims{
-		2,
-		jwt.RegisteredClaims{
+		User: 2,
+		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer:    jwtIssuer,
 			IssuedAt:  jwt.NewNumericDate(futureTime),
 			NotBefore: jwt.NewNumericDate(futureTime),
@@ -351,8 +354,8 @@ func TestTokenWithUnsupportedAlgorithm(t *testing.T) {
 	// We'll manually create a token with alg of "HS256" but then manually change header to test algorithm confusion
 	tokenValid := jwt.New(jwt.SigningMethodHS256)
 	claims := &TokenClaims{
-		2,
-		jwt.RegisteredClaims{
+		User: 2,
+		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer:    jwtIssuer,
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
@@ -429,8 +432,8 @@ func TestInvalidTokenClaims(t *testing.T) {
 		{
 			name: "Invalid Issuer",
 			claims: TokenClaims{
-				2,
-				jwt.RegisteredClaims{
+				User: 2,
+				RegisteredClaims: jwt.RegisteredClaims{
 					Issuer:    "invalid-issuer",
 					IssuedAt:  jwt.NewNumericDate(now),
 					NotBefore: jwt.NewNumericDate(now),
@@ -442,8 +445,8 @@ func TestInvalidTokenClaims(t *testing.T) {
 		{
 			name: "Zero User ID",
 			claims: TokenClaims{
-				0,
-				jwt.RegisteredClaims{
+				User: 0,
+				RegisteredClaims: jwt.RegisteredClaims{
 					Issuer:    jwtIssuer,
 					IssuedAt:  jwt.NewNumericDate(now),
 					NotBefore: jwt.NewNumericDate(now),
@@ -455,8 +458,8 @@ func TestInvalidTokenClaims(t *testing.T) {
 		{
 			name: "Expired Token",
 			claims: TokenClaims{
-				2,
-				jwt.RegisteredClaims{
+				User: 2,
+				RegisteredClaims: jwt.RegisteredClaims{
 					Issuer:    jwtIssuer,
 					IssuedAt:  jwt.NewNumericDate(now.AddDate(0, 0, -100)),
 					NotBefore: jwt.NewNumericDate(now.AddDate(0, 0, -100)),
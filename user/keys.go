@@ -0,0 +1,261 @@
+package user
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	jwt "github.com/golang-jwt/jwt/v5"
+
+	"github.com/eirka/eirka-libs/config"
+	e "github.com/eirka/eirka-libs/errors"
+)
+
+// SigningKey is a private key that signs tokens instead of the shared secret
+// Only the auth service should have it, the other services verify with the public key from the JWKS.
+type SigningKey struct {
+	// ID is the kid of the key in tokens and the JWKS
+	ID string
+
+	key    crypto.Signer
+	method jwt.SigningMethod
+}
+
+// NewSigningKey returns a signing key for an Ed25519, RSA or ECDSA P-256 private key
+// The tokens are signed with EdDSA, RS256 or ES256 to match.
+func NewSigningKey(id string, key crypto.Signer) (*SigningKey, error) {
+	if id == "" {
+		return nil, errors.New("signing key id cannot be empty")
+	}
+
+	method, err := signingMethod(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	return &SigningKey{
+		ID:     id,
+		key:    key,
+		method: method,
+	}, nil
+}
+
+// LoadSigningKey reads a PEM encoded PKCS8, PKCS1 or EC private key file
+func LoadSigningKey(id, path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no pem data in %s", path)
+	}
+
+	var key interface{}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%w: pem type %s", e.ErrUnsupportedKey, block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", e.ErrUnsupportedKey, key)
+	}
+
+	return NewSigningKey(id, signer)
+}
+
+// Public returns the public key
+func (k *SigningKey) Public() crypto.PublicKey {
+	return k.key.Public()
+}
+
+// KeyManager holds the keys for asymmetric tokens
+type KeyManager struct {
+	mu      sync.RWMutex
+	signing *SigningKey
+	retired []*SigningKey
+	set     *KeySet
+}
+
+// keyManager is the singleton instance of KeyManager
+var keyManager = &KeyManager{}
+
+// SetSigningKey signs new tokens with a private key, nil goes back to the shared secret
+// Retired keys are still published in the JWKS so their tokens verify until they expire.
+func SetSigningKey(key *SigningKey, retired ...*SigningKey) {
+	keyManager.mu.Lock()
+	defer keyManager.mu.Unlock()
+
+	keyManager.signing = key
+	keyManager.retired = retired
+}
+
+// SetKeySet verifies asymmetric tokens with the public keys from a JWKS, nil removes it
+func SetKeySet(set *KeySet) {
+	keyManager.mu.Lock()
+	defer keyManager.mu.Unlock()
+
+	keyManager.set = set
+}
+
+// LoadKeys sets the signing key and the key set from the Session config
+func LoadKeys() error {
+	if config.Settings == nil {
+		return e.ErrNoSecret
+	}
+
+	session := config.Settings.Session
+
+	if session.SigningKey != "" {
+		key, err := LoadSigningKey(session.SigningKeyID, session.SigningKey)
+		if err != nil {
+			return err
+		}
+
+		SetSigningKey(key)
+	}
+
+	if session.JWKS != "" {
+		set := NewKeySet(session.JWKS)
+
+		err := set.Load()
+		if err != nil {
+			return err
+		}
+
+		SetKeySet(set)
+	}
+
+	return nil
+}
+
+// signingKey returns the key new tokens are signed with, or nil to use the secret
+func signingKey() *SigningKey {
+	keyManager.mu.RLock()
+	defer keyManager.mu.RUnlock()
+
+	return keyManager.signing
+}
+
+// hasKeys returns true if asymmetric tokens can be verified
+func hasKeys() bool {
+	keyManager.mu.RLock()
+	defer keyManager.mu.RUnlock()
+
+	return keyManager.signing != nil || keyManager.set != nil
+}
+
+// canSign returns true if this service makes tokens
+// Services with a JWKS and no signing key only verify them, the auth service refreshes them.
+func canSign() bool {
+	keyManager.mu.RLock()
+	defer keyManager.mu.RUnlock()
+
+	return keyManager.signing != nil || keyManager.set == nil
+}
+
+// secretRejected returns true if tokens signed with the secrets are not accepted, see Session.RejectHS256
+func secretRejected() bool {
+	return hasKeys() && config.Settings != nil && config.Settings.Session.RejectHS256
+}
+
+// verificationKey returns the public key for an asymmetric token by its kid
+// Our own signing keys are used first so the auth service does not need its JWKS.
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	keyManager.mu.RLock()
+	keys := append([]*SigningKey{keyManager.signing}, keyManager.retired...)
+	set := keyManager.set
+	keyManager.mu.RUnlock()
+
+	if keys[0] == nil && set == nil {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	kid, ok := token.Header[jwtHeaderKeyID].(string)
+	if !ok || kid == "" {
+		return nil, fmt.Errorf("token has no key id")
+	}
+
+	var key publicKey
+
+	for _, k := range keys {
+		if k != nil && k.ID == kid {
+			key = publicKey{key: k.Public(), method: k.method}
+			break
+		}
+	}
+
+	if key.key == nil {
+		if set == nil {
+			return nil, fmt.Errorf("%w: %s", e.ErrUnknownKey, kid)
+		}
+
+		var err error
+
+		key, err = set.key(kid)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// a key only verifies the method it was made for
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	return key.key, nil
+}
+
+// JWKSController is a Gin controller that publishes the public keys of the signing keys as a JWKS
+func JWKSController(c *gin.Context) {
+
+	keyManager.mu.RLock()
+	keys := append([]*SigningKey{keyManager.signing}, keyManager.retired...)
+	keyManager.mu.RUnlock()
+
+	if keys[0] == nil {
+		c.JSON(e.ErrorMessage(e.ErrNotFound))
+		c.Error(e.ErrUnknownKey).SetMeta("JWKSController.NoKey")
+		return
+	}
+
+	set := jwkSet{}
+
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+
+		j, err := encodeJWK(key.ID, key.Public())
+		if err != nil {
+			c.JSON(e.ErrorMessage(e.ErrInternalError))
+			c.Error(err).SetMeta("JWKSController.Encode")
+			return
+		}
+
+		set.Keys = append(set.Keys, j)
+	}
+
+	// verifiers cache the keys anyway
+	c.Header("Cache-Control", "public, max-age=300")
+
+	c.JSON(200, set)
+
+}
@@ -0,0 +1,558 @@
+package user
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eirka/eirka-libs/config"
+	e "github.com/eirka/eirka-libs/errors"
+	"github.com/eirka/eirka-libs/redis"
+)
+
+// resetKeys removes the signing key and key set when the test ends
+func resetKeys(t *testing.T) {
+	t.Cleanup(func() {
+		SetSigningKey(nil)
+		SetKeySet(nil)
+	})
+}
+
+// testSigners returns one private key of every supported type by kid
+func testSigners(t *testing.T) map[string]crypto.Signer {
+	_, ed, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]crypto.Signer{
+		"EdDSA": ed,
+		"RS256": rs,
+		"ES256": ec,
+	}
+}
+
+func TestNewSigningKey(t *testing.T) {
+
+	for alg, signer := range testSigners(t) {
+		key, err := NewSigningKey("key-"+alg, signer)
+		if assert.NoError(t, err, "An error was not expected") {
+			assert.Equal(t, alg, key.method.Alg(), "Method should match the key type")
+			assert.Equal(t, signer.Public(), key.Public(), "Public key should match")
+		}
+	}
+
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if assert.NoError(t, err, "An error was not expected") {
+		_, err = NewSigningKey("small", small)
+		assert.ErrorIs(t, err, e.ErrUnsupportedKey, "Small rsa keys should be rejected")
+	}
+
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if assert.NoError(t, err, "An error was not expected") {
+		_, err = NewSigningKey("p384", p384)
+		assert.ErrorIs(t, err, e.ErrUnsupportedKey, "Other curves should be rejected")
+	}
+
+	_, err = NewSigningKey("", p384)
+	assert.Error(t, err, "An error was expected without an id")
+}
+
+func TestLoadSigningKey(t *testing.T) {
+
+	dir := t.TempDir()
+
+	signers := testSigners(t)
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(signers["EdDSA"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := x509.MarshalECPrivateKey(signers["ES256"].(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]*pem.Block{
+		"EdDSA": {Type: "PRIVATE KEY", Bytes: pkcs8},
+		"RS256": {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(signers["RS256"].(*rsa.PrivateKey))},
+		"ES256": {Type: "EC PRIVATE KEY", Bytes: ecKey},
+	}
+
+	for alg, block := range files {
+		path := filepath.Join(dir, alg+".pem")
+
+		err = os.WriteFile(path, pem.EncodeToMemory(block), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key, err := LoadSigningKey("1", path)
+		if assert.NoError(t, err, "An error was not expected") {
+			assert.Equal(t, alg, key.method.Alg(), "Method should match the key type")
+			assert.Equal(t, signers[alg].Public(), key.Public(), "Public key should match")
+		}
+	}
+
+	path := filepath.Join(dir, "cert.pem")
+
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("blah")}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadSigningKey("1", path)
+	assert.ErrorIs(t, err, e.ErrUnsupportedKey, "Other pem types should be rejected")
+
+	_, err = LoadSigningKey("1", filepath.Join(dir, "missing.pem"))
+	assert.Error(t, err, "An error was expected for a missing file")
+}
+
+func TestAsymmetricTokens(t *testing.T) {
+
+	resetAuthTestConfig()
+	resetKeys(t)
+
+	gin.SetMode(gin.ReleaseMode)
+
+	router := gin.New()
+
+	router.Use(Auth(true))
+
+	router.GET("/", func(c *gin.Context) {
+		c.String(200, "OK")
+	})
+
+	assert.False(t, IsInitialized(), "Nothing should be configured")
+
+	for alg, signer := range testSigners(t) {
+		key, err := NewSigningKey("key-"+alg, signer)
+		if !assert.NoError(t, err, "An error was not expected") {
+			continue
+		}
+
+		SetSigningKey(key)
+
+		// the auth service does not need the shared secret
+		assert.True(t, IsInitialized(), "Signing key should be enough")
+
+		token, err := MakeToken(2)
+		if !assert.NoError(t, err, "An error was not expected") {
+			continue
+		}
+
+		parsed, _, err := jwt.NewParser().ParseUnverified(token, &TokenClaims{})
+		if assert.NoError(t, err, "An error was not expected") {
+			assert.Equal(t, alg, parsed.Method.Alg(), "Token should be signed with the key")
+			assert.Equal(t, key.ID, parsed.Header[jwtHeaderKeyID], "Kid should be the key id")
+		}
+
+		result := performJWTCookieRequest(router, "GET", "/", token)
+		assert.Equal(t, http.StatusOK, result.Code, "HTTP request code should match")
+
+		claims, err := parseClaims(token, "")
+		if assert.NoError(t, err, "An error was not expected") {
+			assert.Equal(t, uint(2), claims.User, "User should match")
+		}
+	}
+}
+
+func TestAsymmetricTokenConfusion(t *testing.T) {
+
+	resetAuthTestConfig()
+	resetKeys(t)
+
+	config.Settings.Session.NewSecret = "secret"
+
+	signers := testSigners(t)
+
+	key, err := NewSigningKey("1", signers["EdDSA"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetSigningKey(key)
+
+	gin.SetMode(gin.ReleaseMode)
+
+	router := gin.New()
+
+	router.Use(Auth(true))
+
+	router.GET("/", func(c *gin.Context) {
+		c.String(200, "OK")
+	})
+
+	claims := TokenClaims{
+		User: 2,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer: jwtIssuer,
+		},
+	}
+
+	// the public key is not a secret
+	public := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	public.Header[jwtHeaderKeyID] = key.ID
+
+	publicToken, err := public.SignedString([]byte(key.Public().(ed25519.PublicKey)))
+	assert.NoError(t, err, "An error was not expected")
+
+	result := performJWTCookieRequest(router, "GET", "/", publicToken)
+	assert.Equal(t, http.StatusUnauthorized, result.Code, "HTTP request code should match")
+
+	// another key type with the kid of our key
+	other := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	other.Header[jwtHeaderKeyID] = key.ID
+
+	otherToken, err := other.SignedString(signers["ES256"])
+	assert.NoError(t, err, "An error was not expected")
+
+	result = performJWTCookieRequest(router, "GET", "/", otherToken)
+	assert.Equal(t, http.StatusUnauthorized, result.Code, "HTTP request code should match")
+
+	_, err = parseClaims(otherToken, "secret")
+	assert.ErrorContains(t, err, "unexpected signing method", "Error should be the signing method")
+
+	// a token without a kid
+	missing := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+
+	missingToken, err := missing.SignedString(signers["EdDSA"])
+	assert.NoError(t, err, "An error was not expected")
+
+	result = performJWTCookieRequest(router, "GET", "/", missingToken)
+	assert.Equal(t, http.StatusUnauthorized, result.Code, "HTTP request code should match")
+
+	// the shared secret still works during the migration
+	legacy, err := func() (string, error) {
+		SetSigningKey(nil)
+		defer SetSigningKey(key)
+		return MakeToken(2)
+	}()
+	assert.NoError(t, err, "An error was not expected")
+
+	result = performJWTCookieRequest(router, "GET", "/", legacy)
+	assert.Equal(t, http.StatusOK, result.Code, "HTTP request code should match")
+}
+
+func TestJWKSController(t *testing.T) {
+
+	resetKeys(t)
+
+	gin.SetMode(gin.ReleaseMode)
+
+	router := gin.New()
+
+	router.GET("/jwks", JWKSController)
+
+	first := performRequest(router, "GET", "/jwks")
+	assert.Equal(t, http.StatusNotFound, first.Code, "HTTP request code should match")
+
+	signers := testSigners(t)
+
+	current, err := NewSigningKey("2", signers["ES256"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	retired, err := NewSigningKey("1", signers["RS256"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetSigningKey(current, retired)
+
+	second := performRequest(router, "GET", "/jwks")
+	assert.Equal(t, http.StatusOK, second.Code, "HTTP request code should match")
+	assert.Equal(t, "public, max-age=300", second.Header().Get("Cache-Control"), "JWKS should be cacheable")
+
+	var set jwkSet
+
+	err = json.Unmarshal(second.Body.Bytes(), &set)
+	if assert.NoError(t, err, "An error was not expected") && assert.Len(t, set.Keys, 2, "Retired keys should be published") {
+		assert.Equal(t, "2", set.Keys[0].Kid, "Current key should be first")
+		assert.Equal(t, "ES256", set.Keys[0].Alg, "Alg should match")
+		assert.Equal(t, "EC", set.Keys[0].Kty, "Kty should match")
+		assert.Equal(t, "1", set.Keys[1].Kid, "Kid should match")
+		assert.Equal(t, "RSA", set.Keys[1].Kty, "Kty should match")
+		assert.Empty(t, set.Keys[1].X, "Only the rsa fields should be set")
+	}
+
+	assert.NotContains(t, second.Body.String(), `"d"`, "Private keys should not be published")
+}
+
+func TestLoadKeys(t *testing.T) {
+
+	resetAuthTestConfig()
+	resetKeys(t)
+
+	t.Cleanup(func() {
+		config.Settings.Session.SigningKey = ""
+		config.Settings.Session.SigningKeyID = ""
+		config.Settings.Session.JWKS = ""
+	})
+
+	dir := t.TempDir()
+
+	signer := testSigners(t)["EdDSA"]
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyPath := filepath.Join(dir, "signing.pem")
+
+	err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	public, err := encodeJWK("auth-1", signer.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksPath := filepath.Join(dir, "jwks.json")
+
+	data, err := json.Marshal(jwkSet{Keys: []jwk{public}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(jwksPath, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, LoadKeys(), "Nothing should be loaded without config")
+	assert.Nil(t, signingKey(), "Signing key should not be set")
+
+	config.Settings.Session.SigningKey = keyPath
+	config.Settings.Session.SigningKeyID = "auth-1"
+	config.Settings.Session.JWKS = jwksPath
+
+	assert.NoError(t, LoadKeys(), "An error was not expected")
+
+	if assert.NotNil(t, signingKey(), "Signing key should be set") {
+		assert.Equal(t, "auth-1", signingKey().ID, "Kid should match")
+	}
+
+	assert.NotNil(t, keyManager.set, "Key set should be set")
+
+	config.Settings.Session.JWKS = filepath.Join(dir, "missing.json")
+
+	assert.Error(t, LoadKeys(), "An error was expected for a missing jwks")
+}
+
+func TestVerifyOnlyService(t *testing.T) {
+
+	resetAuthTestConfig()
+	resetKeys(t)
+
+	redis.NewMemoryCache()
+
+	key, err := NewSigningKey("1", testSigners(t)["EdDSA"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the auth service logs the user in
+	SetSigningKey(key)
+
+	access, refresh, err := MakeTokens(2)
+	assert.NoError(t, err, "An error was not expected")
+
+	// an access token that expired a minute ago
+	old := jwt.NewWithClaims(key.method, TokenClaims{
+		User: 2,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    jwtIssuer,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+		},
+	})
+	old.Header[jwtHeaderKeyID] = key.ID
+
+	expired, err := old.SignedString(key.key)
+	assert.NoError(t, err, "An error was not expected")
+
+	// the other services only have the public key
+	encoded, err := encodeJWK(key.ID, key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(jwkSet{Keys: []jwk{encoded}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+
+	err = os.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set := NewKeySet(path)
+
+	assert.NoError(t, set.Load(), "An error was not expected")
+
+	SetSigningKey(nil)
+	SetKeySet(set)
+
+	assert.True(t, IsInitialized(), "Key set should be enough")
+
+	// a verifier can not make tokens even with the secret
+	config.Settings.Session.NewSecret = "secret"
+
+	_, err = MakeToken(2)
+	assert.Equal(t, e.ErrNoSigningKey, err, "Error should match")
+
+	_, _, _, err = RefreshTokens(refresh)
+	assert.Equal(t, e.ErrNoSigningKey, err, "Error should match")
+
+	config.Settings.Session.NewSecret = ""
+
+	gin.SetMode(gin.ReleaseMode)
+
+	router := func(authenticated bool) *gin.Engine {
+		r := gin.New()
+
+		r.Use(Auth(authenticated))
+
+		r.GET("/", func(c *gin.Context) {
+			userdata := c.MustGet("userdata").(User)
+			c.String(200, "%d", userdata.ID)
+		})
+
+		return r
+	}
+
+	public := router(false)
+	private := router(true)
+
+	result := performRefreshRequest(private, access, refresh)
+	assert.Equal(t, http.StatusOK, result.Code, "HTTP request code should match")
+	assert.Equal(t, "2", result.Body.String(), "User should be set from the access token")
+
+	// an expired or missing access token is anonymous until the client refreshes at the auth service
+	for _, token := range []string{expired, ""} {
+		result = performRefreshRequest(public, token, refresh)
+		assert.Equal(t, http.StatusOK, result.Code, "HTTP request code should match")
+		assert.Equal(t, "1", result.Body.String(), "User should be anonymous")
+		assert.Empty(t, result.Result().Cookies(), "Cookies should not be changed")
+
+		result = performRefreshRequest(private, token, refresh)
+		assert.Equal(t, http.StatusUnauthorized, result.Code, "HTTP request code should match")
+		assert.Empty(t, result.Result().Cookies(), "Cookies should not be changed")
+	}
+
+	// the refresh token was not used up by the verifier
+	SetSigningKey(key)
+
+	uid, _, _, err := RefreshTokens(refresh)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, uint(2), uid, "User should match")
+}
+
+func TestRejectHS256(t *testing.T) {
+
+	resetAuthTestConfig()
+	resetKeys(t)
+
+	config.Settings.Session.NewSecret = "secret"
+	config.Settings.Session.OldSecret = "oldsecret"
+
+	key, err := NewSigningKey("1", testSigners(t)["EdDSA"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+
+	router := gin.New()
+
+	router.Use(Auth(true))
+
+	router.GET("/", func(c *gin.Context) {
+		c.String(200, "OK")
+	})
+
+	secretToken := func(secret string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, TokenClaims{
+			User: 2,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    jwtIssuer,
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			},
+		})
+
+		signed, err := token.SignedString([]byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return signed
+	}
+
+	current := secretToken("secret")
+	previous := secretToken("oldsecret")
+
+	// the option does nothing without keys
+	config.Settings.Session.RejectHS256 = true
+
+	result := performJWTCookieRequest(router, "GET", "/", current)
+	assert.Equal(t, http.StatusOK, result.Code, "HTTP request code should match")
+
+	SetSigningKey(key)
+
+	config.Settings.Session.RejectHS256 = false
+
+	for _, token := range []string{current, previous} {
+		result = performJWTCookieRequest(router, "GET", "/", token)
+		assert.Equal(t, http.StatusOK, result.Code, "HTTP request code should match")
+	}
+
+	config.Settings.Session.RejectHS256 = true
+
+	for _, token := range []string{current, previous} {
+		result = performJWTCookieRequest(router, "GET", "/", token)
+		assert.Equal(t, http.StatusUnauthorized, result.Code, "HTTP request code should match")
+	}
+
+	_, err = parseClaims(current, "secret")
+	assert.ErrorContains(t, err, "signing method", "Error should be the signing method")
+
+	// tokens from the signing key still work
+	signed, err := MakeToken(2)
+	assert.NoError(t, err, "An error was not expected")
+
+	result = performJWTCookieRequest(router, "GET", "/", signed)
+	assert.Equal(t, http.StatusOK, result.Code, "HTTP request code should match")
+}
@@ -0,0 +1,270 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	e "github.com/eirka/eirka-libs/errors"
+	"github.com/eirka/eirka-libs/redis"
+)
+
+const (
+	// refreshKeyPrefix is the redis hash of a refresh token, keyed by its sha256
+	refreshKeyPrefix = "jwt:refresh:"
+	// familyKeyPrefix is the redis key of a refresh token family, deleting it revokes the family
+	familyKeyPrefix = "jwt:family:"
+	// refreshExpiry is how long a refresh token and its family live without being used
+	refreshExpiry = time.Hour * 24 * jwtExpireDays
+)
+
+// errRefreshRace is returned for a refresh token that was rotated by another request moments ago
+var errRefreshRace = errors.New("refresh token is being rotated")
+
+// refreshReuseGrace is how long a rotated refresh token can be presented again without revoking its family
+// Browsers send parallel requests with the same cookie, only the first one rotates and the others go through
+// without new cookies. A claim that never finished rotating can be taken over after it, once it has been set,
+// so two callers never both rotate one token.
+var refreshReuseGrace = 10 * time.Second
+
+// CreateTokens will make an access token and a new refresh token family for a user
+func (u *User) CreateTokens() (access, refresh string, err error) {
+	// check user struct validity
+	if !u.IsValid() {
+		err = e.ErrUserNotValid
+		return
+	}
+
+	// tokens should never be created
+	if !u.IsAuthenticated {
+		err = e.ErrUserNotValid
+		return
+	}
+
+	// check if password was valid
+	if !u.isPasswordValid {
+		err = e.ErrInvalidPassword
+		return
+	}
+
+	return MakeTokens(u.ID)
+}
+
+// MakeTokens will create an access token and the first refresh token of a new family
+// The refresh token is opaque and only its hash is stored in redis.
+func MakeTokens(uid uint) (access, refresh string, err error) {
+	access, err = makeAccessToken(uid)
+	if err != nil {
+		return
+	}
+
+	family, err := newTokenID()
+	if err != nil {
+		return
+	}
+
+	generation, err := tokenGeneration(uid)
+	if err != nil {
+		return
+	}
+
+	refresh, err = saveRefreshToken(uid, family, generation)
+	if err != nil {
+		return "", "", err
+	}
+
+	return
+}
+
+// RefreshTokens exchanges a refresh token for a new access token and the next refresh token of its family
+// Every refresh token can be used once. Presenting one that was already rotated means it was copied, so the
+// whole family is revoked and the user has to log in again, unless it is within refreshReuseGrace. Then the
+// user id is returned with errRefreshRace and no tokens. Errors from redis are wrapped in ErrTokenUnavailable
+// so the session can be kept until it is back.
+func RefreshTokens(token string) (uid uint, access, refresh string, err error) {
+	// the claim would be lost if the tokens can not be made
+	if !canSign() {
+		return 0, "", "", e.ErrNoSigningKey
+	}
+
+	key := refreshKeyPrefix + hashRefreshToken(token)
+
+	record, err := redis.Active().HGetAll(key)
+	if err != nil {
+		return 0, "", "", refreshStoreError(err, e.ErrTokenInvalid)
+	}
+
+	user, err := strconv.ParseUint(string(record["user"]), 10, 64)
+	if err != nil {
+		return 0, "", "", e.ErrTokenInvalid
+	}
+
+	generation, err := strconv.ParseUint(string(record["gen"]), 10, 64)
+	if err != nil {
+		return 0, "", "", e.ErrTokenInvalid
+	}
+
+	family := string(record["family"])
+
+	// the family was revoked by reuse or logout
+	_, err = redis.Active().Get(familyKeyPrefix + family)
+	if err != nil {
+		return 0, "", "", refreshStoreError(err, e.ErrTokenRevoked)
+	}
+
+	// the user logged out everywhere since the family was started
+	current, err := tokenGeneration(uint(user))
+	if err != nil {
+		return 0, "", "", refreshStoreError(err, nil)
+	}
+
+	if generation < current {
+		revokeFamily(family)
+		return 0, "", "", e.ErrTokenRevoked
+	}
+
+	// only the first caller gets to rotate the token
+	used, err := redis.Active().HIncrBy(key, "used", 1)
+	if err != nil {
+		return 0, "", "", refreshStoreError(err, nil)
+	}
+
+	if used > 1 {
+		state, err := redis.Active().HGetAll(key)
+		if err != nil {
+			return 0, "", "", refreshStoreError(err, e.ErrTokenInvalid)
+		}
+
+		rotated := refreshTime(state["rotated"])
+		claimed := refreshTime(state["claimed"])
+
+		switch {
+		case !rotated.IsZero() && time.Since(rotated) < refreshReuseGrace:
+			// the rotation just happened
+			return uint(user), "", "", errRefreshRace
+		case !rotated.IsZero():
+			revokeFamily(family)
+			return 0, "", "", e.ErrTokenRevoked
+		case claimed.IsZero(), time.Since(claimed) < refreshReuseGrace:
+			// the rotation is still in progress, the first caller has not set claimed yet if it is missing
+			return uint(user), "", "", errRefreshRace
+		}
+
+		// the claim never finished rotating so it is taken over
+	}
+
+	// give the claim back so the token can be tried again
+	release := func() {
+		redis.Active().HIncrBy(key, "used", -1)
+	}
+
+	err = redis.Active().HMSet(key, "claimed", []byte(strconv.FormatInt(time.Now().Unix(), 10)))
+	if err != nil {
+		release()
+		return 0, "", "", refreshStoreError(err, nil)
+	}
+
+	access, err = makeAccessToken(uint(user))
+	if err != nil {
+		release()
+		return 0, "", "", err
+	}
+
+	refresh, err = saveRefreshToken(uint(user), family, generation)
+	if err != nil {
+		release()
+		return 0, "", "", refreshStoreError(err, nil)
+	}
+
+	// the new tokens are saved, if this fails the claim is taken over after the grace instead of revoking
+	redis.Active().HMSet(key, "rotated", []byte(strconv.FormatInt(time.Now().Unix(), 10)))
+
+	return uint(user), access, refresh, nil
+}
+
+// refreshStoreError returns miss for a key that does not exist and ErrTokenUnavailable for anything else
+// Reads are misses while the breaker is open so they can not be taken as an answer then.
+func refreshStoreError(err, miss error) error {
+	if err == redis.ErrCacheMiss && miss != nil && !redis.Degraded() {
+		return miss
+	}
+
+	if err == redis.ErrCacheMiss {
+		err = redis.ErrCircuitOpen
+	}
+
+	return fmt.Errorf("%w: %w", e.ErrTokenUnavailable, err)
+}
+
+// refreshTime parses a unix time field of a refresh token, it is zero if the field is not set
+func refreshTime(field []byte) time.Time {
+	at, err := strconv.ParseInt(string(field), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(at, 0)
+}
+
+// RevokeRefreshToken revokes the family of a refresh token, for logging out a session
+func RevokeRefreshToken(token string) error {
+	family, err := redis.Active().HGet(refreshKeyPrefix+hashRefreshToken(token), "family")
+	if err == redis.ErrCacheMiss {
+		return e.ErrTokenInvalid
+	}
+	if err != nil {
+		return err
+	}
+
+	return revokeFamily(string(family))
+}
+
+// saveRefreshToken makes a refresh token in a family and stores its hash
+func saveRefreshToken(uid uint, family string, generation uint64) (token string, err error) {
+	b := make([]byte, 32)
+
+	_, err = rand.Read(b)
+	if err != nil {
+		return
+	}
+
+	token = base64.RawURLEncoding.EncodeToString(b)
+
+	key := refreshKeyPrefix + hashRefreshToken(token)
+
+	results, err := redis.Active().Pipeline(func(p redis.Pipeliner) {
+		p.HMSet(key, "user", []byte(strconv.FormatUint(uint64(uid), 10)))
+		p.HMSet(key, "family", []byte(family))
+		p.HMSet(key, "gen", []byte(strconv.FormatUint(generation, 10)))
+		p.Expire(key, uint(refreshExpiry.Seconds()))
+		// every rotation keeps the family alive
+		p.SetEx(familyKeyPrefix+family, uint(refreshExpiry.Seconds()), []byte(strconv.FormatUint(uint64(uid), 10)))
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for _, result := range results {
+		if result.Err != nil {
+			return "", result.Err
+		}
+	}
+
+	return
+}
+
+// revokeFamily makes every refresh token of a family invalid
+func revokeFamily(family string) error {
+	return redis.Active().Delete(familyKeyPrefix + family)
+}
+
+// hashRefreshToken returns the sha256 of a refresh token, the token itself is never stored
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,347 @@
+package user
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eirka/eirka-libs/config"
+	e "github.com/eirka/eirka-libs/errors"
+	"github.com/eirka/eirka-libs/redis"
+)
+
+// setRefreshReuseGrace changes the reuse grace period until the test ends
+func setRefreshReuseGrace(t *testing.T, grace time.Duration) {
+	original := refreshReuseGrace
+	refreshReuseGrace = grace
+
+	t.Cleanup(func() {
+		refreshReuseGrace = original
+	})
+}
+
+// unreachableRedis makes the active store a redis that can not be dialed until the test ends
+// The breaker opens after the first failure.
+func unreachableRedis(t *testing.T) {
+	original := redis.Cache
+
+	t.Cleanup(func() {
+		redis.Cache = original
+		redis.NewMemoryCache()
+	})
+
+	config := redis.Redis{
+		Protocol:         "unix",
+		Address:          filepath.Join(t.TempDir(), "missing.sock"),
+		MaxIdle:          1,
+		MaxConnections:   1,
+		BreakerThreshold: 1,
+		BreakerInterval:  time.Hour,
+	}
+
+	config.NewRedisCache()
+}
+
+func performRefreshRequest(r http.Handler, access, refresh string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/", nil)
+	if access != "" {
+		req.AddCookie(CreateCookie(access))
+	}
+	if refresh != "" {
+		req.AddCookie(CreateRefreshCookie(refresh))
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// responseCookie returns the cookie a response set by name
+func responseCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// expiredAccessToken makes an access token that expired a minute ago
+func expiredAccessToken(t *testing.T, uid uint) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, TokenClaims{
+		User: uid,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    jwtIssuer,
+			IssuedAt:  jwt.NewNumericDate(time.Now().Add(-jwtAccessExpiry)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+		},
+	})
+
+	signed, err := token.SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+func TestMakeTokens(t *testing.T) {
+
+	resetAuthTestConfig()
+	config.Settings.Session.NewSecret = "secret"
+
+	redis.NewMemoryCache()
+
+	access, refresh, err := MakeTokens(2)
+	assert.NoError(t, err, "An error was not expected")
+	assert.NotEmpty(t, refresh, "Refresh token should be set")
+
+	claims, err := parseClaims(access, "secret")
+	if assert.NoError(t, err, "An error was not expected") {
+		assert.WithinDuration(t, time.Now().Add(jwtAccessExpiry), claims.ExpiresAt.Time, 2*time.Second, "Access token should be short lived")
+	}
+
+	// only the hash of the refresh token is stored
+	record, err := redis.Active().HGetAll(refreshKeyPrefix + hashRefreshToken(refresh))
+	if assert.NoError(t, err, "An error was not expected") {
+		assert.Equal(t, []byte("2"), record["user"], "User should be stored")
+		assert.NotEmpty(t, record["family"], "Family should be stored")
+	}
+
+	_, err = redis.Active().HGetAll(refreshKeyPrefix + refresh)
+	assert.Equal(t, redis.ErrCacheMiss, err, "Refresh token should not be stored in plain")
+
+	_, _, err = MakeTokens(1)
+	assert.Equal(t, e.ErrUserNotValid, err, "Error should be user not valid")
+
+	user := DefaultUser()
+
+	_, _, err = user.CreateTokens()
+	assert.Equal(t, e.ErrUserNotValid, err, "Error should be user not valid")
+}
+
+func TestRefreshTokens(t *testing.T) {
+
+	resetAuthTestConfig()
+	config.Settings.Session.NewSecret = "secret"
+
+	redis.NewMemoryCache()
+
+	_, first, err := MakeTokens(2)
+	assert.NoError(t, err, "An error was not expected")
+
+	uid, access, second, err := RefreshTokens(first)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, uint(2), uid, "User should match")
+	assert.NotEmpty(t, access, "Access token should be set")
+	assert.NotEqual(t, first, second, "Refresh token should be rotated")
+
+	// a parallel request with the same token does not log the user out
+	uid, access, _, err = RefreshTokens(first)
+	assert.Equal(t, errRefreshRace, err, "Error should be a race")
+	assert.Equal(t, uint(2), uid, "User should be returned for a race")
+	assert.Empty(t, access, "Tokens should not be made for a race")
+
+	// once the grace period is over a reused token revokes the family
+	setRefreshReuseGrace(t, 0)
+
+	_, _, _, err = RefreshTokens(first)
+	assert.Equal(t, e.ErrTokenRevoked, err, "Error should be revoked")
+
+	_, _, _, err = RefreshTokens(second)
+	assert.Equal(t, e.ErrTokenRevoked, err, "Newer tokens of the family should be revoked")
+
+	_, _, _, err = RefreshTokens("blah")
+	assert.Equal(t, e.ErrTokenInvalid, err, "Error should be invalid token")
+
+	// logging out revokes the family
+	_, third, err := MakeTokens(2)
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.NoError(t, RevokeRefreshToken(third), "An error was not expected")
+
+	_, _, _, err = RefreshTokens(third)
+	assert.Equal(t, e.ErrTokenRevoked, err, "Error should be revoked")
+
+	assert.Equal(t, e.ErrTokenInvalid, RevokeRefreshToken("blah"), "Error should be invalid token")
+
+	// a claim that never finished rotating is a race until the grace is over
+	setRefreshReuseGrace(t, time.Minute)
+
+	_, abandoned, err := MakeTokens(2)
+	assert.NoError(t, err, "An error was not expected")
+
+	key := refreshKeyPrefix + hashRefreshToken(abandoned)
+
+	_, err = redis.Active().HIncrBy(key, "used", 1)
+	assert.NoError(t, err, "An error was not expected")
+
+	// the first caller has not set claimed yet so it can not be taken over
+	setRefreshReuseGrace(t, 0)
+
+	_, _, _, err = RefreshTokens(abandoned)
+	assert.Equal(t, errRefreshRace, err, "Error should be a race")
+
+	setRefreshReuseGrace(t, time.Minute)
+
+	err = redis.Active().HMSet(key, "claimed", []byte(strconv.FormatInt(time.Now().Unix(), 10)))
+	assert.NoError(t, err, "An error was not expected")
+
+	_, _, _, err = RefreshTokens(abandoned)
+	assert.Equal(t, errRefreshRace, err, "Error should be a race")
+
+	err = redis.Active().HMSet(key, "claimed", []byte(strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)))
+	assert.NoError(t, err, "An error was not expected")
+
+	uid, access, _, err = RefreshTokens(abandoned)
+	assert.NoError(t, err, "A stale claim should be taken over")
+	assert.Equal(t, uint(2), uid, "User should match")
+	assert.NotEmpty(t, access, "Access token should be set")
+
+	setRefreshReuseGrace(t, 0)
+
+	// logging out everywhere revokes every family
+	_, fourth, err := MakeTokens(2)
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.NoError(t, RevokeAllForUser(2), "An error was not expected")
+
+	_, _, _, err = RefreshTokens(fourth)
+	assert.Equal(t, e.ErrTokenRevoked, err, "Error should be revoked")
+}
+
+func TestAuthRefresh(t *testing.T) {
+
+	resetAuthTestConfig()
+	config.Settings.Session.NewSecret = "secret"
+
+	redis.NewMemoryCache()
+
+	gin.SetMode(gin.ReleaseMode)
+
+	router := gin.New()
+
+	router.Use(Auth(true))
+
+	router.GET("/", func(c *gin.Context) {
+		userdata := c.MustGet("userdata").(User)
+		c.String(200, "%d", userdata.ID)
+	})
+
+	_, refresh, err := MakeTokens(2)
+	assert.NoError(t, err, "An error was not expected")
+
+	expired := expiredAccessToken(t, 2)
+
+	// without a refresh token an expired access token is rejected
+	first := performRefreshRequest(router, expired, "")
+	assert.Equal(t, http.StatusUnauthorized, first.Code, "HTTP request code should match")
+
+	// the expired access token is replaced transparently
+	second := performRefreshRequest(router, expired, refresh)
+	assert.Equal(t, http.StatusOK, second.Code, "HTTP request code should match")
+	assert.Equal(t, "2", second.Body.String(), "User should be set from the refresh token")
+
+	access := responseCookie(second, CookieName)
+	rotated := responseCookie(second, RefreshCookieName)
+
+	if assert.NotNil(t, access, "Access cookie should be sent") && assert.NotNil(t, rotated, "Refresh cookie should be sent") {
+		assert.NotEqual(t, refresh, rotated.Value, "Refresh token should be rotated")
+
+		third := performRefreshRequest(router, access.Value, rotated.Value)
+		assert.Equal(t, http.StatusOK, third.Code, "HTTP request code should match")
+		assert.Nil(t, responseCookie(third, CookieName), "A valid access token should not be replaced")
+
+		// the access cookie can be gone while the refresh cookie is still there
+		fourth := performRefreshRequest(router, "", rotated.Value)
+		assert.Equal(t, http.StatusOK, fourth.Code, "HTTP request code should match")
+		assert.NotNil(t, responseCookie(fourth, RefreshCookieName), "Refresh cookie should be sent")
+	}
+
+	// a parallel request goes through as the user and keeps the cookies the first one set
+	race := performRefreshRequest(router, expired, refresh)
+	assert.Equal(t, http.StatusOK, race.Code, "HTTP request code should match")
+	assert.Equal(t, "2", race.Body.String(), "User should be set from the refresh token")
+	assert.Nil(t, responseCookie(race, RefreshCookieName), "Cookies should not be changed")
+
+	// a stolen refresh token logs the user out
+	setRefreshReuseGrace(t, 0)
+
+	reuse := performRefreshRequest(router, expired, refresh)
+	assert.Equal(t, http.StatusUnauthorized, reuse.Code, "HTTP request code should match")
+
+	if deleted := responseCookie(reuse, RefreshCookieName); assert.NotNil(t, deleted, "Refresh cookie should be deleted") {
+		assert.Empty(t, deleted.Value, "Refresh cookie should be empty")
+	}
+
+	// a token that was not signed by us is not refreshed
+	forged := expiredAccessToken(t, 2)
+	forged = forged[:strings.LastIndex(forged, ".")] + ".c2lnbmF0dXJl"
+
+	_, other, err := MakeTokens(2)
+	assert.NoError(t, err, "An error was not expected")
+
+	bad := performRefreshRequest(router, forged, other)
+	assert.Equal(t, http.StatusUnauthorized, bad.Code, "HTTP request code should match")
+	assert.Nil(t, responseCookie(bad, RefreshCookieName), "Refresh token should not be used")
+}
+
+func TestRefreshTokensUnavailable(t *testing.T) {
+
+	resetAuthTestConfig()
+	config.Settings.Session.NewSecret = "secret"
+
+	redis.NewMemoryCache()
+
+	_, refresh, err := MakeTokens(2)
+	assert.NoError(t, err, "An error was not expected")
+
+	unreachableRedis(t)
+
+	_, _, _, err = RefreshTokens(refresh)
+	assert.ErrorIs(t, err, e.ErrTokenUnavailable, "Error should be unavailable")
+
+	// reads are misses while the breaker is open but the token is not invalid
+	assert.True(t, redis.Degraded(), "Breaker should be open")
+
+	_, _, _, err = RefreshTokens(refresh)
+	assert.ErrorIs(t, err, e.ErrTokenUnavailable, "Error should be unavailable")
+	assert.ErrorIs(t, err, redis.ErrCircuitOpen, "Error should be circuit open")
+
+	gin.SetMode(gin.ReleaseMode)
+
+	handler := func(c *gin.Context) {
+		userdata := c.MustGet("userdata").(User)
+		c.String(200, "%d", userdata.ID)
+	}
+
+	router := gin.New()
+
+	router.GET("/private", Auth(true), handler)
+	router.GET("/public", Auth(false), handler)
+
+	expired := expiredAccessToken(t, 2)
+
+	for path, code := range map[string]int{"/private": http.StatusServiceUnavailable, "/public": http.StatusOK} {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.AddCookie(CreateCookie(expired))
+		req.AddCookie(CreateRefreshCookie(refresh))
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, code, w.Code, "HTTP request code should match")
+		assert.Empty(t, w.Result().Cookies(), "Cookies should be kept")
+
+		if code == http.StatusOK {
+			assert.Equal(t, "1", w.Body.String(), "User should be anonymous")
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package user
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+
+	"github.com/eirka/eirka-libs/config"
+	e "github.com/eirka/eirka-libs/errors"
+	"github.com/eirka/eirka-libs/redis"
+)
+
+const (
+	// revokedKeyPrefix is the redis key of a revoked token id
+	revokedKeyPrefix = "jwt:revoked:"
+	// generationKeyPrefix is the redis key of the current token generation of a user
+	generationKeyPrefix = "jwt:generation:"
+)
+
+// newTokenID returns a random id for the jti claim
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// tokenGeneration returns the current token generation of a user
+// Users that never revoked their tokens and apps without redis are at generation 0.
+func tokenGeneration(uid uint) (uint64, error) {
+	result, err := redis.Active().Get(generationKeyPrefix + strconv.FormatUint(uint64(uid), 10))
+	if err == redis.ErrCacheMiss || err == redis.ErrCacheNotInitialized {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(string(result), 10, 64)
+}
+
+// checkRevoked returns ErrTokenRevoked if the token was revoked or is from an older generation
+// Revocations can not be checked while redis is unavailable, then it returns ErrTokenUnavailable
+// unless the session config accepts tokens anyway with RevocationFailOpen.
+func checkRevoked(claims *TokenClaims) error {
+	// reads are misses while the breaker is open so a revoked token would look valid
+	if redis.Degraded() {
+		return revocationUnavailable(redis.ErrCircuitOpen)
+	}
+
+	if claims.ID != "" {
+		_, err := redis.Active().Get(revokedKeyPrefix + claims.ID)
+		if err == nil {
+			return e.ErrTokenRevoked
+		}
+		if err != redis.ErrCacheMiss && err != redis.ErrCacheNotInitialized {
+			return revocationUnavailable(err)
+		}
+	}
+
+	generation, err := tokenGeneration(claims.User)
+	if err != nil {
+		return revocationUnavailable(err)
+	}
+
+	if claims.Generation < generation {
+		return e.ErrTokenRevoked
+	}
+
+	return nil
+}
+
+// revocationUnavailable wraps a redis error in ErrTokenUnavailable, or accepts the token if the config fails open
+func revocationUnavailable(err error) error {
+	if config.Settings != nil && config.Settings.Session.RevocationFailOpen {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %w", e.ErrTokenUnavailable, err)
+}
+
+// RevokeToken revokes a single token so Auth rejects it, for logging out a session
+// The token is verified with the active secrets or its public key first. Expired tokens are already
+// rejected so nothing is stored for them.
+func RevokeToken(token string) error {
+	secrets, err := GetSecrets()
+	if err != nil && !hasKeys() {
+		return err
+	}
+
+	// asymmetric tokens do not need a secret
+	if len(secrets) == 0 {
+		secrets = []string{""}
+	}
+
+	var claims *TokenClaims
+
+	for _, secret := range secrets {
+		claims, err = parseClaims(token, secret)
+		if err == nil || errors.Is(err, jwt.ErrTokenExpired) {
+			break
+		}
+	}
+
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", e.ErrTokenInvalid, err)
+	}
+
+	// tokens from before revocation can only be revoked with RevokeAllForUser
+	if claims.ID == "" {
+		return e.ErrTokenInvalid
+	}
+
+	// the revocation is kept until the token would have expired anyway
+	ttl := time.Until(claims.ExpiresAt.Time).Round(time.Second)
+	if ttl < time.Second {
+		return nil
+	}
+
+	return redis.Active().SetEx(revokedKeyPrefix+claims.ID, uint(ttl.Seconds()), []byte(strconv.FormatUint(uint64(claims.User), 10)))
+}
+
+// RevokeAllForUser revokes every token issued to a user so far, for logging out everywhere
+// It moves the user to a new token generation, tokens made after it are valid.
+func RevokeAllForUser(uid uint) error {
+	if uid == 0 || uid == 1 {
+		return e.ErrUserNotValid
+	}
+
+	_, err := redis.Active().Incr(generationKeyPrefix + strconv.FormatUint(uint64(uid), 10))
+
+	return err
+}
+
+// parseClaims verifies a token with a secret or its public key and returns its claims
+func parseClaims(token, secret string) (*TokenClaims, error) {
+	claims := &TokenClaims{}
+
+	methods := []string{}
+	if !secretRejected() {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	for alg := range asymmetricMethods {
+		methods = append(methods, alg)
+	}
+
+	_, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method.Alg() != jwt.SigningMethodHS256.Alg() {
+			return verificationKey(token)
+		}
+
+		if secret == "" {
+			return nil, e.ErrNoSecret
+		}
+
+		return []byte(secret), nil
+	}, jwt.WithValidMethods(methods), jwt.WithIssuer(jwtIssuer))
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.User == 0 || claims.User == 1 {
+		return nil, fmt.Errorf("invalid user id")
+	}
+
+	return claims, nil
+}
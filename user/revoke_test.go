@@ -0,0 +1,218 @@
+package user
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eirka/eirka-libs/config"
+	e "github.com/eirka/eirka-libs/errors"
+	"github.com/eirka/eirka-libs/redis"
+)
+
+func TestRevokeWithoutCache(t *testing.T) {
+
+	resetAuthTestConfig()
+	config.Settings.Session.NewSecret = "secret"
+
+	// apps without redis get tokens at generation 0 that are never revoked
+	token, err := MakeToken(2)
+	assert.NoError(t, err, "An error was not expected")
+
+	claims, err := parseClaims(token, "secret")
+	if assert.NoError(t, err, "An error was not expected") {
+		assert.NotEmpty(t, claims.ID, "Token should have an id")
+		assert.Equal(t, uint64(0), claims.Generation, "Generation should be 0")
+		assert.NoError(t, checkRevoked(claims), "Token should not be revoked")
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+
+	resetAuthTestConfig()
+	config.Settings.Session.NewSecret = "secret"
+
+	redis.NewMemoryCache()
+
+	gin.SetMode(gin.ReleaseMode)
+
+	router := gin.New()
+
+	router.Use(Auth(true))
+
+	router.GET("/", func(c *gin.Context) {
+		c.String(200, "OK")
+	})
+
+	first, err := MakeToken(2)
+	assert.NoError(t, err, "An error was not expected")
+
+	second, err := MakeToken(2)
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.NotEqual(t, first, second, "Tokens should have different ids")
+
+	assert.NoError(t, RevokeToken(first), "An error was not expected")
+
+	first1 := performJWTCookieRequest(router, "GET", "/", first)
+	assert.Equal(t, http.StatusUnauthorized, first1.Code, "HTTP request code should match")
+	assert.Contains(t, first1.Header().Get("Set-Cookie"), CookieName+"=;", "Cookie should be deleted")
+
+	// the other session is still logged in
+	second1 := performJWTCookieRequest(router, "GET", "/", second)
+	assert.Equal(t, http.StatusOK, second1.Code, "HTTP request code should match")
+
+	// revocations are stored until the token expires
+	claims, err := parseClaims(first, "secret")
+	if assert.NoError(t, err, "An error was not expected") {
+		_, err = redis.Active().Get(revokedKeyPrefix + claims.ID)
+		assert.NoError(t, err, "Revocation should be stored")
+	}
+
+	assert.ErrorIs(t, RevokeToken("blah"), e.ErrTokenInvalid, "Error should be invalid token")
+
+	// a token signed with another secret can not be revoked
+	config.Settings.Session.NewSecret = "othersecret"
+	assert.ErrorIs(t, RevokeToken(second), e.ErrTokenInvalid, "Error should be invalid token")
+
+	// a token signed with the old secret during rotation can
+	config.Settings.Session.OldSecret = "secret"
+	assert.NoError(t, RevokeToken(second), "An error was not expected")
+
+	config.Settings.Session.NewSecret = "secret"
+	config.Settings.Session.OldSecret = ""
+
+	second2 := performJWTCookieRequest(router, "GET", "/", second)
+	assert.Equal(t, http.StatusUnauthorized, second2.Code, "HTTP request code should match")
+
+	// expired tokens have nothing to revoke
+	expired := jwt.NewWithClaims(jwt.SigningMethodHS256, TokenClaims{
+		User: 2,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        "expired",
+			Issuer:    jwtIssuer,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Hour)),
+		},
+	})
+
+	expiredToken, err := expired.SignedString([]byte("secret"))
+	assert.NoError(t, err, "An error was not expected")
+	assert.NoError(t, RevokeToken(expiredToken), "An error was not expected")
+
+	_, err = redis.Active().Get(revokedKeyPrefix + "expired")
+	assert.Equal(t, redis.ErrCacheMiss, err, "Nothing should be stored")
+}
+
+func TestRevokeAllForUser(t *testing.T) {
+
+	resetAuthTestConfig()
+	config.Settings.Session.NewSecret = "secret"
+
+	redis.NewMemoryCache()
+
+	gin.SetMode(gin.ReleaseMode)
+
+	router := gin.New()
+
+	router.Use(Auth(true))
+
+	router.GET("/", func(c *gin.Context) {
+		c.String(200, "OK")
+	})
+
+	old, err := MakeToken(2)
+	assert.NoError(t, err, "An error was not expected")
+
+	other, err := MakeToken(3)
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.NoError(t, RevokeAllForUser(2), "An error was not expected")
+
+	old1 := performJWTCookieRequest(router, "GET", "/", old)
+	assert.Equal(t, http.StatusUnauthorized, old1.Code, "HTTP request code should match")
+
+	// other users are not logged out
+	other1 := performJWTCookieRequest(router, "GET", "/", other)
+	assert.Equal(t, http.StatusOK, other1.Code, "HTTP request code should match")
+
+	// logging in again gets a token in the new generation
+	current, err := MakeToken(2)
+	assert.NoError(t, err, "An error was not expected")
+
+	claims, err := parseClaims(current, "secret")
+	if assert.NoError(t, err, "An error was not expected") {
+		assert.Equal(t, uint64(1), claims.Generation, "Generation should be incremented")
+	}
+
+	current1 := performJWTCookieRequest(router, "GET", "/", current)
+	assert.Equal(t, http.StatusOK, current1.Code, "HTTP request code should match")
+
+	// tokens from before revocation existed have no generation
+	legacy := jwt.NewWithClaims(jwt.SigningMethodHS256, TokenClaims{
+		User: 2,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    jwtIssuer,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	})
+
+	legacyToken, err := legacy.SignedString([]byte("secret"))
+	assert.NoError(t, err, "An error was not expected")
+
+	legacy1 := performJWTCookieRequest(router, "GET", "/", legacyToken)
+	assert.Equal(t, http.StatusUnauthorized, legacy1.Code, "HTTP request code should match")
+
+	assert.Equal(t, e.ErrTokenInvalid, RevokeToken(legacyToken), "Tokens without an id can not be revoked one by one")
+
+	assert.Equal(t, e.ErrUserNotValid, RevokeAllForUser(1), "Error should be user not valid")
+}
+
+func TestRevokeUnavailable(t *testing.T) {
+
+	resetAuthTestConfig()
+	config.Settings.Session.NewSecret = "secret"
+	defer resetAuthTestConfig()
+
+	redis.NewMemoryCache()
+
+	token, err := MakeToken(2)
+	assert.NoError(t, err, "An error was not expected")
+
+	unreachableRedis(t)
+
+	gin.SetMode(gin.ReleaseMode)
+
+	handler := func(c *gin.Context) {
+		userdata := c.MustGet("userdata").(User)
+		c.String(200, "%d", userdata.ID)
+	}
+
+	router := gin.New()
+
+	router.GET("/private", Auth(true), handler)
+	router.GET("/public", Auth(false), handler)
+
+	// the first request finds redis down and opens the breaker, the second is skipped by it
+	for i := 0; i < 2; i++ {
+		private := performJWTCookieRequest(router, "GET", "/private", token)
+		assert.Equal(t, http.StatusServiceUnavailable, private.Code, "HTTP request code should match")
+		assert.Empty(t, private.Header().Get("Set-Cookie"), "Cookie should be kept")
+	}
+
+	assert.True(t, redis.Degraded(), "Breaker should be open")
+
+	public := performJWTCookieRequest(router, "GET", "/public", token)
+	assert.Equal(t, http.StatusOK, public.Code, "HTTP request code should match")
+	assert.Equal(t, "1", public.Body.String(), "User should be anonymous")
+
+	// tokens are accepted without the check when the config fails open
+	config.Settings.Session.RevocationFailOpen = true
+
+	private := performJWTCookieRequest(router, "GET", "/private", token)
+	assert.Equal(t, http.StatusOK, private.Code, "HTTP request code should match")
+	assert.Equal(t, "2", private.Body.String(), "User should be set from the token")
+}
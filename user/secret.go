@@ -122,8 +122,12 @@ func validateSecret(secret string) error {
 	return nil
 }
 
-// IsInitialized returns true if the new secret is properly configured
+// IsInitialized returns true if the new secret or a key for asymmetric tokens is properly configured
 func IsInitialized() bool {
+	if hasKeys() {
+		return true
+	}
+
 	secretManager.mu.RLock()
 	defer secretManager.mu.RUnlock()
 